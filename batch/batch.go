@@ -0,0 +1,429 @@
+package batch
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.bug.st/serial"
+	"go.bug.st/serial/enumerator"
+	"io"
+	"main/common"
+	"main/routers"
+	"main/switches"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Entry is one device in a batch manifest
+type Entry struct {
+	// Serial port or console the device is on. Left empty if USBSerial picks it out instead.
+	Port string `json:"port"`
+	// Serial number of the USB serial adapter the device is on
+	USBSerial string `json:"usb_serial"`
+	// common.ROUTER, common.SWITCH or common.AUTO_PROFILE to work it out
+	Type    string `json:"type"`
+	Profile string `json:"profile"`
+	// Only apply the defaults, if there are any
+	SkipReset bool `json:"skip_reset"`
+	// Path to the defaults to apply after the reset. Relative paths are from the manifest.
+	Defaults string `json:"defaults"`
+	// Baud rate, if it isn't 9600
+	Baud   int           `json:"baud"`
+	Backup common.Backup `json:"backup"`
+}
+
+// Name is how the entry's referred to in errors and reports
+func (e Entry) Name() string {
+	if e.Port != "" {
+		return e.Port
+	}
+	return "USB " + e.USBSerial
+}
+
+// CSV columns and what they set on an entry
+var csvColumns = map[string]func(entry *Entry, value string) error{
+	"port":       func(entry *Entry, value string) error { entry.Port = value; return nil },
+	"usb_serial": func(entry *Entry, value string) error { entry.USBSerial = value; return nil },
+	"type":       func(entry *Entry, value string) error { entry.Type = value; return nil },
+	"profile":    func(entry *Entry, value string) error { entry.Profile = value; return nil },
+	"skip_reset": func(entry *Entry, value string) error { return parseBool(value, &entry.SkipReset) },
+	"defaults":   func(entry *Entry, value string) error { entry.Defaults = value; return nil },
+	"baud": func(entry *Entry, value string) error {
+		if value == "" {
+			return nil
+		}
+		baud, err := strconv.Atoi(value)
+		entry.Baud = baud
+		return err
+	},
+	"backup_destination": func(entry *Entry, value string) error {
+		entry.Backup.Destination = value
+		entry.Backup.Backup = value != ""
+		return nil
+	},
+	"backup_source":  func(entry *Entry, value string) error { entry.Backup.Source = value; return nil },
+	"backup_mask":    func(entry *Entry, value string) error { entry.Backup.SubnetMask = value; return nil },
+	"backup_prefix":  func(entry *Entry, value string) error { entry.Backup.Prefix = value; return nil },
+	"backup_builtin": func(entry *Entry, value string) error { return parseBool(value, &entry.Backup.UseBuiltIn) },
+}
+
+// parseBool reads a true/false column, which spreadsheets are just as likely to fill in with yes or no
+func parseBool(value string, into *bool) error {
+	switch strings.ToLower(value) {
+	case "", "no", "n":
+		*into = false
+		return nil
+	case "yes", "y":
+		*into = true
+		return nil
+	}
+	parsed, err := strconv.ParseBool(value)
+	*into = parsed
+	return err
+}
+
+// Parse reads a manifest, going by name's extension to tell whether it's CSV or JSON. CSV manifests start with a
+// header naming their columns, JSON ones are a list of entries.
+func Parse(name string, contents []byte) ([]Entry, error) {
+	var entries []Entry
+	var err error
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".csv":
+		entries, err = parseCSV(contents)
+	case ".json":
+		err = json.Unmarshal(contents, &entries)
+	default:
+		return nil, fmt.Errorf("batch.Parse: %s isn't a .csv or .json manifest", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("batch.Parse: Error while parsing %s: %w", name, err)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("batch.Parse: %s doesn't have any devices in it", name)
+	}
+
+	for i := range entries {
+		entry := &entries[i]
+		entry.Port = strings.TrimSpace(entry.Port)
+		entry.USBSerial = strings.TrimSpace(entry.USBSerial)
+		entry.Type = strings.ToLower(strings.TrimSpace(entry.Type))
+		if entry.Type == "" {
+			entry.Type = common.AUTO_PROFILE
+		}
+		if entry.Profile == "" {
+			entry.Profile = common.AUTO_PROFILE
+		}
+		entry.Backup.Backup = entry.Backup.Backup || entry.Backup.Destination != ""
+
+		switch {
+		case entry.Port == "" && entry.USBSerial == "":
+			return nil, fmt.Errorf("batch.Parse: Entry %d in %s needs a port or a USB serial number", i+1, name)
+		case entry.Type != common.ROUTER && entry.Type != common.SWITCH && entry.Type != common.AUTO_PROFILE:
+			return nil, fmt.Errorf("batch.Parse: Entry %d in %s has an unknown type %s", i+1, name, entry.Type)
+		case entry.SkipReset && entry.Defaults == "":
+			return nil, fmt.Errorf("batch.Parse: Entry %d in %s has nothing to do", i+1, name)
+		}
+	}
+	return entries, nil
+}
+
+func parseCSV(contents []byte) ([]Entry, error) {
+	reader := csv.NewReader(bytes.NewReader(contents))
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	header := rows[0]
+	for i, column := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(column))
+		if _, ok := csvColumns[header[i]]; !ok {
+			return nil, fmt.Errorf("unknown column %s", column)
+		}
+	}
+
+	entries := make([]Entry, 0, len(rows)-1)
+	for line, row := range rows[1:] {
+		var entry Entry
+		for i, value := range row {
+			err := csvColumns[header[i]](&entry, strings.TrimSpace(value))
+			if err != nil {
+				return nil, fmt.Errorf("row %d has a bad %s: %w", line+1, header[i], err)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Load reads the manifest at path, with the entries' defaults files made relative to wherever it is
+func Load(path string) ([]Entry, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("batch.Load: Error while reading %s: %w", path, err)
+	}
+	entries, err := Parse(path, contents)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range entries {
+		if entries[i].Defaults != "" && !filepath.IsAbs(entries[i].Defaults) {
+			entries[i].Defaults = filepath.Join(filepath.Dir(path), entries[i].Defaults)
+		}
+	}
+	return entries, nil
+}
+
+// Resolve fills in the ports of entries picked out by a USB serial number
+func Resolve(entries []Entry, ports []*enumerator.PortDetails) error {
+	for i := range entries {
+		if entries[i].Port != "" {
+			continue
+		}
+		port, err := common.FindPort(ports, entries[i].USBSerial)
+		if err != nil {
+			return fmt.Errorf("batch.Resolve: Entry %d: %w", i+1, err)
+		}
+		entries[i].Port = port
+	}
+	return nil
+}
+
+// byPort splits entries up by port, keeping each port's entries in the order they were given
+func byPort(entries []Entry) [][]int {
+	var groups [][]int
+	seen := make(map[string]int)
+	for i, entry := range entries {
+		group, ok := seen[entry.Port]
+		if !ok {
+			group = len(groups)
+			seen[entry.Port] = group
+			groups = append(groups, nil)
+		}
+		groups[group] = append(groups[group], i)
+	}
+	return groups
+}
+
+// Options are the settings shared by every entry in a batch
+type Options struct {
+	Mode    serial.Mode
+	Policy  common.Policy
+	Verbose bool
+	// Overrides the routers' break method
+	BreakMethod string
+	// How the defaults get onto each device
+	Apply common.ApplyOptions
+}
+
+// Outcome is how one entry went
+type Outcome struct {
+	Entry  Entry
+	Device common.Device
+	// The flows' files and backups, and where it failed if it did
+	Result   common.Result
+	Started  time.Time
+	Finished time.Time
+}
+
+func (o Outcome) Duration() time.Duration {
+	return o.Finished.Sub(o.Started).Round(time.Second)
+}
+
+// add merges the result of a flow into the outcome, returning whether it succeeded
+func (o *Outcome) add(result common.Result) bool {
+	o.Result.FilesDeleted = append(o.Result.FilesDeleted, result.FilesDeleted...)
+	o.Result.Backups = append(o.Result.Backups, result.Backups...)
+	o.Result.Differences = append(o.Result.Differences, result.Differences...)
+	o.Result.CommandErrors = append(o.Result.CommandErrors, result.CommandErrors...)
+	o.Result.Success = result.Success
+	o.Result.FailedStep = result.FailedStep
+	o.Result.Err = result.Err
+	o.Result.Error = result.Error
+	return result.Success
+}
+
+// Run runs entries, with a device on each port going at the same time. Entries sharing a port take turns in the
+// order they were given.
+func Run(ctx context.Context, entries []Entry, options Options) Report {
+	outcomes := make([]Outcome, len(entries))
+
+	var wg sync.WaitGroup
+	for _, group := range byPort(entries) {
+		wg.Add(1)
+		go func(group []int) {
+			defer wg.Done()
+			for _, i := range group {
+				outcomes[i] = runEntry(ctx, i+1, entries[i], options)
+			}
+		}(group)
+	}
+	wg.Wait()
+
+	return NewReport(outcomes)
+}
+
+// runEntry resets and applies the defaults to the device in entry number num
+func runEntry(ctx context.Context, num int, entry Entry, options Options) (outcome Outcome) {
+	outcome = Outcome{Entry: entry, Started: time.Now()}
+	defer func() { outcome.Finished = time.Now() }()
+
+	if ctx.Err() != nil {
+		outcome.Result.Fail("Waiting for the port", ctx.Err())
+		return
+	}
+
+	var defaults []byte
+	if entry.Defaults != "" {
+		var err error
+		defaults, err = os.ReadFile(entry.Defaults)
+		if err != nil {
+			outcome.Result.Fail("Reading the defaults", err)
+			return
+		}
+	}
+
+	mode := options.Mode
+	if entry.Baud != 0 {
+		mode.BaudRate = entry.Baud
+	}
+	port, err := common.OpenConsole(entry.Port, mode)
+	if err != nil {
+		outcome.Result.Fail("Opening the port", err)
+		return
+	}
+	defer port.Close()
+
+	session := common.NewSession(port, fmt.Sprintf("Batch %d %s", num, entry.Port), nil, options.Verbose)
+	defer session.Close()
+	if options.Policy != nil {
+		session.SetPolicy(options.Policy)
+	}
+
+	deviceType, profileName := entry.Type, entry.Profile
+	if deviceType == common.AUTO_PROFILE {
+		outcome.Device, err = common.Identify(ctx, session)
+		if err != nil {
+			outcome.Result.Fail("Identifying the device", err)
+			return
+		}
+		deviceType = outcome.Device.Type
+		if strings.EqualFold(profileName, common.AUTO_PROFILE) && outcome.Device.Profile != "" {
+			profileName = outcome.Device.Profile
+		}
+	}
+	profile, err := common.FindProfile(deviceType, profileName)
+	if err != nil {
+		outcome.Result.Fail("Finding the profile", err)
+		return
+	}
+
+	switch deviceType {
+	case common.ROUTER:
+		if options.BreakMethod != "" {
+			profile.Break.Method = options.BreakMethod
+		}
+		var config routers.RouterDefaults
+		if defaults != nil && !decode(&outcome, defaults, &config) {
+			return
+		}
+		if !entry.SkipReset && !outcome.add(routers.Reset(ctx, session, profile, entry.Backup)) {
+			return
+		}
+		if defaults != nil {
+			outcome.add(routers.Defaults(ctx, session, profile, config, options.Apply))
+		}
+	case common.SWITCH:
+		var config switches.SwitchConfig
+		if defaults != nil && !decode(&outcome, defaults, &config) {
+			return
+		}
+		if !entry.SkipReset && !outcome.add(switches.Reset(ctx, session, profile, entry.Backup)) {
+			return
+		}
+		if defaults != nil {
+			outcome.add(switches.Defaults(ctx, session, profile, config, options.Apply))
+		}
+	}
+	return
+}
+
+// decode parses the defaults before anything's reset, so a typo in them doesn't leave a wiped device behind
+func decode(outcome *Outcome, defaults []byte, config any) bool {
+	err := json.Unmarshal(defaults, config)
+	if err != nil {
+		outcome.Result.Fail("Reading the defaults", err)
+		return false
+	}
+	return true
+}
+
+// Report is how a whole batch went
+type Report struct {
+	Outcomes  []Outcome
+	Succeeded int
+	Failed    int
+}
+
+func NewReport(outcomes []Outcome) Report {
+	report := Report{Outcomes: outcomes}
+	for _, outcome := range outcomes {
+		if outcome.Result.Success {
+			report.Succeeded += 1
+		} else {
+			report.Failed += 1
+		}
+	}
+	return report
+}
+
+// Write writes the report out as a table, one device to a line
+func (r Report) Write(w io.Writer) error {
+	table := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(table, "#\tPORT\tTYPE\tDEVICE\tRESULT\tTIME\tDETAILS")
+	for i, outcome := range r.Outcomes {
+		deviceType := outcome.Entry.Type
+		if outcome.Device.Type != "" {
+			deviceType = outcome.Device.Type
+		}
+		device := strings.TrimSpace(fmt.Sprintf("%s %s", outcome.Device.Platform, outcome.Device.Serial))
+		if device == "" {
+			device = "-"
+		}
+
+		result := "ok"
+		details := strings.Join(outcome.Result.Backups, ", ")
+		if !outcome.Result.Success {
+			result = "FAILED"
+			details = fmt.Sprintf("%s: %s", outcome.Result.FailedStep, outcome.Result.Error)
+		}
+		fmt.Fprintf(table, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", i+1, outcome.Entry.Name(), deviceType, device, result, outcome.Duration(), details)
+	}
+	fmt.Fprintf(table, "\n%d succeeded, %d failed\n", r.Succeeded, r.Failed)
+	return table.Flush()
+}
+
+// Err is an error listing the entries that failed, or nil if none did
+func (r Report) Err() error {
+	var failed []error
+	for i, outcome := range r.Outcomes {
+		if !outcome.Result.Success {
+			failed = append(failed, fmt.Errorf("entry %d on %s failed while %s: %s", i+1, outcome.Entry.Name(), strings.ToLower(outcome.Result.FailedStep), outcome.Result.Error))
+		}
+	}
+	return errors.Join(failed...)
+}
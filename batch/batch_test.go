@@ -0,0 +1,123 @@
+package batch
+
+import (
+	"bytes"
+	"context"
+	"main/common"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	manifest := `port,usb_serial,type,defaults,skip_reset,backup_destination,backup_builtin
+# Top of the rack
+/dev/ttyUSB0,,Switch,switch.json,,192.168.1.10,true
+,FT1234,router,router.json,yes,,
+`
+	entries, err := Parse("rack.csv", []byte(manifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Got %d entries, want 2", len(entries))
+	}
+	first, second := entries[0], entries[1]
+	if first.Port != "/dev/ttyUSB0" || first.Type != common.SWITCH || first.Profile != common.AUTO_PROFILE || first.SkipReset {
+		t.Errorf("First entry is %+v", first)
+	}
+	if !first.Backup.Backup || first.Backup.Destination != "192.168.1.10" || !first.Backup.UseBuiltIn {
+		t.Errorf("First entry's backup is %+v", first.Backup)
+	}
+	if second.USBSerial != "FT1234" || second.Name() != "USB FT1234" || !second.SkipReset || second.Backup.Backup {
+		t.Errorf("Second entry is %+v", second)
+	}
+
+	entries, err = Parse("rack.JSON", []byte(`[{"port": "COM3", "baud": 115200, "backup": {"destination": "10.0.0.1"}}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries[0].Type != common.AUTO_PROFILE || entries[0].Baud != 115200 || !entries[0].Backup.Backup {
+		t.Errorf("JSON entry is %+v", entries[0])
+	}
+
+	for name, manifest := range map[string]string{
+		"rack.txt":        "port\nCOM3\n",
+		"unknown.csv":     "port,colour\nCOM3,blue\n",
+		"empty.csv":       "port\n",
+		"no-port.csv":     "type\nswitch\n",
+		"bad-type.json":   `[{"port": "COM3", "type": "firewall"}]`,
+		"nothing.json":    `[{"port": "COM3", "skip_reset": true}]`,
+		"bad-boolean.csv": "port,skip_reset\nCOM3,perhaps\n",
+		"not-a-list.json": `{"port": "COM3"}`,
+	} {
+		_, err := Parse(name, []byte(manifest))
+		if err == nil {
+			t.Errorf("%s parsed without an error", name)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rack.csv")
+	err := os.WriteFile(path, []byte("port,defaults\nCOM3,switch.json\nCOM4,/etc/router.json\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries[0].Defaults != filepath.Join(dir, "switch.json") {
+		t.Errorf("Relative defaults became %s", entries[0].Defaults)
+	}
+	if entries[1].Defaults != "/etc/router.json" {
+		t.Errorf("Absolute defaults became %s", entries[1].Defaults)
+	}
+}
+
+func TestRun(t *testing.T) {
+	entries := []Entry{
+		{Port: "/dev/ttyBATCH-missing-1", Type: common.SWITCH, Profile: common.AUTO_PROFILE},
+		{Port: "/dev/ttyBATCH-missing-2", Type: common.ROUTER, Profile: common.AUTO_PROFILE},
+		{Port: "/dev/ttyBATCH-missing-1", Type: common.SWITCH, Profile: common.AUTO_PROFILE, Defaults: "missing.json", SkipReset: true},
+	}
+	if groups := byPort(entries); len(groups) != 2 || len(groups[0]) != 2 || groups[0][1] != 2 {
+		t.Errorf("Entries were grouped into %v", groups)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	report := Run(ctx, entries, Options{Mode: common.DefaultMode(), Policy: common.Abort{}})
+	if report.Succeeded != 0 || report.Failed != 3 || len(report.Outcomes) != 3 {
+		t.Fatalf("Report is %+v", report)
+	}
+	if step := report.Outcomes[0].Result.FailedStep; step != "Opening the port" {
+		t.Errorf("First entry failed while %s", step)
+	}
+	// The defaults are read before the port's even opened
+	if step := report.Outcomes[2].Result.FailedStep; step != "Reading the defaults" {
+		t.Errorf("Third entry failed while %s", step)
+	}
+	if report.Err() == nil {
+		t.Error("Report with failures has no error")
+	}
+
+	var out bytes.Buffer
+	err := report.Write(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := out.String()
+	if !strings.Contains(table, "/dev/ttyBATCH-missing-2") || !strings.Contains(table, "FAILED") || !strings.Contains(table, "0 succeeded, 3 failed") {
+		t.Errorf("Report table is:\n%s", table)
+	}
+
+	if err := NewReport([]Outcome{{Result: common.Result{Success: true}}}).Err(); err != nil {
+		t.Errorf("Report without failures has error %s", err)
+	}
+}
@@ -0,0 +1,384 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Ways of getting rendered config onto a device
+const (
+	// Each command typed in on its own, waiting for the prompt after it
+	APPLY_COMMANDS = "commands"
+	// Each step's commands typed in as one block, a line at a time without waiting for the prompt in between
+	APPLY_PASTE = "paste"
+	// The config copied into the running config from the built-in TFTP server
+	APPLY_TFTP = "tftp"
+)
+
+// What to do when the device turns down a command
+const (
+	// Ask the session's policy whether to carry on, giving up if it says no
+	ON_ERROR_ASK = "ask"
+	// Give up there and then
+	ON_ERROR_ABORT = "abort"
+	// Skip the rest of the command's step and carry on with the next one
+	ON_ERROR_CONTINUE = "continue"
+	// Give up and restart the device without saving, so it comes back up with the config it had saved
+	ON_ERROR_ROLLBACK = "rollback"
+)
+
+// PASTE_DELAY is how long pasting leaves between lines unless told otherwise. Consoles drop what's typed faster than
+// IOS can take it in.
+const PASTE_DELAY = 50 * time.Millisecond
+
+// ApplyOptions is how Defaults gets the rendered config onto the device
+type ApplyOptions struct {
+	// APPLY_COMMANDS, APPLY_PASTE or APPLY_TFTP. Empty is APPLY_COMMANDS.
+	Method string
+	// How long to leave between lines when pasting, PASTE_DELAY if zero
+	PasteDelay time.Duration
+	// Address of this machine as the device sees it, for fetching the config over TFTP
+	Server string
+	// Interface the device reaches the server on, such as vlan 1, and its address there. Without an address, the
+	// interface gets one over DHCP.
+	Interface  string
+	Source     string
+	SubnetMask string
+	// ON_ERROR_ASK, ON_ERROR_ABORT, ON_ERROR_CONTINUE or ON_ERROR_ROLLBACK. Empty is ON_ERROR_ASK.
+	OnError string
+}
+
+// Check makes sure the options have what their method needs
+func (o ApplyOptions) Check() error {
+	switch o.OnError {
+	case "", ON_ERROR_ASK, ON_ERROR_ABORT, ON_ERROR_CONTINUE, ON_ERROR_ROLLBACK:
+	default:
+		return fmt.Errorf("common.ApplyOptions: Unknown error handling %q, use %s, %s, %s or %s", o.OnError, ON_ERROR_ASK, ON_ERROR_ABORT, ON_ERROR_CONTINUE, ON_ERROR_ROLLBACK)
+	}
+
+	switch o.Method {
+	case "", APPLY_COMMANDS, APPLY_PASTE:
+		return nil
+	case APPLY_TFTP:
+		if o.Server == "" {
+			return fmt.Errorf("common.ApplyOptions: Applying over TFTP needs the address of the server")
+		}
+		if o.Interface == "" {
+			return fmt.Errorf("common.ApplyOptions: Applying over TFTP needs an interface to reach the server on")
+		}
+		if (o.Source == "") != (o.SubnetMask == "") {
+			return fmt.Errorf("common.ApplyOptions: The device's address needs both an IP address and a subnet mask")
+		}
+		return nil
+	default:
+		return fmt.Errorf("common.ApplyOptions: Unknown method %q, use %s, %s or %s", o.Method, APPLY_COMMANDS, APPLY_PASTE, APPLY_TFTP)
+	}
+}
+
+// ForDevice fills in what's left out of the options with what suits deviceType. Switches can always be reached
+// through vlan 1.
+func (o ApplyOptions) ForDevice(deviceType string) ApplyOptions {
+	if o.Method == APPLY_TFTP && o.Interface == "" && deviceType == SWITCH {
+		o.Interface = "vlan 1"
+	}
+	return o
+}
+
+// Steps is how many steps applying c takes
+func (o ApplyOptions) Steps(c RenderedConfig) int {
+	if o.Method == APPLY_TFTP {
+		// Entering global configuration, joining the network, then copying the config
+		_, interactive := c.file()
+		return 3 + interactive.Steps()
+	}
+	return c.Steps()
+}
+
+// Apply gets c onto the device using the options' method, starting from privileged exec, with OnError deciding what
+// happens when the device turns down a command. Nothing's waited on in between pasted lines to see they went in, so
+// the flows check the running config afterwards. The step the session ends up on is returned, which is the one that
+// failed if there's an error.
+func (o ApplyOptions) Apply(ctx context.Context, session *Session, c RenderedConfig, step string) (string, error) {
+	switch o.Method {
+	case APPLY_PASTE:
+		delay := o.PasteDelay
+		if delay <= 0 {
+			delay = PASTE_DELAY
+		}
+		return o.steps(ctx, session, c, step, func(part RenderedConfig, step string) (string, error) {
+			return part.Paste(session, step, delay)
+		})
+	case APPLY_TFTP:
+		return o.copy(ctx, session, c)
+	default:
+		return o.steps(ctx, session, c, step, func(part RenderedConfig, step string) (string, error) {
+			return part.Apply(session, step)
+		})
+	}
+}
+
+// steps applies c a step at a time with apply, so a step with a command the device turned down can be skipped
+func (o ApplyOptions) steps(ctx context.Context, session *Session, c RenderedConfig, step string, apply func(RenderedConfig, string) (string, error)) (string, error) {
+	for start := 0; start < len(c.Commands); {
+		end := start + 1
+		for end < len(c.Commands) && c.Commands[end].Step == c.Commands[start].Step {
+			end += 1
+		}
+		part := RenderedConfig{Commands: c.Commands[start:end]}
+
+		var err error
+		step, err = apply(part, step)
+		err = o.rejected(ctx, session, err, part.Commands[len(part.Commands)-1].Next)
+		if err != nil {
+			return step, err
+		}
+		start = end
+	}
+	return step, nil
+}
+
+// rejected decides what happens once the device has turned down a command, going by OnError. Carrying on gets the
+// device back to mode, where the next step starts. Any other error is given back as it is, and nil carries on.
+func (o ApplyOptions) rejected(ctx context.Context, session *Session, err error, mode string) error {
+	var rejected *CommandError
+	if !errors.As(err, &rejected) {
+		return err
+	}
+
+	onError := o.OnError
+	if onError == "" || onError == ON_ERROR_ASK {
+		carryOn, askErr := session.Policy().Confirm(ctx, fmt.Sprintf("The device turned down %q (%s), would you like to carry on with the rest of the defaults?", rejected.Command, rejected.Message))
+		if askErr != nil {
+			return fmt.Errorf("common.ApplyOptions: Couldn't ask whether to carry on (%v) once %w", askErr, err)
+		}
+		onError = ON_ERROR_ABORT
+		if carryOn {
+			onError = ON_ERROR_CONTINUE
+		}
+	}
+
+	switch onError {
+	case ON_ERROR_CONTINUE:
+		session.OutputInfo(fmt.Sprintf("Skipping the rest of %s\n", strings.ToLower(rejected.Step)))
+		return session.toMode(mode)
+	case ON_ERROR_ROLLBACK:
+		session.OutputInfo("Rolling back by restarting without saving\n")
+		rollbackErr := rollback(session)
+		if rollbackErr != nil {
+			return fmt.Errorf("common.ApplyOptions: Couldn't roll back (%v) once %w", rollbackErr, err)
+		}
+		return fmt.Errorf("common.ApplyOptions: Restarted without saving once %w", err)
+	default:
+		return fmt.Errorf("common.ApplyOptions: %w", err)
+	}
+}
+
+// rollback restarts the device without saving, undoing everything that hasn't been saved
+func rollback(session *Session) error {
+	err := session.toMode(MODE_PRIV)
+	if err != nil {
+		return err
+	}
+	err = WriteLine(session, "reload")
+	if err != nil {
+		return err
+	}
+	_, err = session.Expect(Expect{Cases: []Case{
+		Answer(Prompt("[yes/no]:"), session, "no"),
+		{Pattern: CONFIRM_PATTERN, Handle: func(line string) (Action, error) {
+			return Stop, WriteLine(session, "")
+		}},
+	}})
+	return err
+}
+
+// Counts files shared over TFTP, so each one gets its own name
+var tftpFileCount atomic.Int64
+
+// copy gets the device on the network, then has it copy the config from the built-in TFTP server into its running
+// config. Anything that asks questions is typed in afterwards.
+func (o ApplyOptions) copy(ctx context.Context, session *Session, c RenderedConfig) (string, error) {
+	contents, interactive := c.file()
+	name := fmt.Sprintf("defaults-%d.cfg", tftpFileCount.Add(1))
+
+	var join RenderedConfig
+	step := "Joining the network"
+	join.Add(step, "conf t", MODE_CONFIG)
+	join.Add(step, "inter "+o.Interface, MODE_INTERFACE)
+	if o.Source != "" {
+		join.Add(step, fmt.Sprintf("ip address %s %s", o.Source, o.SubnetMask), MODE_INTERFACE)
+	} else {
+		join.Add(step, "ip address dhcp", MODE_INTERFACE)
+	}
+	join.Add(step, "no shutdown", MODE_INTERFACE)
+	join.Add(step, "end", MODE_PRIV)
+	step, err := join.Apply(session, "")
+	if err != nil {
+		return step, err
+	}
+
+	step = session.Step("Copying the config over TFTP")
+	stop, err := ShareTftpFile(name, contents)
+	if err != nil {
+		return step, err
+	}
+	defer stop()
+
+	source := fmt.Sprintf("tftp://%s/%s", o.Server, name)
+	before := session.commandErrorCount()
+	match, err := session.Command(fmt.Sprintf("copy %s running-config", source), PRIV_PROMPT,
+		Answer(Contains("Destination filename"), session, ""))
+	if err != nil {
+		return step, err
+	}
+	for _, line := range match.Lines {
+		if strings.HasPrefix(line, "%Error") {
+			return step, fmt.Errorf("common.ApplyOptions: Error while copying %s: %s", source, line)
+		}
+	}
+	// Lines of the file the device turns down are all put down to the copy
+	if rejected := session.rejectedSince(before); rejected != nil {
+		err = o.rejected(ctx, session, rejected, MODE_PRIV)
+		if err != nil {
+			return step, err
+		}
+	}
+
+	return o.steps(ctx, session, interactive, step, func(part RenderedConfig, step string) (string, error) {
+		return part.Apply(session, step)
+	})
+}
+
+// file is the commands as a config file to copy into the running config. Commands that ask questions can't go in a
+// file, so they're given back to be typed in afterwards.
+func (c RenderedConfig) file() ([]byte, RenderedConfig) {
+	var contents strings.Builder
+	var interactive RenderedConfig
+	for _, command := range c.Commands {
+		if command.Mode == MODE_PRIV || command.Next == MODE_PRIV {
+			continue
+		}
+		if len(command.Answers) > 0 {
+			if len(interactive.Commands) == 0 {
+				interactive.Add(command.Step, "conf t", MODE_CONFIG)
+			}
+			interactive.Add(command.Step, command.Command, command.Next, command.Answers...)
+			continue
+		}
+		if command.Mode != MODE_CONFIG {
+			contents.WriteString(" ")
+		}
+		contents.WriteString(command.Command + "\n")
+	}
+	if len(interactive.Commands) > 0 {
+		last := interactive.Commands[len(interactive.Commands)-1]
+		interactive.Add(last.Step, "end", MODE_PRIV)
+	}
+	return []byte(contents.String()), interactive
+}
+
+// Paste types each step's commands in as one block, leaving delay between lines rather than waiting for the prompt
+// after each one. Commands that ask questions are still typed in on their own. A block with a command the device
+// turns down stops it with a *CommandError once the whole block has gone in.
+func (c RenderedConfig) Paste(session *Session, step string, delay time.Duration) (string, error) {
+	var block []ConfigCommand
+	flush := func() error {
+		if len(block) == 0 {
+			return nil
+		}
+		before := session.commandErrorCount()
+		for i, command := range block {
+			if i > 0 {
+				err := session.pause(delay)
+				if err != nil {
+					return err
+				}
+			}
+			err := WriteLine(session, command.Command)
+			if err != nil {
+				return fmt.Errorf("common.Paste: Error while sending %q: %w", command.Command, err)
+			}
+		}
+
+		// Lines are echoed back in order, so once the last one has been the next prompt is the end of the block
+		echoed := 0
+		_, err := session.Expect(Expect{Cases: []Case{{Pattern: regexp.MustCompile(`.`), WholeLines: true, Handle: func(line string) (Action, error) {
+			if echoes(line, block[echoed].Command) {
+				echoed += 1
+			}
+			if echoed == len(block) {
+				return Stop, nil
+			}
+			return Continue, nil
+		}}}})
+		if err != nil {
+			return fmt.Errorf("common.Paste: Error while waiting for %q to be echoed: %w", block[echoed].Command, err)
+		}
+		// Once something's been turned down, the device could be left at any prompt
+		last := block[len(block)-1]
+		_, err = session.Expect(Expect{Cases: []Case{{Pattern: ANY_PROMPT, Handle: func(line string) (Action, error) {
+			if ModePrompt(last.Next).MatchString(line) || session.rejectedSince(before) != nil {
+				return Stop, nil
+			}
+			return Continue, nil
+		}}}})
+		if err != nil {
+			return fmt.Errorf("common.Paste: Error while waiting for %q to finish: %w", last.Command, err)
+		}
+		block = nil
+		if rejected := session.rejectedSince(before); rejected != nil {
+			return rejected
+		}
+		return nil
+	}
+
+	for _, command := range c.Commands {
+		if command.Step != step {
+			err := flush()
+			if err != nil {
+				return step, err
+			}
+			step = session.Step(command.Step)
+			session.logger.Infof("%s\n", command.Step)
+		}
+
+		if len(command.Answers) > 0 {
+			err := flush()
+			if err != nil {
+				return step, err
+			}
+			_, err = RenderedConfig{Commands: []ConfigCommand{command}}.Apply(session, step)
+			if err != nil {
+				return step, err
+			}
+			continue
+		}
+		block = append(block, command)
+	}
+	return step, flush()
+}
+
+// echoes reports whether line is the device echoing command back, which comes after the prompt it was typed at
+func echoes(line string, command string) bool {
+	command = strings.TrimSpace(command)
+	return line == command || strings.HasSuffix(line, "#"+command)
+}
+
+// pause waits for d, or until the phase is over
+func (s *Session) pause(d time.Duration) error {
+	s.mu.Lock()
+	ctx := s.ctx
+	s.mu.Unlock()
+
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return s.Err()
+	}
+}
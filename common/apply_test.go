@@ -0,0 +1,26 @@
+package common
+
+import (
+	"testing"
+)
+
+func TestApplyOptionsCheck(t *testing.T) {
+	tests := []struct {
+		options ApplyOptions
+		valid   bool
+	}{
+		{options: ApplyOptions{}, valid: true},
+		{options: ApplyOptions{Method: APPLY_PASTE}, valid: true},
+		{options: ApplyOptions{Method: "fax"}},
+		{options: ApplyOptions{Method: APPLY_TFTP, Server: "10.0.0.2"}},
+		{options: ApplyOptions{Method: APPLY_TFTP, Server: "10.0.0.2"}.ForDevice(SWITCH), valid: true},
+		{options: ApplyOptions{Method: APPLY_TFTP, Server: "10.0.0.2", Interface: "g0/0", Source: "10.0.0.1"}},
+		{options: ApplyOptions{Method: APPLY_TFTP, Server: "10.0.0.2", Interface: "g0/0", Source: "10.0.0.1", SubnetMask: "255.255.255.0"}, valid: true},
+	}
+	for _, tt := range tests {
+		err := tt.options.Check()
+		if (err == nil) != tt.valid {
+			t.Errorf("Check(%+v) = %v, want valid %t", tt.options, err, tt.valid)
+		}
+	}
+}
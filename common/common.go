@@ -1,23 +1,18 @@
 package common
 
 import (
-	"bufio"
-	"errors"
+	"bytes"
+	"fmt"
 	"github.com/pin/tftp/v3"
-	"go.bug.st/serial"
 	"io"
 	"main/crglogging"
+	"net"
 	"os"
 	"regexp"
-	"strings"
+	"sync"
 	"time"
 )
 
-type Progress struct {
-	CurrentStep int
-	TotalSteps  int
-}
-
 type Backup struct {
 	Backup      bool
 	Prefix      string
@@ -27,33 +22,6 @@ type Backup struct {
 	UseBuiltIn  bool
 }
 
-var logger *crglogging.Crglogging
-var updateChan chan bool
-
-func SetOutputChannel(c chan bool, loggerName string) {
-	updateChan = c
-
-	logger = crglogging.GetLogger(loggerName)
-	logger.NewLogTarget("WebHandler", c, false)
-}
-
-func OutputInfo(data string) {
-	logger.Info(data)
-	updateChan <- true
-}
-
-var LineTimeout time.Duration = 10 * time.Second
-
-var reader *bufio.Reader
-
-func SetReaderPort(port io.Reader) {
-	reader = bufio.NewReader(port)
-}
-
-func SetReadLineTimeout(t time.Duration) {
-	LineTimeout = t
-}
-
 func TftpWriteHandler(filename string, wt io.WriterTo) error {
 	tftpLogger := crglogging.GetLogger("TftpLogger")
 
@@ -61,102 +29,135 @@ func TftpWriteHandler(filename string, wt io.WriterTo) error {
 	if err != nil {
 		return err
 	}
+	defer file.Close()
 	recvd, err := wt.WriteTo(file)
 	if err != nil {
 		return err
 	}
 
-	tftpLogger.Infof("TftpWriteHandler: Received %d bytes\n", recvd)
+	// Nothing's set up to log to unless something's asked for it
+	if tftpLogger != nil {
+		tftpLogger.Infof("TftpWriteHandler: Received %d bytes\n", recvd)
+	}
 
 	return nil
 }
 
-func BuiltInTftpServer(close chan bool) {
-	tftpLogger := crglogging.New("tftpLogger")
+// TftpListen is where the built-in server listens for devices fetching files shared with ShareTftpFile, and sending
+// the ones it's been told to take in with ReceiveTftpFile
+var TftpListen = ":69"
 
-	s := tftp.NewServer(nil, TftpWriteHandler)
-	s.SetTimeout(5 * time.Second)
-	err := s.ListenAndServe(":69")
-	defer s.Shutdown()
+// Files being shared over TFTP by name, how many are waiting on each file to be sent in, and the server handling them
+// while there are any
+var (
+	tftpFilesMu   sync.Mutex
+	tftpFiles     = make(map[string][]byte)
+	tftpReceiving = make(map[string]int)
+	tftpServer    *tftp.Server
+	tftpConn      net.PacketConn
+)
+
+// listenTftp starts the built-in TFTP server if it's not already running. The caller holds tftpFilesMu.
+func listenTftp() error {
+	if tftpServer != nil {
+		return nil
+	}
+
+	conn, err := net.ListenPacket("udp", TftpListen)
 	if err != nil {
-		tftpLogger.Errorf("server: Built in TFTP server encountered an error: %v\n", err)
-		return
+		return fmt.Errorf("error while listening on %s: %w", TftpListen, err)
 	}
-	for <-close {
+	tftpServer = tftp.NewServer(tftpReadHandler, tftpWriteHandler)
+	tftpServer.SetTimeout(5 * time.Second)
+	tftpConn = conn
+	go tftpServer.Serve(conn)
+	return nil
+}
+
+// releaseTftp runs unregister, then stops the built-in TFTP server if there's nothing left to share or take in
+func releaseTftp(unregister func()) {
+	tftpFilesMu.Lock()
+	unregister()
+	if len(tftpFiles) > 0 || len(tftpReceiving) > 0 {
+		tftpFilesMu.Unlock()
 		return
 	}
+	// Closed straight away so the port's free for the next server, but Shutdown waits on transfers, which need the lock
+	// to find their file
+	server := tftpServer
+	tftpConn.Close()
+	tftpServer, tftpConn = nil, nil
+	tftpFilesMu.Unlock()
+	server.Shutdown()
 }
 
-func WaitForPrefix(port serial.Port, prompt string, debug bool) error {
-	prefixLogger := crglogging.GetLogger("prefixLogger")
-	if prefixLogger == nil {
-		prefixLogger = crglogging.New("prefixLogger")
-	}
+// SharedTftpFile is the file being shared as name, if there is one
+func SharedTftpFile(name string) ([]byte, bool) {
+	tftpFilesMu.Lock()
+	defer tftpFilesMu.Unlock()
 
-	// Handle debug
-	prefixLogger.SetLogLevel(4)
-	if debug {
-		prefixLogger.SetLogLevel(5)
-	}
+	contents, ok := tftpFiles[name]
+	return contents, ok
+}
 
-	var output []byte
-	for !strings.HasPrefix(strings.ToLower(strings.TrimSpace(string(output[:]))), prompt) {
-		prefixLogger.Debugf("Has prefix: %t\n", strings.HasPrefix(strings.ToLower(strings.TrimSpace(string(output[:]))), prompt))
-		prefixLogger.Debugf("Expected prefix: %s\n", prompt)
-		prefixLogger.Debugf("FROM DEVICE: %s", strings.TrimSpace(string(output)))
-		prefixLogger.Debugf("TO DEVICE: %s\n", "\\n")
-		_, err := port.Write(FormatCommand(""))
-		if err != nil {
-			return err
-		}
-		output, err = ReadLine(port, 500, debug)
-		if err != nil {
-			return err
-		}
+func tftpReadHandler(filename string, rf io.ReaderFrom) error {
+	contents, ok := SharedTftpFile(filename)
+	if !ok {
+		return fmt.Errorf("common.tftpReadHandler: No such file %s", filename)
 	}
-	prefixLogger.Debugf("%+v\n", output)
 
-	return nil
+	_, err := rf.ReadFrom(bytes.NewReader(contents))
+	return err
 }
 
-func WaitForSubstring(port serial.Port, prompt string, debug bool) error {
-	substringLogger := crglogging.GetLogger("SubstringLogger")
-	if substringLogger == nil {
-		substringLogger = crglogging.New("SubstringLogger")
-	}
+// ShareTftpFile serves contents as name from the built-in TFTP server until stop is called. The server is shared by
+// every file being served or taken in, so devices being set up at the same time can all fetch theirs.
+func ShareTftpFile(name string, contents []byte) (func(), error) {
+	tftpFilesMu.Lock()
+	defer tftpFilesMu.Unlock()
 
-	// Handle debug
-	substringLogger.SetLogLevel(4)
-	if debug {
-		substringLogger.SetLogLevel(5)
+	err := listenTftp()
+	if err != nil {
+		return nil, fmt.Errorf("common.ShareTftpFile: %w", err)
 	}
+	tftpFiles[name] = contents
+
+	return func() {
+		releaseTftp(func() { delete(tftpFiles, name) })
+	}, nil
+}
+
+// ReceiveTftpFile has the built-in TFTP server take in name when a device sends it, such as a backup, until stop is
+// called. It's written out with TftpWriteHandler. Nothing else sent to the server is taken in.
+func ReceiveTftpFile(name string) (func(), error) {
+	tftpFilesMu.Lock()
+	defer tftpFilesMu.Unlock()
 
-	WriteLine(port, "", debug)
-	output, err := ReadLine(port, 500, debug)
-	if err != nil && !errors.Is(err, io.ErrNoProgress) {
-		substringLogger.Fatalf("Error while waiting for substring: %s\n", err.Error())
-	} else if errors.Is(err, io.ErrNoProgress) {
-		substringLogger.Debugf("TO DEVICE: %s\n", "\\r\\n")
-		WriteLine(port, "", debug)
-		WriteLine(port, "", debug)
-		WriteLine(port, "", debug)
+	err := listenTftp()
+	if err != nil {
+		return nil, fmt.Errorf("common.ReceiveTftpFile: %w", err)
 	}
-	for !strings.Contains(strings.ToLower(strings.TrimSpace(string(output[:]))), strings.ToLower(prompt)) {
-		substringLogger.Debugf("FROM DEVICE: %s\n", output) // We don't really need all 32k bytes
-		substringLogger.Debugf("FROM DEVICE: Output size: %d\n", len(strings.TrimSpace(string(output))))
-		substringLogger.Debugf("FROM DEVICE: Output empty? %t\n", IsEmpty(output))
-		output, err = ReadLine(port, 500, debug)
-		if err != nil && !errors.Is(err, io.ErrNoProgress) {
-			return err
-		} else if errors.Is(err, io.ErrNoProgress) {
-			substringLogger.Debugf("TO DEVICE: %s\n", "\\r\\n")
-			WriteLine(port, "", debug)
-			WriteLine(port, "", debug)
-			WriteLine(port, "", debug)
-		}
+	tftpReceiving[name]++
+
+	return func() {
+		releaseTftp(func() {
+			tftpReceiving[name]--
+			if tftpReceiving[name] <= 0 {
+				delete(tftpReceiving, name)
+			}
+		})
+	}, nil
+}
+
+func tftpWriteHandler(filename string, wt io.WriterTo) error {
+	tftpFilesMu.Lock()
+	receiving := tftpReceiving[filename] > 0
+	tftpFilesMu.Unlock()
+	if !receiving {
+		return fmt.Errorf("common.tftpWriteHandler: Not taking in %s", filename)
 	}
 
-	return nil
+	return TftpWriteHandler(filename, wt)
 }
 
 func FormatCommand(cmd string) []byte {
@@ -167,57 +168,38 @@ func FormatCommand(cmd string) []byte {
 	return formattedString
 }
 
-func WriteLine(port serial.Port, line string, debug bool) error {
-	writeLineLogger := crglogging.GetLogger("WriteLineLogger")
-	if writeLineLogger == nil {
-		writeLineLogger = crglogging.New("WriteLineLogger")
-	}
-
-	// Handle debug
-	writeLineLogger.SetLogLevel(4)
-	if debug {
-		writeLineLogger.SetLogLevel(5)
-	}
-
+func WriteLine(session *Session, line string) error {
 	if line == "\r\n" || line == "\r" || line == "\n" || line == "" || line == "\n\r" {
-		//writeLineLogger.Debugf("Note: quietly discarding command\n")
+		//session.Logger().Debugf("Note: quietly discarding command\n")
 		//return
 	}
-	bytes, err := port.Write(FormatCommand(line))
+	bytes, err := session.Port.Write(FormatCommand(line))
 	if err != nil {
 		return err
 	}
-	writeLineLogger.Debugf("TO DEVICE: sent %d bytes: %s\n", bytes, line+"\\n")
+	session.Logger().Debugf("TO DEVICE: sent %d bytes: %s\n", bytes, line+"\\n")
+	session.sent(line)
 
 	return nil
 }
 
-func ReadLine(port serial.Port, buffSize int, debug bool) ([]byte, error) {
-	line, err := ReadLines(port, buffSize, 1, debug)
+func ReadLine(session *Session, buffSize int) ([]byte, error) {
+	line, err := ReadLines(session, buffSize, 1)
 	if err != nil {
 		return nil, err
 	}
 	return line[0], err
 }
 
-func ReadLines(port serial.Port, buffSize int, maxLines int, debug bool) ([][]byte, error) {
-	readLinesLogger := crglogging.GetLogger("ReadLinesLogger")
-	if readLinesLogger == nil {
-		readLinesLogger = crglogging.New("ReadLinesLogger")
-	}
-
-	// Handle debug
-	readLinesLogger.SetLogLevel(4)
-	if debug {
-		readLinesLogger.SetLogLevel(5)
-	}
+func ReadLines(session *Session, buffSize int, maxLines int) ([][]byte, error) {
+	readLinesLogger := session.Logger()
 
 	output := make([][]byte, maxLines)
 	readLinesLogger.Debugf("\n======================================\nDEBUG: \n")
 	for i := 0; i < maxLines; i++ {
 		//scanner := bufio.NewScanner(port)
 
-		res, err := reader.ReadString('\n')
+		res, err := session.reader.ReadString('\n')
 		if err != nil {
 			return nil, err
 		}
@@ -258,19 +240,8 @@ func IsEmpty(output []byte) bool {
 	return true
 }
 
-func IsSyslog(output string) bool {
-	syslogParserLogger := crglogging.GetLogger("SyslogParserLogger")
-	if syslogParserLogger == nil {
-		syslogParserLogger = crglogging.New("SyslogParserLogger")
-	}
+var syslogPattern = regexp.MustCompile(`\w{3}\s((\s\d|\d{2})\s)((\s\d|\d{2}):){2}\d{2}\.\d{3}:\s%(\w|-)*:\s.*`)
 
-	// Handle debug
-	syslogParserLogger.SetLogLevel(4)
-
-	compile, err := regexp.Compile(`\w{3}\s((\s\d|\d{2})\s)((\s\d|\d{2}):){2}\d{2}\.\d{3}:\s%(\w|-)*:\s.*`)
-	if err != nil {
-		syslogParserLogger.Fatalf("common.IsSyslog: Could not compile Syslog regexp: %s\n", err)
-	}
-
-	return compile.MatchString(output)
+func IsSyslog(output string) bool {
+	return syslogPattern.MatchString(output)
 }
@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"github.com/pin/tftp/v3"
 	"io"
+	"net"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -101,6 +103,70 @@ func compareTftpFiles(filename string) error {
 //	}
 //}
 
+func TestTftpShareAndReceive(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error while finding a free port: %s", err)
+	}
+	address := conn.LocalAddr().String()
+	conn.Close()
+	TftpListen = address
+
+	// Received files land wherever we are
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	os.Chdir(dir)
+	defer os.Chdir(wd)
+
+	// A config going out and a backup coming in at the same time share the one server
+	stopSharing, err := ShareTftpFile("defaults.cfg", []byte("hostname S1\n"))
+	if err != nil {
+		t.Fatalf("Couldn't share defaults.cfg: %s", err)
+	}
+	defer stopSharing()
+	stopReceiving, err := ReceiveTftpFile("backup.txt")
+	if err != nil {
+		t.Fatalf("Couldn't take in backup.txt alongside defaults.cfg: %s", err)
+	}
+	defer stopReceiving()
+
+	client, err := tftp.NewClient(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, err := client.Receive("defaults.cfg", "octet")
+	if err != nil {
+		t.Fatalf("Couldn't fetch defaults.cfg: %s", err)
+	}
+	var fetched bytes.Buffer
+	wt.WriteTo(&fetched)
+	if fetched.String() != "hostname S1\n" {
+		t.Errorf("Fetched %q", fetched.String())
+	}
+
+	send := func(name string) error {
+		rf, err := client.Send(name, "octet")
+		if err != nil {
+			return err
+		}
+		_, err = rf.ReadFrom(bytes.NewReader([]byte("version 15.0\n")))
+		return err
+	}
+	if err := send("backup.txt"); err != nil {
+		t.Fatalf("Couldn't send backup.txt: %s", err)
+	}
+	received, err := os.ReadFile(filepath.Join(dir, "backup.txt"))
+	if err != nil || string(received) != "version 15.0\n" {
+		t.Errorf("backup.txt = %q, %v", received, err)
+	}
+	if err := send("stray.txt"); err == nil {
+		t.Error("Took in a file nobody was expecting")
+	}
+}
+
 func TestIsSyslog(t *testing.T) {
 	type args struct {
 		output string
@@ -0,0 +1,197 @@
+package common
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Modes a config command can be typed in, named after what the prompt shows for them
+const (
+	MODE_PRIV      = "priv"
+	MODE_CONFIG    = "config"
+	MODE_INTERFACE = "config-if"
+	MODE_LINE      = "config-line"
+)
+
+// ConfigAnswer is a question a command asks before it finishes, and what to reply with
+type ConfigAnswer struct {
+	Question string
+	Answer   string
+}
+
+// ConfigCommand is one command of a rendered config
+type ConfigCommand struct {
+	Command string
+	// The mode it's typed in, and the mode it leaves the device in
+	Mode string
+	Next string
+	// Which step of the flow it belongs to
+	Step    string
+	Answers []ConfigAnswer `json:",omitempty"`
+}
+
+// RenderedConfig is every command it takes to apply some defaults, starting and finishing in privileged exec
+type RenderedConfig struct {
+	Commands []ConfigCommand
+	// Anything in the defaults that got adjusted to suit the device or left out
+	Warnings []string `json:",omitempty"`
+}
+
+// RenderError is defaults that can't be turned into commands, along with the step they would've failed in
+type RenderError struct {
+	Step string
+	Err  error
+}
+
+func (e *RenderError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RenderError) Unwrap() error {
+	return e.Err
+}
+
+// ModePrompt matches the prompt the device shows in mode
+func ModePrompt(mode string) *regexp.Regexp {
+	if mode == MODE_PRIV {
+		return PRIV_PROMPT
+	}
+	return ConfigPrompt(mode)
+}
+
+// promptMode is the mode a prompt is for, such as config-if for Router(config-if)#
+func promptMode(prompt string) (string, bool) {
+	match := ANY_PROMPT.FindStringSubmatch(prompt)
+	switch {
+	case match == nil || strings.HasSuffix(prompt, ">"):
+		return "", false
+	case match[1] != "":
+		return match[1], true
+	default:
+		return MODE_PRIV, true
+	}
+}
+
+// toMode gets the device back to mode from wherever it's ended up, as far as privileged exec or global configuration
+func (s *Session) toMode(mode string) error {
+	match, err := s.Command("", ANY_PROMPT)
+	if err != nil {
+		return err
+	}
+	current, ok := promptMode(match.Line)
+	if !ok {
+		return fmt.Errorf("common.toMode: Can't tell what mode %q is", match.Line)
+	}
+	if current == mode {
+		return nil
+	}
+
+	if current != MODE_PRIV {
+		_, err = s.Command("end", PRIV_PROMPT)
+		if err != nil {
+			return err
+		}
+	}
+	switch mode {
+	case MODE_PRIV:
+		return nil
+	case MODE_CONFIG:
+		_, err = s.Command("conf t", ConfigPrompt(MODE_CONFIG))
+		return err
+	default:
+		return fmt.Errorf("common.toMode: Can't get back into %s from %s", mode, current)
+	}
+}
+
+// Add appends a command for step that leaves the device in next. It's typed in whichever mode the last command left
+// the device in.
+func (c *RenderedConfig) Add(step string, command string, next string, answers ...ConfigAnswer) {
+	mode := MODE_PRIV
+	if len(c.Commands) > 0 {
+		mode = c.Commands[len(c.Commands)-1].Next
+	}
+	c.Commands = append(c.Commands, ConfigCommand{
+		Command: command,
+		Mode:    mode,
+		Next:    next,
+		Step:    step,
+		Answers: answers,
+	})
+}
+
+// Warn notes something about the defaults that won't be applied as written
+func (c *RenderedConfig) Warn(format string, args ...any) {
+	c.Warnings = append(c.Warnings, fmt.Sprintf(format, args...))
+}
+
+// Steps is how many steps it takes to apply the commands
+func (c RenderedConfig) Steps() int {
+	steps := 0
+	for i, command := range c.Commands {
+		if i == 0 || command.Step != c.Commands[i-1].Step {
+			steps += 1
+		}
+	}
+	return steps
+}
+
+// String lays the commands out the way they'd be typed, indented under the interface or line they're for, with each
+// step and any warnings as ! comments so it can be read or diffed
+func (c RenderedConfig) String() string {
+	var text strings.Builder
+	for _, warning := range c.Warnings {
+		fmt.Fprintf(&text, "! WARNING: %s\n", warning)
+	}
+
+	for i, command := range c.Commands {
+		if i == 0 || command.Step != c.Commands[i-1].Step {
+			fmt.Fprintf(&text, "! %s\n", command.Step)
+		}
+		indent := ""
+		if command.Mode != MODE_PRIV && command.Mode != MODE_CONFIG {
+			indent = " "
+		}
+		fmt.Fprintf(&text, "%s%s\n", indent, command.Command)
+		for _, answer := range command.Answers {
+			fmt.Fprintf(&text, "%s ! %s %s\n", indent, answer.Question, answer.Answer)
+		}
+	}
+	return text.String()
+}
+
+// Apply types each command in, waiting for the prompt of the mode it leaves the device in. step is the step the
+// session is on to begin with. The step the session ends up on is returned, which is the one that failed if there's
+// an error. A command the device turns down stops it with a *CommandError.
+func (c RenderedConfig) Apply(session *Session, step string) (string, error) {
+	for _, command := range c.Commands {
+		if command.Step != step {
+			step = session.Step(command.Step)
+			session.logger.Infof("%s\n", command.Step)
+		}
+
+		cases := make([]Case, 0, len(command.Answers)+1)
+		for _, answer := range command.Answers {
+			cases = append(cases, Answer(Contains(answer.Question), session, answer.Answer))
+		}
+		// A command that was meant to change mode and didn't leaves the device at the prompt it was typed at
+		stayed := -1
+		if command.Mode != command.Next {
+			stayed = len(cases)
+			cases = append(cases, Case{Pattern: ModePrompt(command.Mode)})
+		}
+
+		before := session.commandErrorCount()
+		match, err := session.Command(command.Command, ModePrompt(command.Next), cases...)
+		if err != nil {
+			return step, err
+		}
+		if rejected := session.rejectedSince(before); rejected != nil {
+			return step, rejected
+		}
+		if match.Case == stayed {
+			return step, fmt.Errorf("common.Apply: %q left the device in %s rather than %s", command.Command, command.Mode, command.Next)
+		}
+	}
+	return step, nil
+}
@@ -0,0 +1,161 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Device is what's been worked out about the device on the other end of a session, from its boot banner, its
+// bootloader prompt, or show version
+type Device struct {
+	// ROUTER or SWITCH
+	Type     string
+	Platform string
+	Version  string
+	Serial   string
+	// Name of the profile for the model, if there is one
+	Profile string
+}
+
+var platformPatterns = []*regexp.Regexp{
+	// show version
+	regexp.MustCompile(`(?i)^cisco (\S+) \(.+\) processor`),
+	regexp.MustCompile(`(?i)^model number\s*:\s*(\S+)`),
+	// ROMMON's banner
+	regexp.MustCompile(`(?i)^(\S+) platform with`),
+}
+var versionPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)^cisco ios(?: xe)? software.*version ([^\s,]+)`),
+}
+var serialPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)^processor board id (\S+)`),
+	regexp.MustCompile(`(?i)^system serial number\s*:\s*(\S+)`),
+}
+
+// How long Identify waits for the device to say something it can go off
+var IdentifyTimeout = 20 * time.Minute
+
+// Parse picks out anything line says about the device. Whatever's found first is kept, as show version repeats
+// itself in less useful ways further down.
+func (d *Device) Parse(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+
+	for _, field := range []struct {
+		value    *string
+		patterns []*regexp.Regexp
+	}{
+		{&d.Platform, platformPatterns},
+		{&d.Version, versionPatterns},
+		{&d.Serial, serialPatterns},
+	} {
+		if *field.value != "" {
+			continue
+		}
+		for _, pattern := range field.patterns {
+			found := pattern.FindStringSubmatch(line)
+			if found != nil {
+				*field.value = found[1]
+				break
+			}
+		}
+	}
+
+	if d.Profile == "" {
+		profile, ok := DetectProfile(d.Type, line)
+		if ok {
+			d.Profile = profile.Name
+			d.Type = profile.Type
+		}
+	}
+
+	// Sitting at ROMMON or the bootloader gives away what sort of device it is, if not the model
+	if d.Type == "" {
+		for _, deviceType := range []string{ROUTER, SWITCH} {
+			profile, _ := DefaultProfile(deviceType)
+			prompt, err := profile.RecoveryPrompt()
+			if err == nil && prompt.MatchString(line) {
+				d.Type = deviceType
+			}
+		}
+	}
+}
+
+func (d Device) String() string {
+	if d.Type == "" {
+		return "unknown device"
+	}
+
+	description := d.Type
+	if d.Platform != "" {
+		description = fmt.Sprintf("%s %s", d.Platform, d.Type)
+	}
+	if d.Version != "" {
+		description += fmt.Sprintf(" running %s", d.Version)
+	}
+	if d.Serial != "" {
+		description += fmt.Sprintf(", serial number %s", d.Serial)
+	}
+	return description
+}
+
+// Device is everything the session has worked out about the device from its output so far
+func (s *Session) Device() Device {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.device
+}
+
+func (s *Session) identify(line string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.device.Parse(line)
+}
+
+// Identify works out what the device is. A device that's up is asked with show version, otherwise it's whatever the
+// boot banner or the prompt at ROMMON or the bootloader gives away.
+func Identify(ctx context.Context, session *Session) (Device, error) {
+	defer session.EndPhase()
+	session.Phase(ctx, IdentifyTimeout)
+
+	const (
+		execPrompt = iota
+		privPrompt
+		recoveryPrompt
+	)
+	router, _ := DefaultProfile(ROUTER)
+	switchProfile, _ := DefaultProfile(SWITCH)
+	match, err := session.Expect(Expect{Cases: []Case{
+		{Pattern: EXEC_PROMPT},
+		{Pattern: PRIV_PROMPT},
+		{Pattern: regexp.MustCompile(router.Prompts.Recovery + "|" + switchProfile.Prompts.Recovery)},
+	}, Nudge: true})
+	if err != nil {
+		return session.Device(), fmt.Errorf("common.Identify: Error while waiting for the device: %w", err)
+	}
+
+	if match.Case != recoveryPrompt {
+		prompt := EXEC_PROMPT
+		if match.Case == privPrompt {
+			prompt = PRIV_PROMPT
+		}
+		_, err = session.Command("show version", prompt)
+		if err != nil {
+			return session.Device(), fmt.Errorf("common.Identify: %w", err)
+		}
+	}
+
+	device := session.Device()
+	if device.Type == "" {
+		return device, fmt.Errorf("common.Identify: Couldn't tell what the device is")
+	}
+	session.OutputInfo(fmt.Sprintf("Identified the device: %s\n", device))
+	return device, nil
+}
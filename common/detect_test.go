@@ -0,0 +1,59 @@
+package common
+
+import "testing"
+
+func TestDeviceParse(t *testing.T) {
+	tests := []struct {
+		name   string
+		output []string
+		want   Device
+	}{
+		{
+			name: "Switch show version",
+			output: []string{
+				"Cisco IOS Software, C2960 Software (C2960-LANBASEK9-M), Version 15.0(2)SE11, RELEASE SOFTWARE (fc3)",
+				"cisco WS-C2960-24TT-L (PowerPC405) processor (revision B0) with 65536K bytes of memory.",
+				"Processor board ID FOC1127Z4LK",
+				"Model number                    : WS-C2960-24TT-L",
+				"System serial number            : FOC1127Z4LK",
+			},
+			want: Device{Type: SWITCH, Platform: "WS-C2960-24TT-L", Version: "15.0(2)SE11", Serial: "FOC1127Z4LK", Profile: "C2960"},
+		},
+		{
+			name: "Router show version",
+			output: []string{
+				"Cisco IOS XE Software, Version 16.09.04",
+				"Cisco IOS Software [Fuji], ISR Software (X86_64_LINUX_IOSD-UNIVERSALK9_IAS-M), Version 16.9.4, RELEASE SOFTWARE (fc2)",
+				"cisco ISR4221/K9 (1RU) processor with 1647778K/6147K bytes of memory.",
+				"Processor board ID FGL2231918D",
+			},
+			want: Device{Type: ROUTER, Platform: "ISR4221/K9", Version: "16.09.04", Serial: "FGL2231918D", Profile: "ISR4221"},
+		},
+		{
+			name:   "ROMMON banner",
+			output: []string{"System Bootstrap, Version 16.9(1r), RELEASE SOFTWARE", "ISR4331/K9 platform with 4194304 Kbytes of main memory"},
+			want:   Device{Type: ROUTER, Platform: "ISR4331/K9", Profile: "ISR4331"},
+		},
+		{
+			name:   "Unknown router in ROMMON",
+			output: []string{"rommon 1 >"},
+			want:   Device{Type: ROUTER},
+		},
+		{
+			name:   "Unknown switch in the bootloader",
+			output: []string{"switch:"},
+			want:   Device{Type: SWITCH},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var device Device
+			for _, line := range tt.output {
+				device.Parse(line)
+			}
+			if device != tt.want {
+				t.Errorf("Parsed %+v, want %+v", device, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,259 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Action tells Expect what to do once a case has matched
+type Action int
+
+const (
+	// Stop waiting and return the case that matched
+	Stop Action = iota
+	// Keep waiting for another case
+	Continue
+)
+
+// Case is something Expect watches for in the device's output
+type Case struct {
+	// Matched against every line, and against whatever's been printed since the last line, as prompts don't end
+	// with a new line
+	Pattern *regexp.Regexp
+	// Called with the line that matched. A nil Handle stops at this case.
+	Handle func(line string) (Action, error)
+	// Only match complete lines, leaving anything still being printed alone
+	WholeLines bool
+}
+
+// Expect describes what to wait for. Cases are tried in order and the first one to match wins.
+type Expect struct {
+	Cases []Case
+	// Send a new line whenever the device goes quiet without anything matching, to bring the prompt back
+	Nudge bool
+	// Called after every read from the device, even one that timed out with nothing, for keeping an eye on things
+	// that aren't output. Returning an error stops Expect.
+	Poll func() error
+	// Leave --More--, [confirm], (y/n)? and the initial configuration dialog for the cases, rather than answering them
+	NoAutoAnswer bool
+	// Match syslog messages against the cases, rather than skipping over them
+	KeepSyslog bool
+}
+
+// Match is what Expect stopped on
+type Match struct {
+	// Index into Cases
+	Case int
+	Line string
+	// Every line read while waiting, including the one that matched
+	Lines []string
+}
+
+var MORE_PATTERN = regexp.MustCompile(`(?i)-+\s*more\s*-+`)
+var CONFIRM_PATTERN = regexp.MustCompile(`(?i)\[confirm\]$`)
+var YES_NO_PATTERN = regexp.MustCompile(`(?i)\(y/n\)\??$`)
+var INITIAL_CONFIG_PATTERN = regexp.MustCompile(`(?i)initial configuration dialog\? \[yes/no\]:$`)
+
+// Prompts IOS shows in each mode, whatever the hostname is
+var EXEC_PROMPT = regexp.MustCompile(`^[\w.-]+>$`)
+var PRIV_PROMPT = regexp.MustCompile(`^[\w.-]+#$`)
+
+// ANY_PROMPT matches the prompt in any mode, with configuration modes in brackets
+var ANY_PROMPT = regexp.MustCompile(`^[\w.-]+(?:\(([\w-]+)\))?[>#]$`)
+
+// ConfigPrompt matches the prompt for a configuration mode, such as "config" or "config-if"
+func ConfigPrompt(mode string) *regexp.Regexp {
+	return regexp.MustCompile(`^[\w.-]+\(` + regexp.QuoteMeta(mode) + `\)#$`)
+}
+
+// Prompt matches a line ending in text, ignoring case
+func Prompt(text string) *regexp.Regexp {
+	return regexp.MustCompile(`(?i)` + regexp.QuoteMeta(text) + `$`)
+}
+
+// Contains matches a line containing any of texts, ignoring case
+func Contains(texts ...string) *regexp.Regexp {
+	quoted := make([]string, len(texts))
+	for i, text := range texts {
+		quoted[i] = regexp.QuoteMeta(text)
+	}
+	return regexp.MustCompile(`(?i)` + strings.Join(quoted, "|"))
+}
+
+// Answer is a case that replies to a question and keeps waiting
+func Answer(pattern *regexp.Regexp, session *Session, reply string) Case {
+	return Case{Pattern: pattern, Handle: func(line string) (Action, error) {
+		session.logger.Debugf("Answering %q with %q\n", line, reply)
+		return Continue, WriteLine(session, reply)
+	}}
+}
+
+// Expect reads from the device until one of e's cases stops it. Anything read past the line that matched is kept for
+// the next read.
+func (s *Session) Expect(e Expect) (Match, error) {
+	var match Match
+	buff := make([]byte, s.reader.Size())
+	var pending []byte
+
+	for {
+		n, err := s.reader.Read(buff)
+		if err != nil {
+			return match, err
+		}
+		if e.Poll != nil {
+			err = e.Poll()
+			if err != nil {
+				return match, err
+			}
+		}
+		if n == 0 {
+			if e.Nudge {
+				err = WriteLine(s, "")
+				if err != nil {
+					return match, err
+				}
+			}
+			continue
+		}
+		pending = append(pending, buff[:n]...)
+
+		for {
+			end := bytes.IndexByte(pending, '\n')
+			if end < 0 {
+				break
+			}
+			raw := pending[:end+1]
+			pending = pending[end+1:]
+			s.Record(raw)
+
+			line := cleanLine(raw)
+			match.Lines = append(match.Lines, line)
+			_, stop, err := s.match(e, line, true, &match)
+			if err != nil {
+				return match, err
+			}
+			if stop {
+				s.unread(pending)
+				return match, nil
+			}
+		}
+
+		// Prompts and questions sit on a line of their own until they're answered
+		partial := cleanLine(pending)
+		if partial == "" {
+			continue
+		}
+		matched, stop, err := s.match(e, partial, false, &match)
+		if err != nil {
+			return match, err
+		}
+		if matched {
+			s.Record(pending)
+			match.Lines = append(match.Lines, partial)
+			pending = nil
+		}
+		if stop {
+			return match, nil
+		}
+	}
+}
+
+// match runs line past e's cases, then the automatic answers. whole is false for a line that's still being printed.
+func (s *Session) match(e Expect, line string, whole bool, match *Match) (bool, bool, error) {
+	if line == "" || (!e.KeepSyslog && IsSyslog(line)) {
+		return false, false, nil
+	}
+	s.identify(line)
+	s.logger.Debugf("FROM DEVICE: %s\n", line)
+	if whole {
+		s.heard(line)
+	}
+
+	for i, c := range e.Cases {
+		if (c.WholeLines && !whole) || !c.Pattern.MatchString(line) {
+			continue
+		}
+		match.Case = i
+		match.Line = line
+		if c.Handle == nil {
+			return true, true, nil
+		}
+		action, err := c.Handle(line)
+		return true, action == Stop, err
+	}
+
+	if e.NoAutoAnswer {
+		return false, false, nil
+	}
+
+	var reply []byte
+	switch {
+	case MORE_PATTERN.MatchString(line):
+		reply = []byte(" ")
+	case CONFIRM_PATTERN.MatchString(line):
+		reply = FormatCommand("")
+	case YES_NO_PATTERN.MatchString(line):
+		reply = FormatCommand("y")
+	case INITIAL_CONFIG_PATTERN.MatchString(line):
+		reply = FormatCommand("no")
+	default:
+		return false, false, nil
+	}
+
+	s.logger.Debugf("Answering %q with %q\n", line, reply)
+	_, err := s.Port.Write(reply)
+	if err != nil {
+		return true, false, fmt.Errorf("common.Expect: Error while answering %q: %w", line, err)
+	}
+	return true, false, nil
+}
+
+// DetectCase watches every line for a model there's a profile for, calling found the first time one turns up. It
+// matches everything, so it goes after the other cases and nothing it sees gets answered automatically.
+func DetectCase(deviceType string, found func(profile Profile)) Case {
+	detected := false
+	return Case{Pattern: regexp.MustCompile(`.`), WholeLines: true, Handle: func(line string) (Action, error) {
+		if detected {
+			return Continue, nil
+		}
+		profile, ok := DetectProfile(deviceType, line)
+		if ok {
+			detected = true
+			found(profile)
+		}
+		return Continue, nil
+	}}
+}
+
+// Command sends cmd, then waits for prompt, with cases handling anything asked along the way
+func (s *Session) Command(cmd string, prompt *regexp.Regexp, cases ...Case) (Match, error) {
+	err := WriteLine(s, cmd)
+	if err != nil {
+		return Match{}, fmt.Errorf("common.Command: Error while sending %q: %w", cmd, err)
+	}
+
+	match, err := s.Expect(Expect{Cases: append(cases, Case{Pattern: prompt})})
+	if err != nil {
+		return match, fmt.Errorf("common.Command: Error while waiting for %q to finish: %w", cmd, err)
+	}
+	return match, nil
+}
+
+// cleanLine strips what isn't text from a line of output, including the backspaces IOS rubs out --More-- with
+func cleanLine(raw []byte) string {
+	return strings.TrimSpace(strings.ReplaceAll(string(TrimNull(raw)), "\b", ""))
+}
+
+// unread puts output back to be read again, ahead of anything still to come from the port
+func (s *Session) unread(output []byte) {
+	if len(output) == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pushback = append(append([]byte{}, output...), s.pushback...)
+}
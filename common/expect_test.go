@@ -0,0 +1,98 @@
+package common
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// scriptedPort prints a reply to each line written to it, and otherwise times out with nothing like a quiet console
+type scriptedPort struct {
+	mu      sync.Mutex
+	output  []byte
+	replies map[string]string
+	written []string
+}
+
+func (p *scriptedPort) Read(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.output) == 0 {
+		return 0, nil
+	}
+	n := copy(b, p.output)
+	p.output = p.output[n:]
+	return n, nil
+}
+
+func (p *scriptedPort) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	line := strings.TrimRight(string(b), "\r\n")
+	p.written = append(p.written, line)
+	p.output = append(p.output, []byte(p.replies[line])...)
+	return len(b), nil
+}
+
+func (p *scriptedPort) Close() error                       { return nil }
+func (p *scriptedPort) SetReadTimeout(time.Duration) error { return nil }
+func (p *scriptedPort) Name() string                       { return "scripted" }
+
+func TestExpect(t *testing.T) {
+	port := &scriptedPort{
+		output: []byte("*Nov  6 21:15:29.667: %SYS-5-CONFIG_I: Configured from console by console\r\nRouter#"),
+		replies: map[string]string{
+			"show flash:":  "show flash:\r\n -#- --length-- name\r\n1 1024 config.text\r\n --More-- ",
+			" ":            "\b\b\b\b\b\b\b\b\b\b2 616 vlan.dat\r\nRouter#",
+			"erase nvram:": "erase nvram:\r\nErasing the nvram filesystem will remove all configuration files! Continue? [confirm]",
+			"":             "[OK]\r\nErase of nvram: complete\r\nRouter#",
+		},
+	}
+	session := NewSession(port, t.Name(), nil, testing.Verbose())
+
+	match, err := session.Expect(Expect{Cases: []Case{
+		{Pattern: Contains("%SYS-5-CONFIG_I")},
+		{Pattern: PRIV_PROMPT},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if match.Case != 1 {
+		t.Errorf("Matched case %d on %q, syslog messages should be skipped", match.Case, match.Line)
+	}
+
+	match, err = session.Command("show flash:", PRIV_PROMPT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listing := strings.Join(match.Lines, "\n")
+	if !strings.Contains(listing, "config.text") || !strings.Contains(listing, "vlan.dat") {
+		t.Errorf("Listing wasn't paged through: %q", match.Lines)
+	}
+
+	_, err = session.Command("erase nvram:", PRIV_PROMPT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"show flash:", " ", "erase nvram:", ""}
+	if strings.Join(port.written, "|") != strings.Join(want, "|") {
+		t.Errorf("Sent %q, want %q", port.written, want)
+	}
+
+	// Whatever's left after the matching line is kept for the next read
+	port.output = []byte("first\r\nsecond\r\nRouter>")
+	match, err = session.Expect(Expect{Cases: []Case{{Pattern: Contains("first")}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	match, err = session.Expect(Expect{Cases: []Case{{Pattern: Contains("second")}, {Pattern: EXEC_PROMPT}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if match.Case != 0 {
+		t.Errorf("Matched %q rather than the line after the last match", match.Line)
+	}
+}
@@ -0,0 +1,141 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Policy is how a flow gets past the points where it would otherwise need someone to do something or make a call
+type Policy interface {
+	// Pause holds the flow until whoever's at the device has done what message asks of them
+	Pause(ctx context.Context, message string) error
+	// Confirm decides whether to carry on when things can't go the way they were asked to
+	Confirm(ctx context.Context, question string) (bool, error)
+}
+
+const (
+	// Carry on without waiting, going ahead with anything that needs confirming
+	POLICY_CONTINUE = "continue"
+	// Carry on without waiting, but give up rather than go ahead with anything that needs confirming
+	POLICY_ABORT = "abort"
+	// Give whoever's at the device a while before carrying on, going ahead with anything that needs confirming
+	POLICY_PAUSE = "pause"
+)
+
+// NewPolicy gets the unattended policy called name. delay is how long POLICY_PAUSE waits for.
+func NewPolicy(name string, delay time.Duration) (Policy, error) {
+	switch strings.ToLower(name) {
+	case POLICY_CONTINUE:
+		return AutoContinue{}, nil
+	case POLICY_ABORT:
+		return Abort{}, nil
+	case POLICY_PAUSE:
+		return TimedPause{Delay: delay}, nil
+	}
+	return nil, fmt.Errorf("common.NewPolicy: %s isn't a policy, expected %s, %s or %s", name, POLICY_CONTINUE, POLICY_ABORT, POLICY_PAUSE)
+}
+
+// AutoContinue never waits and goes ahead with everything
+type AutoContinue struct{}
+
+func (AutoContinue) Pause(ctx context.Context, message string) error {
+	return ctx.Err()
+}
+
+func (AutoContinue) Confirm(ctx context.Context, question string) (bool, error) {
+	return true, ctx.Err()
+}
+
+// Abort never waits and turns down everything
+type Abort struct{}
+
+func (Abort) Pause(ctx context.Context, message string) error {
+	return ctx.Err()
+}
+
+func (Abort) Confirm(ctx context.Context, question string) (bool, error) {
+	return false, ctx.Err()
+}
+
+// TimedPause waits for Delay every time it's asked, then goes ahead
+type TimedPause struct {
+	Delay time.Duration
+}
+
+func (p TimedPause) Pause(ctx context.Context, message string) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(p.Delay):
+		return nil
+	}
+}
+
+func (p TimedPause) Confirm(ctx context.Context, question string) (bool, error) {
+	err := p.Pause(ctx, question)
+	return err == nil, err
+}
+
+// Terminal asks whoever started the flow, printing to Out and reading their answer from In
+type Terminal struct {
+	In  io.Reader
+	Out io.Writer
+}
+
+func (t Terminal) Pause(ctx context.Context, message string) error {
+	_, err := fmt.Fprintf(t.Out, "%s, then press enter ", message)
+	if err != nil {
+		return err
+	}
+	_, err = t.readLine(ctx)
+	return err
+}
+
+// Confirm takes anything but yes as a no
+func (t Terminal) Confirm(ctx context.Context, question string) (bool, error) {
+	_, err := fmt.Fprintf(t.Out, "%s (y/N) ", question)
+	if err != nil {
+		return false, err
+	}
+	answer, err := t.readLine(ctx)
+	if err != nil {
+		return false, err
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes", nil
+}
+
+// readLine reads a byte at a time so nothing past the line is taken from In, giving up on it if ctx ends first
+func (t Terminal) readLine(ctx context.Context) (string, error) {
+	type read struct {
+		line string
+		err  error
+	}
+	done := make(chan read, 1)
+	go func() {
+		var line []byte
+		b := make([]byte, 1)
+		for {
+			n, err := t.In.Read(b)
+			if n == 1 && b[0] == '\n' {
+				done <- read{strings.TrimSuffix(string(line), "\r"), nil}
+				return
+			}
+			line = append(line, b[:n]...)
+			if err != nil {
+				done <- read{string(line), err}
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case r := <-done:
+		return r.line, r.err
+	}
+}
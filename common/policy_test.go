@@ -0,0 +1,73 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTerminalPolicy(t *testing.T) {
+	var out bytes.Buffer
+	terminal := Terminal{In: strings.NewReader("\nYes\r\nn\n"), Out: &out}
+
+	err := terminal.Pause(context.Background(), "Release the MODE button")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []bool{true, false} {
+		got, err := terminal.Confirm(context.Background(), "Would you like to continue?")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("Confirm = %t, want %t", got, want)
+		}
+	}
+	if !strings.Contains(out.String(), "Release the MODE button") || !strings.Contains(out.String(), "(y/N)") {
+		t.Errorf("Asked %q", out.String())
+	}
+
+	// Nobody answering doesn't hold up a cancelled flow
+	reader, writer := io.Pipe()
+	defer writer.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = Terminal{In: reader, Out: io.Discard}.Confirm(ctx, "Anyone there?")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Confirm with nobody answering = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestUnattendedPolicies(t *testing.T) {
+	tests := []struct {
+		name    string
+		confirm bool
+	}{
+		{POLICY_CONTINUE, true},
+		{POLICY_ABORT, false},
+		{POLICY_PAUSE, true},
+	}
+	for _, tt := range tests {
+		policy, err := NewPolicy(tt.name, 10*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		got, err := policy.Confirm(context.Background(), "Would you like to continue?")
+		if err != nil || got != tt.confirm {
+			t.Errorf("%s: Confirm = %t, %v, want %t", tt.name, got, err, tt.confirm)
+		}
+		if tt.name == POLICY_PAUSE && time.Since(start) < 10*time.Millisecond {
+			t.Errorf("%s didn't wait before confirming", tt.name)
+		}
+	}
+
+	_, err := NewPolicy("ask", 0)
+	if err == nil {
+		t.Error("NewPolicy accepted ask")
+	}
+}
@@ -0,0 +1,283 @@
+package common
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Ways of interrupting a router's boot to get into ROMMON
+const (
+	BREAK_SERIAL = "serial-break"
+	BREAK_CTRL_C = "ctrl-c"
+	BREAK_TELNET = "telnet-break"
+)
+
+// Types of device, which decide the flow a profile is used with
+const (
+	ROUTER = "router"
+	SWITCH = "switch"
+)
+
+// AUTO_PROFILE starts with the type's default profile and switches to whichever profile the device turns out to match
+const AUTO_PROFILE = "auto"
+
+// BreakStrategy is how and when a boot gets interrupted
+type BreakStrategy struct {
+	Method string `yaml:"method"`
+	// How long a serial break is held for
+	Duration time.Duration `yaml:"duration"`
+	// Time between attempts
+	Interval time.Duration `yaml:"interval"`
+	// How long after the boot starts to keep trying before giving up on this boot. Zero waits until the boot image
+	// is seen loading.
+	Window time.Duration `yaml:"window"`
+}
+
+// Timeouts are how long each phase of a flow gets before it's given up on. Zero leaves a phase unbounded.
+type Timeouts struct {
+	// The whole flow, from start to finish
+	Overall time.Duration `yaml:"overall"`
+	// Waiting for the device to be power cycled and reach ROMMON or the bootloader
+	Boot time.Duration `yaml:"boot"`
+	// Working in ROMMON or the bootloader
+	Recovery time.Duration `yaml:"recovery"`
+	// Waiting for IOS to start up and give us a prompt
+	Startup time.Duration `yaml:"startup"`
+	// Running commands at the IOS prompt
+	Commands time.Duration `yaml:"commands"`
+}
+
+// Prompts are what the flows watch for while the device boots
+type Prompts struct {
+	// Regexp for the ROMMON or bootloader prompt
+	Recovery string `yaml:"recovery"`
+	// Output seen at the start of the self test, which is the window to interrupt the boot in
+	BootStart []string `yaml:"boot_start"`
+	// Output seen once the boot image is loading, at which point it's too late to interrupt it
+	ImageLoading []string `yaml:"image_loading"`
+}
+
+// Recovery is the procedure for getting past the config once the device is at the recovery prompt
+type Recovery struct {
+	// Run at the recovery prompt, each waiting for the prompt to come back
+	Commands []string `yaml:"commands"`
+	// Lists flash so the files to delete can be found, skipped when empty
+	List string `yaml:"list"`
+	// Deletes a file from flash, with %s standing in for its name
+	Delete string `yaml:"delete"`
+	// Leaves the recovery prompt and boots IOS
+	Boot string `yaml:"boot"`
+	// Run from global configuration once IOS is up, e.g. to put the configuration register back
+	Restore []string `yaml:"restore"`
+	// Run from privileged exec to erase the config
+	Erase []string `yaml:"erase"`
+	// Interface the config is backed up through
+	BackupInterface string `yaml:"backup_interface"`
+}
+
+// Profile holds what differs between models of the same type of device
+type Profile struct {
+	Name string `yaml:"name"`
+	// ROUTER or SWITCH
+	Type string `yaml:"type"`
+	// Regexps matched against boot output to recognise the model
+	Detect   []string      `yaml:"detect"`
+	Break    BreakStrategy `yaml:"break"`
+	Timeouts Timeouts      `yaml:"timeouts"`
+	Prompts  Prompts       `yaml:"prompts"`
+	Recovery Recovery      `yaml:"recovery"`
+	// Files in flash with any of these in their name get deleted
+	DeleteFiles []string `yaml:"delete_files"`
+	// Highest vty line the model has
+	MaxVty int `yaml:"max_vty"`
+}
+
+func DefaultRouterProfile() Profile {
+	return Profile{
+		Name:   "ISR4221",
+		Type:   ROUTER,
+		Detect: []string{`ISR4221`},
+		Break: BreakStrategy{
+			Method:   BREAK_CTRL_C,
+			Duration: 500 * time.Millisecond,
+			Interval: 250 * time.Millisecond,
+			Window:   time.Minute,
+		},
+		Timeouts: Timeouts{
+			Overall:  time.Hour,
+			Boot:     15 * time.Minute,
+			Recovery: 5 * time.Minute,
+			Startup:  20 * time.Minute,
+			Commands: 10 * time.Minute,
+		},
+		Prompts: Prompts{
+			Recovery:     `(?i)rommon \d+ >$`,
+			BootStart:    []string{"initializing hardware", "system bootstrap"},
+			ImageLoading: []string{"boot: attempting to boot", "boot: reading file", "cisco ios xe software", "press return to get started"},
+		},
+		Recovery: Recovery{
+			Commands:        []string{"confreg 0x2142"},
+			Boot:            "reset",
+			Restore:         []string{"config-register 0x2102"},
+			Erase:           []string{"erase nvram:"},
+			BackupInterface: "g0/0/0",
+		},
+		MaxVty: 4,
+	}
+}
+
+func DefaultSwitchProfile() Profile {
+	return Profile{
+		Name:   "C2960",
+		Type:   SWITCH,
+		Detect: []string{`C2960`},
+		Timeouts: Timeouts{
+			Overall:  time.Hour,
+			Boot:     15 * time.Minute,
+			Recovery: 10 * time.Minute,
+			Startup:  15 * time.Minute,
+			Commands: 10 * time.Minute,
+		},
+		Prompts: Prompts{
+			Recovery: `(?i)switch:$`,
+		},
+		Recovery: Recovery{
+			Commands: []string{"flash_init"},
+			List:     "dir flash:",
+			Delete:   "del flash:%s",
+			Boot:     "reset",
+		},
+		DeleteFiles: []string{"config", "vlan"},
+		MaxVty:      15,
+	}
+}
+
+// DefaultProfile is the profile for the type of device that everything else is based on
+func DefaultProfile(deviceType string) (Profile, error) {
+	switch deviceType {
+	case ROUTER:
+		return DefaultRouterProfile(), nil
+	case SWITCH:
+		return DefaultSwitchProfile(), nil
+	default:
+		return Profile{}, fmt.Errorf("common.DefaultProfile: Unknown device type %q", deviceType)
+	}
+}
+
+// RecoveryPrompt matches the profile's ROMMON or bootloader prompt
+func (p Profile) RecoveryPrompt() (*regexp.Regexp, error) {
+	prompt, err := regexp.Compile(p.Prompts.Recovery)
+	if err != nil {
+		return nil, fmt.Errorf("common.RecoveryPrompt: Profile %s has an invalid recovery prompt: %w", p.Name, err)
+	}
+	return prompt, nil
+}
+
+// SendBreak interrupts the device once using the strategy's method
+func SendBreak(port Transport, strategy BreakStrategy) error {
+	switch strategy.Method {
+	case BREAK_CTRL_C, "":
+		_, err := port.Write([]byte{0x03})
+		return err
+	case BREAK_SERIAL:
+		breaker, ok := port.(Breaker)
+		if !ok {
+			return fmt.Errorf("common.SendBreak: %s can't send a serial break", port.Name())
+		}
+		return breaker.Break(strategy.Duration)
+	case BREAK_TELNET:
+		console, ok := port.(*TcpTransport)
+		if !ok || !console.telnet {
+			return fmt.Errorf("common.SendBreak: %s isn't a telnet console", port.Name())
+		}
+		return console.Break(strategy.Duration)
+	default:
+		return fmt.Errorf("common.SendBreak: Unknown break method %s", strategy.Method)
+	}
+}
+
+// BreakSender sends breaks on a timer in the background, so the boot still gets interrupted while we're waiting on
+// output from the device
+type BreakSender struct {
+	port     Transport
+	strategy BreakStrategy
+
+	mu     sync.Mutex
+	paused bool
+	stop   chan bool
+	done   chan bool
+	Errors chan error
+}
+
+func StartBreaks(port Transport, strategy BreakStrategy) *BreakSender {
+	if strategy.Interval <= 0 {
+		strategy.Interval = 250 * time.Millisecond
+	}
+
+	b := &BreakSender{
+		port:     port,
+		strategy: strategy,
+		stop:     make(chan bool),
+		done:     make(chan bool),
+		Errors:   make(chan error, 1),
+	}
+
+	go func() {
+		defer close(b.done)
+		ticker := time.NewTicker(strategy.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-b.stop:
+				return
+			case <-ticker.C:
+				b.mu.Lock()
+				paused := b.paused
+				b.mu.Unlock()
+				if paused {
+					continue
+				}
+
+				err := SendBreak(port, strategy)
+				if err != nil {
+					b.Errors <- err
+					return
+				}
+			}
+		}
+	}()
+
+	return b
+}
+
+// Pause stops sending breaks until Resume, e.g. while the boot image is loading and a break would do nothing
+func (b *BreakSender) Pause() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.paused = true
+}
+
+func (b *BreakSender) Resume() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.paused = false
+}
+
+func (b *BreakSender) Paused() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.paused
+}
+
+// Stop sends no more breaks once it returns
+func (b *BreakSender) Stop() {
+	select {
+	case <-b.done:
+	default:
+		close(b.stop)
+		<-b.done
+	}
+}
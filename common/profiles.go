@@ -0,0 +1,164 @@
+package common
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Profiles for models beyond the defaults, which are built in
+//
+//go:embed profiles
+var builtInProfiles embed.FS
+
+// Every profile that's been loaded, keyed by lowercase name
+var profiles = make(map[string]Profile)
+var profilesMu sync.Mutex
+
+func init() {
+	for _, profile := range []Profile{DefaultRouterProfile(), DefaultSwitchProfile()} {
+		profiles[strings.ToLower(profile.Name)] = profile
+	}
+
+	err := loadProfiles(builtInProfiles, "profiles")
+	if err != nil {
+		panic(err)
+	}
+}
+
+// ParseProfile reads a profile from YAML or JSON. Anything left out is taken from the default profile for its type.
+func ParseProfile(contents []byte) (Profile, error) {
+	var header struct {
+		Name string `yaml:"name"`
+		Type string `yaml:"type"`
+	}
+	err := yaml.Unmarshal(contents, &header)
+	if err != nil {
+		return Profile{}, fmt.Errorf("common.ParseProfile: Error while parsing profile: %w", err)
+	}
+	if header.Name == "" {
+		return Profile{}, fmt.Errorf("common.ParseProfile: Profile is missing a name")
+	}
+	if strings.ToLower(header.Name) == AUTO_PROFILE {
+		return Profile{}, fmt.Errorf("common.ParseProfile: %s is reserved for auto-detecting the profile", AUTO_PROFILE)
+	}
+
+	profile, err := DefaultProfile(header.Type)
+	if err != nil {
+		return Profile{}, fmt.Errorf("common.ParseProfile: Profile %s: %w", header.Name, err)
+	}
+
+	// Lists in the file replace the default's rather than adding to them
+	decoder := yaml.NewDecoder(bytes.NewReader(contents))
+	decoder.KnownFields(true)
+	err = decoder.Decode(&profile)
+	if err != nil {
+		return Profile{}, fmt.Errorf("common.ParseProfile: Error while parsing profile %s: %w", header.Name, err)
+	}
+
+	_, err = profile.RecoveryPrompt()
+	if err != nil {
+		return Profile{}, err
+	}
+	for _, pattern := range profile.Detect {
+		_, err = regexp.Compile(pattern)
+		if err != nil {
+			return Profile{}, fmt.Errorf("common.ParseProfile: Profile %s has an invalid detect pattern: %w", profile.Name, err)
+		}
+	}
+
+	return profile, nil
+}
+
+// LoadProfiles adds every .yaml, .yml and .json profile in dir, replacing any already loaded with the same name
+func LoadProfiles(dir string) error {
+	return loadProfiles(os.DirFS(dir), ".")
+}
+
+func loadProfiles(fsys fs.FS, dir string) error {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return fmt.Errorf("common.LoadProfiles: Error while listing profiles: %w", err)
+	}
+
+	for _, entry := range entries {
+		switch strings.ToLower(filepath.Ext(entry.Name())) {
+		case ".yaml", ".yml", ".json":
+		default:
+			continue
+		}
+
+		contents, err := fs.ReadFile(fsys, filepath.ToSlash(filepath.Join(dir, entry.Name())))
+		if err != nil {
+			return fmt.Errorf("common.LoadProfiles: Error while reading %s: %w", entry.Name(), err)
+		}
+		profile, err := ParseProfile(contents)
+		if err != nil {
+			return fmt.Errorf("common.LoadProfiles: %s: %w", entry.Name(), err)
+		}
+
+		profilesMu.Lock()
+		profiles[strings.ToLower(profile.Name)] = profile
+		profilesMu.Unlock()
+	}
+
+	return nil
+}
+
+// FindProfile looks up a profile of deviceType by name. AUTO_PROFILE, or no name at all, gives the type's default to
+// start with, named AUTO_PROFILE so the flow knows to detect the model.
+func FindProfile(deviceType string, name string) (Profile, error) {
+	if name == "" || strings.ToLower(name) == AUTO_PROFILE {
+		profile, err := DefaultProfile(deviceType)
+		profile.Name = AUTO_PROFILE
+		return profile, err
+	}
+
+	profilesMu.Lock()
+	profile, ok := profiles[strings.ToLower(name)]
+	profilesMu.Unlock()
+	if !ok {
+		return Profile{}, fmt.Errorf("common.FindProfile: No profile named %s", name)
+	}
+	if deviceType != "" && profile.Type != deviceType {
+		return Profile{}, fmt.Errorf("common.FindProfile: %s is a %s profile, not a %s one", profile.Name, profile.Type, deviceType)
+	}
+	return profile, nil
+}
+
+// ListProfiles gives every profile of deviceType sorted by name, or every profile if deviceType is empty
+func ListProfiles(deviceType string) []Profile {
+	profilesMu.Lock()
+	defer profilesMu.Unlock()
+
+	list := make([]Profile, 0, len(profiles))
+	for _, profile := range profiles {
+		if deviceType == "" || profile.Type == deviceType {
+			list = append(list, profile)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// DetectProfile finds the profile of deviceType whose detect patterns match output
+func DetectProfile(deviceType string, output string) (Profile, bool) {
+	for _, profile := range ListProfiles(deviceType) {
+		for _, pattern := range profile.Detect {
+			if regexp.MustCompile(pattern).MatchString(output) {
+				return profile, true
+			}
+		}
+	}
+	return Profile{}, false
+}
@@ -0,0 +1,71 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseProfile(t *testing.T) {
+	profile, err := ParseProfile([]byte(`{"name": "Cisco1841", "type": "router", "detect": ["1841"], "break": {"method": "serial-break"}, "max_vty": 15}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.Break.Method != BREAK_SERIAL || profile.MaxVty != 15 {
+		t.Errorf("Profile didn't take what was given: %+v", profile)
+	}
+	// Everything else comes from the router defaults
+	defaults := DefaultRouterProfile()
+	if profile.Break.Interval != defaults.Break.Interval || profile.Timeouts.Boot != defaults.Timeouts.Boot || len(profile.Recovery.Commands) == 0 {
+		t.Errorf("Profile didn't inherit the router defaults: %+v", profile)
+	}
+
+	profile, err = ParseProfile([]byte("name: slow\ntype: switch\ntimeouts:\n  boot: 20m\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.Timeouts.Boot != 20*time.Minute || profile.MaxVty != DefaultSwitchProfile().MaxVty {
+		t.Errorf("Profile = %+v", profile)
+	}
+
+	for _, bad := range []string{
+		"type: router\n",
+		"name: auto\ntype: router\n",
+		"name: x\ntype: firewall\n",
+		"name: x\ntype: router\nrecovery_prompt: x\n",
+		"name: x\ntype: router\ndetect: ['(']\n",
+	} {
+		_, err = ParseProfile([]byte(bad))
+		if err == nil {
+			t.Errorf("ParseProfile(%q) should have failed", bad)
+		}
+	}
+}
+
+func TestBuiltInProfiles(t *testing.T) {
+	profile, err := FindProfile(SWITCH, "c9200")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.Recovery.List != "" || len(profile.DeleteFiles) != 0 {
+		t.Errorf("C9200 shouldn't delete anything from flash: %+v", profile.Recovery)
+	}
+
+	_, err = FindProfile(ROUTER, "c9200")
+	if err == nil {
+		t.Error("Found a switch profile when asking for a router")
+	}
+
+	profile, err = FindProfile(ROUTER, "")
+	if err != nil || profile.Name != AUTO_PROFILE {
+		t.Errorf("FindProfile(router, \"\") = %s, %v", profile.Name, err)
+	}
+
+	profile, ok := DetectProfile(ROUTER, "Cisco CISCO1941/K9 (revision 1.0) with 491520K/32768K bytes of memory.")
+	if !ok || profile.Name != "CISCO1941" {
+		t.Errorf("DetectProfile picked %q", profile.Name)
+	}
+	_, ok = DetectProfile(SWITCH, "Cisco CISCO1941/K9 (revision 1.0) with 491520K/32768K bytes of memory.")
+	if ok {
+		t.Error("Detected a router as a switch")
+	}
+}
@@ -0,0 +1,119 @@
+package common
+
+import (
+	"time"
+)
+
+// Step is one named stage of a flow, such as entering ROMMON or configuring a vlan
+type Step struct {
+	Name    string
+	Started time.Time
+	// Zero until the next step starts or the flow finishes
+	Finished time.Time
+}
+
+// Duration is how long the step took to the nearest tenth of a second, or has taken so far if it's still going
+func (s Step) Duration() time.Duration {
+	finished := s.Finished
+	if finished.IsZero() {
+		finished = time.Now()
+	}
+	return finished.Sub(s.Started).Round(100 * time.Millisecond)
+}
+
+// Progress is how far through its flows a session is. TotalSteps is a best guess until the flows finish, as some
+// steps only turn up once the device has been looked at.
+type Progress struct {
+	CurrentStep int
+	TotalSteps  int
+	Steps       []Step
+}
+
+// Percent is how far through the steps the flows are, from 0 to 100
+func (p Progress) Percent() int {
+	if p.TotalSteps <= 0 {
+		return 0
+	}
+	done := p.CurrentStep
+	// The step that's going hasn't been done yet
+	if len(p.Steps) > 0 && p.Steps[len(p.Steps)-1].Finished.IsZero() {
+		done -= 1
+	}
+	return done * 100 / p.TotalSteps
+}
+
+// start finishes the step that's going and starts the next one
+func (p *Progress) start(name string) {
+	now := time.Now()
+	p.finish(now)
+	p.Steps = append(p.Steps, Step{Name: name, Started: now})
+	p.CurrentStep = len(p.Steps)
+	if p.TotalSteps < p.CurrentStep {
+		p.TotalSteps = p.CurrentStep
+	}
+}
+
+func (p *Progress) finish(now time.Time) {
+	if len(p.Steps) > 0 && p.Steps[len(p.Steps)-1].Finished.IsZero() {
+		p.Steps[len(p.Steps)-1].Finished = now
+	}
+}
+
+func (p Progress) copy() Progress {
+	p.Steps = append([]Step{}, p.Steps...)
+	return p
+}
+
+// AddSteps adds n to the number of steps the flows expect to take. Flows call it as they start, and again whenever
+// they find out there's more to do.
+func (s *Session) AddSteps(n int) {
+	s.updateProgress(func(p *Progress) {
+		p.TotalSteps += n
+	})
+}
+
+// Step finishes the step that's going and starts the one called name, which it gives back so flows can keep it for
+// reporting failures, e.g. step = session.Step("Entering ROMMON")
+func (s *Session) Step(name string) string {
+	s.logger.Debugf("Starting step: %s\n", name)
+	s.updateProgress(func(p *Progress) {
+		p.start(name)
+	})
+	return name
+}
+
+// FinishSteps finishes the step that's going once a flow has got to the end, dropping any steps it expected but
+// didn't need
+func (s *Session) FinishSteps() {
+	s.updateProgress(func(p *Progress) {
+		p.finish(time.Now())
+		p.TotalSteps = p.CurrentStep
+	})
+}
+
+func (s *Session) Progress() Progress {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.progress.copy()
+}
+
+// OnProgress calls fn with the progress every time it changes
+func (s *Session) OnProgress(fn func(Progress)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.onProgress = fn
+}
+
+func (s *Session) updateProgress(update func(p *Progress)) {
+	s.mu.Lock()
+	update(&s.progress)
+	progress := s.progress.copy()
+	fn := s.onProgress
+	s.mu.Unlock()
+
+	if fn != nil {
+		fn(progress)
+	}
+}
@@ -0,0 +1,56 @@
+package common
+
+import (
+	"testing"
+)
+
+func TestProgress(t *testing.T) {
+	session := NewSession(nil, t.Name(), nil, testing.Verbose())
+	var published []Progress
+	session.OnProgress(func(progress Progress) {
+		published = append(published, progress)
+	})
+
+	session.AddSteps(3)
+	if session.Step("Entering ROMMON") != "Entering ROMMON" {
+		t.Error("Step didn't give back its name")
+	}
+	progress := session.Progress()
+	if progress.CurrentStep != 1 || progress.TotalSteps != 3 || progress.Percent() != 0 {
+		t.Errorf("Progress = %d of %d at %d%%", progress.CurrentStep, progress.TotalSteps, progress.Percent())
+	}
+
+	session.Step("Deleting vlan.dat")
+	progress = session.Progress()
+	if !progress.Steps[1].Finished.IsZero() || progress.Steps[0].Finished.IsZero() {
+		t.Error("Starting a step didn't finish the one before it")
+	}
+	if progress.Percent() != 33 {
+		t.Errorf("Percent = %d, want 33", progress.Percent())
+	}
+
+	// More steps than expected stretch the total
+	session.Step("Applying VLANs")
+	session.Step("Leaving global configuration")
+	progress = session.Progress()
+	if progress.TotalSteps != 4 {
+		t.Errorf("TotalSteps = %d, want 4", progress.TotalSteps)
+	}
+
+	session.FinishSteps()
+	progress = session.Progress()
+	if progress.Percent() != 100 {
+		t.Errorf("Percent = %d once finished, want 100", progress.Percent())
+	}
+	if current := progress.Steps[3]; current.Finished.IsZero() || current.Duration() < 0 {
+		t.Errorf("Last step = %+v once finished", current)
+	}
+
+	if len(published) != 6 {
+		t.Errorf("Progress was published %d times, want 6", len(published))
+	}
+	// Published progress doesn't change underneath whoever has it
+	if len(published[1].Steps) != 1 || !published[1].Steps[0].Finished.IsZero() {
+		t.Errorf("Published progress changed to %+v", published[1])
+	}
+}
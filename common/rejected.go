@@ -0,0 +1,129 @@
+package common
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Ways IOS turns down a command
+const (
+	IOS_INVALID_INPUT = "invalid input"
+	IOS_INCOMPLETE    = "incomplete"
+	IOS_AMBIGUOUS     = "ambiguous"
+)
+
+var iosErrors = []struct {
+	kind    string
+	pattern *regexp.Regexp
+}{
+	{IOS_INVALID_INPUT, regexp.MustCompile(`^% Invalid input detected`)},
+	{IOS_INCOMPLETE, regexp.MustCompile(`^% Incomplete command`)},
+	{IOS_AMBIGUOUS, regexp.MustCompile(`^% Ambiguous command`)},
+}
+
+// ClassifyIOSError works out which of the ways IOS turns down a command line is, if it's one of them
+func ClassifyIOSError(line string) (string, bool) {
+	for _, iosError := range iosErrors {
+		if iosError.pattern.MatchString(line) {
+			return iosError.kind, true
+		}
+	}
+	return "", false
+}
+
+// CommandError is a command the device turned down
+type CommandError struct {
+	Command string
+	// IOS_INVALID_INPUT, IOS_INCOMPLETE or IOS_AMBIGUOUS
+	Kind string
+	// What the device said, such as % Incomplete command.
+	Message string
+	// The step the flow was on
+	Step string
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("the device turned down %q: %s", e.Command, e.Message)
+}
+
+// How many commands are kept while waiting for the device to echo them back
+const maxUnechoed = 64
+
+// sent keeps line until the device echoes it back, so any error that comes after can be pinned on it
+func (s *Session) sent(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.unechoed = append(s.unechoed, line)
+	if len(s.unechoed) > maxUnechoed {
+		s.unechoed = s.unechoed[len(s.unechoed)-maxUnechoed:]
+	}
+}
+
+// heard follows which command the device's output is about from the echoes, noting any error it gives for it.
+// Commands that are pasted in get echoed in the order they were sent, so the errors still land on the right one.
+func (s *Session) heard(line string) {
+	s.mu.Lock()
+	for i, command := range s.unechoed {
+		if echoes(line, command) {
+			s.echoed = command
+			s.unechoed = s.unechoed[i+1:]
+			s.mu.Unlock()
+			return
+		}
+	}
+
+	kind, ok := ClassifyIOSError(line)
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+	// A device that doesn't echo is most likely answering the oldest command it hasn't yet
+	command := s.echoed
+	if command == "" && len(s.unechoed) > 0 {
+		command = s.unechoed[0]
+	}
+	rejected := CommandError{Command: command, Kind: kind, Message: line}
+	if len(s.progress.Steps) > 0 {
+		rejected.Step = s.progress.Steps[len(s.progress.Steps)-1].Name
+	}
+	s.commandErrors = append(s.commandErrors, rejected)
+	s.mu.Unlock()
+
+	s.logger.Errorf("ERROR: %s\n", &rejected)
+}
+
+// CommandErrors are the commands the device has turned down, in the order it did
+func (s *Session) CommandErrors() []CommandError {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]CommandError{}, s.commandErrors...)
+}
+
+// rejectedSince is the first command turned down after the first n, or nil if there hasn't been one
+func (s *Session) rejectedSince(n int) *CommandError {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.commandErrors) <= n {
+		return nil
+	}
+	rejected := s.commandErrors[n]
+	return &rejected
+}
+
+// commandErrorCount is how many commands the device has turned down, for picking out the ones after this with
+// rejectedSince
+func (s *Session) commandErrorCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.commandErrors)
+}
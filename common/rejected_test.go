@@ -0,0 +1,115 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+const invalidInput = "          ^\r\n% Invalid input detected at '^' marker.\r\n\r\n"
+
+func TestClassifyIOSError(t *testing.T) {
+	tests := []struct {
+		line string
+		kind string
+	}{
+		{"% Invalid input detected at '^' marker.", IOS_INVALID_INPUT},
+		{"% Incomplete command.", IOS_INCOMPLETE},
+		{`% Ambiguous command:  "sh"`, IOS_AMBIGUOUS},
+		{"% Please define a domain-name first.", ""},
+		{"Invalid input detected", ""},
+	}
+	for _, tt := range tests {
+		kind, ok := ClassifyIOSError(tt.line)
+		if kind != tt.kind || ok != (tt.kind != "") {
+			t.Errorf("ClassifyIOSError(%q) = %q, %t, want %q", tt.line, kind, ok, tt.kind)
+		}
+	}
+}
+
+// rejectingRouter scripts a router that doesn't have a g0/9
+func rejectingRouter() *scriptedPort {
+	return &scriptedPort{replies: map[string]string{
+		"conf t":                     "conf t\r\nEnter configuration commands, one per line.  End with CNTL/Z.\r\nRouter(config)#",
+		"inter g0/9":                 "inter g0/9\r\n" + invalidInput + "Router(config)#",
+		"ip addr 10.0.0.1 255.0.0.0": "ip addr 10.0.0.1 255.0.0.0\r\n" + invalidInput + "Router(config)#",
+		"exit":                       "exit\r\nRouter#",
+		"":                           "\r\nRouter(config)#",
+		"hostname R1":                "hostname R1\r\nR1(config)#",
+		"end":                        "end\r\nR1#",
+		"reload":                     "reload\r\nProceed with reload? [confirm]",
+	}}
+}
+
+func rejectedConfig() RenderedConfig {
+	var rendered RenderedConfig
+	rendered.Add("Entering global configuration", "conf t", MODE_CONFIG)
+	rendered.Add("Configuring interface g0/9", "inter g0/9", MODE_INTERFACE)
+	rendered.Add("Configuring interface g0/9", "ip addr 10.0.0.1 255.0.0.0", MODE_INTERFACE)
+	rendered.Add("Configuring interface g0/9", "exit", MODE_CONFIG)
+	rendered.Add("Setting the hostname", "hostname R1", MODE_CONFIG)
+	rendered.Add("Leaving global configuration", "end", MODE_PRIV)
+	return rendered
+}
+
+func TestApplyOnError(t *testing.T) {
+	tests := []struct {
+		onError string
+		policy  Policy
+		written []string
+		failed  bool
+	}{
+		{onError: ON_ERROR_CONTINUE, written: []string{"conf t", "inter g0/9", "", "hostname R1", "end"}},
+		{onError: ON_ERROR_ASK, policy: AutoContinue{}, written: []string{"conf t", "inter g0/9", "", "hostname R1", "end"}},
+		{onError: ON_ERROR_ASK, policy: Abort{}, written: []string{"conf t", "inter g0/9"}, failed: true},
+		{onError: ON_ERROR_ABORT, written: []string{"conf t", "inter g0/9"}, failed: true},
+		{onError: ON_ERROR_ROLLBACK, written: []string{"conf t", "inter g0/9", "", "end", "reload", ""}, failed: true},
+	}
+	for _, tt := range tests {
+		port := rejectingRouter()
+		session := NewSession(port, t.Name(), nil, testing.Verbose())
+		if tt.policy != nil {
+			session.SetPolicy(tt.policy)
+		}
+
+		_, err := ApplyOptions{OnError: tt.onError}.Apply(context.Background(), session, rejectedConfig(), "")
+		var rejected *CommandError
+		if tt.failed && !errors.As(err, &rejected) {
+			t.Errorf("%s: Apply = %v, want the command that was turned down", tt.onError, err)
+		}
+		if !tt.failed && err != nil {
+			t.Errorf("%s: Apply = %v, want it to carry on", tt.onError, err)
+		}
+		if strings.Join(port.written, "|") != strings.Join(tt.written, "|") {
+			t.Errorf("%s: Sent %q, want %q", tt.onError, port.written, tt.written)
+		}
+
+		commandErrors := session.CommandErrors()
+		want := CommandError{Command: "inter g0/9", Kind: IOS_INVALID_INPUT, Message: "% Invalid input detected at '^' marker.", Step: "Configuring interface g0/9"}
+		if len(commandErrors) != 1 || commandErrors[0] != want {
+			t.Errorf("%s: Turned down %+v, want %+v", tt.onError, commandErrors, want)
+		}
+	}
+}
+
+func TestPasteCommandErrors(t *testing.T) {
+	port := rejectingRouter()
+	session := NewSession(port, t.Name(), nil, testing.Verbose())
+
+	// Everything's echoed before the errors get looked at, so each one has to be pinned on the right command
+	_, err := rejectedConfig().Paste(session, "", 0)
+	var rejected *CommandError
+	if !errors.As(err, &rejected) || rejected.Command != "inter g0/9" {
+		t.Errorf("Paste = %v, want inter g0/9 turned down", err)
+	}
+
+	var commands []string
+	for _, commandError := range session.CommandErrors() {
+		commands = append(commands, commandError.Command)
+	}
+	want := []string{"inter g0/9", "ip addr 10.0.0.1 255.0.0.0"}
+	if strings.Join(commands, "|") != strings.Join(want, "|") {
+		t.Errorf("Turned down %q, want %q", commands, want)
+	}
+}
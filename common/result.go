@@ -0,0 +1,33 @@
+package common
+
+// Result is what a reset or defaults flow reports back once it's finished
+type Result struct {
+	Success      bool
+	FailedStep   string
+	FilesDeleted []string
+	Backups      []string
+	// Settings the defaults asked for that the device doesn't have afterwards
+	Differences Differences
+	// Commands the device turned down while the defaults were going in
+	CommandErrors []CommandError
+	Err           error `json:"-"`
+	Error         string
+}
+
+// Fail marks the result as failed while on step. Flows return the result directly, e.g. return result.Fail(step, err)
+func (r *Result) Fail(step string, err error) Result {
+	r.Success = false
+	r.FailedStep = step
+	r.Err = err
+	r.Error = err.Error()
+	return *r
+}
+
+// Succeed marks the result as successful
+func (r *Result) Succeed() Result {
+	r.Success = true
+	r.FailedStep = ""
+	r.Err = nil
+	r.Error = ""
+	return *r
+}
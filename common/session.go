@@ -0,0 +1,234 @@
+package common
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"main/crglogging"
+	"os"
+	"sync"
+	"time"
+)
+
+// Session is a single job's connection to a device. It carries its own reader, logger, and transcript so several
+// devices can be worked on at once without stepping on each other.
+type Session struct {
+	Port  Transport
+	Debug bool
+
+	reader  *bufio.Reader
+	logger  *crglogging.Crglogging
+	updates chan bool
+	policy  Policy
+
+	// How far through the flows the session is, and who wants to hear about it
+	progress   Progress
+	onProgress func(Progress)
+
+	mu         sync.Mutex
+	transcript [][]byte
+	// Output Expect read past what it matched
+	pushback []byte
+	// What the output has given away about the device
+	device Device
+	// Commands sent that the device hasn't echoed back yet, the last one it has, and every one it's turned down
+	unechoed      []string
+	echoed        string
+	commandErrors []CommandError
+
+	// The phase the flow is in, which reads are bounded by
+	ctx     context.Context
+	cancel  context.CancelFunc
+	timeout time.Duration
+}
+
+// NewSession logs under loggerName. If updates isn't nil, the log is also kept in memory under "WebHandler" and
+// updates is notified whenever OutputInfo is called. Nobody gets asked anything until a policy saying otherwise is set
+// with SetPolicy.
+func NewSession(port Transport, loggerName string, updates chan bool, debug bool) *Session {
+	logger := crglogging.New(loggerName)
+	if updates != nil {
+		logger.NewLogTarget("WebHandler", updates, false)
+	}
+
+	logger.SetLogLevel(logLevel(debug))
+
+	session := &Session{
+		Port:    port,
+		Debug:   debug,
+		logger:  logger,
+		updates: updates,
+		policy:  AutoContinue{},
+		ctx:     context.Background(),
+	}
+	session.reader = bufio.NewReader(phaseReader{session})
+
+	return session
+}
+
+// WithTimeout is context.WithTimeout, except a timeout of zero or less never expires
+func WithTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// Phase starts a new phase of the flow, ending the last one. Reads fail once ctx is done or the phase has gone on
+// longer than timeout, so a device that never shows up doesn't leave the flow waiting forever.
+func (s *Session) Phase(ctx context.Context, timeout time.Duration) {
+	phaseCtx, cancel := WithTimeout(ctx, timeout)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.ctx = phaseCtx
+	s.cancel = cancel
+	s.timeout = timeout
+}
+
+// EndPhase ends the current phase, leaving reads unbounded
+func (s *Session) EndPhase() {
+	s.Phase(context.Background(), 0)
+}
+
+// Err explains why the current phase is over, or is nil while it's still going
+func (s *Session) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.ctx.Err()
+	if errors.Is(err, context.DeadlineExceeded) && s.timeout > 0 {
+		return fmt.Errorf("gave up after %s: %w", s.timeout, err)
+	}
+	return err
+}
+
+// phaseReader checks the phase is still going before every read, so a read is never more than one port read timeout
+// behind a cancellation
+type phaseReader struct {
+	session *Session
+}
+
+func (r phaseReader) Read(p []byte) (int, error) {
+	err := r.session.Err()
+	if err != nil {
+		return 0, err
+	}
+
+	r.session.mu.Lock()
+	if len(r.session.pushback) > 0 {
+		n := copy(p, r.session.pushback)
+		r.session.pushback = r.session.pushback[n:]
+		r.session.mu.Unlock()
+		return n, nil
+	}
+	r.session.mu.Unlock()
+
+	return r.session.Port.Read(p)
+}
+
+func (s *Session) Logger() *crglogging.Crglogging {
+	return s.logger
+}
+
+func (s *Session) LoggerName() string {
+	return s.logger.GetLoggerName()
+}
+
+// Policy decides what happens whenever the flow needs someone to do something or make a call
+func (s *Session) Policy() Policy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.policy
+}
+
+func (s *Session) SetPolicy(policy Policy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.policy = policy
+}
+
+// Close drops the session's logger. Nothing should be logged to the session after.
+func (s *Session) Close() {
+	crglogging.Remove(s.LoggerName())
+}
+
+// logLevel is how much a session logs, with debug logging everything it reads and writes
+func logLevel(debug bool) int {
+	if debug {
+		return 5
+	}
+	return 4
+}
+
+// OnOutput calls fn with every record the session logs from now on, as it's logged
+func (s *Session) OnOutput(fn func(record string)) {
+	s.logger.NewLogTarget("Output", fn, false)
+	// New targets log everything until they're told otherwise
+	s.logger.SetLogLevel(logLevel(s.Debug))
+}
+
+// Updates is notified whenever there's new output, nil when nobody is watching
+func (s *Session) Updates() chan bool {
+	return s.updates
+}
+
+// OutputInfo logs data and lets whoever is watching the session know there's something new
+func (s *Session) OutputInfo(data string) {
+	s.logger.Info(data)
+
+	// Don't hold up the flow if nobody is waiting on an update
+	select {
+	case s.updates <- true:
+	default:
+	}
+}
+
+// Record adds output read from the device to the transcript
+func (s *Session) Record(output []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.transcript = append(s.transcript, output)
+}
+
+func (s *Session) Transcript() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([][]byte{}, s.transcript...)
+}
+
+// WriteTranscript dumps the transcript to the file named by DumpConsoleOutput, if it's set
+func (s *Session) WriteTranscript() error {
+	dumpFile := os.Getenv("DumpConsoleOutput")
+	if dumpFile == "" {
+		return nil
+	}
+
+	file, err := os.OpenFile(dumpFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("common.WriteTranscript: Error while opening file %s to dump console outputs: %w", dumpFile, err)
+	}
+	defer file.Close()
+
+	totalWritten := 0
+	for _, line := range s.Transcript() {
+		written, err := file.Write(line)
+		if err != nil {
+			return fmt.Errorf("common.WriteTranscript: Error while writing %v to %s: %w", line, dumpFile, err)
+		}
+		totalWritten += written
+	}
+
+	s.logger.Infof("Wrote %d bytes to %s\n", totalWritten, dumpFile)
+
+	return nil
+}
@@ -0,0 +1,264 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Telnet commands and options we need to know about (RFC 854, 856, 857, 858)
+const (
+	TELNET_IAC   = 255
+	TELNET_DONT  = 254
+	TELNET_DO    = 253
+	TELNET_WONT  = 252
+	TELNET_WILL  = 251
+	TELNET_SB    = 250
+	TELNET_BREAK = 243
+	TELNET_SE    = 240
+
+	TELNET_OPT_BINARY = 0
+	TELNET_OPT_ECHO   = 1
+	TELNET_OPT_SGA    = 3
+)
+
+const (
+	telnetData = iota
+	telnetIac
+	telnetOption
+	telnetSub
+	telnetSubIac
+)
+
+// TcpTransport is a console reached through a terminal server, either as a raw TCP port (tcp://host:port) or a
+// reverse telnet port (telnet://host:port)
+type TcpTransport struct {
+	conn        net.Conn
+	name        string
+	telnet      bool
+	readTimeout time.Duration
+
+	// Negotiation state, carried across reads as commands can be split between packets
+	state   int
+	command byte
+	local   map[byte]bool
+	remote  map[byte]bool
+
+	writeMu sync.Mutex
+}
+
+// IsRemoteConsole checks if target is a tcp:// or telnet:// console rather than a local serial port
+func IsRemoteConsole(target string) bool {
+	return strings.HasPrefix(target, "tcp://") || strings.HasPrefix(target, "telnet://")
+}
+
+func DialConsole(target string) (*TcpTransport, error) {
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Scheme != "tcp" && parsed.Scheme != "telnet" {
+		return nil, fmt.Errorf("common.DialConsole: Unsupported console type %s", parsed.Scheme)
+	}
+	if parsed.Port() == "" {
+		return nil, fmt.Errorf("common.DialConsole: No port given in %s", target)
+	}
+
+	conn, err := net.DialTimeout("tcp", parsed.Host, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TcpTransport{
+		conn:        conn,
+		name:        target,
+		telnet:      parsed.Scheme == "telnet",
+		readTimeout: -1,
+		local:       make(map[byte]bool),
+		remote:      make(map[byte]bool),
+	}, nil
+}
+
+func (t *TcpTransport) Name() string {
+	return t.name
+}
+
+// SetReadTimeout mirrors serial ports, so a read that times out returns no data rather than an error
+func (t *TcpTransport) SetReadTimeout(timeout time.Duration) error {
+	t.readTimeout = timeout
+	return nil
+}
+
+func (t *TcpTransport) Read(p []byte) (int, error) {
+	if t.readTimeout >= 0 {
+		err := t.conn.SetReadDeadline(time.Now().Add(t.readTimeout))
+		if err != nil {
+			return 0, err
+		}
+	} else {
+		err := t.conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	for {
+		n, err := t.conn.Read(p)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		if !t.telnet {
+			return n, nil
+		}
+
+		n, err = t.decode(p[:n])
+		if err != nil {
+			return 0, err
+		}
+		// Only negotiation came through, so keep waiting for console output
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// decode strips telnet commands out of buff in place, answering any negotiation, and returns the console output left
+func (t *TcpTransport) decode(buff []byte) (int, error) {
+	n := 0
+	for _, b := range buff {
+		switch t.state {
+		case telnetData:
+			if b == TELNET_IAC {
+				t.state = telnetIac
+			} else {
+				buff[n] = b
+				n += 1
+			}
+		case telnetIac:
+			switch b {
+			case TELNET_IAC:
+				buff[n] = b
+				n += 1
+				t.state = telnetData
+			case TELNET_DO, TELNET_DONT, TELNET_WILL, TELNET_WONT:
+				t.command = b
+				t.state = telnetOption
+			case TELNET_SB:
+				t.state = telnetSub
+			default:
+				t.state = telnetData
+			}
+		case telnetOption:
+			t.state = telnetData
+			err := t.negotiate(t.command, b)
+			if err != nil {
+				return 0, err
+			}
+		case telnetSub:
+			// We don't agree to any options that need subnegotiation, so skip it
+			if b == TELNET_IAC {
+				t.state = telnetSubIac
+			}
+		case telnetSubIac:
+			if b == TELNET_SE {
+				t.state = telnetData
+			} else {
+				t.state = telnetSub
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// negotiate only agrees to binary mode, suppressing go ahead, and the server echoing. Replies are only sent when an
+// option changes state so the two sides don't loop acknowledging each other.
+func (t *TcpTransport) negotiate(command byte, option byte) error {
+	supported := option == TELNET_OPT_BINARY || option == TELNET_OPT_SGA
+	var reply byte
+
+	switch command {
+	case TELNET_DO:
+		if supported && !t.local[option] {
+			t.local[option] = true
+			reply = TELNET_WILL
+		} else if !supported {
+			reply = TELNET_WONT
+		}
+	case TELNET_DONT:
+		if t.local[option] {
+			t.local[option] = false
+			reply = TELNET_WONT
+		}
+	case TELNET_WILL:
+		if (supported || option == TELNET_OPT_ECHO) && !t.remote[option] {
+			t.remote[option] = true
+			reply = TELNET_DO
+		} else if !supported && option != TELNET_OPT_ECHO {
+			reply = TELNET_DONT
+		}
+	case TELNET_WONT:
+		if t.remote[option] {
+			t.remote[option] = false
+			reply = TELNET_DONT
+		}
+	}
+
+	if reply == 0 {
+		return nil
+	}
+
+	return t.writeRaw([]byte{TELNET_IAC, reply, option})
+}
+
+func (t *TcpTransport) writeRaw(data []byte) error {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+
+	_, err := t.conn.Write(data)
+	return err
+}
+
+func (t *TcpTransport) Write(p []byte) (int, error) {
+	if !t.telnet {
+		return t.conn.Write(p)
+	}
+
+	// Escape IAC, and follow a bare CR with a NUL as the NVT expects
+	escaped := make([]byte, 0, len(p))
+	for i, b := range p {
+		escaped = append(escaped, b)
+		if b == TELNET_IAC {
+			escaped = append(escaped, TELNET_IAC)
+		} else if b == '\r' && (i+1 == len(p) || p[i+1] != '\n') {
+			escaped = append(escaped, 0)
+		}
+	}
+
+	err := t.writeRaw(escaped)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Break sends a telnet break, which terminal servers pass on to the device as a serial break. Raw TCP has no way to
+// signal one.
+func (t *TcpTransport) Break(d time.Duration) error {
+	if !t.telnet {
+		return fmt.Errorf("common.Break: %s is a raw TCP console, which can't send a break", t.name)
+	}
+	return t.writeRaw([]byte{TELNET_IAC, TELNET_BREAK})
+}
+
+func (t *TcpTransport) Close() error {
+	return t.conn.Close()
+}
@@ -0,0 +1,120 @@
+package common
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// consoleServer accepts a single connection on a random port, handing it to serve
+func consoleServer(t *testing.T, serve func(conn net.Conn)) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error while listening: %s", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		serve(conn)
+	}()
+
+	return listener.Addr().String()
+}
+
+// readAll reads from port until want bytes have arrived or the deadline passes
+func readAll(port io.Reader, want int) []byte {
+	var output []byte
+	buff := make([]byte, 64)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(output) < want && time.Now().Before(deadline) {
+		n, err := port.Read(buff)
+		if err != nil {
+			break
+		}
+		output = append(output, buff[:n]...)
+	}
+	return output
+}
+
+func TestTelnetNegotiation(t *testing.T) {
+	received := make(chan []byte, 1)
+	addr := consoleServer(t, func(conn net.Conn) {
+		conn.Write([]byte{TELNET_IAC, TELNET_WILL, TELNET_OPT_ECHO, TELNET_IAC, TELNET_DO, TELNET_OPT_BINARY, TELNET_IAC, TELNET_DO, 24})
+		conn.Write([]byte{TELNET_IAC, TELNET_SB, 24, 1, TELNET_IAC, TELNET_SE})
+		conn.Write([]byte("Switch>"))
+		conn.Write([]byte{TELNET_IAC, TELNET_IAC})
+		received <- readAll(conn, 15)
+	})
+
+	console, err := OpenConsole("telnet://"+addr, DefaultMode())
+	if err != nil {
+		t.Fatalf("Error while opening console: %s", err)
+	}
+	defer console.Close()
+	console.SetReadTimeout(100 * time.Millisecond)
+
+	output := readAll(console, 8)
+	if !bytes.Equal(output, []byte("Switch>\xff")) {
+		t.Errorf("Console output = %q, want %q", output, "Switch>\xff")
+	}
+
+	console.Write([]byte("a\r"))
+	console.Write([]byte{0xff})
+	err = console.(Breaker).Break(250 * time.Millisecond)
+	if err != nil {
+		t.Errorf("Error while sending break: %s", err)
+	}
+
+	want := []byte{
+		TELNET_IAC, TELNET_DO, TELNET_OPT_ECHO,
+		TELNET_IAC, TELNET_WILL, TELNET_OPT_BINARY,
+		TELNET_IAC, TELNET_WONT, 24,
+		'a', '\r', 0,
+		TELNET_IAC, TELNET_IAC,
+		TELNET_IAC, TELNET_BREAK,
+	}
+	select {
+	case got := <-received:
+		if !bytes.Equal(got, want) {
+			t.Errorf("Server received %v, want %v", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Server never received the replies")
+	}
+}
+
+func TestRawTcpConsole(t *testing.T) {
+	received := make(chan []byte, 1)
+	addr := consoleServer(t, func(conn net.Conn) {
+		conn.Write([]byte{'o', 'k', TELNET_IAC})
+		received <- readAll(conn, 3)
+	})
+
+	console, err := OpenConsole("tcp://"+addr, DefaultMode())
+	if err != nil {
+		t.Fatalf("Error while opening console: %s", err)
+	}
+	defer console.Close()
+
+	console.SetReadTimeout(100 * time.Millisecond)
+	output := readAll(console, 3)
+	if !bytes.Equal(output, []byte{'o', 'k', TELNET_IAC}) {
+		t.Errorf("Console output = %v, want the bytes untouched", output)
+	}
+
+	console.Write([]byte("a\r\xff"))
+	if got := <-received; !bytes.Equal(got, []byte("a\r\xff")) {
+		t.Errorf("Server received %v, want the bytes untouched", got)
+	}
+
+	if console.(Breaker).Break(250*time.Millisecond) == nil {
+		t.Errorf("Raw TCP console claimed to send a break")
+	}
+}
@@ -0,0 +1,125 @@
+package common
+
+import (
+	"fmt"
+	"go.bug.st/serial"
+	"go.bug.st/serial/enumerator"
+	"io"
+	"strings"
+	"time"
+)
+
+// Transport is the console connection the reset and defaults flows talk over.
+// A local serial port is the usual implementation, but anything that can read,
+// write, time out, and close (a TCP console server, a recorded session, a fake
+// device) can be used in its place.
+type Transport interface {
+	io.ReadWriteCloser
+	SetReadTimeout(t time.Duration) error
+	Name() string
+}
+
+// Breaker is implemented by transports that can signal a serial break
+type Breaker interface {
+	Break(d time.Duration) error
+}
+
+// DefaultMode is 9600 8N1, which every device we've come across uses out of the box
+func DefaultMode() serial.Mode {
+	return serial.Mode{
+		BaudRate: 9600,
+		Parity:   serial.NoParity,
+		DataBits: 8,
+		StopBits: serial.OneStopBit,
+	}
+}
+
+// ParseParity reads a parity setting given as none, even, odd, mark or space, or just its first letter
+func ParseParity(parity string) (serial.Parity, error) {
+	switch strings.ToLower(parity) {
+	case "n", "none":
+		return serial.NoParity, nil
+	case "e", "even":
+		return serial.EvenParity, nil
+	case "o", "odd":
+		return serial.OddParity, nil
+	case "m", "mark":
+		return serial.MarkParity, nil
+	case "s", "space":
+		return serial.SpaceParity, nil
+	}
+	return serial.NoParity, fmt.Errorf("common.ParseParity: %s isn't a parity, expected none, even, odd, mark or space", parity)
+}
+
+// ParseStopBits reads a stop bits setting of 1, 1.5 or 2
+func ParseStopBits(stopBits string) (serial.StopBits, error) {
+	switch stopBits {
+	case "1":
+		return serial.OneStopBit, nil
+	case "1.5":
+		return serial.OnePointFiveStopBits, nil
+	case "2":
+		return serial.TwoStopBits, nil
+	}
+	return serial.OneStopBit, fmt.Errorf("common.ParseStopBits: %s isn't a number of stop bits, expected 1, 1.5 or 2", stopBits)
+}
+
+// FindPort picks the one port out of ports matching selector, which is either a USB VID:PID or a USB serial number.
+// Having more than one match is an error, as there's no telling which was meant.
+func FindPort(ports []*enumerator.PortDetails, selector string) (string, error) {
+	var found []string
+	for _, port := range ports {
+		if !port.IsUSB {
+			continue
+		}
+		usbId := fmt.Sprintf("%s:%s", port.VID, port.PID)
+		if strings.EqualFold(usbId, selector) || (port.SerialNumber != "" && port.SerialNumber == selector) {
+			found = append(found, port.Name)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("common.FindPort: No USB serial port matches %s", selector)
+	case 1:
+		return found[0], nil
+	default:
+		return "", fmt.Errorf("common.FindPort: %s matches more than one port: %s", selector, strings.Join(found, ", "))
+	}
+}
+
+// OpenConsole opens target as a tcp:// or telnet:// console if it's given as one, otherwise as a local serial port
+func OpenConsole(target string, mode serial.Mode) (Transport, error) {
+	if IsRemoteConsole(target) {
+		return DialConsole(target)
+	}
+	return OpenSerial(target, mode)
+}
+
+// SerialTransport wraps a go.bug.st/serial port so it satisfies Transport
+type SerialTransport struct {
+	serial.Port
+	name string
+	mode serial.Mode
+}
+
+func OpenSerial(name string, mode serial.Mode) (*SerialTransport, error) {
+	port, err := serial.Open(name, &mode)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SerialTransport{
+		Port: port,
+		name: name,
+		mode: mode,
+	}, nil
+}
+
+func (s *SerialTransport) Name() string {
+	return s.name
+}
+
+func (s *SerialTransport) Mode() serial.Mode {
+	return s.mode
+}
@@ -0,0 +1,54 @@
+package common
+
+import (
+	"go.bug.st/serial"
+	"go.bug.st/serial/enumerator"
+	"testing"
+)
+
+func TestParseSerialSettings(t *testing.T) {
+	parity, err := ParseParity("Even")
+	if err != nil || parity != serial.EvenParity {
+		t.Errorf("ParseParity(Even) = %v, %v", parity, err)
+	}
+	_, err = ParseParity("sideways")
+	if err == nil {
+		t.Error("ParseParity accepted sideways")
+	}
+
+	stopBits, err := ParseStopBits("1.5")
+	if err != nil || stopBits != serial.OnePointFiveStopBits {
+		t.Errorf("ParseStopBits(1.5) = %v, %v", stopBits, err)
+	}
+	_, err = ParseStopBits("3")
+	if err == nil {
+		t.Error("ParseStopBits accepted 3")
+	}
+}
+
+func TestFindPort(t *testing.T) {
+	ports := []*enumerator.PortDetails{
+		{Name: "/dev/ttyS0"},
+		{Name: "/dev/ttyUSB0", IsUSB: true, VID: "0403", PID: "6001", SerialNumber: "A10KZP45"},
+		{Name: "/dev/ttyUSB1", IsUSB: true, VID: "067B", PID: "2303", SerialNumber: "FT1"},
+		{Name: "/dev/ttyUSB2", IsUSB: true, VID: "067B", PID: "2303", SerialNumber: "FT2"},
+	}
+
+	tests := []struct {
+		selector string
+		want     string
+		wantErr  bool
+	}{
+		{selector: "0403:6001", want: "/dev/ttyUSB0"},
+		{selector: "A10KZP45", want: "/dev/ttyUSB0"},
+		{selector: "067b:2303", wantErr: true},
+		{selector: "FT2", want: "/dev/ttyUSB2"},
+		{selector: "1a86:7523", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := FindPort(ports, tt.selector)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("FindPort(%s) = %q, %v", tt.selector, got, err)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Difference is a setting the device doesn't have the way the defaults asked for it
+type Difference struct {
+	// Where the setting is in the defaults, such as Ports[Fa0/1].Vlan
+	Setting  string
+	Expected string
+	// Empty if the device doesn't have the setting at all
+	Actual string
+}
+
+func (d Difference) String() string {
+	if d.Actual == "" {
+		return fmt.Sprintf("%s is missing, expected %s", d.Setting, d.Expected)
+	}
+	return fmt.Sprintf("%s is %s, expected %s", d.Setting, d.Actual, d.Expected)
+}
+
+// Differences is everything about a device that isn't what the defaults asked for
+type Differences []Difference
+
+// Compare notes setting if actual isn't expected. Nothing's expected of a setting left empty.
+func (d *Differences) Compare(setting string, expected string, actual string) {
+	if expected == "" || strings.EqualFold(expected, actual) {
+		return
+	}
+	*d = append(*d, Difference{Setting: setting, Expected: expected, Actual: actual})
+}
+
+// Missing notes that setting isn't on the device at all
+func (d *Differences) Missing(setting string) {
+	*d = append(*d, Difference{Setting: setting, Expected: "present"})
+}
+
+// Err lists the differences, or is nil if there aren't any
+func (d Differences) Err() error {
+	if len(d) == 0 {
+		return nil
+	}
+	listed := make([]string, len(d))
+	for i, difference := range d {
+		listed[i] = difference.String()
+	}
+	return fmt.Errorf("%d settings aren't what the defaults asked for: %s", len(d), strings.Join(listed, "; "))
+}
+
+// Secret is how a password gets compared. IOS shows them hashed, so only whether there is one can be checked.
+func Secret(password string) string {
+	if password == "" {
+		return ""
+	}
+	return "set"
+}
+
+// RunningConfig gets each line show running-config prints, without paging through it
+func RunningConfig(session *Session) ([]string, error) {
+	_, err := session.Command("terminal length 0", PRIV_PROMPT)
+	if err != nil {
+		return nil, err
+	}
+	return ShowLines(session, "show running-config")
+}
+
+// ShowLines runs a show command, giving back what it printed without the command's echo or the prompt afterwards
+func ShowLines(session *Session, cmd string) ([]string, error) {
+	match, err := session.Command(cmd, PRIV_PROMPT)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, line := range match.Lines[:len(match.Lines)-1] {
+		if !echoes(line, cmd) {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// ConfigSection is an interface or line in the running config, along with the lines under it
+type ConfigSection struct {
+	Header string
+	Lines  []string
+}
+
+// ShownConfig is show running-config split into the lines at the top and the interfaces and lines
+type ShownConfig struct {
+	Global   []string
+	Sections []ConfigSection
+}
+
+// ParseShownConfig splits up the lines of show running-config. Lines under a section have had their indentation
+// trimmed, so they're taken to run until the next ! or section.
+func ParseShownConfig(running []string) ShownConfig {
+	var shown ShownConfig
+	inSection := false
+	for _, line := range running {
+		switch {
+		case strings.HasPrefix(line, "interface ") || strings.HasPrefix(line, "line "):
+			shown.Sections = append(shown.Sections, ConfigSection{Header: line})
+			inSection = true
+		case line == "!":
+			inSection = false
+		case inSection:
+			last := &shown.Sections[len(shown.Sections)-1]
+			last.Lines = append(last.Lines, line)
+		default:
+			shown.Global = append(shown.Global, line)
+		}
+	}
+	return shown
+}
+
+// sameWord reports whether a and b are the same word of a command, either of which could be cut short
+func sameWord(a string, b string) bool {
+	a, b = strings.ToLower(a), strings.ToLower(b)
+	if a == b {
+		return true
+	}
+	if a == "" || b == "" || !unicode.IsLetter([]rune(a)[0]) {
+		return false
+	}
+	return strings.HasPrefix(a, b) || strings.HasPrefix(b, a)
+}
+
+// ConfigValue is what comes after the first of commands found at the start of any of lines, such as S1 for hostname.
+// Later commands are tried if earlier ones aren't there, for commands newer IOS shows differently.
+func ConfigValue(lines []string, commands ...string) (string, bool) {
+	for _, command := range commands {
+		words := strings.Fields(command)
+		for _, line := range lines {
+			fields := strings.Fields(line)
+			if len(fields) < len(words) {
+				continue
+			}
+			found := true
+			for i, word := range words {
+				if !sameWord(word, fields[i]) {
+					found = false
+					break
+				}
+			}
+			if found {
+				return strings.Join(fields[len(words):], " "), true
+			}
+		}
+	}
+	return "", false
+}
+
+// HasCommand reports whether command is one of lines, word for word
+func HasCommand(lines []string, command string) bool {
+	value, found := ConfigValue(lines, command)
+	return found && value == ""
+}
+
+// UserPassword picks the username and password out of what follows username in the running config, such as admin
+// password 0 cisco. The number IOS puts before the password for its type, and anything before that like the
+// privilege, are skipped over.
+func UserPassword(user string) (string, string) {
+	fields := strings.Fields(user)
+	if len(fields) == 0 {
+		return "", ""
+	}
+	for i := 1; i < len(fields)-1; i++ {
+		if fields[i] != "password" && fields[i] != "secret" {
+			continue
+		}
+		password := fields[i+1:]
+		if _, err := strconv.Atoi(password[0]); err == nil && len(password) > 1 {
+			password = password[1:]
+		}
+		return fields[0], strings.Join(password, " ")
+	}
+	return fields[0], ""
+}
+
+// BannerText is a banner without the characters either side of it, such as the ^C in ^CAuthorized only^C
+func BannerText(banner string) string {
+	for _, delimiter := range []string{"^C", `"`, "#", "%"} {
+		if strings.HasPrefix(banner, delimiter) && strings.HasSuffix(banner, delimiter) && len(banner) >= 2*len(delimiter) {
+			return banner[len(delimiter) : len(banner)-len(delimiter)]
+		}
+	}
+	return banner
+}
+
+// LineRange picks the type and the first and last line out of a line section's header, such as line vty 0 4. IOS
+// shows console lines as con, which is given back as console.
+func LineRange(header string) (string, int, int, bool) {
+	fields := strings.Fields(header)
+	if len(fields) < 3 || fields[0] != "line" {
+		return "", 0, 0, false
+	}
+	lineType := fields[1]
+	if sameWord(lineType, "console") {
+		lineType = "console"
+	}
+	start, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return "", 0, 0, false
+	}
+	end := start
+	if len(fields) > 3 {
+		end, err = strconv.Atoi(fields[3])
+		if err != nil {
+			return "", 0, 0, false
+		}
+	}
+	return lineType, start, end, true
+}
+
+// ConfigLine is a range of lines and their settings, laid out the same as the flows' LineConfig so either converts
+// to the other
+type ConfigLine struct {
+	Type      string
+	StartLine int
+	EndLine   int
+	Login     string
+	Transport string
+	Password  string
+}
+
+// Lines are the line sections, along with their settings
+func (c ShownConfig) Lines() []ConfigLine {
+	var lines []ConfigLine
+	for _, section := range c.Sections {
+		lineType, start, end, ok := LineRange(section.Header)
+		if !ok {
+			continue
+		}
+		line := ConfigLine{Type: lineType, StartLine: start, EndLine: end}
+		line.Login, _ = ConfigValue(section.Lines, "login")
+		line.Transport, _ = ConfigValue(section.Lines, "transport input")
+		line.Password, _ = ConfigValue(section.Lines, "password")
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// CompareLines notes where the lines shown don't have what requested asks for. The range is kept to what the model
+// has, the same as Render does, and IOS can show it split up, such as line vty 0 4 and line vty 5 15.
+func (d *Differences) CompareLines(profile Profile, requested ConfigLine, shown []ConfigLine) {
+	start, end := requested.StartLine, requested.EndLine
+	if start > profile.MaxVty {
+		start = profile.MaxVty
+	}
+	if end > profile.MaxVty {
+		end = profile.MaxVty
+	}
+	if requested.Type == "" || start > end {
+		return
+	}
+
+	// Render logs vty lines with a password in locally
+	login := requested.Login
+	if requested.Password != "" && login != "" && requested.Type == "vty" {
+		login = "local"
+	}
+	transport := ""
+	if requested.Type == "vty" {
+		transport = requested.Transport
+	}
+
+	// Lines that aren't shown at all are listed as ranges
+	missingFrom := -1
+	missing := func(to int) {
+		if missingFrom >= 0 {
+			d.Missing(fmt.Sprintf("Lines[%s %d %d]", requested.Type, missingFrom, to))
+			missingFrom = -1
+		}
+	}
+	for n := start; n <= end; n++ {
+		var covering *ConfigLine
+		for i := range shown {
+			if sameWord(shown[i].Type, requested.Type) && shown[i].StartLine <= n && n <= shown[i].EndLine {
+				covering = &shown[i]
+				break
+			}
+		}
+		if covering == nil {
+			if missingFrom < 0 {
+				missingFrom = n
+			}
+			continue
+		}
+		missing(n - 1)
+
+		setting := fmt.Sprintf("Lines[%s %d %d]", covering.Type, covering.StartLine, covering.EndLine)
+		d.Compare(setting+".Login", login, covering.Login)
+		d.Compare(setting+".Transport", transport, covering.Transport)
+		d.Compare(setting+".Password", Secret(requested.Password), Secret(covering.Password))
+		n = covering.EndLine
+	}
+	missing(end)
+}
+
+// configWords splits a line of config into words, with names like GigabitEthernet0/1 split into the name and the
+// numbers after it
+func configWords(line string) []string {
+	var words []string
+	var word []rune
+	letters := false
+	for _, r := range strings.ToLower(line) {
+		if unicode.IsSpace(r) {
+			if len(word) > 0 {
+				words = append(words, string(word))
+			}
+			word = nil
+			continue
+		}
+		if len(word) > 0 && unicode.IsLetter(r) != letters {
+			words = append(words, string(word))
+			word = nil
+		}
+		letters = unicode.IsLetter(r)
+		word = append(word, r)
+	}
+	if len(word) > 0 {
+		words = append(words, string(word))
+	}
+	return words
+}
+
+// SameInterface reports whether a and b name the same interface, however they're abbreviated, such as Fa0/1 and
+// FastEthernet0/1 or vlan 1 and Vlan1
+func SameInterface(a string, b string) bool {
+	aWords, bWords := configWords(a), configWords(b)
+	if len(aWords) != len(bWords) {
+		return false
+	}
+	for i, word := range aWords {
+		if !sameWord(word, bWords[i]) {
+			return false
+		}
+	}
+	return true
+}
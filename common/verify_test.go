@@ -0,0 +1,105 @@
+package common
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseShownConfig(t *testing.T) {
+	running := strings.Split(`Building configuration...
+Current configuration : 1024 bytes
+!
+hostname R1
+!
+enable secret 9 $9$abcdef
+ip domain name example.com
+banner motd ^CAuthorized only^C
+!
+interface GigabitEthernet0/1
+ip address 10.0.0.1 255.255.255.0
+!
+interface GigabitEthernet0/2
+no ip address
+shutdown
+!
+line con 0
+login
+line vty 0 4
+transport input ssh
+!
+end`, "\n")
+
+	shown := ParseShownConfig(running)
+	headers := make([]string, len(shown.Sections))
+	for i, section := range shown.Sections {
+		headers[i] = section.Header
+	}
+	expected := []string{"interface GigabitEthernet0/1", "interface GigabitEthernet0/2", "line con 0", "line vty 0 4"}
+	if !reflect.DeepEqual(headers, expected) {
+		t.Errorf("Sections = %q, want %q", headers, expected)
+	}
+	if !HasCommand(shown.Sections[1].Lines, "shut") || HasCommand(shown.Sections[0].Lines, "shutdown") {
+		t.Errorf("Shutdown is on the wrong interfaces: %+v", shown.Sections[:2])
+	}
+
+	for _, tt := range []struct {
+		commands []string
+		value    string
+	}{
+		{commands: []string{"hostname"}, value: "R1"},
+		{commands: []string{"ip domain name", "ip domain-name"}, value: "example.com"},
+		{commands: []string{"enable secret"}, value: "9 $9$abcdef"},
+	} {
+		value, found := ConfigValue(shown.Global, tt.commands...)
+		if !found || value != tt.value {
+			t.Errorf("ConfigValue(%q) = %q, %t, want %q", tt.commands, value, found, tt.value)
+		}
+	}
+	if value, _ := ConfigValue(shown.Sections[0].Lines, "ip addr"); value != "10.0.0.1 255.255.255.0" {
+		t.Errorf("Address = %q, want it read back from ip address", value)
+	}
+	if banner, _ := ConfigValue(shown.Global, "banner motd"); BannerText(banner) != "Authorized only" {
+		t.Errorf("Banner = %q", BannerText(banner))
+	}
+
+	lineType, start, end, ok := LineRange(shown.Sections[2].Header)
+	if !ok || lineType != "console" || start != 0 || end != 0 {
+		t.Errorf("LineRange(%q) = %s %d %d %t", shown.Sections[2].Header, lineType, start, end, ok)
+	}
+
+	if !SameInterface("Fa0/1", "FastEthernet0/1") || !SameInterface("vlan 1", "Vlan1") || SameInterface("Fa0/1", "Fa0/10") {
+		t.Error("SameInterface doesn't match interfaces by their abbreviations")
+	}
+
+	for user, want := range map[string][2]string{
+		"admin password cisco":                 {"admin", "cisco"},
+		"admin password 0 cisco":               {"admin", "cisco"},
+		"admin privilege 15 secret 5 $1$mERr$": {"admin", "$1$mERr$"},
+		"admin password 7":                     {"admin", "7"},
+		"admin nopassword":                     {"admin", ""},
+	} {
+		username, password := UserPassword(user)
+		if username != want[0] || password != want[1] {
+			t.Errorf("UserPassword(%q) = %q, %q, want %q, %q", user, username, password, want[0], want[1])
+		}
+	}
+}
+
+func TestDifferences(t *testing.T) {
+	var differences Differences
+	differences.Compare("Hostname", "S1", "s1")
+	differences.Compare("DomainName", "", "example.com")
+	if differences.Err() != nil {
+		t.Errorf("Differences = %v, want none", differences)
+	}
+
+	differences.Compare("EnablePassword", Secret("class"), Secret(""))
+	differences.Compare("Ports[Fa0/1].Vlan", "10", "1")
+	differences.Missing("Ports[Fa0/99]")
+	err := differences.Err()
+	if err == nil || err.Error() != "3 settings aren't what the defaults asked for: EnablePassword is missing, expected set; "+
+		"Ports[Fa0/1].Vlan is 1, expected 10; Ports[Fa0/99] is missing, expected present" {
+		t.Errorf("Err = %v", err)
+	}
+}
@@ -284,3 +284,16 @@ func TestLogToMemory(t *testing.T) {
 		})
 	}
 }
+
+func TestRemove(t *testing.T) {
+	New("remove_test")
+	kept := New("kept_test")
+
+	Remove("remove_test")
+	if GetLogger("remove_test") != nil {
+		t.Error("remove_test was still around after being removed")
+	}
+	if GetLogger("kept_test") != kept {
+		t.Error("Removing remove_test took kept_test with it")
+	}
+}
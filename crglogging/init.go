@@ -5,11 +5,15 @@ import (
 	"github.com/op/go-logging"
 	"io"
 	"os"
+	"sync"
 )
 
 var Format = logging.MustStringFormatter(`%{time:15:04:05.000} %{shortfunc} ▶ %{level} %{id:03x} %{message}`)
 var Instances []Instance
 
+// Loggers are created and looked up from several jobs at once
+var instancesMu sync.Mutex
+
 type Crglogging struct {
 	DebugCount int
 	InfoCount  int
@@ -37,6 +41,14 @@ type Instance struct {
 	Instance *Crglogging
 }
 
+// hookBackend calls a func with every record, formatted, as it's logged
+type hookBackend func(string)
+
+func (h hookBackend) Log(level logging.Level, calldepth int, rec *logging.Record) error {
+	h(rec.Formatted(calldepth + 1))
+	return nil
+}
+
 func New(name string) *Crglogging {
 	l := &Crglogging{}
 
@@ -55,6 +67,8 @@ func New(name string) *Crglogging {
 	})
 
 	// Save list of instances
+	instancesMu.Lock()
+	defer instancesMu.Unlock()
 	if len(Instances) == 0 {
 		Instances = make([]Instance, 0)
 	}
@@ -99,6 +113,10 @@ func (l *Crglogging) NewLogTarget(name string, target interface{}, file bool) {
 			// Create writer and add to backend list
 			fileBackend = logging.NewLogBackend(v, "", 0)
 			break
+		case func(string):
+			// Hand each record over as it's logged
+			fileBackend = hookBackend(v)
+			break
 		case chan bool:
 			buff := MemBuffer{
 				Name: name,
@@ -141,6 +159,9 @@ func (l *Crglogging) GetMemLogContents(name string) (MemBuffer, error) {
 }
 
 func GetLogger(name string) *Crglogging {
+	instancesMu.Lock()
+	defer instancesMu.Unlock()
+
 	for _, instance := range Instances {
 		if instance.Name == name {
 			return instance.Instance
@@ -150,6 +171,24 @@ func GetLogger(name string) *Crglogging {
 	return nil
 }
 
+// Remove drops every logger named name, once whatever it was logging for is finished with it
+func Remove(name string) {
+	instancesMu.Lock()
+	defer instancesMu.Unlock()
+
+	kept := Instances[:0]
+	for _, instance := range Instances {
+		if instance.Name != name {
+			kept = append(kept, instance)
+		}
+	}
+	// Don't leave the dropped loggers hanging on past the end
+	for i := len(kept); i < len(Instances); i++ {
+		Instances[i] = Instance{}
+	}
+	Instances = kept
+}
+
 func (l *Crglogging) GetLoggerName() string {
 	return l.name
 }
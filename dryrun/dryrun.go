@@ -0,0 +1,232 @@
+package dryrun
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"main/common"
+	"main/routers"
+	"main/simulator"
+	"main/switches"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Options is what to run against the simulated device
+type Options struct {
+	// common.ROUTER or common.SWITCH
+	DeviceType string
+	Profile    common.Profile
+	Reset      bool
+	// Whichever matches the device type gets applied, if it's there
+	SwitchDefaults *switches.SwitchConfig
+	RouterDefaults *routers.RouterDefaults
+	// How the defaults get onto the device. Copying over TFTP hands the simulated device the shared file directly.
+	Apply   common.ApplyOptions
+	Verbose bool
+}
+
+// Command is a line sent to the device, along with the step the flow was on when it got sent
+type Command struct {
+	Step string
+	Line string
+	// How many times in a row it got sent, e.g. ^C while the router boots
+	Times int
+}
+
+// Flow is how one of the flows went
+type Flow struct {
+	Name   string
+	Result common.Result
+}
+
+// Report is everything that got sent to the simulated device, and what it ended up with
+type Report struct {
+	Commands      []Command
+	Flows         []Flow
+	RunningConfig string
+}
+
+// console records every line written to the device, so what got sent can be listed step by step
+type console struct {
+	*simulator.Device
+	session *common.Session
+
+	mu       sync.Mutex
+	pending  []byte
+	commands []Command
+}
+
+// add records line under the step the session's on. Blank lines are only ever enter being pressed to move things
+// along, so they're left out.
+func (c *console) add(line string) {
+	if line == "" {
+		return
+	}
+	step := ""
+	if progress := c.session.Progress(); len(progress.Steps) > 0 {
+		step = progress.Steps[len(progress.Steps)-1].Name
+	}
+	if last := len(c.commands) - 1; last >= 0 && c.commands[last].Step == step && c.commands[last].Line == line {
+		c.commands[last].Times += 1
+		return
+	}
+	c.commands = append(c.commands, Command{Step: step, Line: line, Times: 1})
+}
+
+func (c *console) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	for _, b := range p {
+		switch b {
+		case '\r', '\n':
+			c.add(string(c.pending))
+			c.pending = c.pending[:0]
+		case 0x03:
+			c.add("^C")
+		default:
+			c.pending = append(c.pending, b)
+		}
+	}
+	c.mu.Unlock()
+
+	return c.Device.Write(p)
+}
+
+func (c *console) Break(d time.Duration) error {
+	c.mu.Lock()
+	c.add("<break>")
+	c.mu.Unlock()
+
+	return c.Device.Break(d)
+}
+
+// Run goes through the flows options asks for against a simulated 4221 or 2960, as they'd run against the real thing.
+// Nobody's there to answer anything, so the flows carry on whenever they'd ask.
+func Run(ctx context.Context, options Options) (Report, error) {
+	var report Report
+
+	var device *simulator.Device
+	var erase func()
+	switch options.DeviceType {
+	case common.ROUTER:
+		router := simulator.NewRouter("dry-run")
+		device, erase = router.Device, router.Erase
+	case common.SWITCH:
+		sw := simulator.NewSwitch("dry-run")
+		// Held for the reset to get into the boot loader, otherwise it'd never get past it
+		sw.ModeHeld = options.Reset
+		device, erase = sw.Device, sw.Erase
+	default:
+		return report, fmt.Errorf("dryrun.Run: Unknown device type %q", options.DeviceType)
+	}
+	defer device.Close()
+
+	device.Fetch = func(url string) ([]byte, error) {
+		contents, ok := common.SharedTftpFile(path.Base(url))
+		if !ok {
+			return nil, fmt.Errorf("dryrun.Run: Nothing's being shared as %s", url)
+		}
+		return contents, nil
+	}
+
+	port := &console{Device: device}
+	session := common.NewSession(port, fmt.Sprintf("Dry run %s", options.DeviceType), nil, options.Verbose)
+	port.session = session
+	defer session.Close()
+
+	// Without a reset, the defaults go onto a device that's already been cleared out
+	if !options.Reset {
+		erase()
+	}
+	device.PowerOn()
+
+	run := func(name string, flow func() common.Result) bool {
+		result := flow()
+		report.Flows = append(report.Flows, Flow{Name: name, Result: result})
+		return result.Success
+	}
+
+	carryOn := true
+	if options.Reset {
+		carryOn = run("Reset", func() common.Result {
+			if options.DeviceType == common.ROUTER {
+				return routers.Reset(ctx, session, options.Profile, common.Backup{})
+			}
+			return switches.Reset(ctx, session, options.Profile, common.Backup{})
+		})
+	}
+	if carryOn && options.DeviceType == common.ROUTER && options.RouterDefaults != nil {
+		run("Defaults", func() common.Result {
+			return routers.Defaults(ctx, session, options.Profile, *options.RouterDefaults, options.Apply)
+		})
+	}
+	if carryOn && options.DeviceType == common.SWITCH && options.SwitchDefaults != nil {
+		run("Defaults", func() common.Result {
+			return switches.Defaults(ctx, session, options.Profile, *options.SwitchDefaults, options.Apply)
+		})
+	}
+
+	port.mu.Lock()
+	report.Commands = port.commands
+	port.mu.Unlock()
+	report.RunningConfig = device.RunningConfig()
+	return report, nil
+}
+
+// Write lists the commands under the steps they were sent in, then how each flow went and the config the device was
+// left with
+func (r Report) Write(w io.Writer) error {
+	var text strings.Builder
+
+	for i, command := range r.Commands {
+		if i == 0 || command.Step != r.Commands[i-1].Step {
+			fmt.Fprintf(&text, "! %s\n", command.Step)
+		}
+		if command.Times > 1 {
+			fmt.Fprintf(&text, "%s (x%d)\n", command.Line, command.Times)
+		} else {
+			fmt.Fprintf(&text, "%s\n", command.Line)
+		}
+	}
+
+	text.WriteString("!\n")
+	for _, flow := range r.Flows {
+		if flow.Result.Success {
+			fmt.Fprintf(&text, "! %s succeeded\n", flow.Name)
+		} else if len(flow.Result.Differences) > 0 {
+			fmt.Fprintf(&text, "! %s failed while %s, these settings aren't what the defaults asked for:\n", flow.Name, strings.ToLower(flow.Result.FailedStep))
+		} else {
+			fmt.Fprintf(&text, "! %s failed while %s: %s\n", flow.Name, strings.ToLower(flow.Result.FailedStep), flow.Result.Error)
+		}
+		for _, file := range flow.Result.FilesDeleted {
+			fmt.Fprintf(&text, "!   Deleted %s\n", file)
+		}
+		for _, difference := range flow.Result.Differences {
+			fmt.Fprintf(&text, "!   %s\n", difference)
+		}
+		if len(flow.Result.CommandErrors) > 0 {
+			text.WriteString("! The device turned down these commands:\n")
+		}
+		for _, rejected := range flow.Result.CommandErrors {
+			fmt.Fprintf(&text, "!   %q while %s: %s\n", rejected.Command, strings.ToLower(rejected.Step), rejected.Message)
+		}
+	}
+
+	text.WriteString("!\n! Running config afterwards\n")
+	text.WriteString(r.RunningConfig + "\n")
+
+	_, err := io.WriteString(w, text.String())
+	return err
+}
+
+// Err is why the first flow that failed failed, or nil if they all went through
+func (r Report) Err() error {
+	for _, flow := range r.Flows {
+		if !flow.Result.Success {
+			return fmt.Errorf("%s failed while %s: %s", flow.Name, strings.ToLower(flow.Result.FailedStep), flow.Result.Error)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package dryrun
+
+import (
+	"bytes"
+	"context"
+	"main/common"
+	"main/routers"
+	"main/switches"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	if os.Getenv("SKIP_RESET_TESTS") != "" {
+		t.Skip("Skipping all reset tests")
+	}
+
+	report, err := Run(context.Background(), Options{
+		DeviceType:     common.SWITCH,
+		Profile:        common.DefaultSwitchProfile(),
+		Reset:          true,
+		SwitchDefaults: &switches.SwitchConfig{Version: 0.02, Hostname: "S1", Vlans: []switches.VlanConfig{{Vlan: 1}}},
+	})
+	if err != nil {
+		t.Fatalf("Dry run failed: %s", err)
+	}
+	if report.Err() != nil {
+		t.Fatalf("Dry run of the switch went wrong: %s", report.Err())
+	}
+
+	var output bytes.Buffer
+	err = report.Write(&output)
+	if err != nil {
+		t.Fatalf("Error while writing the report: %s", err)
+	}
+	for _, expected := range []string{
+		"! Deleting config.text\ndel flash:config.text\n",
+		"! Configuring vlan 1\ninter vlan 1\nno shutdown\nexit\n",
+		"hostname S1\n",
+		"! Reset succeeded\n",
+		"! Defaults succeeded\n",
+	} {
+		if !strings.Contains(output.String(), expected) {
+			t.Errorf("Dry run output is missing %q:\n%s", expected, output.String())
+		}
+	}
+	if !strings.Contains(report.RunningConfig, "hostname S1\n") || strings.Contains(report.RunningConfig, "OldSwitch") {
+		t.Errorf("Switch was left with\n%s", report.RunningConfig)
+	}
+
+	// Without a reset, the defaults go straight onto a cleared router
+	report, err = Run(context.Background(), Options{
+		DeviceType:     common.ROUTER,
+		Profile:        common.DefaultRouterProfile(),
+		RouterDefaults: &routers.RouterDefaults{Hostname: "R1"},
+	})
+	if err != nil {
+		t.Fatalf("Dry run failed: %s", err)
+	}
+	if report.Err() != nil {
+		t.Fatalf("Dry run of the router went wrong: %s", report.Err())
+	}
+	if len(report.Flows) != 1 || report.Flows[0].Name != "Defaults" {
+		t.Errorf("Flows = %+v, want only the defaults", report.Flows)
+	}
+	for _, command := range report.Commands {
+		if strings.HasPrefix(command.Line, "confreg") || command.Line == "^C" {
+			t.Errorf("Router was reset without asking: sent %q while %s", command.Line, command.Step)
+		}
+	}
+
+	// A switch that isn't being reset boots straight into IOS
+	report, err = Run(context.Background(), Options{
+		DeviceType:     common.SWITCH,
+		Profile:        common.DefaultSwitchProfile(),
+		SwitchDefaults: &switches.SwitchConfig{Version: 0.02, Hostname: "S2"},
+		Apply:          common.ApplyOptions{Method: common.APPLY_PASTE, PasteDelay: time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("Dry run failed: %s", err)
+	}
+	if report.Err() != nil {
+		t.Fatalf("Dry run of the switch without a reset went wrong: %s", report.Err())
+	}
+	if !strings.Contains(report.RunningConfig, "hostname S2\n") {
+		t.Errorf("Switch was left with\n%s", report.RunningConfig)
+	}
+
+	// A port the router hasn't got is turned down, and the rest of the defaults still go in
+	report, err = Run(context.Background(), Options{
+		DeviceType:     common.ROUTER,
+		Profile:        common.DefaultRouterProfile(),
+		RouterDefaults: &routers.RouterDefaults{Hostname: "R2", Ports: []routers.RouterPorts{{Port: "g0/9", Shutdown: true}}},
+		Apply:          common.ApplyOptions{OnError: common.ON_ERROR_CONTINUE},
+	})
+	if err != nil {
+		t.Fatalf("Dry run failed: %s", err)
+	}
+	commandErrors := report.Flows[0].Result.CommandErrors
+	if len(commandErrors) != 1 || commandErrors[0].Command != "inter g0/9" || commandErrors[0].Kind != common.IOS_INVALID_INPUT {
+		t.Errorf("Turned down %+v, want inter g0/9", commandErrors)
+	}
+	if !strings.Contains(report.RunningConfig, "hostname R2\n") {
+		t.Errorf("Router was left with\n%s", report.RunningConfig)
+	}
+	var text strings.Builder
+	err = report.Write(&text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(text.String(), `"inter g0/9" while configuring interface g0/9: % Invalid input`) {
+		t.Errorf("Report doesn't say what was turned down:\n%s", text.String())
+	}
+
+	_, err = Run(context.Background(), Options{DeviceType: "firewall"})
+	if err == nil {
+		t.Errorf("Dry run of a firewall succeeded")
+	}
+}
@@ -5,13 +5,16 @@ go 1.20
 require go.bug.st/serial v1.6.2
 
 require (
+	github.com/creack/pty v1.1.24
 	github.com/gorilla/mux v1.8.1
+	github.com/gorilla/websocket v1.5.1
 	github.com/op/go-logging v0.0.0-20160315200505-970db520ece7
 	github.com/pin/tftp/v3 v3.1.0
+	golang.org/x/sys v0.27.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/creack/goselect v0.1.2 // indirect
 	golang.org/x/net v0.31.0 // indirect
-	golang.org/x/sys v0.27.0 // indirect
 )
@@ -1,23 +1,29 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"go.bug.st/serial"
 	"go.bug.st/serial/enumerator"
 	"io"
+	"main/batch"
 	"main/common"
 	"main/crglogging"
+	"main/dryrun"
 	"main/routers"
 	"main/switches"
 	"main/web"
 	"os"
+	"os/signal"
 	"runtime/debug"
 	"strings"
+	"time"
 )
 
-func SetupSerial() (string, serial.Mode) {
+// ChoosePort lists the serial ports and asks which one to use
+func ChoosePort() string {
 	var userInput string
 	var chosenPort string
 
@@ -55,6 +61,15 @@ func SetupSerial() (string, serial.Mode) {
 		}
 	}
 
+	return chosenPort
+}
+
+func SetupSerial() (string, serial.Mode) {
+	var userInput string
+
+	logger := crglogging.Instances[0].Instance
+	chosenPort := ChoosePort()
+
 	fmt.Println("Default settings are 9600 8N1. Would you like to change these? (y/N)")
 	_, err := fmt.Scanln(&userInput)
 	if err != nil {
@@ -158,6 +173,180 @@ func SetupSerial() (string, serial.Mode) {
 	return chosenPort, *settings
 }
 
+// checkResult reports how a flow went, exiting if it failed
+func checkResult(flow string, result common.Result) {
+	logger := crglogging.GetLogger("main")
+
+	for _, file := range result.FilesDeleted {
+		logger.Infof("Deleted %s\n", file)
+	}
+	for _, backup := range result.Backups {
+		logger.Infof("Backed up the config to %s\n", backup)
+	}
+	if len(result.CommandErrors) > 0 {
+		logger.Errorf("The device turned down these commands:\n")
+		for _, rejected := range result.CommandErrors {
+			logger.Errorf("  %q while %s: %s\n", rejected.Command, strings.ToLower(rejected.Step), rejected.Message)
+		}
+	}
+
+	if !result.Success && len(result.Differences) > 0 {
+		logger.Errorf("%s failed while %s, these settings aren't what the defaults asked for:\n", flow, strings.ToLower(result.FailedStep))
+		for _, difference := range result.Differences {
+			logger.Errorf("  %s\n", difference)
+		}
+		os.Exit(1)
+	}
+	if !result.Success {
+		logger.Errorf("%s failed while %s: %s\n", flow, strings.ToLower(result.FailedStep), result.Err)
+		os.Exit(1)
+	}
+}
+
+// runBatch runs every device in manifest at once, printing how each went. Nobody can be asked anything with that many
+// devices going, so the flows carry on unless unattended says otherwise.
+func runBatch(manifest string, reportPath string, mode serial.Mode, unattended string, pauseFor time.Duration, breakMethod string, apply common.ApplyOptions, verbose bool) error {
+	logger := crglogging.GetLogger("main")
+
+	entries, err := batch.Load(manifest)
+	if err != nil {
+		return err
+	}
+	ports, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		return fmt.Errorf("Error while listing serial ports: %w", err)
+	}
+	err = batch.Resolve(entries, ports)
+	if err != nil {
+		return err
+	}
+
+	if unattended == "" {
+		unattended = common.POLICY_CONTINUE
+	}
+	policy, err := common.NewPolicy(unattended, pauseFor)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	logger.Infof("Running %d devices from %s\n", len(entries), manifest)
+	report := batch.Run(ctx, entries, batch.Options{
+		Mode:        mode,
+		Policy:      policy,
+		Verbose:     verbose,
+		BreakMethod: breakMethod,
+		Apply:       apply,
+	})
+	err = report.Write(os.Stdout)
+	if err != nil {
+		return err
+	}
+
+	if reportPath != "" {
+		contents, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return fmt.Errorf("Error while encoding the batch report: %w", err)
+		}
+		err = os.WriteFile(reportPath, contents, 0644)
+		if err != nil {
+			return fmt.Errorf("Error while writing %s: %w", reportPath, err)
+		}
+	}
+
+	return report.Err()
+}
+
+// renderDefaults prints the commands the defaults files would send, so they can be checked over before any device is
+// touched
+func renderDefaults(w io.Writer, switchDefaults string, routerDefaults string, profileName string) error {
+	for _, file := range []struct {
+		path       string
+		deviceType string
+	}{
+		{switchDefaults, common.SWITCH},
+		{routerDefaults, common.ROUTER},
+	} {
+		if file.path == "" {
+			continue
+		}
+
+		contents, err := os.ReadFile(file.path)
+		if err != nil {
+			return err
+		}
+		profile, err := common.FindProfile(file.deviceType, profileName)
+		if err != nil {
+			return err
+		}
+
+		var rendered common.RenderedConfig
+		if file.deviceType == common.SWITCH {
+			var defaults switches.SwitchConfig
+			err = json.Unmarshal(contents, &defaults)
+			if err != nil {
+				return fmt.Errorf("Error while parsing %s: %w", file.path, err)
+			}
+			rendered, err = switches.Render(profile, defaults)
+		} else {
+			var defaults routers.RouterDefaults
+			err = json.Unmarshal(contents, &defaults)
+			if err != nil {
+				return fmt.Errorf("Error while parsing %s: %w", file.path, err)
+			}
+			rendered, err = routers.Render(profile, defaults)
+		}
+		if err != nil {
+			return fmt.Errorf("Error while rendering %s: %w", file.path, err)
+		}
+
+		_, err = fmt.Fprintf(w, "! %s defaults from %s\n%s", file.deviceType, file.path, rendered)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runDryRun goes through the flows against a simulated device instead of a real one, printing everything that gets
+// sent
+func runDryRun(deviceType string, profile common.Profile, reset bool, defaultsPath string, apply common.ApplyOptions, verbose bool) error {
+	options := dryrun.Options{DeviceType: deviceType, Profile: profile, Reset: reset, Apply: apply, Verbose: verbose}
+	// Nothing's really fetching the config, so there's no need for the usual port
+	common.TftpListen = "127.0.0.1:0"
+	if defaultsPath != "" {
+		contents, err := os.ReadFile(defaultsPath)
+		if err != nil {
+			return err
+		}
+		if deviceType == common.ROUTER {
+			options.RouterDefaults = &routers.RouterDefaults{}
+			err = json.Unmarshal(contents, options.RouterDefaults)
+		} else {
+			options.SwitchDefaults = &switches.SwitchConfig{}
+			err = json.Unmarshal(contents, options.SwitchDefaults)
+		}
+		if err != nil {
+			return fmt.Errorf("Error while parsing %s: %w", defaultsPath, err)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	report, err := dryrun.Run(ctx, options)
+	if err != nil {
+		return err
+	}
+	err = report.Write(os.Stdout)
+	if err != nil {
+		return err
+	}
+	return report.Err()
+}
+
 func main() {
 	var verboseOutput bool
 	var resetRouter bool
@@ -169,6 +358,34 @@ func main() {
 	var skipReset bool
 	var webServer bool
 	var version bool
+	var console string
+	var remoteConsoles string
+	var batchManifest string
+	var batchReport string
+	var jobsDir string
+	var defaultsDir string
+	var breakMethod string
+	var profileName string
+	var profilesDir string
+	var detect bool
+	var render bool
+	var dryRun bool
+	var portName string
+	var usbId string
+	var usbSerial string
+	var baudRate int
+	var dataBits int
+	var parity string
+	var stopBits string
+	var unattended string
+	var pauseFor time.Duration
+	var applyMethod string
+	var pasteDelay time.Duration
+	var tftpServer string
+	var tftpInterface string
+	var tftpSource string
+	var tftpMask string
+	var onError string
 	var portSettings serial.Mode
 
 	logger := crglogging.New("main")
@@ -182,6 +399,34 @@ func main() {
 	flag.BoolVar(&skipReset, "skip-reset", false, "Skip resetting devices")
 	flag.BoolVar(&webServer, "web-server", false, "Use the web server")
 	flag.BoolVar(&version, "version", false, "Show version")
+	flag.StringVar(&console, "console", "", "Console to use instead of prompting for a serial port, e.g. telnet://host:2001, tcp://host:2001, or /dev/ttyUSB0")
+	flag.StringVar(&portName, "port", "", "Serial port to use instead of prompting for one, e.g. /dev/ttyUSB0 or COM3")
+	flag.StringVar(&usbId, "usb-id", "", "Use the USB serial port with this VID:PID, e.g. 0403:6001")
+	flag.StringVar(&usbSerial, "usb-serial", "", "Use the USB serial port with this serial number")
+	flag.IntVar(&baudRate, "baud", 9600, "Baud rate")
+	flag.IntVar(&dataBits, "data-bits", 8, "Data bits")
+	flag.StringVar(&parity, "parity", "none", "Parity: none, even, odd, mark, or space")
+	flag.StringVar(&stopBits, "stop-bits", "1", "Stop bits: 1, 1.5, or 2")
+	flag.StringVar(&unattended, "unattended", "", "Don't ask anything at the terminal: continue, abort, or pause (default is to ask)")
+	flag.DurationVar(&pauseFor, "pause", 30*time.Second, "How long --unattended pause waits whenever it would have asked something")
+	flag.StringVar(&breakMethod, "break", "", "How to interrupt a router's boot: ctrl-c, serial-break, or telnet-break (default ctrl-c)")
+	flag.StringVar(&profileName, "profile", common.AUTO_PROFILE, "Device profile to reset with, or auto to work it out from the boot output")
+	flag.BoolVar(&dryRun, "dry-run", false, "Run --router or --switch against a simulated device, printing every command that would be sent")
+	flag.BoolVar(&render, "render", false, "Print the commands --switch-defaults or --router-defaults would send, without connecting to anything")
+	flag.BoolVar(&detect, "detect", false, "Work out what the device is before doing anything, picking --router or --switch if neither is given")
+	flag.StringVar(&profilesDir, "profiles", "", "Directory of extra YAML/JSON device profiles to load")
+	flag.StringVar(&jobsDir, "jobs-dir", "jobs", "Directory the web server keeps its jobs in, or empty to only keep them in memory")
+	flag.StringVar(&batchManifest, "batch", "", "CSV or JSON manifest of devices to reset at once, one per port")
+	flag.StringVar(&batchReport, "batch-report", "", "Also write the --batch summary to this file as JSON")
+	flag.StringVar(&defaultsDir, "defaults-dir", "defaults", "Directory the web server keeps defaults templates in, or empty to not keep any")
+	flag.StringVar(&applyMethod, "apply", common.APPLY_COMMANDS, "How to apply defaults: commands (one at a time), paste, or tftp")
+	flag.DurationVar(&pasteDelay, "paste-delay", common.PASTE_DELAY, "How long --apply paste leaves between lines")
+	flag.StringVar(&tftpServer, "tftp-server", "", "Address of this machine as the device sees it, for --apply tftp")
+	flag.StringVar(&tftpInterface, "tftp-interface", "", "Interface the device reaches --tftp-server on, for --apply tftp (default vlan 1 on switches)")
+	flag.StringVar(&tftpSource, "tftp-source", "", "IP address to give --tftp-interface, or empty to use DHCP")
+	flag.StringVar(&tftpMask, "tftp-mask", "", "Subnet mask to go with --tftp-source")
+	flag.StringVar(&onError, "on-error", common.ON_ERROR_ASK, "What to do when the device turns down a command while applying defaults: ask (going by --unattended), abort, continue, or rollback")
+	flag.StringVar(&remoteConsoles, "remote-consoles", "", "Comma separated tcp:// or telnet:// consoles to offer in the web server")
 	flag.Parse()
 
 	if version {
@@ -214,7 +459,7 @@ func main() {
 		os.Exit(0)
 	}
 
-	if !(resetRouter || resetSwitch || webServer) {
+	if !(resetRouter || resetSwitch || webServer || detect || batchManifest != "" || render) {
 		_, err := fmt.Fprintf(os.Stderr, "Usage of %s\n", os.Args[0])
 		if err != nil {
 			logger.Fatalf("Error while printing error message to Stderr: %s\n", err)
@@ -223,7 +468,72 @@ func main() {
 		os.Exit(1)
 	}
 
+	if profilesDir != "" {
+		err := common.LoadProfiles(profilesDir)
+		if err != nil {
+			logger.Fatalf("Error while loading profiles from %s: %s\n", profilesDir, err)
+		}
+	}
+
+	apply := common.ApplyOptions{
+		Method:     applyMethod,
+		PasteDelay: pasteDelay,
+		Server:     tftpServer,
+		Interface:  tftpInterface,
+		Source:     tftpSource,
+		SubnetMask: tftpMask,
+		OnError:    onError,
+	}
+	// A device that's yet to be detected, or any in a batch, could be a switch, which fills in its own interface. The
+	// flows check again once they know what they're on.
+	checked := apply
+	if resetSwitch || (detect && !resetRouter) || batchManifest != "" {
+		checked = apply.ForDevice(common.SWITCH)
+	}
+	err := checked.Check()
+	if err != nil {
+		logger.Fatalf("%s\n", err)
+	}
+
+	if render {
+		if switchDefaults == "" && routerDefaults == "" {
+			logger.Fatalf("--render needs --switch-defaults or --router-defaults\n")
+		}
+		err := renderDefaults(os.Stdout, switchDefaults, routerDefaults, profileName)
+		if err != nil {
+			logger.Fatalf("%s\n", err)
+		}
+		os.Exit(0)
+	}
+
+	if dryRun {
+		if resetRouter == resetSwitch {
+			logger.Fatalf("--dry-run needs one of --router or --switch\n")
+		}
+		deviceType, defaultsPath := common.SWITCH, switchDefaults
+		if resetRouter {
+			deviceType, defaultsPath = common.ROUTER, routerDefaults
+		}
+		profile, err := common.FindProfile(deviceType, profileName)
+		if err != nil {
+			logger.Fatalf("%s\n", err)
+		}
+		if breakMethod != "" {
+			profile.Break.Method = breakMethod
+		}
+		err = runDryRun(deviceType, profile, !skipReset, defaultsPath, apply, verboseOutput)
+		if err != nil {
+			logger.Fatalf("%s\n", err)
+		}
+		os.Exit(0)
+	}
+
 	if webServer {
+		if remoteConsoles != "" {
+			web.RemoteConsoles = strings.Split(remoteConsoles, ",")
+		}
+		web.JobsDir = jobsDir
+		web.DefaultsDir = defaultsDir
 		web.ServeWeb()
 	}
 
@@ -243,13 +553,117 @@ func main() {
 		}
 	}
 
-	serialDevice, portSettings = SetupSerial()
+	// Only ask about the port settings if none of them were given
+	settingsGiven := false
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "baud", "data-bits", "parity", "stop-bits":
+			settingsGiven = true
+		}
+	})
+	portSettings = common.DefaultMode()
+	portSettings.BaudRate = baudRate
+	portSettings.DataBits = dataBits
+	portSettings.Parity, err = common.ParseParity(parity)
+	if err != nil {
+		logger.Fatalf("%s\n", err)
+	}
+	portSettings.StopBits, err = common.ParseStopBits(stopBits)
+	if err != nil {
+		logger.Fatalf("%s\n", err)
+	}
+
+	if batchManifest != "" {
+		err = runBatch(batchManifest, batchReport, portSettings, unattended, pauseFor, breakMethod, apply, verboseOutput)
+		if err != nil {
+			logger.Fatalf("%s\n", err)
+		}
+		os.Exit(0)
+	}
+
+	switch {
+	case console != "":
+		serialDevice = console
+	case portName != "":
+		serialDevice = portName
+	case usbId != "" || usbSerial != "":
+		ports, err := enumerator.GetDetailedPortsList()
+		if err != nil {
+			logger.Fatalf("Error while listing serial ports: %s\n", err)
+		}
+		// A serial number picks out a single adapter, where a VID:PID might not
+		selector := usbSerial
+		if selector == "" {
+			selector = usbId
+		}
+		serialDevice, err = common.FindPort(ports, selector)
+		if err != nil {
+			logger.Fatalf("%s\n", err)
+		}
+	case settingsGiven:
+		serialDevice = ChoosePort()
+	default:
+		serialDevice, portSettings = SetupSerial()
+	}
+
+	port, err := common.OpenConsole(serialDevice, portSettings)
+	if err != nil {
+		logger.Fatalf("Error while opening port %s: %s\n", serialDevice, err)
+	}
+	defer port.Close()
+
+	session := common.NewSession(port, fmt.Sprintf("Console %s", serialDevice), nil, verboseOutput)
+	if unattended == "" {
+		session.SetPolicy(common.Terminal{In: os.Stdin, Out: os.Stdout})
+	} else {
+		policy, err := common.NewPolicy(unattended, pauseFor)
+		if err != nil {
+			logger.Fatalf("%s\n", err)
+		}
+		session.SetPolicy(policy)
+	}
+
+	// ^C gives up on whatever the device is doing rather than leaving the port open mid-flow
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if detect {
+		device, err := common.Identify(ctx, session)
+		if err != nil {
+			logger.Fatalf("Error while identifying the device: %s\n", err)
+		}
+		if !resetRouter && !resetSwitch {
+			resetRouter = device.Type == common.ROUTER
+			resetSwitch = device.Type == common.SWITCH
+		}
+		matches := (device.Type == common.ROUTER && resetRouter) || (device.Type == common.SWITCH && resetSwitch)
+		if strings.EqualFold(profileName, common.AUTO_PROFILE) && device.Profile != "" && matches {
+			profileName = device.Profile
+		}
+	}
+
+	var routerProfile, switchProfile common.Profile
+	if resetRouter {
+		routerProfile, err = common.FindProfile(common.ROUTER, profileName)
+		if err != nil {
+			logger.Fatalf("%s\n", err)
+		}
+		if breakMethod != "" {
+			routerProfile.Break.Method = breakMethod
+		}
+	}
+	if resetSwitch {
+		switchProfile, err = common.FindProfile(common.SWITCH, profileName)
+		if err != nil {
+			logger.Fatalf("%s\n", err)
+		}
+	}
 
 	if resetRouter && !skipReset {
-		routers.Reset(serialDevice, portSettings, backupRules, verboseOutput, nil)
+		checkResult("Reset", routers.Reset(ctx, session, routerProfile, backupRules))
 	}
 	if resetSwitch && !skipReset {
-		switches.Reset(serialDevice, portSettings, backupRules, verboseOutput, nil)
+		checkResult("Reset", switches.Reset(ctx, session, switchProfile, backupRules))
 	}
 
 	if resetRouter && routerDefaults != "" {
@@ -265,7 +679,7 @@ func main() {
 		if err != nil {
 			logger.Fatal(err)
 		}
-		routers.Defaults(serialDevice, portSettings, defaults, verboseOutput, nil)
+		checkResult("Applying defaults", routers.Defaults(ctx, session, routerProfile, defaults, apply))
 	} else {
 		fmt.Println("File path not provided, not setting defaults on switch")
 	}
@@ -283,7 +697,7 @@ func main() {
 		if err != nil {
 			logger.Fatal(err)
 		}
-		switches.Defaults(serialDevice, portSettings, defaults, verboseOutput, nil)
+		checkResult("Applying defaults", switches.Defaults(ctx, session, switchProfile, defaults, apply))
 	} else {
 		logger.Warnln("File path not provided, not setting defaults on switch")
 	}
@@ -1,11 +1,11 @@
 package routers
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"go.bug.st/serial"
 	"main/common"
-	"main/crglogging"
-	"os"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -47,220 +47,195 @@ type RouterDefaults struct {
 	DefaultRoute   string
 }
 
-var consoleOutput [][]byte
-var LoggerName string
+func Reset(ctx context.Context, session *common.Session, profile common.Profile, backup common.Backup) common.Result {
+	port := session.Port
+	resetterLog := session.Logger()
 
-func GetLoggerName() string {
-	logger := crglogging.GetLogger(LoggerName)
-	logger.Debugf("Logger name: %s\n", LoggerName)
-	return LoggerName
-}
-
-func WriteConsoleOutput() error {
-	dumpFile := os.Getenv("DumpConsoleOutput")
-	if dumpFile != "" {
-		file, err := os.OpenFile(dumpFile, os.O_RDWR|os.O_CREATE, 0644)
-		if err != nil {
-			return err
-		}
-
-		defer file.Close()
+	var result common.Result
+	step := "Entering ROMMON"
 
-		totalWritten := 0
-
-		for _, line := range consoleOutput {
-			written, err := file.Write(line)
-			if err != nil {
-				return err
-			}
-			totalWritten += written
-		}
+	ctx, cancel := common.WithTimeout(ctx, profile.Timeouts.Overall)
+	defer cancel()
+	defer session.EndPhase()
+	session.Phase(ctx, profile.Timeouts.Boot)
+	// Backing up and erasing get added once we know about them
+	session.AddSteps(5)
+	session.Step(step)
 
-		common.OutputInfo(fmt.Sprintf("Wrote %d bytes to %s\n", totalWritten, dumpFile))
-	}
-
-	return nil
-}
-
-func Reset(SerialPort string, PortSettings serial.Mode, backup common.Backup, debug bool, updateChan chan bool) {
-	LoggerName = fmt.Sprintf("RouterResetter%s%d%d%d", SerialPort, PortSettings.BaudRate, PortSettings.StopBits, PortSettings.DataBits)
-	resetterLog := crglogging.New(LoggerName)
-
-	const BUFFER_SIZE = 4096
-	const SHELL_PROMPT = "router"
-	const ROMMON_PROMPT = "rommon"
-	const CONFIRMATION_PROMPT = "[confirm]"
-	const RECOVERY_REGISTER = "0x2142"
-	const NORMAL_REGISTER = "0x2102"
 	const SAVE_PROMPT = "[yes/no]:"
 	const SHELL_CUE = "press return to get started!"
 
-	if updateChan != nil {
-		common.SetOutputChannel(updateChan, LoggerName)
-	}
-
-	if debug {
-		resetterLog.SetLogLevel(5)
-	} else {
-		resetterLog.SetLogLevel(4)
-	}
-
-	currentTime := time.Now()
-	backup.Prefix = currentTime.Format(fmt.Sprintf("%d-%02d-%02d %02d:%02d:%02d", currentTime.Year(), currentTime.Month(),
-		currentTime.Day(), currentTime.Hour(), currentTime.Minute(), currentTime.Second()))
-
-	port, err := serial.Open(SerialPort, &PortSettings)
-	defer func(port serial.Port) {
-		err := port.Close()
-		if err != nil {
-			resetterLog.Fatalf("routers.Reset: Error while closing port %s: %s\n", SerialPort, err)
-		}
-	}(port)
-
-	common.SetReaderPort(port)
-
-	if err != nil {
-		resetterLog.Fatalf("routers.Reset: Error while opening port %s: %s\n", SerialPort, err)
+	// Backups are named after when they were taken unless they were given a prefix
+	if backup.Prefix == "" {
+		backup.Prefix = time.Now().Format("20060102_150405")
 	}
 
-	err = port.SetReadTimeout(2 * time.Second)
+	err := port.SetReadTimeout(2 * time.Second)
 	if err != nil {
-		resetterLog.Fatal(err)
+		return result.Fail(step, err)
 	}
 
 	resetterLog.Infof("Trigger the recovery sequence by following these steps: \n")
 	resetterLog.Infof("1. Turn off the router\n")
 	resetterLog.Infof("2. After waiting for the lights to shut off, turn the router back on\n")
 
-	resetterLog.Infof("Sending ^C until we get into ROMMON...\n")
-	var output []byte
+	if profile.Break.Method == "" {
+		profile.Break = common.DefaultRouterProfile().Break
+	}
+	romPrompt, err := profile.RecoveryPrompt()
+	if err != nil {
+		return result.Fail(step, err)
+	}
+	// Detecting the model part way through doesn't change how we're getting into ROMMON
+	strategy := profile.Break
+	prompts := profile.Prompts
+	resetterLog.Infof("Sending %s until we get into ROMMON...\n", strategy.Method)
+	var bootStarted time.Time
 
 	// Get to ROMMON
-	for !strings.HasSuffix(strings.ToLower(strings.TrimSpace(string(output[:]))), ROMMON_PROMPT+" 1 >") {
-		resetterLog.Debugf("Has prefix: %t\n", strings.HasSuffix(strings.ToLower(strings.TrimSpace(string(output[:]))), ROMMON_PROMPT+" 1 >"))
-		resetterLog.Debugf("Expected prefix: %s\n", ROMMON_PROMPT+" 1 >")
-		output, err = common.ReadLine(port, BUFFER_SIZE, debug)
-		if err != nil {
-			resetterLog.Fatalf("routers.Reset: Error while reading line: %s\n", err)
-		}
-		consoleOutput = append(consoleOutput, output)
-		resetterLog.Debugf("FROM DEVICE: %s\n", strings.ToLower(strings.TrimSpace(string(output[:]))))
-		resetterLog.Debugf("TO DEVICE: %s\n", "^c")
-		_, err = port.Write([]byte("\x03"))
-		if err != nil {
-			resetterLog.Fatal(err)
-		}
+	breaks := common.StartBreaks(port, strategy)
+	defer breaks.Stop()
+	missedWindow := func() {
+		resetterLog.Warningf("Missed the window to interrupt the boot, power cycle the router to try again\n")
+		breaks.Pause()
+	}
+	cases := []common.Case{
+		{Pattern: romPrompt},
+		{Pattern: common.Contains("aborted due to user interrupt"), Handle: func(line string) (common.Action, error) {
+			// A break doesn't bring the prompt back like ^C does, so ask for it
+			breaks.Pause()
+			return common.Continue, common.WriteLine(session, "")
+		}},
+		{Pattern: common.Contains(prompts.BootStart...), Handle: func(line string) (common.Action, error) {
+			if breaks.Paused() {
+				resetterLog.Infof("The router is booting again, sending %s\n", strategy.Method)
+			}
+			bootStarted = time.Now()
+			breaks.Resume()
+
+			// This is the best chance at interrupting the boot, so don't wait for the next attempt
+			resetterLog.Debugf("TO DEVICE: %s\n", strategy.Method)
+			err := common.SendBreak(port, strategy)
+			if err != nil {
+				return common.Stop, fmt.Errorf("routers.Reset: Error while sending %s: %w", strategy.Method, err)
+			}
+			return common.Continue, nil
+		}},
+		{Pattern: common.Contains(prompts.ImageLoading...), Handle: func(line string) (common.Action, error) {
+			if !breaks.Paused() {
+				missedWindow()
+			}
+			return common.Continue, nil
+		}},
+	}
+	if profile.Name == common.AUTO_PROFILE {
+		cases = append(cases, common.DetectCase(common.ROUTER, func(detected common.Profile) {
+			resetterLog.Infof("Detected a %s, using its profile\n", detected.Name)
+			profile = detected
+		}))
+	}
+	_, err = session.Expect(common.Expect{
+		Cases: cases,
+		// The router stays quiet until it's powered back on
+		Poll: func() error {
+			select {
+			case err := <-breaks.Errors:
+				return fmt.Errorf("routers.Reset: Error while sending %s: %w", strategy.Method, err)
+			default:
+			}
+			if !breaks.Paused() && !bootStarted.IsZero() && strategy.Window > 0 && time.Since(bootStarted) > strategy.Window {
+				missedWindow()
+			}
+			return nil
+		},
+		NoAutoAnswer: true,
+	})
+	if err != nil {
+		return result.Fail(step, err)
 	}
-	resetterLog.Debugf("%s\n", output)
-	WriteConsoleOutput()
+	romPrompt, err = profile.RecoveryPrompt()
+	if err != nil {
+		return result.Fail(step, err)
+	}
+	breaks.Stop()
+	session.WriteTranscript()
 
 	// In ROMMON
-	resetterLog.Infof("We've entered ROMMON, setting the register to 0x2142.\n")
-	commands := []string{"confreg " + RECOVERY_REGISTER, "reset"}
-
-	for idx, cmd := range commands {
-		resetterLog.Debugf("TO DEVICE: %s\n", cmd)
-		_, err = port.Write(common.FormatCommand(cmd))
+	step = session.Step("Setting the configuration register")
+	session.Phase(ctx, profile.Timeouts.Recovery)
+	resetterLog.Infof("We've entered ROMMON, setting the router to ignore its config.\n")
+	for _, command := range profile.Recovery.Commands {
+		_, err = session.Command(command, romPrompt)
 		if err != nil {
-			resetterLog.Fatal(err)
-		}
-		output, err = common.ReadLine(port, BUFFER_SIZE, debug)
-		if err != nil {
-			resetterLog.Fatalf("routers.Reset: Error while reading line: %s\n", err)
-		}
-		parsedOutput := strings.TrimSpace(string(common.TrimNull(output)))
-		consoleOutput = append(consoleOutput, output)
-		resetterLog.Debugf("DEBUG: Sent %s to device\n", cmd)
-
-		for !strings.HasPrefix(strings.ToLower(parsedOutput), fmt.Sprintf("%s %d >", ROMMON_PROMPT, idx+1)) {
-			_, err = port.Write([]byte("\r\n"))
-			resetterLog.Debugf("TO DEVICE: %s\n", "\\r\\n")
-			output, err = common.ReadLine(port, BUFFER_SIZE, debug)
-			if err != nil {
-				resetterLog.Fatalf("routers.Reset: Error while reading line: %s\n", err)
-			}
-			parsedOutput = strings.TrimSpace(string(common.TrimNull(output)))
-			consoleOutput = append(consoleOutput, output)
-			resetterLog.Debugf("FROM DEVICE: %s\n", output)
+			return result.Fail(step, fmt.Errorf("routers.Reset: Error while running %s: %w", command, err))
 		}
 	}
+	err = common.WriteLine(session, profile.Recovery.Boot)
+	if err != nil {
+		return result.Fail(step, err)
+	}
 
 	// We've made it out of ROMMON
-	// Set timeout (does this do anything? idk)
 	err = port.SetReadTimeout(10 * time.Second)
 	if err != nil {
-		resetterLog.Fatal(err)
+		return result.Fail(step, err)
 	}
 	resetterLog.Infof("We've finished with ROMMON, going back into the regular console\n")
-	WriteConsoleOutput()
-	resetterLog.Debugf("TO DEVICE: %s\n", "\\r\\n")
-	_, err = port.Write([]byte("\r\n"))
-	if err != nil {
-		resetterLog.Fatal(err)
-	}
-	output, err = common.ReadLine(port, BUFFER_SIZE, debug)
-	if err != nil {
-		resetterLog.Fatalf("routers.Reset: Error while reading line: %s\n", err)
-	}
-	consoleOutput = append(consoleOutput, output)
+	session.WriteTranscript()
 
 	// Wait until we get clue that we're ready for input, intentionally not sending anything
-	for !strings.HasSuffix(strings.ToLower(strings.TrimSpace(string(output))), SHELL_CUE) {
-		resetterLog.Debugf("FROM DEVICE: %s\n", output)
-		resetterLog.Debugf("FROM DEVICE: Output size: %d\n", len(strings.TrimSpace(string(output))))
-		resetterLog.Debugf("FROM DEVICE: Output empty? %t\n", common.IsEmpty(output))
-		output, err = common.ReadLine(port, BUFFER_SIZE, debug)
-		if err != nil {
-			resetterLog.Fatalf("routers.Reset: Error while reading line: %s\n", err)
-		}
-		consoleOutput = append(consoleOutput, output)
+	step = session.Step("Waiting for the router to start up")
+	session.Phase(ctx, profile.Timeouts.Startup)
+	_, err = session.Expect(common.Expect{Cases: []common.Case{{Pattern: common.Contains(SHELL_CUE)}}})
+	if err != nil {
+		return result.Fail(step, fmt.Errorf("routers.Reset: Error while waiting for the router to start up: %w", err))
 	}
 
 	// Send new lines until we get to shell prompt
-	for !strings.HasSuffix(strings.ToLower(strings.TrimSpace(string(output[:]))), SHELL_PROMPT+">") {
-		resetterLog.Debugf("FROM DEVICE: %s\n", output) // We don't really need all 32k bytes
-		resetterLog.Debugf("FROM DEVICE: Output size: %d\n", len(strings.TrimSpace(string(output))))
-		resetterLog.Debugf("FROM DEVICE: Output empty? %t\n", common.IsEmpty(output))
-		resetterLog.Debugf("TO DEVICE: %s\n", "\\r\\n")
-		_, err = port.Write([]byte("\r\n"))
-		if err != nil {
-			resetterLog.Fatal(err)
-		}
-		output, err = common.ReadLine(port, BUFFER_SIZE, debug)
-		if err != nil {
-			resetterLog.Fatalf("routers.Reset: Error while reading line: %s\n", err)
-		}
-		consoleOutput = append(consoleOutput, output)
+	_, err = session.Expect(common.Expect{Cases: []common.Case{{Pattern: common.EXEC_PROMPT}}, Nudge: true})
+	if err != nil {
+		return result.Fail(step, fmt.Errorf("routers.Reset: Error while waiting for the prompt: %w", err))
 	}
 
 	resetterLog.Infof("We've made it into the regular console\n")
-	WriteConsoleOutput()
-
-	closeTftpServer := make(chan bool)
+	session.WriteTranscript()
 
 	// Check if we can and should back up
-	if backup.Backup {
-		if backup.Destination != "" || (backup.Source == "" && backup.SubnetMask != "") || (backup.Source != "" && backup.SubnetMask == "") {
-			backup.Backup = false
-		}
+	if backup.Backup && (backup.Destination == "" || (backup.Source == "") != (backup.SubnetMask == "")) {
+		backup.Backup = false
 		resetterLog.Infof("Unable to back up the config due to missing values\n")
 		if backup.Destination == "" {
 			resetterLog.Infof("Backup destination is empty\n")
 		}
-		if backup.Source == "" {
+		if backup.Source == "" && backup.SubnetMask != "" {
 			resetterLog.Infof("Backup source is empty\n")
 		}
-		if backup.SubnetMask == "" {
+		if backup.Source != "" && backup.SubnetMask == "" {
 			resetterLog.Infof("Subnet mask is empty\n")
 		}
 	}
 
 	err = port.SetReadTimeout(5 * time.Second)
 	if err != nil {
-		resetterLog.Fatal(err)
+		return result.Fail(step, err)
 	}
 	// We can safely assume we're at the prompt, begin running commands to restore registers, back up, and reset
-	commands = []string{"enable", "conf t", "config-register " + NORMAL_REGISTER}
+	step = session.Step("Restoring the configuration register")
+	session.Phase(ctx, profile.Timeouts.Commands)
+
+	type command struct {
+		command string
+		prompt  *regexp.Regexp
+		step    string
+		message string
+	}
+	commands := []command{
+		{"enable", common.PRIV_PROMPT, step, "Setting our register back to normal\n"},
+		{"conf t", common.ConfigPrompt("config"), step, "Entering privileged exec\n"},
+	}
+	for _, restore := range profile.Recovery.Restore {
+		commands = append(commands, command{restore, common.ConfigPrompt("config"), step, ""})
+	}
 
 	// Add in the relevant commands to back up if we are
 	if backup.Backup {
@@ -270,599 +245,401 @@ func Reset(SerialPort string, PortSettings serial.Mode, backup common.Backup, de
 		} else {
 			ip = fmt.Sprintf("%s %s", backup.Source, backup.SubnetMask)
 		}
-		commands = append(commands, "inter g0/0/0", fmt.Sprintf("ip addr %s", ip), "no shutdown")
+		commands = append(commands,
+			command{"inter " + profile.Recovery.BackupInterface, common.ConfigPrompt("config-if"), step, "Setting an IP address to back up the config\n"},
+			command{fmt.Sprintf("ip addr %s", ip), common.ConfigPrompt("config-if"), step, ""},
+			command{"no shutdown", common.ConfigPrompt("config-if"), step, ""})
 
-		// Begin the built-in TFTP server if chosen
+		// Have the built-in TFTP server take the backup in if chosen
 		if backup.UseBuiltIn {
-			go common.BuiltInTftpServer(closeTftpServer)
+			stopReceiving, err := common.ReceiveTftpFile(fmt.Sprintf("%s-router-config.txt", backup.Prefix))
+			if err != nil {
+				return result.Fail(step, fmt.Errorf("routers.Reset: %w", err))
+			}
+			defer stopReceiving()
 		}
 	}
 
 	// We're no longer needed in global config, so queue command to get out of that
-	commands = append(commands, "end")
+	commands = append(commands, command{"end", common.PRIV_PROMPT, step, "Finished configuring our console\n"})
 
 	// Add in some more backup-oriented commands
+	backupUrl := fmt.Sprintf("tftp://%s/%s-router-config.txt", backup.Destination, backup.Prefix)
+	backupCommand := "copy startup-config " + backupUrl
 	if backup.Backup {
-		commands = append(commands, fmt.Sprintf("copy startup-config tftp://%s/%s-router-config.txt", backup.Destination, backup.Prefix))
+		commands = append(commands, command{backupCommand, common.PRIV_PROMPT, "Backing up the config",
+			fmt.Sprintf("Backing up the config to %s\n", backup.Destination)})
 	}
 
-	// Queue command to erase the NVRAM and reload
-	commands = append(commands, "erase nvram:", "")
-
-	// Execute the commands
-	for _, cmd := range commands {
-		prefix := ""
-		switch cmd {
-		case "enable":
-			resetterLog.Infof("Setting our register back to normal\n")
-			prefix = SHELL_PROMPT + "#"
-			break
-		case "conf t":
-			resetterLog.Infof("Entering privileged exec\n")
-			prefix = SHELL_PROMPT + "(config)#"
-		case "inter g0/0/0":
-			resetterLog.Infof("Setting an IP address to back up the config\n")
-			prefix = SHELL_PROMPT + "(config-if)#"
-			break
-		case "end":
-			resetterLog.Infof("Finished configuring our console\n")
-			prefix = SHELL_PROMPT + "#"
-			break
-		case fmt.Sprintf("copy startup-config tftp://%s/%s-router-config.txt", backup.Destination, backup.Prefix):
-			resetterLog.Infof("Backing up the config to %s\n", backup.Destination)
-			prefix = SHELL_PROMPT + "#"
-			break
-		case "erase nvram:":
-			resetterLog.Infof("Erasing the router's config\n")
-			prefix = SHELL_PROMPT + "#"
-			break
-		case "reload":
-			resetterLog.Infof("Restarting the switch\n")
-			break
-		}
-
-		resetterLog.Debugf("TO DEVICE: %s\n", cmd)
-		_, err = port.Write(common.FormatCommand(cmd))
-		if err != nil {
-			resetterLog.Fatal(err)
-		}
-
-		output, err = common.ReadLine(port, BUFFER_SIZE, debug)
-		if err != nil {
-			resetterLog.Fatalf("routers.Reset: Error while reading line: %s\n", err)
-		}
-		resetterLog.Debugf("FROM DEVICE: %s\n", output)
-		consoleOutput = append(consoleOutput, output)
-		WriteConsoleOutput()
-
-		for common.IsSyslog(string(output)) || // Disregard syslog messages
-			!(strings.HasSuffix(strings.ToLower(strings.TrimSpace(string(output))), prefix) || // Disregard lines that don't have the prompt we're looking for
-				cmd == "conf t" && strings.Contains(strings.ToLower(strings.TrimSpace(string(output))),
-					strings.ToLower(strings.TrimSpace("enter configuration commands, one per line.  end with cntl/z.")))) { // Global config specific test
-
-			resetterLog.Debugf("TO DEVICE: %s\n", "\\r\\n")
-			err := common.WriteLine(port, "", debug)
-			if err != nil {
-
-			}
-
-			output, err = common.ReadLine(port, BUFFER_SIZE, debug)
-			if err != nil {
-				resetterLog.Fatalf("routers.Reset: Error while reading line: %s\n", err)
-			}
-			resetterLog.Debugf("FROM DEVICE: %s\n", output)
-			consoleOutput = append(consoleOutput, output)
-			WriteConsoleOutput()
+	// Erasing asks for confirmation, which gets answered for us
+	for i, erase := range profile.Recovery.Erase {
+		message := ""
+		if i == 0 {
+			message = "Erasing the router's config\n"
 		}
+		commands = append(commands, command{erase, common.PRIV_PROMPT, "Erasing the config", message})
 	}
 
-	// Reload the switch
-	resetterLog.Debugf("TO DEVICE: %s\n", "reload")
-
-	common.WriteLine(port, "reload", debug)
-	output, err = common.ReadLine(port, BUFFER_SIZE, debug)
-	if err != nil {
-		resetterLog.Fatalf("routers.Reset: Error while reading line: %s\n", err)
+	if backup.Backup {
+		session.AddSteps(1)
 	}
-
-	consoleOutput = append(consoleOutput, output)
-	resetterLog.Debugf("FROM DEVICE: %s\n", output)
-	for !strings.HasSuffix(strings.ToLower(strings.TrimSpace(string(output))), SAVE_PROMPT) {
-		resetterLog.Debugf("TO DEVICE: %s\n", "\\r\\n")
-		common.WriteLine(port, "", debug)
-		output, err = common.ReadLine(port, BUFFER_SIZE, debug)
-		if err != nil {
-			resetterLog.Fatalf("routers.Reset: Error while reading line: %s\n", err)
-		}
-		consoleOutput = append(consoleOutput, output)
-		resetterLog.Debugf("FROM DEVICE: %s\n", output)
+	if len(profile.Recovery.Erase) > 0 {
+		session.AddSteps(1)
 	}
 
-	resetterLog.Debugf("TO DEVICE: %s\n", "yes")
-	common.WriteLine(port, "yes", debug)
-	output, err = common.ReadLine(port, BUFFER_SIZE, debug)
-	if err != nil {
-		resetterLog.Fatalf("routers.Reset: Error while reading line: %s\n", err)
-	}
-	consoleOutput = append(consoleOutput, output)
-
-	// Send blank new lines until we've reset
-	for !strings.HasSuffix(strings.ToLower(strings.TrimSpace(string(output))), CONFIRMATION_PROMPT) {
-		resetterLog.Debugf("FROM DEVICE: %s\n", output)
-
-		resetterLog.Debugf("TO DEVICE: %s\n", "\\r\\n")
-		common.WriteLine(port, "", debug)
-		output, err = common.ReadLine(port, BUFFER_SIZE, debug)
-		if err != nil {
-			resetterLog.Fatalf("routers.Reset: Error while reading line: %s\n", err)
+	// Execute the commands, accepting the suggested host and file names when copying
+	for _, cmd := range commands {
+		if cmd.step != step {
+			step = session.Step(cmd.step)
 		}
-		consoleOutput = append(consoleOutput, output)
-	}
-	resetterLog.Debugf("FROM DEVICE: %s\n", output)
-
-	if backup.UseBuiltIn {
-		closeTftpServer <- true
-	}
-
-	WriteConsoleOutput()
-	resetterLog.Infof("Successfully reset!\n")
-	resetterLog.Infof("---EOF---")
-}
-
-func Defaults(SerialPort string, PortSettings serial.Mode, config RouterDefaults, debug bool, updateChan chan bool) {
-	LoggerName = fmt.Sprintf("RouterDefaults%s%d%d%d", SerialPort, PortSettings.BaudRate, PortSettings.StopBits, PortSettings.DataBits)
-	defaultsLogger := crglogging.New(LoggerName)
-
-	if updateChan != nil {
-		common.SetOutputChannel(updateChan, LoggerName)
-	}
-
-	// Handle debug
-	defaultsLogger.SetLogLevel(4)
-	if debug {
-		defaultsLogger.SetLogLevel(5)
-	}
-
-	hostname := "Router"
-	prompt := hostname + ">"
-
-	port, err := serial.Open(SerialPort, &PortSettings)
-	defer func(port serial.Port) {
-		err := port.Close()
+		if cmd.message != "" {
+			resetterLog.Info(cmd.message)
+		}
+		match, err := session.Command(cmd.command, cmd.prompt, common.Answer(common.Prompt("]?"), session, ""))
 		if err != nil {
-			defaultsLogger.Fatalf("routers.Defaults: Error while closing port %s: %s\n", SerialPort, err)
+			return result.Fail(step, fmt.Errorf("routers.Reset: %w", err))
 		}
-	}(port)
-
-	if err != nil {
-		defaultsLogger.Errorf("routers.Defaults: Error while opening port %s: %s\n", SerialPort, err)
-	}
-
-	common.SetReaderPort(port)
-
-	err = port.SetReadTimeout(1 * time.Minute)
-	if err != nil {
-		defaultsLogger.Errorf("An error occurred while setting the timeout: %s\n", err)
-	}
+		session.WriteTranscript()
 
-	defaultsLogger.Debugf("TO DEVICE: %s\n", "\\r\\n")
-
-	_, err = port.Write([]byte("\r\n"))
-	if err != nil {
-		defaultsLogger.Errorf("An error occurred while writing a new line: %s\n", err)
-		return
-	}
-	output, err := common.ReadLine(port, 500, debug)
-	if err != nil {
-		defaultsLogger.Errorf("routers.Defaults: Error while reading line: %s\n", err)
-		return
-	}
-	defaultsLogger.Infof("Waiting for the router to start up\n")
-	for !strings.Contains(strings.ToLower(strings.TrimSpace(string(output[:]))), strings.ToLower(prompt)) {
-		defaultsLogger.Debugf("FROM DEVICE: %s\n", output) // We don't really need all 32k bytes
-		defaultsLogger.Debugf("FROM DEVICE: Output size: %d\n", len(strings.TrimSpace(string(output))))
-		defaultsLogger.Debugf("FROM DEVICE: Output empty? %t\n", common.IsEmpty(output))
-		if strings.Contains(strings.ToLower(strings.TrimSpace(string(output[:]))), strings.ToLower("Would you like to enter the initial configuration dialog? [yes/no]:")) {
-			defaultsLogger.Debugf("TO DEVICE: %s\n", "no")
-			_, err = port.Write(common.FormatCommand("no"))
-			if err != nil {
-				defaultsLogger.Fatal(err)
-			}
-		} else {
-			defaultsLogger.Debugf("TO DEVICE: %s\n", "\\r\\n")
-			_, err = port.Write([]byte("\r\n"))
-			if err != nil {
-				defaultsLogger.Fatal(err)
+		// A backup that didn't make it has to stop the config being erased
+		if backup.Backup && cmd.command == backupCommand {
+			for _, line := range match.Lines {
+				if strings.HasPrefix(line, "%Error") {
+					return result.Fail(step, fmt.Errorf("routers.Reset: Error while backing up the config to %s: %s", backupUrl, line))
+				}
 			}
-		}
-		time.Sleep(1 * time.Second)
-		output, err = common.ReadLine(port, 500, debug)
-		if err != nil {
-			defaultsLogger.Fatalf("routers.Defaults: Error while reading line: %s\n", err)
+			result.Backups = append(result.Backups, backupUrl)
 		}
 	}
-	err = port.SetReadTimeout(1 * time.Second)
-	if err != nil {
-		defaultsLogger.Fatal(err)
-	}
 
-	_, err = port.Write(common.FormatCommand(""))
+	// Reload the router
+	step = session.Step("Restarting the router")
+	resetterLog.Infof("Restarting the router\n")
+	err = common.WriteLine(session, "reload")
 	if err != nil {
-		defaultsLogger.Fatal(err)
-	}
-	output, err = common.ReadLine(port, 500, debug)
+		return result.Fail(step, err)
+	}
+	_, err = session.Expect(common.Expect{Cases: []common.Case{
+		common.Answer(common.Prompt(SAVE_PROMPT), session, "yes"),
+		{Pattern: common.CONFIRM_PATTERN, Handle: func(line string) (common.Action, error) {
+			return common.Stop, common.WriteLine(session, "")
+		}},
+	}})
 	if err != nil {
-		defaultsLogger.Fatalf("routers.Defaults: Error while reading line: %s\n", err)
+		return result.Fail(step, fmt.Errorf("routers.Reset: Error while restarting the router: %w", err))
 	}
 
-	defaultsLogger.Infof("Elevating our privileges\n")
+	session.FinishSteps()
+	session.WriteTranscript()
+	resetterLog.Infof("Successfully reset!\n")
 
-	defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(output)))))
-	defaultsLogger.Debugf("INPUT: %s\n", "enable")
-	_, err = port.Write(common.FormatCommand("enable"))
-	if err != nil {
-		defaultsLogger.Fatal(err)
-	}
+	return result.Succeed()
+}
 
-	prompt = hostname + "#"
-	common.WaitForSubstring(port, prompt, debug)
+// sshBits fits the requested key size into what IOS 12.2 allows
+func sshBits(rendered *common.RenderedConfig, bits int) int {
+	if bits > 0 && bits < 360 {
+		rendered.Warn("Requested bit setting of %d is too low, defaulting to 360", bits)
+		return 360 // User presumably wanted minimum bit setting, 360 is minimum on IOS 12.2
+	} else if bits <= 0 {
+		return 512 // Accept default bit setting for non-provided values
+	} else if bits > 2048 {
+		rendered.Warn("Requested bit setting of %d is too high, defaulting to 2048", bits)
+		return 2048 // User presumably wanted highest allowed bit setting, 2048 is max on IOS 12.2
+	}
+	return bits
+}
 
-	output, err = common.ReadLine(port, 500, debug)
-	if err != nil {
-		defaultsLogger.Fatalf("routers.Defaults: Error while reading line: %s\n", err)
-	}
+// Render turns config into the commands Defaults sends, without needing a router. profile is only used for how many
+// lines the model has.
+func Render(profile common.Profile, config RouterDefaults) (common.RenderedConfig, error) {
+	var rendered common.RenderedConfig
 
-	defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(output)))))
-	defaultsLogger.Debugf("INPUT: %s\n", "conf t")
-
-	defaultsLogger.Infof("Entering global configuration mode\n")
-	_, err = port.Write(common.FormatCommand("conf t"))
-	if err != nil {
-		defaultsLogger.Fatal(err)
-	}
-	prompt = hostname + "(config)#"
-	common.WaitForSubstring(port, prompt, debug)
+	step := "Entering global configuration"
+	rendered.Add(step, "conf t", common.MODE_CONFIG)
 
 	// Configure router ports
-	if len(config.Ports) != 0 {
-		defaultsLogger.Infof("Configuring the physical interfaces\n")
-		for _, routerPort := range config.Ports {
-			defaultsLogger.Infof("Configuring interface %s\n", routerPort.Port)
-			defaultsLogger.Debugf("INPUT: %s\n", "inter "+routerPort.Port)
-			_, err = port.Write(common.FormatCommand("inter " + routerPort.Port))
-			if err != nil {
-				defaultsLogger.Fatal(err)
-			}
-			output, err = common.ReadLine(port, 500, debug)
-			if err != nil {
-				defaultsLogger.Fatalf("routers.Defaults: Error while reading line: %s\n", err)
-			}
-			prompt = hostname + "(config-if)#"
-			common.WaitForSubstring(port, prompt, debug)
-
-			defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(output)))))
-
-			// Assign an IP address
-			if routerPort.IpAddress != "" && routerPort.SubnetMask != "" {
-				defaultsLogger.Infof("Assigning IP %s with subnet mask %s\n", routerPort.IpAddress, routerPort.SubnetMask)
-				defaultsLogger.Debugf("INPUT: %s\n", "ip addr "+routerPort.IpAddress+" subnet mask "+routerPort.SubnetMask)
-				_, err = port.Write(common.FormatCommand("ip addr " + routerPort.IpAddress + " " + routerPort.SubnetMask))
-				if err != nil {
-					defaultsLogger.Fatal(err)
-				}
-				output, err = common.ReadLine(port, 500, debug)
-				if err != nil {
-					defaultsLogger.Fatalf("routers.Defaults: Error while reading line: %s\n", err)
-				}
-				defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(output)))))
-			}
+	for _, routerPort := range config.Ports {
+		step = fmt.Sprintf("Configuring interface %s", routerPort.Port)
+		rendered.Add(step, "inter "+routerPort.Port, common.MODE_INTERFACE)
 
-			// Decide if the port is up
-			if routerPort.Shutdown {
-				defaultsLogger.Infof("Shutting down the interface\n")
-				defaultsLogger.Debugf("INPUT: %s\n", "shutdown")
-				_, err = port.Write(common.FormatCommand("shutdown"))
-				if err != nil {
-					defaultsLogger.Fatal(err)
-				}
-				output, err = common.ReadLine(port, 500, debug)
-				if err != nil {
-					defaultsLogger.Fatalf("routers.Defaults: Error while reading line: %s\n", err)
-				}
-				defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(output)))))
-			} else {
-				defaultsLogger.Infof("Brining up the interface\n")
-				defaultsLogger.Debugf("INPUT: %s\n", "no shutdown")
-				_, err = port.Write(common.FormatCommand("no shutdown"))
-				if err != nil {
-					defaultsLogger.Fatal(err)
-				}
-				output, err = common.ReadLine(port, 500, debug)
-				if err != nil {
-					defaultsLogger.Fatalf("routers.Defaults: Error while reading line: %s\n", err)
-				}
-				defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(output)))))
-			}
-
-			// Exit out to maintain consistent prompt state
-			defaultsLogger.Infof("Finished configuring %s\n", routerPort.Port)
-			defaultsLogger.Debugf("INPUT: %s\n", "exit")
-			_, err = port.Write(common.FormatCommand("exit"))
-			if err != nil {
-				defaultsLogger.Fatal(err)
-			}
-			output, err = common.ReadLine(port, 500, debug)
-			if err != nil {
-				defaultsLogger.Fatalf("routers.Defaults: Error while reading line: %s\n", err)
-			}
-			defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(output)))))
+		if routerPort.IpAddress != "" && routerPort.SubnetMask != "" {
+			rendered.Add(step, "ip addr "+routerPort.IpAddress+" "+routerPort.SubnetMask, common.MODE_INTERFACE)
+		}
 
-			prompt = hostname + "(config)#"
-			common.WaitForSubstring(port, prompt, debug)
+		if routerPort.Shutdown {
+			rendered.Add(step, "shutdown", common.MODE_INTERFACE)
+		} else {
+			rendered.Add(step, "no shutdown", common.MODE_INTERFACE)
 		}
 
-		defaultsLogger.Infof("Finished configuring physical interfaces\n")
+		// Exit out to maintain consistent prompt state
+		rendered.Add(step, "exit", common.MODE_CONFIG)
 	}
 
 	// Configure console lines
 	// Literally stolen from switches/switches.go
-	if len(config.Lines) != 0 {
-		defaultsLogger.Infof("Configuring console lines\n")
-		for _, line := range config.Lines {
-			defaultsLogger.Infof("Configuring line %s %d to %d\n", line.Type, line.StartLine, line.EndLine)
-			if line.Type != "" {
-				// Ensure both lines are <= 4
-				if line.StartLine > 4 {
-					defaultsLogger.Infof("Starting line of %d is invalid, defaulting back to 4\n", line.StartLine)
-					line.StartLine = 4
-				}
-				if line.EndLine > 4 {
-					defaultsLogger.Infof("Ending line of %d is invalid, defaulting back to 4\n", line.EndLine)
-					line.EndLine = 4
-				}
-
-				// Figure out line ranges
-				command := ""
-				if line.StartLine == line.EndLine { // Check if start line = end line
-					command = "line " + line.Type + " " + strconv.Itoa(line.StartLine)
-				} else if line.StartLine < line.EndLine { // Make sure starting line < end line
-					command = "line " + line.Type + " " + strconv.Itoa(line.StartLine) + " " + strconv.Itoa(line.EndLine)
-				} else { // Check if invalid ranges were given
-					defaultsLogger.Fatalln("Start line is greater than end line.")
-				}
-				defaultsLogger.Debugf("INPUT: %s\n", command)
-				_, err = port.Write(common.FormatCommand(command))
-				if err != nil {
-					defaultsLogger.Fatal(err)
-				}
+	for _, line := range config.Lines {
+		if line.Type == "" {
+			continue
+		}
+		step = fmt.Sprintf("Configuring %s lines %d to %d", line.Type, line.StartLine, line.EndLine)
 
-				prompt = hostname + "(config-line)#"
-				common.WaitForSubstring(port, prompt, debug)
+		// Ensure both lines are within what the model has
+		if line.StartLine > profile.MaxVty {
+			rendered.Warn("Starting %s line of %d is invalid, defaulting back to %d", line.Type, line.StartLine, profile.MaxVty)
+			line.StartLine = profile.MaxVty
+		}
+		if line.EndLine > profile.MaxVty {
+			rendered.Warn("Ending %s line of %d is invalid, defaulting back to %d", line.Type, line.EndLine, profile.MaxVty)
+			line.EndLine = profile.MaxVty
+		}
 
-				output, err = common.ReadLine(port, 500, debug)
-				if err != nil {
-					defaultsLogger.Fatalf("routers.Defaults: Error while reading line: %s\n", err)
-				}
-				defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(output)))))
-
-				// Set the line password
-				if line.Password != "" {
-					defaultsLogger.Infof("Applying the password %s to the line\n", line.Password)
-					defaultsLogger.Debugf("INPUT: %s\n", "password "+line.Password)
-					_, err = port.Write(common.FormatCommand("password " + line.Password))
-					if err != nil {
-						defaultsLogger.Fatal(err)
-					}
-					defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(output)))))
-
-					// In case login type wasn't provided, set that.
-					if line.Login != "" && line.Type == "vty" {
-						line.Login = "local"
-					}
-				}
+		// Figure out line ranges
+		if line.StartLine == line.EndLine {
+			rendered.Add(step, "line "+line.Type+" "+strconv.Itoa(line.StartLine), common.MODE_LINE)
+		} else if line.StartLine < line.EndLine {
+			rendered.Add(step, "line "+line.Type+" "+strconv.Itoa(line.StartLine)+" "+strconv.Itoa(line.EndLine), common.MODE_LINE)
+		} else {
+			return rendered, &common.RenderError{Step: step, Err: fmt.Errorf("routers.Render: Start line %d is greater than end line %d", line.StartLine, line.EndLine)}
+		}
 
-				// Set login method (empty string is valid for line console 0)
-				if line.Login != "" || (line.Type == "console" && line.Password != "") {
-					defaultsLogger.Infof("Enforcing credential usage on the line\n")
-					defaultsLogger.Debugf("INPUT: %s\n", "login "+line.Login)
-					_, err = port.Write(common.FormatCommand("login " + line.Login))
-					if err != nil {
-						defaultsLogger.Fatal(err)
-					}
-					output, err = common.ReadLine(port, 500, debug)
-					if err != nil {
-						defaultsLogger.Fatalf("routers.Defaults: Error while reading line: %s\n", err)
-					}
-					defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(output)))))
-				}
+		if line.Password != "" {
+			rendered.Add(step, "password "+line.Password, common.MODE_LINE)
 
-				if line.Transport != "" && line.Type == "vty" { // console 0 can't use telnet or ssh
-					defaultsLogger.Infof("Setting the transport type to %s\n", line.Transport)
-					defaultsLogger.Debugf("INPUT: %s\n", "transport input "+line.Transport)
-					_, err = port.Write(common.FormatCommand("transport input " + line.Transport))
-					if err != nil {
-						defaultsLogger.Fatal(err)
-					}
-					output, err = common.ReadLine(port, 500, debug)
-					if err != nil {
-						defaultsLogger.Fatalf("routers.Defaults: Error while reading line: %s\n", err)
-					}
-					defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(output)))))
-				}
+			// In case login type wasn't provided, set that.
+			if line.Login != "" && line.Type == "vty" {
+				line.Login = "local"
 			}
-
-			defaultsLogger.Infof("Configuring line %s %d to %d done\n", line.Type, line.StartLine, line.EndLine)
-			defaultsLogger.Debugf("TO DEVICE: %s\n", "exit")
-			common.WriteLine(port, "exit", debug)
-			prompt = hostname + "(config)#"
-			common.WaitForSubstring(port, prompt, debug)
 		}
-	}
 
-	// Set the default route
-	if config.DefaultRoute != "" {
-		defaultsLogger.Infof("Setting the default route to %s\n", config.DefaultRoute)
-		defaultsLogger.Debugf("INPUT: %s\n", "ip route 0.0.0.0 0.0.0.0 "+config.DefaultRoute)
-		_, err = port.Write(common.FormatCommand("ip route 0.0.0.0 0.0.0.0 " + config.DefaultRoute))
-		if err != nil {
-			defaultsLogger.Fatal(err)
+		// Set login method (empty string is valid for line console 0)
+		if line.Login != "" || (line.Type == "console" && line.Password != "") {
+			rendered.Add(step, "login "+line.Login, common.MODE_LINE)
 		}
-		output, err = common.ReadLine(port, 500, debug)
-		if err != nil {
-			defaultsLogger.Fatalf("routers.Defaults: Error while reading line: %s\n", err)
+
+		if line.Transport != "" && line.Type == "vty" { // console 0 can't use telnet or ssh
+			rendered.Add(step, "transport input "+line.Transport, common.MODE_LINE)
 		}
-		defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(output)))))
+		rendered.Add(step, "exit", common.MODE_CONFIG)
 	}
 
-	// Set the domain name
+	if config.DefaultRoute != "" {
+		rendered.Add("Setting the default route", "ip route 0.0.0.0 0.0.0.0 "+config.DefaultRoute, common.MODE_CONFIG)
+	}
 	if config.DomainName != "" {
-		defaultsLogger.Infof("Setting the domain name to %s\n", config.DomainName)
-		defaultsLogger.Debugf("INPUT: %s\n", "ip domain-name "+config.DomainName)
-		_, err = port.Write(common.FormatCommand("ip domain-name " + config.DomainName))
-		if err != nil {
-			defaultsLogger.Fatal(err)
-		}
-		output, err = common.ReadLine(port, 500, debug)
-		if err != nil {
-			defaultsLogger.Fatalf("routers.Defaults: Error while reading line: %s\n", err)
-		}
-		defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(output)))))
+		rendered.Add("Setting the domain name", "ip domain-name "+config.DomainName, common.MODE_CONFIG)
 	}
-
-	// Set the enable password
 	if config.EnablePassword != "" {
-		defaultsLogger.Infof("Setting the enable password to %s\n", config.EnablePassword)
-		defaultsLogger.Debugf("INPUT: %s\n", "enable secret "+config.EnablePassword)
-		_, err = port.Write(common.FormatCommand("enable secret " + config.EnablePassword))
-		if err != nil {
-			defaultsLogger.Fatal(err)
-		}
-		output, err = common.ReadLine(port, 500, debug)
-		if err != nil {
-			defaultsLogger.Fatalf("routers.Defaults: Error while reading line: %s\n", err)
-		}
-		defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(output)))))
+		rendered.Add("Setting the enable password", "enable secret "+config.EnablePassword, common.MODE_CONFIG)
 	}
-
-	// Set the hostname
 	if config.Hostname != "" {
-		defaultsLogger.Debugf("Setting the hostname to %s\n", config.Hostname)
-		defaultsLogger.Debugf("INPUT: %s\n", "hostname "+config.Hostname)
-		_, err = port.Write(common.FormatCommand("hostname " + config.Hostname))
-		if err != nil {
-			defaultsLogger.Fatal(err)
-		}
-		hostname = config.Hostname
-		prompt = hostname + "(config)"
-		common.WaitForSubstring(port, prompt, debug)
-		output, err = common.ReadLine(port, 500, debug)
-		if err != nil {
-			defaultsLogger.Fatalf("routers.Defaults: Error while reading line: %s\n", err)
-		}
-		defaultsLogger.Infof("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(output)))))
+		rendered.Add("Setting the hostname", "hostname "+config.Hostname, common.MODE_CONFIG)
 	}
-
 	if config.Banner != "" {
-		defaultsLogger.Infof("Setting the banner to %s\n", config.Banner)
-		defaultsLogger.Debugf("INPUT: %s\"%s\"\n", "banner motd ", config.Banner)
-		_, err = port.Write(common.FormatCommand(fmt.Sprintf("banner motd \"%s\"", config.Banner)))
-		if err != nil {
-			defaultsLogger.Fatal(err)
-		}
-		output, err = common.ReadLine(port, 500, debug)
-		if err != nil {
-			defaultsLogger.Fatalf("routers.Defaults: Error while reading line: %s\n", err)
-		}
-		defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(output)))))
+		rendered.Add("Setting the banner", fmt.Sprintf("banner motd \"%s\"", config.Banner), common.MODE_CONFIG)
 	}
+
 	if config.Ssh.Enable {
-		defaultsLogger.Infof("Determing if SSH can be enabled\n")
-		allowSSH := true
+		var missing []string
 		if config.Ssh.Username == "" {
-			defaultsLogger.Warningf("WARNING: SSH username not specified.\n")
-			allowSSH = false
+			missing = append(missing, "SSH username")
 		}
 		if config.Ssh.Password == "" {
-			defaultsLogger.Warningf("WARNING: SSH password not specified.\n")
-			allowSSH = false
+			missing = append(missing, "SSH password")
 		}
 		if config.DomainName == "" {
-			defaultsLogger.Warningf("WARNING: Domain name not specified.\n")
-			allowSSH = false
+			missing = append(missing, "domain name")
 		}
 		if config.Hostname == "" {
-			defaultsLogger.Warningf("WARNING: Hostname not specified.\n")
-			allowSSH = false
+			missing = append(missing, "hostname")
 		}
 
-		if allowSSH {
-			defaultsLogger.Debugf("Setting the username to %s and the password to %s\n", config.Ssh.Username, config.Ssh.Password)
-			defaultsLogger.Debugf("INPUT: %s\n", "username "+config.Ssh.Username+" password "+config.Ssh.Password)
-			_, err = port.Write(common.FormatCommand("username " + config.Ssh.Username + " password " + config.Ssh.Password))
-			if err != nil {
-				defaultsLogger.Fatal(err)
-			}
-			output, err = common.ReadLine(port, 500, debug)
-			if err != nil {
-				defaultsLogger.Fatalf("routers.Defaults: Error while reading line: %s\n", err)
-			}
-			defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(output)))))
+		if len(missing) > 0 {
+			rendered.Warn("SSH isn't being set up without a %s", strings.Join(missing, ", "))
+		} else {
+			step = "Setting up SSH"
+			rendered.Add(step, "username "+config.Ssh.Username+" password "+config.Ssh.Password, common.MODE_CONFIG)
+			// Generating the key can take a while, so the prompt takes a while to come back
+			rendered.Add(step, "crypto key gen rsa", common.MODE_CONFIG,
+				common.ConfigAnswer{Question: "How many bits in the modulus", Answer: strconv.Itoa(sshBits(&rendered, config.Ssh.Bits))},
+				common.ConfigAnswer{Question: "Do you really want to replace them? [yes/no]", Answer: "yes"})
+		}
+	}
 
-			defaultsLogger.Infof("Generating the RSA key\n")
-			defaultsLogger.Debugf("INPUT: %s\n", "crypto key gen rsa")
-			_, err = port.Write(common.FormatCommand("crypto key gen rsa"))
-			if err != nil {
-				defaultsLogger.Fatal(err)
-			}
-			output, err = common.ReadLine(port, 500, debug)
-			if err != nil {
-				defaultsLogger.Fatalf("routers.Defaults: Error while reading line: %s\n", err)
-			}
-			defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(output)))))
-
-			if config.Ssh.Bits > 0 && config.Ssh.Bits < 360 {
-				defaultsLogger.Debugf("DEBUG: Requested bit setting of %d is too low, defaulting to 360\n", config.Ssh.Bits)
-				config.Ssh.Bits = 360 // User presumably wanted minimum bit setting, 360 is minimum on IOS 12.2
-			} else if config.Ssh.Bits <= 0 {
-				defaultsLogger.Debugf("DEBUG: Bit setting not provided, defaulting to 512\n")
-				config.Ssh.Bits = 512 // Accept default bit setting for non-provided values
-			} else if config.Ssh.Bits > 2048 {
-				defaultsLogger.Debugf("DEBUG: Requested bit setting of %d is too low, defaulting to 2048\n", config.Ssh.Bits)
-				config.Ssh.Bits = 2048 // User presumably wanted highest allowed bit setting, 2048 is max on IOS 12.2
-			}
+	rendered.Add("Leaving global configuration", "end", common.MODE_PRIV)
+	return rendered, nil
+}
+
+// sshSetUp reports whether Render sets up SSH for config, which it only does with everything SSH needs
+func sshSetUp(config RouterDefaults) bool {
+	return config.Ssh.Enable && config.Ssh.Username != "" && config.Ssh.Password != "" && config.DomainName != "" && config.Hostname != ""
+}
 
-			defaultsLogger.Debugf("Generating an RSA key %d bits wide\n", config.Ssh.Bits)
+// Parse reads show running-config back into the settings it shows. Passwords are as IOS shows them, which is usually
+// hashed, and SSH counts as set up once there's a user to log in as.
+func Parse(running []string) RouterDefaults {
+	shown := common.ParseShownConfig(running)
 
-			defaultsLogger.Debugf("INPUT: %s\n", strconv.Itoa(config.Ssh.Bits))
-			_, err = port.Write(common.FormatCommand(strconv.Itoa(config.Ssh.Bits)))
-			if err != nil {
-				defaultsLogger.Fatal(err)
-			}
-			output, err = common.ReadLine(port, 500, debug)
-			if err != nil {
-				defaultsLogger.Fatalf("routers.Defaults: Error while reading line: %s\n", err)
-			}
-			defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(output)))))
+	var config RouterDefaults
+	config.Hostname, _ = common.ConfigValue(shown.Global, "hostname")
+	// Newer IOS shows ip domain-name as ip domain name
+	config.DomainName, _ = common.ConfigValue(shown.Global, "ip domain name", "ip domain-name")
+	config.DefaultRoute, _ = common.ConfigValue(shown.Global, "ip route 0.0.0.0 0.0.0.0")
+	config.EnablePassword, _ = common.ConfigValue(shown.Global, "enable secret")
+	banner, _ := common.ConfigValue(shown.Global, "banner motd")
+	config.Banner = common.BannerText(banner)
+	if user, found := common.ConfigValue(shown.Global, "username"); found && user != "" {
+		config.Ssh.Enable = true
+		config.Ssh.Username, config.Ssh.Password = common.UserPassword(user)
+	}
 
-			// Previous command can take a while, so wait for the prompt
-			err = port.SetReadTimeout(10 * time.Second)
-			if err != nil {
-				defaultsLogger.Fatal(err)
+	for _, section := range shown.Sections {
+		name, isInterface := strings.CutPrefix(section.Header, "interface ")
+		if !isInterface {
+			continue
+		}
+		port := RouterPorts{Port: name, Shutdown: common.HasCommand(section.Lines, "shutdown")}
+		address, _ := common.ConfigValue(section.Lines, "ip address")
+		if fields := strings.Fields(address); len(fields) == 2 {
+			port.IpAddress, port.SubnetMask = fields[0], fields[1]
+		}
+		config.Ports = append(config.Ports, port)
+	}
+
+	for _, line := range shown.Lines() {
+		config.Lines = append(config.Lines, LineConfig(line))
+	}
+	return config
+}
+
+// Diff lists what in requested the router doesn't have, going by actual, what Parse read back off it. Only what
+// Render would have sent is checked.
+func Diff(profile common.Profile, requested RouterDefaults, actual RouterDefaults) common.Differences {
+	var differences common.Differences
+	differences.Compare("Hostname", requested.Hostname, actual.Hostname)
+	differences.Compare("DomainName", requested.DomainName, actual.DomainName)
+	differences.Compare("DefaultRoute", requested.DefaultRoute, actual.DefaultRoute)
+	differences.Compare("EnablePassword", common.Secret(requested.EnablePassword), common.Secret(actual.EnablePassword))
+	differences.Compare("Banner", requested.Banner, actual.Banner)
+	if sshSetUp(requested) {
+		differences.Compare("Ssh.Username", requested.Ssh.Username, actual.Ssh.Username)
+	}
+
+	for _, port := range requested.Ports {
+		setting := fmt.Sprintf("Ports[%s]", port.Port)
+		var found *RouterPorts
+		for i := range actual.Ports {
+			if common.SameInterface(port.Port, actual.Ports[i].Port) {
+				found = &actual.Ports[i]
+				break
 			}
-			common.WaitForSubstring(port, prompt, debug)
 		}
+		if found == nil {
+			differences.Missing(setting)
+			continue
+		}
+		if port.IpAddress != "" && port.SubnetMask != "" {
+			differences.Compare(setting+".IpAddress", port.IpAddress, found.IpAddress)
+			differences.Compare(setting+".SubnetMask", port.SubnetMask, found.SubnetMask)
+		}
+		differences.Compare(setting+".Shutdown", strconv.FormatBool(port.Shutdown), strconv.FormatBool(found.Shutdown))
 	}
 
-	defaultsLogger.Infof("Leaving global exec")
+	shownLines := make([]common.ConfigLine, len(actual.Lines))
+	for i, line := range actual.Lines {
+		shownLines[i] = common.ConfigLine(line)
+	}
+	for _, line := range requested.Lines {
+		differences.CompareLines(profile, common.ConfigLine(line), shownLines)
+	}
+	return differences
+}
 
-	defaultsLogger.Debugf("INPUT: %s\n", "end")
-	common.WriteLine(port, "end", debug)
-	prompt = hostname + "#"
+// check reads the running config back off the router, failing if it isn't what config asked for
+func check(session *common.Session, profile common.Profile, config RouterDefaults) (common.Differences, error) {
+	running, err := common.RunningConfig(session)
+	if err != nil {
+		return nil, err
+	}
+	differences := Diff(profile, config, Parse(running))
+	return differences, differences.Err()
+}
 
-	common.WaitForSubstring(port, prompt, debug)
+func Defaults(ctx context.Context, session *common.Session, profile common.Profile, config RouterDefaults, apply common.ApplyOptions) common.Result {
+	port := session.Port
+	defaultsLogger := session.Logger()
+
+	var result common.Result
+	step := "Waiting for the router to start up"
+
+	// Worked out up front, so a config that can't be applied doesn't get partway onto the router
+	rendered, err := Render(profile, config)
+	if err != nil {
+		var renderErr *common.RenderError
+		if errors.As(err, &renderErr) {
+			step = renderErr.Step
+		}
+		return result.Fail(step, err)
+	}
+	for _, warning := range rendered.Warnings {
+		defaultsLogger.Warningf("WARNING: %s\n", warning)
+	}
+	err = apply.Check()
+	if err != nil {
+		return result.Fail(step, err)
+	}
+
+	ctx, cancel := common.WithTimeout(ctx, profile.Timeouts.Overall)
+	defer cancel()
+	defer session.EndPhase()
+	session.Phase(ctx, profile.Timeouts.Startup)
+	// Starting up, everything rendered, then checking it all went in
+	session.AddSteps(2 + apply.Steps(rendered))
+	session.Step(step)
+
+	err = port.SetReadTimeout(1 * time.Second)
+	if err != nil {
+		return result.Fail(step, err)
+	}
+
+	// The initial configuration dialog sometimes pops up on the way, which gets answered for us
+	defaultsLogger.Infof("Waiting for the router to start up\n")
+	match, err := session.Expect(common.Expect{Cases: []common.Case{
+		{Pattern: common.EXEC_PROMPT},
+		{Pattern: common.PRIV_PROMPT},
+	}, Nudge: true})
+	if err != nil {
+		return result.Fail(step, fmt.Errorf("routers.Defaults: Error while waiting for the router to start up: %w", err))
+	}
+
+	step = session.Step("Entering global configuration")
+	session.Phase(ctx, profile.Timeouts.Commands)
+	if match.Case == 0 {
+		defaultsLogger.Infof("Elevating our privileges\n")
+		_, err = session.Command("enable", common.PRIV_PROMPT)
+		if err != nil {
+			return result.Fail(step, err)
+		}
+	}
+
+	rejectedBefore := len(session.CommandErrors())
+	step, err = apply.Apply(ctx, session, rendered, step)
+	result.CommandErrors = session.CommandErrors()[rejectedBefore:]
+	if err != nil {
+		return result.Fail(step, err)
+	}
+
+	step = session.Step("Checking the running config")
+	result.Differences, err = check(session, profile, config)
+	if err != nil {
+		return result.Fail(step, err)
+	}
+	session.FinishSteps()
 
 	defaultsLogger.Infof("Settings applied!\n")
 	defaultsLogger.Infof("Note: Settings have not been made persistent and will be lost upon reboot.\n")
 	defaultsLogger.Infof("To fix this, run `wr` on the target device.\n")
-	defaultsLogger.Infof("---EOF---")
+
+	return result.Succeed()
 }
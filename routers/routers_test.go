@@ -1,13 +1,17 @@
 package routers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"go.bug.st/serial"
 	"io"
 	"main/common"
+	"main/simulator"
 	"math"
 	"os"
+	"reflect"
 	"runtime"
 	"strings"
 	"testing"
@@ -100,7 +104,12 @@ func TestReset(t *testing.T) {
 		start := time.Now()
 		timeout := time.After(20 * time.Minute)
 		go t.Run(tt.name, func(t *testing.T) {
-			Reset(tt.args.SerialPort, tt.args.PortSettings, tt.args.backup, tt.args.debug, tt.args.progressDest)
+			port, err := common.OpenSerial(tt.args.SerialPort, tt.args.PortSettings)
+			if err != nil {
+				t.Fatalf("Error while opening port %s: %s", tt.args.SerialPort, err)
+			}
+			defer port.Close()
+			Reset(context.Background(), common.NewSession(port, tt.name, tt.args.progressDest, tt.args.debug), common.DefaultRouterProfile(), tt.args.backup)
 		})
 
 		for {
@@ -216,7 +225,12 @@ func TestDefaults(t *testing.T) {
 		timeout := time.After(20 * time.Minute)
 
 		go t.Run(tt.name, func(t *testing.T) {
-			Defaults(tt.args.SerialPort, tt.args.PortSettings, tt.args.config, tt.args.debug, tt.args.progressDest)
+			port, err := common.OpenSerial(tt.args.SerialPort, tt.args.PortSettings)
+			if err != nil {
+				t.Fatalf("Error while opening port %s: %s", tt.args.SerialPort, err)
+			}
+			defer port.Close()
+			Defaults(context.Background(), common.NewSession(port, tt.name, tt.args.progressDest, tt.args.debug), common.DefaultRouterProfile(), tt.args.config, common.ApplyOptions{})
 		})
 		for {
 			canExit := false
@@ -356,7 +370,12 @@ func TestResetAndDefaults(t *testing.T) {
 		timeout := time.After(20 * time.Minute)
 
 		go t.Run(tt.name, func(t *testing.T) {
-			Reset(tt.resetArgs.SerialPort, tt.resetArgs.PortSettings, tt.resetArgs.backup, tt.resetArgs.debug, tt.resetArgs.progressDest)
+			port, err := common.OpenSerial(tt.resetArgs.SerialPort, tt.resetArgs.PortSettings)
+			if err != nil {
+				t.Fatalf("Error while opening port %s: %s", tt.resetArgs.SerialPort, err)
+			}
+			defer port.Close()
+			Reset(context.Background(), common.NewSession(port, tt.name, tt.resetArgs.progressDest, tt.resetArgs.debug), common.DefaultRouterProfile(), tt.resetArgs.backup)
 		})
 
 		for {
@@ -380,7 +399,12 @@ func TestResetAndDefaults(t *testing.T) {
 		time.Sleep(5 * time.Second)
 
 		go t.Run(tt.name, func(t *testing.T) {
-			Defaults(tt.defaultsArgs.SerialPort, tt.defaultsArgs.PortSettings, tt.defaultsArgs.config, tt.defaultsArgs.debug, tt.defaultsArgs.progressDest)
+			port, err := common.OpenSerial(tt.defaultsArgs.SerialPort, tt.defaultsArgs.PortSettings)
+			if err != nil {
+				t.Fatalf("Error while opening port %s: %s", tt.defaultsArgs.SerialPort, err)
+			}
+			defer port.Close()
+			Defaults(context.Background(), common.NewSession(port, tt.name, tt.defaultsArgs.progressDest, tt.defaultsArgs.debug), common.DefaultRouterProfile(), tt.defaultsArgs.config, common.ApplyOptions{})
 		})
 		for {
 			canExit := false
@@ -402,3 +426,369 @@ func TestResetAndDefaults(t *testing.T) {
 		time.Sleep(5 * time.Second)
 	}
 }
+
+func TestResetAndDefaultsSimulated(t *testing.T) {
+	if os.Getenv("SKIP_RESET_TESTS") != "" {
+		t.Skip("Skipping all reset tests")
+	}
+
+	defaults := RouterDefaults{
+		Version: 0.02,
+		Ports: []RouterPorts{
+			{Port: "g0/0/0", IpAddress: "192.168.1.1", SubnetMask: "255.255.255.0"},
+			{Port: "g0/0/1", Shutdown: true},
+		},
+		Lines: []LineConfig{
+			{Type: "vty", StartLine: 0, EndLine: 15, Login: "local", Transport: "ssh"},
+		},
+		Ssh:            SshConfig{Enable: true, Username: "admin", Password: "cisco", Bits: 2048},
+		EnablePassword: "class",
+		Banner:         "Authorized access only",
+		Hostname:       "R1",
+		DomainName:     "example.com",
+		DefaultRoute:   "192.168.1.254",
+	}
+
+	router := simulator.NewRouter("sim-isr4221")
+	defer router.Close()
+
+	progress := make(chan bool)
+	go func() {
+		for range progress {
+		}
+	}()
+
+	session := common.NewSession(router, t.Name(), progress, testing.Verbose())
+
+	var resetResult, defaultsResult common.Result
+	done := make(chan bool)
+	go func() {
+		router.PowerOn()
+		resetResult = Reset(context.Background(), session, common.DefaultRouterProfile(), common.Backup{})
+		if router.Register() != "0x2102" {
+			t.Errorf("Config register after reset = %s, want 0x2102", router.Register())
+		}
+		if resetResult.Success {
+			defaultsResult = Defaults(context.Background(), session, common.DefaultRouterProfile(), defaults, common.ApplyOptions{})
+		}
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Minute):
+		t.Fatalf("Reset and defaults against the simulated router timed out. Received: %q", router.Received())
+	}
+
+	if !resetResult.Success {
+		t.Fatalf("Reset failed while %s: %s", resetResult.FailedStep, resetResult.Err)
+	}
+	if !defaultsResult.Success {
+		t.Fatalf("Defaults failed while %s: %s", defaultsResult.FailedStep, defaultsResult.Err)
+	}
+
+	config := router.RunningConfig()
+	for _, expected := range []string{
+		"hostname R1",
+		"enable secret class",
+		"ip domain-name example.com",
+		"ip route 0.0.0.0 0.0.0.0 192.168.1.254",
+		"username admin password cisco",
+		"interface GigabitEthernet0/0/0",
+		" ip addr 192.168.1.1 255.255.255.0",
+		"line vty 0 4",
+		" transport input ssh",
+	} {
+		if !strings.Contains(config, expected+"\n") {
+			t.Errorf("Running config is missing %q:\n%s", expected, config)
+		}
+	}
+	if strings.Contains(config, "OldRouter") {
+		t.Errorf("Running config still contains the old configuration:\n%s", config)
+	}
+}
+
+func TestRender(t *testing.T) {
+	config := RouterDefaults{
+		Version: 0.02,
+		Ports:   []RouterPorts{{Port: "g0/0/0", IpAddress: "192.168.1.1", SubnetMask: "255.255.255.0"}},
+		Lines: []LineConfig{
+			{Type: "console", StartLine: 0, EndLine: 0, Password: "cisco"},
+			{Type: "vty", StartLine: 0, EndLine: 15, Login: "local", Transport: "ssh"},
+		},
+		Ssh:          SshConfig{Enable: true, Username: "admin", Password: "cisco"},
+		Hostname:     "R1",
+		DomainName:   "example.com",
+		DefaultRoute: "192.168.1.254",
+	}
+
+	rendered, err := Render(common.DefaultRouterProfile(), config)
+	if err != nil {
+		t.Fatalf("Render failed: %s", err)
+	}
+
+	var commands []string
+	for _, command := range rendered.Commands {
+		commands = append(commands, fmt.Sprintf("%s: %s", command.Mode, command.Command))
+	}
+	expected := []string{
+		"priv: conf t",
+		"config: inter g0/0/0",
+		"config-if: ip addr 192.168.1.1 255.255.255.0",
+		"config-if: no shutdown",
+		"config-if: exit",
+		"config: line console 0",
+		"config-line: password cisco",
+		"config-line: login ",
+		"config-line: exit",
+		"config: line vty 0 4",
+		"config-line: login local",
+		"config-line: transport input ssh",
+		"config-line: exit",
+		"config: ip route 0.0.0.0 0.0.0.0 192.168.1.254",
+		"config: ip domain-name example.com",
+		"config: hostname R1",
+		"config: username admin password cisco",
+		"config: crypto key gen rsa",
+		"config: end",
+	}
+	if strings.Join(commands, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Rendered commands are\n%s\nwant\n%s", strings.Join(commands, "\n"), strings.Join(expected, "\n"))
+	}
+	if len(rendered.Warnings) != 1 || !strings.Contains(rendered.Warnings[0], "Ending vty line of 15") {
+		t.Errorf("Warnings = %q, want one about the vty lines", rendered.Warnings)
+	}
+
+	// Nothing gets sent for a config that would fail partway through
+	config.Lines = []LineConfig{{Type: "vty", StartLine: 4, EndLine: 1}}
+	_, err = Render(common.DefaultRouterProfile(), config)
+	var renderErr *common.RenderError
+	if !errors.As(err, &renderErr) || renderErr.Step != "Configuring vty lines 4 to 1" {
+		t.Errorf("Render error = %v, want one from configuring vty lines 4 to 1", err)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	running := strings.Split(`Building configuration...
+
+Current configuration : 1536 bytes
+!
+hostname R1
+!
+enable secret 9 $9$4ZkV2nYHM3Y2$wOxm0xcWd6aw
+!
+ip domain name example.com
+username admin password 0 cisco
+!
+interface GigabitEthernet0/0/0
+ip address 10.0.0.1 255.255.255.0
+!
+interface GigabitEthernet0/0/1
+ip address 10.0.1.1 255.255.255.0
+shutdown
+!
+ip route 0.0.0.0 0.0.0.0 10.0.0.254
+!
+line con 0
+login
+line vty 0 4
+login local
+transport input ssh
+!
+end`, "\n")
+
+	actual := Parse(running)
+	if actual.Hostname != "R1" || actual.DomainName != "example.com" || actual.DefaultRoute != "10.0.0.254" || actual.EnablePassword == "" || actual.Ssh.Password != "cisco" {
+		t.Errorf("Parse got the global settings wrong: %+v", actual)
+	}
+	if len(actual.Ports) != 2 || actual.Ports[0].IpAddress != "10.0.0.1" || !actual.Ports[1].Shutdown || len(actual.Lines) != 2 {
+		t.Errorf("Parse got the ports or lines wrong: %+v", actual)
+	}
+
+	requested := RouterDefaults{
+		Ports: []RouterPorts{
+			{Port: "g0/0/0", IpAddress: "10.0.0.1", SubnetMask: "255.255.255.0"},
+			{Port: "g0/0/1", IpAddress: "10.0.2.1", SubnetMask: "255.255.255.0"},
+			{Port: "g0/0/9", IpAddress: "10.0.9.1", SubnetMask: "255.255.255.0"},
+		},
+		Lines:          []LineConfig{{Type: "vty", StartLine: 0, EndLine: 4, Login: "local", Transport: "ssh"}},
+		Ssh:            SshConfig{Enable: true, Username: "admin", Password: "cisco"},
+		EnablePassword: "class",
+		Hostname:       "R1",
+		DomainName:     "example.com",
+		DefaultRoute:   "10.0.0.254",
+	}
+	differences := Diff(common.DefaultRouterProfile(), requested, actual)
+	expected := common.Differences{
+		{Setting: "Ports[g0/0/1].IpAddress", Expected: "10.0.2.1", Actual: "10.0.1.1"},
+		{Setting: "Ports[g0/0/1].Shutdown", Expected: "false", Actual: "true"},
+		{Setting: "Ports[g0/0/9]", Expected: "present"},
+	}
+	if !reflect.DeepEqual(differences, expected) {
+		t.Errorf("Diff = %+v, want %+v", differences, expected)
+	}
+}
+
+func TestResetWithSerialBreak(t *testing.T) {
+	if os.Getenv("SKIP_RESET_TESTS") != "" {
+		t.Skip("Skipping all reset tests")
+	}
+
+	router := simulator.NewRouter("sim-isr4221")
+	router.NeedsBreak = true
+	defer router.Close()
+
+	profile := common.DefaultRouterProfile()
+	profile.Break.Method = common.BREAK_SERIAL
+	profile.Break.Interval = 10 * time.Millisecond
+
+	results := make(chan common.Result, 1)
+	go func() {
+		router.PowerOn()
+		results <- Reset(context.Background(), common.NewSession(router, t.Name(), nil, testing.Verbose()), profile, common.Backup{})
+	}()
+
+	select {
+	case result := <-results:
+		if !result.Success {
+			t.Fatalf("Reset failed while %s: %s", result.FailedStep, result.Err)
+		}
+	case <-time.After(2 * time.Minute):
+		t.Fatalf("Reset with a serial break timed out. Received: %q", router.Received())
+	}
+}
+
+func TestResetWithBackup(t *testing.T) {
+	if os.Getenv("SKIP_RESET_TESTS") != "" {
+		t.Skip("Skipping all reset tests")
+	}
+
+	router := simulator.NewRouter("sim-isr4221")
+	defer router.Close()
+	sent := make(map[string]string)
+	router.Send = func(url string, contents []byte) error {
+		sent[url] = string(contents)
+		return nil
+	}
+
+	// Everything a backup needs, with the address coming from DHCP
+	backup := common.Backup{Backup: true, Destination: "192.0.2.10"}
+	results := make(chan common.Result, 1)
+	go func() {
+		router.PowerOn()
+		results <- Reset(context.Background(), common.NewSession(router, t.Name(), nil, testing.Verbose()), common.DefaultRouterProfile(), backup)
+	}()
+
+	select {
+	case result := <-results:
+		if !result.Success {
+			t.Fatalf("Reset failed while %s: %s", result.FailedStep, result.Err)
+		}
+		if len(result.Backups) != 1 || !strings.HasPrefix(result.Backups[0], "tftp://192.0.2.10/") {
+			t.Fatalf("Backups = %q, want the config copied to 192.0.2.10", result.Backups)
+		}
+		// Names with spaces or colons don't make it over TFTP
+		if name := strings.TrimPrefix(result.Backups[0], "tftp://192.0.2.10/"); strings.ContainsAny(name, " :") {
+			t.Errorf("Backed up as %q", name)
+		}
+		if !strings.Contains(sent[result.Backups[0]], "hostname OldRouter") {
+			t.Errorf("Sent %q, want the old startup config at %s", sent, result.Backups[0])
+		}
+	case <-time.After(2 * time.Minute):
+		t.Fatalf("Reset with a backup timed out. Received: %q", router.Received())
+	}
+}
+
+func TestResetBackupFails(t *testing.T) {
+	if os.Getenv("SKIP_RESET_TESTS") != "" {
+		t.Skip("Skipping all reset tests")
+	}
+
+	// Nothing's there to take the backup, so the copy times out
+	router := simulator.NewRouter("sim-isr4221")
+	defer router.Close()
+
+	backup := common.Backup{Backup: true, Destination: "192.0.2.10"}
+	results := make(chan common.Result, 1)
+	go func() {
+		router.PowerOn()
+		results <- Reset(context.Background(), common.NewSession(router, t.Name(), nil, testing.Verbose()), common.DefaultRouterProfile(), backup)
+	}()
+
+	select {
+	case result := <-results:
+		if result.Success || result.FailedStep != "Backing up the config" {
+			t.Fatalf("Reset = %t while %s, want it to fail backing up the config", result.Success, result.FailedStep)
+		}
+		if len(result.Backups) != 0 {
+			t.Errorf("Backups = %q, want none", result.Backups)
+		}
+	case <-time.After(2 * time.Minute):
+		t.Fatalf("Reset with a failing backup timed out. Received: %q", router.Received())
+	}
+
+	// The config's kept if it couldn't be backed up
+	for _, line := range router.Received() {
+		if strings.HasPrefix(line, "erase") {
+			t.Errorf("Sent %q after the backup failed", line)
+		}
+	}
+}
+
+func TestResetTimesOut(t *testing.T) {
+	// Nobody turns the router back on
+	router := simulator.NewRouter("sim-isr4221")
+	defer router.Close()
+
+	profile := common.DefaultRouterProfile()
+	profile.Timeouts.Boot = 200 * time.Millisecond
+
+	results := make(chan common.Result, 1)
+	go func() {
+		results <- Reset(context.Background(), common.NewSession(router, t.Name(), nil, testing.Verbose()), profile, common.Backup{})
+	}()
+
+	select {
+	case result := <-results:
+		if result.Success {
+			t.Fatalf("Reset succeeded against a router that was never turned on")
+		}
+		if result.FailedStep != "Entering ROMMON" {
+			t.Errorf("FailedStep = %q, want %q", result.FailedStep, "Entering ROMMON")
+		}
+		if !errors.Is(result.Err, context.DeadlineExceeded) {
+			t.Errorf("Err = %v, want a deadline exceeded error", result.Err)
+		}
+	case <-time.After(time.Minute):
+		t.Fatalf("Reset kept waiting on the router after its boot timeout")
+	}
+}
+
+func TestIdentify(t *testing.T) {
+	router := simulator.NewRouter("sim-isr4221")
+	defer router.Close()
+
+	session := common.NewSession(router, t.Name(), nil, testing.Verbose())
+	results := make(chan error, 1)
+	var device common.Device
+	go func() {
+		router.PowerOn()
+		var err error
+		device, err = common.Identify(context.Background(), session)
+		results <- err
+	}()
+
+	select {
+	case err := <-results:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Minute):
+		t.Fatalf("Identifying the router timed out. Received: %q", router.Received())
+	}
+
+	want := common.Device{Type: common.ROUTER, Platform: "ISR4221/K9", Version: "16.09.04", Serial: "FGL2231918D", Profile: "ISR4221"}
+	if device != want {
+		t.Errorf("Identified %+v, want %+v", device, want)
+	}
+}
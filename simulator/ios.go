@@ -0,0 +1,735 @@
+package simulator
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	modeDialog   = "dialog"
+	modeActivate = "activate"
+	modeExec     = "exec"
+	modePriv     = "priv"
+	modeConfig   = "config"
+	modeIf       = "config-if"
+	modeLine     = "config-line"
+)
+
+const CONFIG_DIALOG_PROMPT = "Would you like to enter the initial configuration dialog? [yes/no]: "
+
+var execKeywords = []string{"enable", "exit", "logout", "show", "ping", "terminal"}
+var privKeywords = []string{"configure", "copy", "disable", "enable", "erase", "exit", "logout", "reload", "show", "terminal", "write", "ping"}
+var configKeywords = []string{"banner", "config-register", "crypto", "enable", "end", "exit", "hostname", "interface", "ip", "line", "logging", "no", "ntp", "service", "snmp-server", "spanning-tree", "username", "vlan", "do"}
+var ifKeywords = []string{"description", "duplex", "end", "exit", "interface", "ip", "no", "shutdown", "spanning-tree", "speed", "switchport", "negotiation"}
+var lineKeywords = []string{"end", "exec-timeout", "exit", "history", "logging", "login", "password", "privilege", "transport"}
+
+type section struct {
+	Header string
+	Lines  []string
+}
+
+// config is the simulated running/startup configuration
+type config struct {
+	Hostname   string
+	Global     []string
+	Interfaces []*section
+	Lines      []*section
+}
+
+func (c *config) clone() *config {
+	dup := &config{Hostname: c.Hostname, Global: append([]string{}, c.Global...)}
+	for _, s := range c.Interfaces {
+		dup.Interfaces = append(dup.Interfaces, &section{Header: s.Header, Lines: append([]string{}, s.Lines...)})
+	}
+	for _, s := range c.Lines {
+		dup.Lines = append(dup.Lines, &section{Header: s.Header, Lines: append([]string{}, s.Lines...)})
+	}
+	return dup
+}
+
+func findSection(sections []*section, header string) *section {
+	for _, s := range sections {
+		if strings.EqualFold(s.Header, header) {
+			return s
+		}
+	}
+	return nil
+}
+
+// ios emulates enough of the IOS command line to run the reset and defaults flows
+type ios struct {
+	d           *Device
+	defaultName string
+	interfaces  []string
+	mode        string
+	context     *section
+	pending     func(answer string)
+	running     *config
+	startup     *config
+	register    string
+	modified    bool
+	reload      func()
+	persist     func(startup *config)
+	// What show vlan brief prints, for devices that have vlans
+	vlanBrief func() []string
+	// What show version prints
+	version []string
+	// The contents of a file in flash, for devices that copy them anywhere
+	flash func(name string) ([]byte, bool)
+}
+
+func newIos(d *Device, defaultName string, interfaces []string) *ios {
+	return &ios{
+		d:           d,
+		defaultName: defaultName,
+		interfaces:  interfaces,
+		running:     &config{Hostname: defaultName},
+		register:    "0x2102",
+	}
+}
+
+// start is called once the image has finished booting. ignoreStartup mirrors a 0x2142 config register.
+func (s *ios) start(ignoreStartup bool) {
+	s.pending = nil
+	s.context = nil
+	s.modified = false
+
+	if s.startup != nil && !ignoreStartup {
+		s.running = s.startup.clone()
+	} else {
+		s.running = &config{Hostname: s.defaultName}
+	}
+
+	if s.startup == nil && !ignoreStartup {
+		s.mode = modeDialog
+		s.d.println("", "", "         --- System Configuration Dialog ---", "")
+		s.d.print(CONFIG_DIALOG_PROMPT)
+	} else {
+		s.mode = modeActivate
+		s.d.println("", "", "Press RETURN to get started!", "", "")
+	}
+
+	s.d.ready()
+}
+
+func (s *ios) prompt() string {
+	switch s.mode {
+	case modeExec:
+		return s.running.Hostname + ">"
+	case modePriv:
+		return s.running.Hostname + "#"
+	case modeConfig, modeIf, modeLine:
+		return fmt.Sprintf("%s(%s)#", s.running.Hostname, s.mode)
+	}
+	return ""
+}
+
+func (s *ios) enter(line string) {
+	s.d.println(line)
+	cmd := strings.TrimSpace(line)
+
+	if s.pending != nil {
+		pending := s.pending
+		s.pending = nil
+		pending(cmd)
+	} else {
+		switch s.mode {
+		case modeDialog:
+			s.dialog(cmd)
+		case modeActivate:
+			s.mode = modeExec
+		default:
+			s.execute(cmd)
+		}
+	}
+
+	if s.pending == nil && s.prompt() != "" {
+		s.d.print(s.prompt())
+	}
+}
+
+// interrupt handles ^C, which backs out of configuration mode
+func (s *ios) interrupt() {
+	switch s.mode {
+	case modeConfig, modeIf, modeLine:
+		s.mode = modePriv
+		s.context = nil
+		s.pending = nil
+		s.d.println("^C")
+		s.d.print(s.prompt())
+	}
+}
+
+func (s *ios) dialog(answer string) {
+	switch strings.ToLower(answer) {
+	case "no", "n":
+		s.mode = modeActivate
+		s.d.println("", "", "Press RETURN to get started!", "", "")
+	default:
+		s.d.println("% Please answer 'yes' or 'no'.")
+		s.d.print(CONFIG_DIALOG_PROMPT)
+		s.pending = s.dialogPending
+	}
+}
+
+func (s *ios) dialogPending(answer string) {
+	s.dialog(answer)
+}
+
+// invalid reports a command the parser rejected, pointing at the offending word
+func (s *ios) invalid(line string, word int) {
+	fields := strings.Fields(line)
+	offset := 0
+	if word < len(fields) {
+		offset = strings.Index(line, fields[word])
+	}
+	s.d.println(strings.Repeat(" ", len(s.prompt())+offset)+"^", "% Invalid input detected at '^' marker.", "")
+}
+
+// keyword expands an abbreviated keyword, reporting ambiguous and unknown input
+func (s *ios) keyword(line string, word string, keywords []string) (string, bool) {
+	matches := make([]string, 0)
+	for _, keyword := range keywords {
+		if keyword == strings.ToLower(word) {
+			return keyword, true
+		}
+		if strings.HasPrefix(keyword, strings.ToLower(word)) {
+			matches = append(matches, keyword)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		s.invalid(line, 0)
+		return "", false
+	case 1:
+		return matches[0], true
+	default:
+		s.d.println(fmt.Sprintf("%% Ambiguous command:  \"%s\"", line))
+		return "", false
+	}
+}
+
+func (s *ios) incomplete() {
+	s.d.println("% Incomplete command.", "")
+}
+
+// interfaceName expands abbreviations such as g0/0/0 or inter vlan 1 into the full interface name
+func (s *ios) interfaceName(args []string) (string, bool) {
+	raw := strings.Join(args, "")
+	split := strings.IndexAny(raw, "0123456789")
+	if split <= 0 {
+		return "", false
+	}
+	kind := strings.ToLower(raw[:split])
+	number := raw[split:]
+
+	switch {
+	case strings.HasPrefix("vlan", kind):
+		return "Vlan" + number, true
+	case strings.HasPrefix("loopback", kind):
+		return "Loopback" + number, true
+	}
+
+	for _, name := range s.interfaces {
+		nameSplit := strings.IndexAny(name, "0123456789")
+		if strings.HasPrefix(strings.ToLower(name[:nameSplit]), kind) && name[nameSplit:] == number {
+			return name, true
+		}
+	}
+
+	return "", false
+}
+
+func (s *ios) execute(line string) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return
+	}
+
+	if resp, ok := s.d.scripted(line); ok {
+		s.d.print(resp)
+		return
+	}
+
+	switch s.mode {
+	case modeExec:
+		s.execExec(line, fields)
+	case modePriv:
+		s.execPriv(line, fields)
+	case modeConfig:
+		s.execConfig(line, fields)
+	case modeIf:
+		s.execInterface(line, fields)
+	case modeLine:
+		s.execLine(line, fields)
+	}
+}
+
+func (s *ios) execExec(line string, fields []string) {
+	keyword, ok := s.keyword(line, fields[0], execKeywords)
+	if !ok {
+		return
+	}
+
+	switch keyword {
+	case "enable":
+		if s.enableSecret() != "" {
+			s.d.print("Password: ")
+			s.pending = func(answer string) {
+				if answer == s.enableSecret() {
+					s.mode = modePriv
+				} else {
+					s.d.println("% Bad secrets", "")
+				}
+			}
+			return
+		}
+		s.mode = modePriv
+	case "exit", "logout":
+		s.mode = modeActivate
+		s.d.println("", "", "Press RETURN to get started!", "", "")
+	case "show":
+		s.show(line, fields[1:])
+	}
+}
+
+func (s *ios) execPriv(line string, fields []string) {
+	keyword, ok := s.keyword(line, fields[0], privKeywords)
+	if !ok {
+		return
+	}
+
+	switch keyword {
+	case "configure":
+		s.mode = modeConfig
+		s.d.println("Enter configuration commands, one per line.  End with CNTL/Z.")
+	case "disable":
+		s.mode = modeExec
+	case "exit", "logout":
+		s.mode = modeActivate
+		s.d.println("", "", "Press RETURN to get started!", "", "")
+	case "erase":
+		if len(fields) < 2 {
+			s.incomplete()
+			return
+		}
+		s.d.print("Erasing the nvram filesystem will remove all configuration files! Continue? [confirm]")
+		s.pending = func(answer string) {
+			if answer == "" || strings.HasPrefix(strings.ToLower(answer), "y") {
+				s.startup = nil
+				if s.persist != nil {
+					s.persist(nil)
+				}
+				s.d.println("[OK]", "Erase of nvram: complete")
+				s.d.println("*Nov  6 21:15:38.133: %SYS-7-NV_BLOCK_INIT: Initialized the geometry of nvram")
+			}
+		}
+	case "write":
+		s.save()
+	case "copy":
+		if len(fields) >= 3 && strings.HasPrefix(fields[1], "run") && strings.HasPrefix(fields[2], "start") {
+			s.save()
+			return
+		}
+		if len(fields) >= 3 && strings.HasPrefix(fields[2], "tftp:") {
+			s.copyToTftp(fields[1], fields[2])
+			return
+		}
+		if len(fields) >= 3 && strings.HasPrefix(fields[1], "tftp:") && strings.HasPrefix(fields[2], "run") {
+			s.d.print("Destination filename [running-config]? ")
+			s.pending = func(answer string) {
+				s.copyTftp(fields[1])
+			}
+			return
+		}
+		s.d.println(fmt.Sprintf("%%Error opening %s (Timed out)", fields[len(fields)-1]))
+	case "reload":
+		if s.modified {
+			s.d.print("System configuration has been modified. Save? [yes/no]: ")
+			s.pending = s.reloadSave
+			return
+		}
+		s.confirmReload()
+	case "show":
+		s.show(line, fields[1:])
+	}
+}
+
+// copyTftp merges the config at url into the running config, as if it had been typed in
+func (s *ios) copyTftp(url string) {
+	if s.d.Fetch == nil {
+		s.d.println(fmt.Sprintf("%%Error opening %s (Timed out)", url))
+		return
+	}
+	contents, err := s.d.Fetch(url)
+	if err != nil {
+		s.d.println(fmt.Sprintf("%%Error opening %s (Timed out)", url))
+		return
+	}
+
+	s.d.println(fmt.Sprintf("Accessing %s...", url), fmt.Sprintf("Loading %s", url), fmt.Sprintf("[OK - %d bytes]", len(contents)), "")
+	s.mode = modeConfig
+	for _, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line == "!" {
+			continue
+		}
+		s.execute(line)
+	}
+	s.mode = modePriv
+	s.context = nil
+	s.d.println(fmt.Sprintf("%d bytes copied in 0.052 secs", len(contents)))
+}
+
+// copyToTftp sends source to url once the host and file name have been confirmed, as long as something's there to
+// take it
+func (s *ios) copyToTftp(source string, url string) {
+	contents, ok := s.contents(source)
+	if !ok {
+		s.d.println(fmt.Sprintf("%%Error opening %s (No such file or directory)", source))
+		return
+	}
+
+	host, name, _ := strings.Cut(strings.TrimPrefix(url, "tftp://"), "/")
+	s.d.print(fmt.Sprintf("Address or name of remote host [%s]? ", host))
+	s.pending = func(answer string) {
+		s.d.print(fmt.Sprintf("Destination filename [%s]? ", name))
+		s.pending = func(answer string) {
+			if s.d.Send == nil || s.d.Send(url, contents) != nil {
+				s.d.println(fmt.Sprintf("%%Error opening %s (Timed out)", url))
+				return
+			}
+			s.d.println("!!", fmt.Sprintf("%d bytes copied in 0.052 secs (%d bytes/sec)", len(contents), len(contents)*19))
+		}
+	}
+}
+
+// contents is what copying source would send, such as startup-config or flash:config.text
+func (s *ios) contents(source string) ([]byte, bool) {
+	var c *config
+	switch {
+	case strings.HasPrefix(source, "flash:"):
+		if s.flash == nil {
+			return nil, false
+		}
+		return s.flash(strings.TrimPrefix(strings.TrimPrefix(source, "flash:"), "/"))
+	case strings.HasPrefix(source, "start"), strings.HasPrefix(source, "nvram:start"):
+		c = s.startup
+	case strings.HasPrefix(source, "run"), strings.HasPrefix(source, "system:run"):
+		c = s.running
+	}
+	if c == nil {
+		return nil, false
+	}
+	return []byte(strings.Join(c.show(), "\n")), true
+}
+
+func (s *ios) save() {
+	s.startup = s.running.clone()
+	s.modified = false
+	if s.persist != nil {
+		s.persist(s.startup)
+	}
+	s.d.println("Building configuration...", "[OK]")
+}
+
+func (s *ios) reloadSave(answer string) {
+	switch strings.ToLower(answer) {
+	case "yes", "y":
+		s.save()
+		s.confirmReload()
+	case "no", "n":
+		s.confirmReload()
+	default:
+		s.d.println("% Please answer 'yes' or 'no'.")
+		s.d.print("System configuration has been modified. Save? [yes/no]: ")
+		s.pending = s.reloadSave
+	}
+}
+
+func (s *ios) confirmReload() {
+	s.d.print("Proceed with reload? [confirm]")
+	s.pending = func(answer string) {
+		if answer != "" && !strings.HasPrefix(strings.ToLower(answer), "y") {
+			return
+		}
+		s.d.println("", "*Nov  6 21:18:42.901: %SYS-5-RELOAD: Reload requested by console. Reload Reason: Reload Command.")
+		s.mode = ""
+		s.reload()
+	}
+}
+
+func (s *ios) execConfig(line string, fields []string) {
+	keyword, ok := s.keyword(line, fields[0], configKeywords)
+	if !ok {
+		return
+	}
+
+	switch keyword {
+	case "end":
+		s.mode = modePriv
+		s.d.println("*Nov  6 21:15:29.667: %SYS-5-CONFIG_I: Configured from console by console")
+	case "exit":
+		s.mode = modePriv
+	case "do":
+		if len(fields) > 1 && strings.HasPrefix("show", strings.ToLower(fields[1])) {
+			s.show(line, fields[2:])
+		}
+	case "interface":
+		s.enterInterface(line, fields)
+	case "line":
+		if len(fields) < 3 {
+			s.incomplete()
+			return
+		}
+		kind, ok := s.keyword(line, fields[1], []string{"console", "vty", "aux"})
+		if !ok {
+			return
+		}
+		header := "line " + kind + " " + strings.Join(fields[2:], " ")
+		current := findSection(s.running.Lines, header)
+		if current == nil {
+			current = &section{Header: header}
+			s.running.Lines = append(s.running.Lines, current)
+		}
+		s.context = current
+		s.mode = modeLine
+	case "hostname":
+		if len(fields) < 2 {
+			s.incomplete()
+			return
+		}
+		s.running.Hostname = fields[1]
+		s.modified = true
+	case "config-register":
+		if len(fields) < 2 {
+			s.incomplete()
+			return
+		}
+		s.register = fields[1]
+		s.modified = true
+	case "crypto":
+		s.generateKey()
+	default:
+		if len(fields) < 2 {
+			s.incomplete()
+			return
+		}
+		s.running.Global = setLine(s.running.Global, line)
+		s.modified = true
+	}
+}
+
+func (s *ios) enterInterface(line string, fields []string) {
+	if len(fields) < 2 {
+		s.incomplete()
+		return
+	}
+
+	name, ok := s.interfaceName(fields[1:])
+	if !ok {
+		s.invalid(line, 1)
+		return
+	}
+
+	header := "interface " + name
+	current := findSection(s.running.Interfaces, header)
+	if current == nil {
+		current = &section{Header: header}
+		s.running.Interfaces = append(s.running.Interfaces, current)
+	}
+	s.context = current
+	s.mode = modeIf
+	s.modified = true
+}
+
+func (s *ios) execInterface(line string, fields []string) {
+	keyword, ok := s.keyword(line, fields[0], ifKeywords)
+	if !ok {
+		return
+	}
+
+	switch keyword {
+	case "end":
+		s.mode = modePriv
+		s.context = nil
+	case "exit":
+		s.mode = modeConfig
+		s.context = nil
+	case "interface":
+		s.enterInterface(line, fields)
+	case "shutdown":
+		s.context.Lines = setLine(s.context.Lines, "shutdown")
+	default:
+		if len(fields) < 2 {
+			s.incomplete()
+			return
+		}
+		s.context.Lines = setLine(s.context.Lines, line)
+	}
+	s.modified = true
+}
+
+func (s *ios) execLine(line string, fields []string) {
+	keyword, ok := s.keyword(line, fields[0], lineKeywords)
+	if !ok {
+		return
+	}
+
+	switch keyword {
+	case "end":
+		s.mode = modePriv
+		s.context = nil
+	case "exit":
+		s.mode = modeConfig
+		s.context = nil
+	case "login":
+		s.context.Lines = setLine(s.context.Lines, line)
+	default:
+		if len(fields) < 2 {
+			s.incomplete()
+			return
+		}
+		s.context.Lines = setLine(s.context.Lines, line)
+	}
+	s.modified = true
+}
+
+func (s *ios) generateKey() {
+	if s.running.Hostname == s.defaultName {
+		s.d.println("% Please define a hostname other than "+s.defaultName+".", "")
+		return
+	}
+	domain := ""
+	for _, global := range s.running.Global {
+		fields := strings.Fields(global)
+		if len(fields) == 3 && fields[0] == "ip" && strings.HasPrefix(fields[1], "domain") {
+			domain = fields[2]
+		}
+	}
+	if domain == "" {
+		s.d.println("% Please define a domain-name first.", "")
+		return
+	}
+
+	s.d.println(fmt.Sprintf("The name for the keys will be: %s.%s", s.running.Hostname, domain),
+		"Choose the size of the key modulus in the range of 360 to 4096 for your",
+		"  General Purpose Keys. Choosing a key modulus greater than 512 may take",
+		"  a few minutes.", "")
+	s.d.print("How many bits in the modulus [512]: ")
+	s.pending = func(answer string) {
+		bits := answer
+		if bits == "" {
+			bits = "512"
+		}
+		s.d.println(fmt.Sprintf("%% Generating %s bit RSA keys, keys will be non-exportable...", bits),
+			"[OK] (elapsed time was 1 seconds)", "")
+	}
+}
+
+func (s *ios) enableSecret() string {
+	for _, global := range s.running.Global {
+		fields := strings.Fields(global)
+		if len(fields) == 3 && fields[0] == "enable" && fields[1] == "secret" {
+			return fields[2]
+		}
+	}
+	return ""
+}
+
+func (s *ios) show(line string, args []string) {
+	if len(args) == 0 {
+		s.incomplete()
+		return
+	}
+
+	switch {
+	case strings.HasPrefix("running-config", strings.ToLower(args[0])):
+		s.d.println(s.runningConfig()...)
+	case strings.HasPrefix("vlan", strings.ToLower(args[0])) && s.vlanBrief != nil:
+		s.d.println(s.vlanBrief()...)
+	case strings.HasPrefix("version", strings.ToLower(args[0])):
+		s.d.println(s.version...)
+		s.d.println(fmt.Sprintf("Configuration register is %s", s.register), "")
+	default:
+		s.invalid(line, 1)
+	}
+}
+
+func (s *ios) runningConfig() []string {
+	return append([]string{"Building configuration...", "", "Current configuration:"}, s.running.show()...)
+}
+
+// show is the config the way show running-config prints it, without the lines before it
+func (c *config) show() []string {
+	lines := []string{"!", "hostname " + c.Hostname, "!"}
+	lines = append(lines, c.Global...)
+	lines = append(lines, "!")
+	for _, iface := range c.Interfaces {
+		lines = append(lines, iface.Header)
+		for _, ifLine := range iface.Lines {
+			lines = append(lines, " "+ifLine)
+		}
+		lines = append(lines, "!")
+	}
+	for _, consoleLine := range c.Lines {
+		lines = append(lines, consoleLine.Header)
+		for _, lineConfig := range consoleLine.Lines {
+			lines = append(lines, " "+lineConfig)
+		}
+		lines = append(lines, "!")
+	}
+	return append(lines, "end", "")
+}
+
+// setLine applies a configuration command to a block, handling "no" forms and replacing earlier values
+func setLine(lines []string, line string) []string {
+	line = strings.Join(strings.Fields(line), " ")
+	negated := strings.HasPrefix(line, "no ")
+	target := strings.TrimPrefix(line, "no ")
+	key := configKey(target)
+
+	kept := make([]string, 0, len(lines)+1)
+	for _, existing := range lines {
+		if configKey(existing) != key {
+			kept = append(kept, existing)
+		}
+	}
+	if !negated {
+		kept = append(kept, line)
+	}
+	return kept
+}
+
+// configKey is the part of a command that identifies what it sets, so later commands replace earlier ones
+func configKey(line string) string {
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) == 0:
+		return ""
+	case fields[0] == "username" && len(fields) > 1:
+		return "username " + fields[1]
+	case fields[0] == "ip" && len(fields) > 2 && fields[1] == "route":
+		return strings.Join(fields[:4], " ")
+	case len(fields) > 2 && (fields[0] == "ip" || fields[0] == "enable" || fields[0] == "transport" || fields[0] == "switchport"):
+		if fields[0] == "switchport" && len(fields) > 3 {
+			return strings.Join(fields[:3], " ")
+		}
+		return strings.Join(fields[:2], " ")
+	default:
+		return fields[0]
+	}
+}
+
+// RunningConfig returns the device's running configuration as show running-config prints it
+func (d *Device) RunningConfig() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	shell, ok := d.handler.(interface{ shell() *ios })
+	if !ok {
+		return ""
+	}
+	return strings.Join(shell.shell().runningConfig(), "\n")
+}
@@ -0,0 +1,44 @@
+//go:build linux
+
+package simulator
+
+import (
+	"github.com/creack/pty"
+	"golang.org/x/sys/unix"
+)
+
+// OpenPty serves the device on a new pseudo-terminal and returns the path of its terminal side, which can be
+// opened like any other serial port. The terminal is released once the device is closed.
+func (d *Device) OpenPty() (string, error) {
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		return "", err
+	}
+
+	// Put the terminal in raw mode so the line discipline doesn't echo or translate anything before a client opens it
+	termios, err := unix.IoctlGetTermios(int(tty.Fd()), unix.TCGETS)
+	if err != nil {
+		ptmx.Close()
+		tty.Close()
+		return "", err
+	}
+	termios.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	termios.Oflag &^= unix.OPOST
+	termios.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	termios.Cflag &^= unix.CSIZE | unix.PARENB
+	termios.Cflag |= unix.CS8
+	err = unix.IoctlSetTermios(int(tty.Fd()), unix.TCSETS, termios)
+	if err != nil {
+		ptmx.Close()
+		tty.Close()
+		return "", err
+	}
+
+	go func() {
+		d.Serve(ptmx)
+		ptmx.Close()
+		tty.Close()
+	}()
+
+	return tty.Name(), nil
+}
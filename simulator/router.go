@@ -0,0 +1,185 @@
+package simulator
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	routerOff     = "off"
+	routerPost    = "post"
+	routerLoading = "loading"
+	routerRommon  = "rommon"
+	routerIos     = "ios"
+)
+
+// Router simulates the console of an ISR 4221
+type Router struct {
+	*Device
+	// NeedsBreak makes ^C do nothing during the self test, like platforms that only stop for a serial break
+	NeedsBreak bool
+
+	state   string
+	command int
+	ios     *ios
+}
+
+// NewRouter returns a powered off 4221 with a previously used startup config
+func NewRouter(name string) *Router {
+	r := &Router{
+		Device: newDevice(name),
+		state:  routerOff,
+	}
+	r.ios = newIos(r.Device, "Router", []string{"GigabitEthernet0/0/0", "GigabitEthernet0/0/1", "GigabitEthernet0/1/0"})
+	r.ios.startup = &config{Hostname: "OldRouter", Global: []string{"enable secret 5 $1$forgotten"}}
+	r.ios.reload = r.boot
+	r.ios.version = []string{
+		"Cisco IOS XE Software, Version 16.09.04",
+		"Cisco IOS Software [Fuji], ISR Software (X86_64_LINUX_IOSD-UNIVERSALK9_IAS-M), Version 16.9.4, RELEASE SOFTWARE (fc2)",
+		"",
+		"ROM: IOS-XE ROMMON",
+		"",
+		"cisco ISR4221/K9 (1RU) processor with 1647778K/6147K bytes of memory.",
+		"Processor board ID FGL2231918D",
+		"2 Gigabit Ethernet interfaces",
+	}
+	r.handler = r
+	return r
+}
+
+// Register returns the configuration register that will be used on the next boot
+func (r *Router) Register() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.ios.register
+}
+
+// Erase clears the startup config, so the router comes up in the initial configuration dialog as if it had just
+// been reset
+func (r *Router) Erase() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.ios.startup = nil
+}
+
+func (r *Router) shell() *ios {
+	return r.ios
+}
+
+func (r *Router) mergeCRLF() bool {
+	return r.state == routerIos
+}
+
+func (r *Router) powerOn() {
+	r.boot()
+}
+
+// boot runs ROMMON's power on self test, which ^C or a break can interrupt, then loads IOS
+func (r *Router) boot() {
+	r.state = routerPost
+	r.busy = true
+	r.cancelSequence()
+
+	r.sequence([]string{
+		"",
+		"Initializing Hardware ...",
+		"",
+		"System Bootstrap, Version 16.9(1r), RELEASE SOFTWARE",
+		"Copyright (c) 1994-2018  by cisco Systems, Inc.",
+		"",
+		"ISR4221/K9 platform with 4194304 Kbytes of main memory",
+		"",
+	}, r.loadImage)
+}
+
+func (r *Router) loadImage() {
+	r.state = routerLoading
+	r.sequence([]string{
+		"boot: attempting to boot from [bootflash:isr4200-universalk9_ias.16.09.04.SPA.bin]",
+		"boot: reading file isr4200-universalk9_ias.16.09.04.SPA.bin",
+		"###############################################################################",
+		"Cisco IOS XE Software, Version 16.09.04",
+	}, func() {
+		r.state = routerIos
+		r.ios.start(r.ios.register == "0x2142")
+	})
+}
+
+func (r *Router) interrupt() {
+	switch r.state {
+	case routerPost:
+		if !r.NeedsBreak {
+			r.abortBoot()
+		}
+	case routerRommon:
+		r.println("")
+		r.print(r.prompt())
+	case routerIos:
+		r.ios.interrupt()
+	}
+}
+
+// serialBreak only does anything during the self test, as IOS ignores breaks with the default register
+func (r *Router) serialBreak() {
+	if r.state == routerPost {
+		r.abortBoot()
+	}
+}
+
+func (r *Router) abortBoot() {
+	r.cancelSequence()
+	r.state = routerRommon
+	r.command = 1
+	r.println("", "monitor: command \"boot\" aborted due to user interrupt")
+	r.print(r.prompt())
+	r.ready()
+}
+
+func (r *Router) prompt() string {
+	return fmt.Sprintf("rommon %d > ", r.command)
+}
+
+func (r *Router) enter(line string) {
+	switch r.state {
+	case routerRommon:
+		r.rommon(line)
+	case routerIos:
+		r.ios.enter(line)
+	}
+}
+
+func (r *Router) rommon(line string) {
+	r.println(line)
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		r.print(r.prompt())
+		return
+	}
+	r.command += 1
+
+	if resp, ok := r.scripted(line); ok {
+		r.print(resp)
+		r.print(r.prompt())
+		return
+	}
+
+	switch fields[0] {
+	case "confreg":
+		if len(fields) < 2 {
+			r.println("", fmt.Sprintf("Configuration register is %s", r.ios.register))
+			break
+		}
+		r.ios.register = fields[1]
+		r.println("", "You must reset or power cycle for new config to take effect")
+	case "reset", "boot":
+		r.boot()
+		return
+	default:
+		r.println(fmt.Sprintf("monitor: command \"%s\" not found", fields[0]))
+	}
+
+	r.print(r.prompt())
+}
@@ -0,0 +1,313 @@
+package simulator
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// handler is implemented by each simulated device family. Every method is
+// called with the device lock held.
+type handler interface {
+	powerOn()
+	enter(line string)
+	interrupt()
+	serialBreak()
+	mergeCRLF() bool
+}
+
+// Device is an in-memory console that satisfies common.Transport. The device
+// family decides what gets printed in response to what is written.
+type Device struct {
+	// Upper bound applied to the read timeout requested through SetReadTimeout so tests aren't waiting on
+	// real serial timings
+	MaxReadTimeout time.Duration
+	// Delay between boot messages
+	LineDelay time.Duration
+	// Extra commands the device should answer, keyed by the exact command line
+	Responses map[string]string
+	// Gets the file at a tftp:// URL for copy to read from. Without it, copying from TFTP times out.
+	Fetch func(url string) ([]byte, error)
+	// Takes a file copy sends to a tftp:// URL. Without it, copying to TFTP times out.
+	Send func(url string, contents []byte) error
+
+	name        string
+	mu          sync.Mutex
+	notify      chan struct{}
+	output      []byte
+	input       []byte
+	lastCR      bool
+	closed      bool
+	poweredOn   bool
+	readTimeout time.Duration
+	generation  int
+	received    []string
+	busy        bool
+	typeahead   []string
+	handler     handler
+}
+
+// TYPEAHEAD_LINES is how many lines the device holds on to while it is busy booting
+const TYPEAHEAD_LINES = 16
+
+var ErrClosed = errors.New("simulator: device closed")
+
+func newDevice(name string) *Device {
+	return &Device{
+		MaxReadTimeout: 5 * time.Millisecond,
+		LineDelay:      2 * time.Millisecond,
+		Responses:      make(map[string]string),
+		name:           name,
+		notify:         make(chan struct{}, 1),
+		readTimeout:    time.Second,
+	}
+}
+
+func (d *Device) Name() string {
+	return d.name
+}
+
+func (d *Device) SetReadTimeout(t time.Duration) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.readTimeout = t
+	return nil
+}
+
+// Read mirrors go.bug.st/serial: it returns (0, nil) once the read timeout expires with nothing to read
+func (d *Device) Read(p []byte) (int, error) {
+	d.mu.Lock()
+	timeout := d.readTimeout
+	if d.MaxReadTimeout > 0 && (timeout < 0 || timeout > d.MaxReadTimeout) {
+		timeout = d.MaxReadTimeout
+	}
+	d.mu.Unlock()
+
+	deadline := time.After(timeout)
+	for {
+		d.mu.Lock()
+		if d.closed {
+			d.mu.Unlock()
+			return 0, ErrClosed
+		}
+		if len(d.output) > 0 {
+			n := copy(p, d.output)
+			d.output = d.output[n:]
+			d.mu.Unlock()
+			return n, nil
+		}
+		d.mu.Unlock()
+
+		select {
+		case <-d.notify:
+		case <-deadline:
+			return 0, nil
+		}
+	}
+}
+
+func (d *Device) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return 0, ErrClosed
+	}
+	if !d.poweredOn {
+		return len(p), nil
+	}
+
+	for _, b := range p {
+		switch b {
+		case 0x03:
+			d.input = d.input[:0]
+			d.handler.interrupt()
+		case '\r':
+			d.submit()
+		case '\n':
+			if !(d.lastCR && d.handler.mergeCRLF()) {
+				d.submit()
+			}
+		default:
+			d.input = append(d.input, b)
+		}
+		d.lastCR = b == '\r'
+	}
+
+	return len(p), nil
+}
+
+// Break signals a serial break, which is passed on to the device if it's powered on
+func (d *Device) Break(t time.Duration) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return ErrClosed
+	}
+	if d.poweredOn {
+		d.input = d.input[:0]
+		d.handler.serialBreak()
+	}
+
+	return nil
+}
+
+func (d *Device) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.closed = true
+	d.generation += 1
+	d.wake()
+	return nil
+}
+
+// PowerOn starts the device's boot sequence. Calling it again power cycles the device.
+func (d *Device) PowerOn() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.poweredOn = true
+	d.generation += 1
+	d.input = d.input[:0]
+	d.typeahead = nil
+	d.handler.powerOn()
+}
+
+// Received returns every line the device has received, in order
+func (d *Device) Received() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	received := make([]string, len(d.received))
+	copy(received, d.received)
+	return received
+}
+
+// Serve bridges the device to rw, for example one end of a pty pair, until either side fails
+func (d *Device) Serve(rw io.ReadWriter) error {
+	errs := make(chan error, 2)
+
+	go func() {
+		buff := make([]byte, 512)
+		for {
+			n, err := d.Read(buff)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if n == 0 {
+				continue
+			}
+			_, err = rw.Write(buff[:n])
+			if err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	go func() {
+		buff := make([]byte, 512)
+		for {
+			n, err := rw.Read(buff)
+			if err != nil {
+				errs <- err
+				return
+			}
+			_, err = d.Write(buff[:n])
+			if err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	return <-errs
+}
+
+func (d *Device) submit() {
+	line := string(d.input)
+	d.input = d.input[:0]
+	d.received = append(d.received, line)
+
+	if d.busy {
+		d.typeahead = append(d.typeahead, line)
+		if len(d.typeahead) > TYPEAHEAD_LINES {
+			d.typeahead = d.typeahead[len(d.typeahead)-TYPEAHEAD_LINES:]
+		}
+		return
+	}
+	d.handler.enter(line)
+}
+
+// ready marks the device as accepting input again and replays anything typed while it was busy
+func (d *Device) ready() {
+	d.busy = false
+	for len(d.typeahead) > 0 && !d.busy {
+		line := d.typeahead[0]
+		d.typeahead = d.typeahead[1:]
+		d.handler.enter(line)
+	}
+}
+
+func (d *Device) wake() {
+	select {
+	case d.notify <- struct{}{}:
+	default:
+	}
+}
+
+// print queues raw output, the device lock must be held
+func (d *Device) print(s string) {
+	d.output = append(d.output, []byte(s)...)
+	d.wake()
+}
+
+// println queues each line followed by CRLF, the device lock must be held
+func (d *Device) println(lines ...string) {
+	for _, line := range lines {
+		d.print(line + "\r\n")
+	}
+}
+
+// scripted looks up a response registered through Responses
+func (d *Device) scripted(cmd string) (string, bool) {
+	resp, ok := d.Responses[strings.TrimSpace(cmd)]
+	return resp, ok
+}
+
+// sequence prints lines in the background with LineDelay between them, then calls done with the lock held.
+// A power cycle or interrupt that bumps the generation stops the sequence.
+func (d *Device) sequence(lines []string, done func()) {
+	gen := d.generation
+	delay := d.LineDelay
+
+	go func() {
+		for _, line := range lines {
+			time.Sleep(delay)
+			d.mu.Lock()
+			if d.generation != gen {
+				d.mu.Unlock()
+				return
+			}
+			d.println(line)
+			d.mu.Unlock()
+		}
+
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if d.generation == gen && done != nil {
+			done()
+		}
+	}()
+}
+
+// cancelSequence stops any running boot sequence
+func (d *Device) cancelSequence() {
+	d.generation += 1
+}
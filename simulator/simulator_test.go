@@ -0,0 +1,253 @@
+package simulator
+
+import (
+	"fmt"
+	"go.bug.st/serial"
+	"io"
+	"main/common"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// expect reads from port until want shows up, returning everything read
+func expect(port io.Reader, want string) (string, error) {
+	var output []byte
+	buff := make([]byte, 256)
+	deadline := time.Now().Add(5 * time.Second)
+
+	for time.Now().Before(deadline) {
+		n, err := port.Read(buff)
+		if err != nil {
+			return string(output), err
+		}
+		output = append(output, buff[:n]...)
+		if strings.Contains(string(output), want) {
+			return string(output), nil
+		}
+	}
+
+	return string(output), fmt.Errorf("timed out waiting for %q", want)
+}
+
+func bootloader(t *testing.T) *Switch {
+	s := NewSwitch("sim-2960")
+	s.ModeHeld = true
+	s.PowerOn()
+
+	output, err := expect(s, SWITCH_PROMPT)
+	if err != nil {
+		t.Fatalf("Switch never reached the bootloader: %s\n%s", err, output)
+	}
+	if !strings.Contains(output, "password-recovery mechanism is enabled") {
+		t.Fatalf("Switch didn't report password recovery being enabled:\n%s", output)
+	}
+	return s
+}
+
+func privExec(t *testing.T) *Router {
+	r := NewRouter("sim-isr4221")
+	r.PowerOn()
+
+	output, err := expect(r, "Press RETURN to get started!")
+	if err != nil {
+		t.Fatalf("Router never finished booting: %s\n%s", err, output)
+	}
+	r.Write([]byte("\r\nenable\r\n"))
+	output, err = expect(r, "OldRouter#")
+	if err != nil {
+		t.Fatalf("Router never reached privileged exec: %s\n%s", err, output)
+	}
+	return r
+}
+
+func TestSwitchBootloader(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{name: "Directory before flash_init", input: "dir flash:\r", want: "unable to stat flash:/"},
+		{name: "Unknown command", input: "show version\r", want: "Unknown cmd: show"},
+		{name: "Initialize flash", input: "flash_init\r", want: "...done Initializing Flash."},
+		{name: "List flash", input: "dir flash:\r", want: "config.text"},
+		{name: "Delete prompt", input: "del flash:config.text\r", want: "Are you sure you want to delete \"flash:config.text\" (y/n)?"},
+		{name: "Delete confirm", input: "y\r", want: "File \"flash:config.text\" deleted"},
+		{name: "Rename", input: "rename flash:vlan.dat flash:old-vlan.dat\r", want: SWITCH_PROMPT},
+		{name: "Deleted file is gone", input: "dir flash:\r", want: "old-vlan.dat"},
+	}
+
+	s := bootloader(t)
+	defer s.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.Write([]byte(tt.input))
+			output, err := expect(s, tt.want)
+			if err != nil {
+				t.Errorf("%s\n%s", err, output)
+			}
+			if tt.name == "Deleted file is gone" && strings.Contains(output, " config.text") {
+				t.Errorf("config.text is still listed:\n%s", output)
+			}
+		})
+	}
+
+	s.Write([]byte("reset\r"))
+	if output, err := expect(s, "(y/n)?"); err != nil {
+		t.Fatalf("%s\n%s", err, output)
+	}
+	s.Write([]byte("y\r"))
+	if output, err := expect(s, CONFIG_DIALOG_PROMPT); err != nil {
+		t.Fatalf("Switch without a config.text didn't offer the configuration dialog: %s\n%s", err, output)
+	}
+}
+
+func TestSwitchPasswordRecoveryDisabled(t *testing.T) {
+	s := NewSwitch("sim-2960")
+	s.ModeHeld = true
+	s.PasswordRecovery = false
+	s.PowerOn()
+	defer s.Close()
+
+	output, err := expect(s, "(y/n)?")
+	if err != nil {
+		t.Fatalf("%s\n%s", err, output)
+	}
+	if !strings.Contains(output, "password-recovery mechanism is disabled") {
+		t.Errorf("Switch didn't report password recovery being disabled:\n%s", output)
+	}
+
+	s.Write([]byte("y\r"))
+	if output, err := expect(s, SWITCH_PROMPT); err != nil {
+		t.Fatalf("%s\n%s", err, output)
+	}
+	for _, file := range s.Files {
+		if file.Name == "config.text" || file.Name == "vlan.dat" {
+			t.Errorf("%s survived the reset", file.Name)
+		}
+	}
+}
+
+func TestRouterRommon(t *testing.T) {
+	r := NewRouter("sim-isr4221")
+	r.PowerOn()
+	defer r.Close()
+
+	if output, err := expect(r, "System Bootstrap"); err != nil {
+		t.Fatalf("%s\n%s", err, output)
+	}
+	r.Write([]byte{0x03})
+	if output, err := expect(r, "rommon 1 > "); err != nil {
+		t.Fatalf("^C during boot didn't drop into ROMMON: %s\n%s", err, output)
+	}
+
+	r.Write([]byte("confreg 0x2142\r"))
+	if output, err := expect(r, "rommon 2 > "); err != nil {
+		t.Fatalf("%s\n%s", err, output)
+	}
+	if r.Register() != "0x2142" {
+		t.Errorf("Register() = %s, want 0x2142", r.Register())
+	}
+
+	r.Write([]byte("reset\r"))
+	output, err := expect(r, "Press RETURN to get started!")
+	if err != nil {
+		t.Fatalf("%s\n%s", err, output)
+	}
+	if strings.Contains(output, CONFIG_DIALOG_PROMPT) {
+		t.Errorf("Router offered the configuration dialog while ignoring the startup config:\n%s", output)
+	}
+
+	r.Write([]byte("\r\n"))
+	if output, err := expect(r, "Router>"); err != nil {
+		t.Fatalf("Startup config wasn't ignored: %s\n%s", err, output)
+	}
+}
+
+func TestIosErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{name: "Invalid input", input: "conf t\r\nfoo bar\r\n", want: "% Invalid input detected at '^' marker."},
+		{name: "Incomplete command", input: "hostname\r\n", want: "% Incomplete command."},
+		{name: "Ambiguous command", input: "end\r\nco\r\n", want: "% Ambiguous command:  \"co\""},
+		{name: "Unknown interface", input: "conf t\r\ninterface g9/9/9\r\n", want: "% Invalid input detected at '^' marker."},
+		{name: "Scripted response", input: "end\r\nshow clock\r\n", want: "*21:15:00.000 UTC Fri Nov 6 2026"},
+	}
+
+	r := privExec(t)
+	r.Responses["show clock"] = "*21:15:00.000 UTC Fri Nov 6 2026\r\n"
+	defer r.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r.Write([]byte(tt.input))
+			output, err := expect(r, tt.want)
+			if err != nil {
+				t.Errorf("%s\n%s", err, output)
+			}
+		})
+	}
+}
+
+func TestIosReload(t *testing.T) {
+	r := privExec(t)
+	defer r.Close()
+
+	r.Write([]byte("erase nvram:\r\n"))
+	if output, err := expect(r, "[confirm]"); err != nil {
+		t.Fatalf("%s\n%s", err, output)
+	}
+	r.Write([]byte("\r\n"))
+	if output, err := expect(r, "OldRouter#"); err != nil {
+		t.Fatalf("%s\n%s", err, output)
+	}
+
+	r.Write([]byte("conf t\r\nhostname R1\r\nend\r\nreload\r\n"))
+	if output, err := expect(r, "Save? [yes/no]: "); err != nil {
+		t.Fatalf("Modified config didn't prompt to be saved: %s\n%s", err, output)
+	}
+	r.Write([]byte("no\r\n"))
+	if output, err := expect(r, "Proceed with reload? [confirm]"); err != nil {
+		t.Fatalf("%s\n%s", err, output)
+	}
+	r.Write([]byte("\r\n"))
+	if output, err := expect(r, CONFIG_DIALOG_PROMPT); err != nil {
+		t.Fatalf("Router with an erased NVRAM didn't offer the configuration dialog: %s\n%s", err, output)
+	}
+}
+
+func TestOpenPty(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Pseudo-terminals are only supported on Linux")
+	}
+
+	s := NewSwitch("sim-2960")
+	s.ModeHeld = true
+	defer s.Close()
+
+	path, err := s.OpenPty()
+	if err != nil {
+		t.Fatalf("Error while opening pty: %s", err)
+	}
+
+	port, err := common.OpenSerial(path, serial.Mode{BaudRate: 9600, DataBits: 8, Parity: serial.NoParity, StopBits: serial.OneStopBit})
+	if err != nil {
+		t.Fatalf("Error while opening %s: %s", path, err)
+	}
+	defer port.Close()
+	port.SetReadTimeout(100 * time.Millisecond)
+
+	s.PowerOn()
+	if output, err := expect(port, SWITCH_PROMPT); err != nil {
+		t.Fatalf("%s\n%s", err, output)
+	}
+	port.Write([]byte("flash_init\r"))
+	if output, err := expect(port, "...done Initializing Flash."); err != nil {
+		t.Fatalf("%s\n%s", err, output)
+	}
+}
@@ -0,0 +1,411 @@
+package simulator
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	switchOff        = "off"
+	switchBooting    = "booting"
+	switchBootloader = "bootloader"
+	switchIos        = "ios"
+)
+
+const SWITCH_PROMPT = "switch: "
+
+type File struct {
+	Name      string
+	Size      int
+	Directory bool
+}
+
+// Switch simulates the console of a Catalyst 2960
+type Switch struct {
+	*Device
+	// Hold the MODE button through the next PowerOn
+	ModeHeld bool
+	// Whether the bootloader allows password recovery
+	PasswordRecovery bool
+	// Contents of flash:
+	Files []File
+
+	state     string
+	flashInit bool
+	pending   func(answer string)
+	ios       *ios
+}
+
+func switchInterfaces() []string {
+	interfaces := make([]string, 0)
+	for i := 1; i <= 24; i++ {
+		interfaces = append(interfaces, fmt.Sprintf("FastEthernet0/%d", i))
+	}
+	return append(interfaces, "GigabitEthernet0/1", "GigabitEthernet0/2")
+}
+
+// NewSwitch returns a powered off 2960 with a previously used configuration in flash
+func NewSwitch(name string) *Switch {
+	s := &Switch{
+		Device:           newDevice(name),
+		PasswordRecovery: true,
+		Files: []File{
+			{Name: "multiple-fs", Size: 1048},
+			{Name: "c2960-lanbasek9-mz.150-2.SE11", Directory: true},
+			{Name: "vlan.dat", Size: 616},
+			{Name: "config.text", Size: 1915},
+			{Name: "private-config.text", Size: 5},
+		},
+		state: switchOff,
+	}
+	s.ios = newIos(s.Device, "Switch", switchInterfaces())
+	s.ios.startup = &config{Hostname: "OldSwitch", Global: []string{"enable secret 5 $1$forgotten"}}
+	s.ios.reload = s.boot
+	s.ios.version = []string{
+		"Cisco IOS Software, C2960 Software (C2960-LANBASEK9-M), Version 15.0(2)SE11, RELEASE SOFTWARE (fc3)",
+		"",
+		"ROM: Bootstrap program is C2960 boot loader",
+		"",
+		"cisco WS-C2960-24TT-L (PowerPC405) processor (revision B0) with 65536K bytes of memory.",
+		"Processor board ID FOC1127Z4LK",
+		"24 FastEthernet interfaces",
+		"",
+		"Model number                    : WS-C2960-24TT-L",
+		"System serial number            : FOC1127Z4LK",
+	}
+	s.ios.persist = func(startup *config) {
+		if startup == nil {
+			s.remove("config.text")
+		} else if s.file("config.text") < 0 {
+			s.Files = append(s.Files, File{Name: "config.text", Size: 1024})
+		}
+	}
+	s.ios.vlanBrief = s.vlanBrief
+	s.ios.flash = s.contents
+	s.handler = s
+	return s
+}
+
+// vlanBrief lists the vlans the ports are on, the way show vlan brief does. Trunks aren't on any.
+func (s *Switch) vlanBrief() []string {
+	ports := map[int][]string{1: nil}
+	for _, name := range s.ios.interfaces {
+		vlan, trunk := 1, false
+		if section := findSection(s.ios.running.Interfaces, "interface "+name); section != nil {
+			for _, line := range section.Lines {
+				fields := strings.Fields(line)
+				switch {
+				case line == "switchport mode trunk":
+					trunk = true
+				case len(fields) == 4 && fields[0] == "switchport" && fields[1] == "access" && fields[2] == "vlan":
+					vlan, _ = strconv.Atoi(fields[3])
+				}
+			}
+		}
+		if !trunk {
+			split := strings.IndexAny(name, "0123456789")
+			ports[vlan] = append(ports[vlan], name[:2]+name[split:])
+		}
+	}
+
+	vlans := make([]int, 0, len(ports))
+	for vlan := range ports {
+		vlans = append(vlans, vlan)
+	}
+	sort.Ints(vlans)
+
+	lines := []string{
+		"",
+		"VLAN Name                             Status    Ports",
+		"---- -------------------------------- --------- -------------------------------",
+	}
+	for _, vlan := range vlans {
+		name := fmt.Sprintf("VLAN%04d", vlan)
+		if vlan == 1 {
+			name = "default"
+		}
+		// Four ports to a row, with the rest lined up underneath
+		row := fmt.Sprintf("%-4d %-32s %-9s ", vlan, name, "active")
+		for i := 0; i < len(ports[vlan]); i += 4 {
+			end := i + 4
+			if end > len(ports[vlan]) {
+				end = len(ports[vlan])
+			}
+			lines = append(lines, row+strings.Join(ports[vlan][i:end], ", "))
+			row = strings.Repeat(" ", 48)
+		}
+		if len(ports[vlan]) == 0 {
+			lines = append(lines, strings.TrimSpace(row))
+		}
+	}
+	return append(lines,
+		"1002 fddi-default                     act/unsup",
+		"1003 token-ring-default               act/unsup",
+		"1004 fddinet-default                  act/unsup",
+		"1005 trnet-default                    act/unsup",
+	)
+}
+
+func (s *Switch) shell() *ios {
+	return s.ios
+}
+
+func (s *Switch) mergeCRLF() bool {
+	return s.state == switchIos
+}
+
+func (s *Switch) interrupt() {
+	if s.state == switchIos {
+		s.ios.interrupt()
+	}
+}
+
+// serialBreak is ignored, as the bootloader is reached with the mode button
+func (s *Switch) serialBreak() {}
+
+func (s *Switch) enter(line string) {
+	switch s.state {
+	case switchBootloader:
+		s.bootloader(line)
+	case switchIos:
+		s.ios.enter(line)
+	}
+}
+
+func (s *Switch) powerOn() {
+	s.state = switchBooting
+	s.busy = true
+	s.flashInit = false
+	s.pending = nil
+
+	lines := []string{
+		"",
+		"Boot Sector Filesystem (bs) installed, fsid: 2",
+		"Base ethernet MAC Address: 00:1b:d4:53:8a:80",
+		"Xmodem file system is available.",
+	}
+
+	if !s.ModeHeld {
+		s.sequence(lines, s.loadImage)
+		return
+	}
+	s.ModeHeld = false
+
+	if !s.PasswordRecovery {
+		lines = append(lines, "The password-recovery mechanism is disabled.",
+			"",
+			"The system has been interrupted prior to loading the operating",
+			"system software, and password-recovery mechanism is disabled.",
+			"")
+		s.sequence(lines, func() {
+			s.print("Would you like to reset the system back to the default configuration (y/n)?")
+			s.state = switchBootloader
+			s.pending = s.recoveryDisabled
+			s.ready()
+		})
+		return
+	}
+
+	lines = append(lines, "The password-recovery mechanism is enabled.",
+		"",
+		"The system has been interrupted prior to initializing the",
+		"flash filesystem.  The following commands will initialize",
+		"the flash filesystem, and finish loading the operating",
+		"system software:",
+		"",
+		"    flash_init",
+		"    boot",
+		"")
+	s.sequence(lines, func() {
+		s.state = switchBootloader
+		s.print(SWITCH_PROMPT)
+		s.ready()
+	})
+}
+
+func (s *Switch) recoveryDisabled(answer string) {
+	switch strings.ToLower(answer) {
+	case "y", "yes":
+		s.remove("config.text")
+		s.remove("private-config.text")
+		s.remove("vlan.dat")
+		s.flashInit = true
+		s.println("", "Proceeding with system reset...", "")
+		s.print(SWITCH_PROMPT)
+	case "n", "no":
+		s.boot()
+	default:
+		s.print("Would you like to reset the system back to the default configuration (y/n)?")
+		s.pending = s.recoveryDisabled
+	}
+}
+
+// boot loads IOS from flash, skipping the bootloader
+func (s *Switch) boot() {
+	s.state = switchBooting
+	s.busy = true
+	s.pending = nil
+	s.cancelSequence()
+	s.sequence([]string{"", "Base ethernet MAC Address: 00:1b:d4:53:8a:80", "Xmodem file system is available."}, s.loadImage)
+}
+
+func (s *Switch) loadImage() {
+	s.sequence([]string{
+		"Loading \"flash:/c2960-lanbasek9-mz.150-2.SE11/c2960-lanbasek9-mz.150-2.SE11.bin\"...@@@@@@@@@@@@@@@@@@@@",
+		"File \"flash:/c2960-lanbasek9-mz.150-2.SE11/c2960-lanbasek9-mz.150-2.SE11.bin\" uncompressed and installed, entry point: 0x3000",
+		"executing...",
+		"",
+		"Cisco IOS Software, C2960 Software (C2960-LANBASEK9-M), Version 15.0(2)SE11, RELEASE SOFTWARE (fc3)",
+		"cisco WS-C2960-24TT-L (PowerPC405) processor (revision B0) with 65536K bytes of memory.",
+	}, func() {
+		s.state = switchIos
+		if s.file("config.text") < 0 {
+			s.ios.startup = nil
+		}
+		s.ios.start(false)
+	})
+}
+
+// Erase clears the startup config from flash, so the switch comes up in the initial configuration dialog as if it had
+// just been reset
+func (s *Switch) Erase() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.remove("config.text")
+	s.remove("private-config.text")
+	s.ios.startup = nil
+}
+
+func (s *Switch) file(name string) int {
+	for i, file := range s.Files {
+		if file.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// contents is what's in a file in flash. Only the config is kept, so anything else is as many bytes as it's big.
+func (s *Switch) contents(name string) ([]byte, bool) {
+	i := s.file(name)
+	if i < 0 || s.Files[i].Directory {
+		return nil, false
+	}
+	if strings.HasSuffix(name, "config.text") && !strings.HasSuffix(name, "private-config.text") && s.ios.startup != nil {
+		return []byte(strings.Join(s.ios.startup.show(), "\n")), true
+	}
+	return make([]byte, s.Files[i].Size), true
+}
+
+func (s *Switch) remove(name string) bool {
+	i := s.file(name)
+	if i < 0 {
+		return false
+	}
+	s.Files = append(s.Files[:i], s.Files[i+1:]...)
+	return true
+}
+
+func (s *Switch) bootloader(line string) {
+	s.println(line)
+
+	if s.pending != nil {
+		pending := s.pending
+		s.pending = nil
+		pending(strings.TrimSpace(line))
+		return
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		s.print(SWITCH_PROMPT)
+		return
+	}
+
+	if resp, ok := s.scripted(line); ok {
+		s.print(resp)
+		s.print(SWITCH_PROMPT)
+		return
+	}
+
+	switch fields[0] {
+	case "flash_init":
+		s.println("Initializing Flash...")
+		if !s.flashInit {
+			s.println("flashfs[0]: 600 files, 19 directories",
+				"flashfs[0]: 0 orphaned files, 0 orphaned directories",
+				"flashfs[0]: Total bytes: 32514048",
+				"flashfs[0]: Bytes used: 11838464",
+				"flashfs[0]: Bytes available: 20675584",
+				"flashfs[0]: flashfs fsck took 10 seconds.")
+		}
+		s.println("...done Initializing Flash.")
+		s.flashInit = true
+	case "dir":
+		if !s.flashInit {
+			s.println("unable to stat flash:/: no such device")
+			break
+		}
+		s.println("Directory of flash:/", "")
+		for i, file := range s.Files {
+			attributes := "-rwx"
+			if file.Directory {
+				attributes = "drwx"
+			}
+			s.println(fmt.Sprintf("%5d  %s  %-8d  <date>               %s", i+2, attributes, file.Size, file.Name))
+		}
+		s.println("", "20675584 bytes available (11838464 bytes used)", "")
+	case "del", "delete":
+		if len(fields) < 2 || !s.flashInit {
+			s.println("usage: delete <file>")
+			break
+		}
+		name := strings.TrimPrefix(strings.TrimPrefix(fields[1], "flash:"), "/")
+		s.print(fmt.Sprintf("Are you sure you want to delete \"flash:%s\" (y/n)?", name))
+		s.pending = func(answer string) {
+			if strings.ToLower(answer) == "y" {
+				if s.remove(name) {
+					s.println(fmt.Sprintf("File \"flash:%s\" deleted", name))
+				} else {
+					s.println(fmt.Sprintf("unable to delete flash:%s: no such file or directory", name))
+				}
+			} else {
+				s.println(fmt.Sprintf("File \"flash:%s\" not deleted", name))
+			}
+			s.print(SWITCH_PROMPT)
+		}
+		return
+	case "rename":
+		if len(fields) < 3 || !s.flashInit {
+			s.println("usage: rename <source> <destination>")
+			break
+		}
+		i := s.file(strings.TrimPrefix(fields[1], "flash:"))
+		if i < 0 {
+			s.println(fmt.Sprintf("unable to rename %s: no such file or directory", fields[1]))
+			break
+		}
+		s.Files[i].Name = strings.TrimPrefix(fields[2], "flash:")
+	case "reset":
+		s.print("Are you sure you want to reset the system (y/n)?")
+		s.pending = func(answer string) {
+			if strings.ToLower(answer) == "y" {
+				s.println("System resetting...")
+				s.boot()
+				return
+			}
+			s.print(SWITCH_PROMPT)
+		}
+		return
+	case "boot":
+		s.boot()
+		return
+	default:
+		s.println(fmt.Sprintf("Unknown cmd: %s", fields[0]))
+	}
+
+	s.print(SWITCH_PROMPT)
+}
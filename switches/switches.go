@@ -1,13 +1,11 @@
 package switches
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"go.bug.st/serial"
-	"io"
 	"main/common"
-	"main/crglogging"
-	"os"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -58,33 +56,21 @@ type SwitchConfig struct {
 	Lines           []LineConfig
 }
 
-const BUFFER_SIZE = 500
-const RECOVERY_PROMPT = "switch:"
-const CONFIRMATION_PROMPT = "[confirm]"
-const PASSWORD_RECOVERY = "password-recovery"
 const PASSWORD_RECOVERY_DISABLED = "password-recovery mechanism is disabled"
 const PASSWORD_RECOVERY_TRIGGERED = "password-recovery mechanism has been triggered"
 const PASSWORD_RECOVERY_ENABLED = "password-recovery mechanism is enabled"
 const YES_NO_PROMPT = "(y/n)?"
-const LOW_PRIV_PREFIX = "Switch>"
-const ELEVATED_PREFIX = "Switch#"
-const INITIAL_CONFIG_PROMPT = "Would you like to enter the initial configuration dialog? [yes/no]:"
 
-var redirectedOutput chan string
-var consoleOutput [][]byte
+// ParseFilesToDelete picks the files out of a flash listing with any of patterns in their name
+func ParseFilesToDelete(session *common.Session, files [][]byte, patterns []string) []string {
+	logger := session.Logger()
 
-var LoggerName string
-
-func ParseFilesToDelete(files [][]byte, debug bool) []string {
-	logger := crglogging.GetLogger(LoggerName)
-
-	commonPrefixes := []string{"config", "vlan"}
 	filesToDelete := make([]string, 0)
 
 	for _, file := range files {
 		cleanLine := strings.Split(strings.TrimSpace(string(common.TrimNull(file))), " ")
 		if len(cleanLine) > 1 {
-			for _, prefix := range commonPrefixes {
+			for _, prefix := range patterns {
 				for i := 0; i < len(cleanLine); i++ {
 					if len(cleanLine[i]) > 0 && strings.Contains(strings.ToLower(strings.TrimSpace(cleanLine[i])), prefix) {
 						getRidOfSpacesPlease := strings.TrimSpace(cleanLine[i])
@@ -100,1144 +86,827 @@ func ParseFilesToDelete(files [][]byte, debug bool) []string {
 	return filesToDelete
 }
 
-func Reset(SerialPort string, PortSettings serial.Mode, backup common.Backup, debug bool, updateChan chan bool) {
-	LoggerName = fmt.Sprintf("SwitchResetter%s%d%d%d", SerialPort, PortSettings.BaudRate, PortSettings.StopBits, PortSettings.DataBits)
-	resetLogger := crglogging.New(LoggerName)
-
-	var files []string
-	currentTime := time.Now()
-	backup.Prefix = currentTime.Format(fmt.Sprintf("%d%02d%02d_%02d%02d%02d", currentTime.Year(), currentTime.Month(),
-		currentTime.Day(), currentTime.Hour(), currentTime.Minute(), currentTime.Second()))
-
-	if updateChan != nil {
-		common.SetOutputChannel(updateChan, LoggerName)
-	}
-
-	if debug {
-		resetLogger.SetLogLevel(5)
-	} else {
-		resetLogger.SetLogLevel(4)
-	}
+func Reset(ctx context.Context, session *common.Session, profile common.Profile, backup common.Backup) common.Result {
+	port := session.Port
+	resetLogger := session.Logger()
 
-	var progress common.Progress
-	progress.TotalSteps = 10
-	progress.CurrentStep = 0
+	var result common.Result
+	step := "Waiting for the switch to start up"
 
-	port, err := serial.Open(SerialPort, &PortSettings)
+	ctx, cancel := common.WithTimeout(ctx, profile.Timeouts.Overall)
+	defer cancel()
+	defer session.EndPhase()
+	session.Phase(ctx, profile.Timeouts.Boot)
 
+	recoveryPrompt, err := profile.RecoveryPrompt()
 	if err != nil {
-		resetLogger.Fatalf("switches.Reset: Error while opening port: %s\n", err)
+		return result.Fail(step, err)
 	}
 
-	defer func(port serial.Port) {
-		err := port.Close()
-		if err != nil {
-			resetLogger.Fatalf("switches.Reset: Error while closing port: %s\n", err)
-		}
-	}(port)
+	var files []string
+	// Backups are named after when they were taken unless they were given a prefix
+	if backup.Prefix == "" {
+		backup.Prefix = time.Now().Format("20060102_150405")
+	}
 
-	common.SetReaderPort(port)
+	// The steps for files and restoring get added once we know about them
+	session.AddSteps(6)
+	session.Step(step)
 
 	err = port.SetReadTimeout(1 * time.Second)
 	if err != nil {
-		resetLogger.Fatalf("switches.Reset: Error while setting read timeout: %s\n", err)
+		return result.Fail(step, fmt.Errorf("switches.Reset: Error while setting read timeout: %w", err))
+	}
+
+	session.OutputInfo("Trigger password recovery by following these steps: \n")
+	session.OutputInfo("1. Unplug the switch\n")
+	session.OutputInfo("2. Hold the MODE button on the switch.\n")
+	session.OutputInfo("3. Plug the switch in while holding the button\n")
+	session.OutputInfo("4. When you are told, release the MODE button\n")
+
+	// Wait for switch to startup. The recovery disabled question is left for us to answer once we know about backups.
+	const (
+		recoveryDisabled = iota
+		recoveryEnabled
+		atRecoveryPrompt
+	)
+	cases := []common.Case{
+		{Pattern: common.Contains(PASSWORD_RECOVERY_DISABLED, PASSWORD_RECOVERY_TRIGGERED)},
+		{Pattern: common.Contains(PASSWORD_RECOVERY_ENABLED)},
+		{Pattern: recoveryPrompt},
+	}
+	if profile.Name == common.AUTO_PROFILE {
+		cases = append(cases, common.DetectCase(common.SWITCH, func(detected common.Profile) {
+			session.OutputInfo(fmt.Sprintf("Detected a %s, using its profile\n", detected.Name))
+			profile = detected
+		}))
+	}
+	match, err := session.Expect(common.Expect{Cases: cases, NoAutoAnswer: true})
+	if err != nil {
+		return result.Fail(step, fmt.Errorf("switches.Reset: Error while waiting for password recovery: %w", err))
 	}
-
-	common.OutputInfo("Trigger password recovery by following these steps: \n")
-	common.OutputInfo("1. Unplug the switch\n")
-	common.OutputInfo("2. Hold the MODE button on the switch.\n")
-	common.OutputInfo("3. Plug the switch in while holding the button\n")
-	common.OutputInfo("4. When you are told, release the MODE button\n")
-	progress.CurrentStep += 1
-
-	// Wait for switch to startup
-	var output []byte
-	var parsedOutput string
-	for !(strings.Contains(parsedOutput, PASSWORD_RECOVERY) || strings.Contains(parsedOutput, RECOVERY_PROMPT)) {
-		output, err = common.ReadLine(port, BUFFER_SIZE, debug)
-		if err != nil {
-			resetLogger.Fatalf("switches.Reset: Error while reading line: %s\n", err)
-		}
-		parsedOutput = strings.ToLower(strings.TrimSpace(string(common.TrimNull(output))))
-		resetLogger.Debugf("\n=============================================\nFROM DEVICE: %s\n", parsedOutput)
-		consoleOutput = append(consoleOutput, output)
-		resetLogger.Debugf("Has prefix: %t\n", strings.Contains(parsedOutput, PASSWORD_RECOVERY) ||
-			strings.Contains(parsedOutput, PASSWORD_RECOVERY_DISABLED) ||
-			strings.Contains(parsedOutput, PASSWORD_RECOVERY_TRIGGERED) ||
-			strings.Contains(parsedOutput, PASSWORD_RECOVERY_ENABLED) ||
-			strings.Contains(parsedOutput, RECOVERY_PROMPT))
-		resetLogger.Debugf("Expected substrings: %s, %s, %s, %s, or %s\n", RECOVERY_PROMPT, PASSWORD_RECOVERY, PASSWORD_RECOVERY_DISABLED, PASSWORD_RECOVERY_TRIGGERED, PASSWORD_RECOVERY_ENABLED)
-		//common.WriteLine(port, "\r", debug)
+	if profile.Name == common.AUTO_PROFILE {
+		session.OutputInfo("Couldn't tell what model the switch is, carrying on with the defaults\n")
+	}
+	recoveryPrompt, err = profile.RecoveryPrompt()
+	if err != nil {
+		return result.Fail(step, err)
 	}
 
-	common.OutputInfo("Release the mode button now\n")
-	// Assumption being made: we are being ran as a CLI app rather than the web gui
+	session.OutputInfo("Release the mode button now\n")
 	// Allow the user to have time to release the button
-	if updateChan == nil {
-		common.OutputInfo("Press enter once you've released it")
-		_, err := fmt.Scanln()
-		if err != nil {
-			resetLogger.Fatalf("Error while processing entered string: %s\n", err)
-		}
+	err = session.Policy().Pause(ctx, "Release the MODE button")
+	if err != nil {
+		return result.Fail(step, fmt.Errorf("switches.Reset: Error while waiting for the MODE button to be released: %w", err))
 	}
 
-	//err = port.SetReadTimeout(5 * time.Second)
-	//if err != nil {
-	//	resetLogger.Fatal(err)
-	//}
-
-	// Ensure we have one of the test cases in the buffer
-	common.OutputInfo("Checking to see if password recovery is enabled\n")
-	for !(strings.Contains(parsedOutput, PASSWORD_RECOVERY_DISABLED) || strings.Contains(parsedOutput, PASSWORD_RECOVERY_TRIGGERED) ||
-		strings.Contains(parsedOutput, PASSWORD_RECOVERY_ENABLED) || strings.Contains(parsedOutput, RECOVERY_PROMPT)) {
-		for i := 0; i < 5; i++ {
-			common.WriteLine(port, "\r", debug)
-		}
-		output, err = common.ReadLine(port, BUFFER_SIZE, debug)
-		if err != nil {
-			resetLogger.Fatalf("switches.Reset: Error while reading line: %s\n", err)
-		}
-		parsedOutput = strings.ToLower(strings.TrimSpace(string(common.TrimNull(output))))
-	}
+	step = session.Step("Checking to see if password recovery is enabled")
+	session.Phase(ctx, profile.Timeouts.Recovery)
+	session.OutputInfo("Checking to see if password recovery is enabled\n")
 
 	// Test to see what we triggered on.
 	// Password recovery was disabled
-	if strings.Contains(parsedOutput, PASSWORD_RECOVERY_DISABLED) || strings.Contains(parsedOutput, PASSWORD_RECOVERY_TRIGGERED) {
-		common.OutputInfo("Password recovery was disabled\n")
+	if match.Case == recoveryDisabled {
+		session.OutputInfo("Password recovery was disabled\n")
+		step = session.Step("Resetting the switch with password recovery disabled")
 
 		// We can't back up the config if password recovery is disabled
 		if backup.Backup {
-			common.OutputInfo("Backing up the config is impossible as password recovery is disabled.\n")
-
-			// Assumption being made: we're being ran from the CLI rather than the web gui, so prompt if we want to continue
-			if updateChan == nil {
-				common.OutputInfo("Would you like to continue? (y/N)\n")
-				var userInput string
-				_, err := fmt.Scanln(&userInput)
-				switch {
-				case err != nil:
-					resetLogger.Fatalf("Switch not reset\nError while processing input: %s\n", err)
-				case strings.ToLower(userInput) == "n" || strings.ToLower(userInput) == "no" || userInput == "":
-					common.OutputInfo("Not resetting\n")
-					break
-				case strings.ToLower(userInput) == "y" || strings.ToLower(userInput) == "yes":
-					common.OutputInfo("Continuing with reset.\n")
-					backup.Backup = false
-					break
-				}
-				// Assumption being made, we are being run from the web gui.
-				// We don't have prompts going (yet), so defaulting to continuing
-			} else {
-				common.OutputInfo("Continuing with reset.\n")
-				backup.Backup = false
-			}
-		}
-		progress.TotalSteps = 4
-		progress.CurrentStep += 1
-		for !(strings.Contains(parsedOutput, YES_NO_PROMPT)) {
-			common.WriteLine(port, "", debug)
-			output, err = common.ReadLine(port, BUFFER_SIZE, debug)
+			session.OutputInfo("Backing up the config is impossible as password recovery is disabled.\n")
+
+			carryOn, err := session.Policy().Confirm(ctx, "Would you like to continue without backing up?")
 			if err != nil {
-				resetLogger.Fatalf("switches.Reset: Error while reading line: %s\n", err)
+				return result.Fail(step, fmt.Errorf("switches.Reset: Switch not reset, error while asking whether to continue: %w", err))
+			}
+			if !carryOn {
+				session.OutputInfo("Not resetting\n")
+				return result.Fail(step, errors.New("switches.Reset: Switch not reset as the config couldn't be backed up"))
 			}
+			session.OutputInfo("Continuing with reset.\n")
+			backup.Backup = false
 		}
 
-		common.WriteLine(port, "", debug)
-
-		for !(strings.Contains(strings.ToLower(strings.TrimSpace(string(common.TrimNull(output)))), RECOVERY_PROMPT)) {
-			common.WriteLine(port, "", debug)
-			time.Sleep(1 * time.Second)
-			output, err = common.ReadLine(port, BUFFER_SIZE, debug)
-			if err != nil {
-				resetLogger.Fatalf("switches.Reset: Error while reading line: %s\n", err)
-			}
+		// Saying yes to the reset deletes the config and vlans for us
+		_, err = session.Expect(common.Expect{Cases: []common.Case{
+			common.Answer(common.Prompt(YES_NO_PROMPT), session, "y"),
+			{Pattern: recoveryPrompt},
+		}})
+		if err != nil {
+			return result.Fail(step, fmt.Errorf("switches.Reset: Error while resetting the switch: %w", err))
 		}
-		common.WriteLine(port, "boot", debug)
-		_, err = common.ReadLines(port, BUFFER_SIZE, 10, debug)
+		err = common.WriteLine(session, "boot")
 		if err != nil {
-			resetLogger.Fatalf("switches.Reset: Error while reading lines: %s\n", err)
+			return result.Fail(step, fmt.Errorf("switches.Reset: Error while booting the switch: %w", err))
 		}
 
 		// Password recovery was enabled
-	} else if strings.Contains(parsedOutput, RECOVERY_PROMPT) || strings.Contains(parsedOutput, PASSWORD_RECOVERY_ENABLED) {
-		common.OutputInfo("Password recovery was enabled\n")
-		progress.CurrentStep += 1
-		for !strings.HasSuffix(strings.ToLower(strings.TrimSpace(string(common.TrimNull(output)))), RECOVERY_PROMPT) {
-			resetLogger.Debugf(fmt.Sprintf("DEBUG: %s\n", common.TrimNull(output)))
-			output, err = common.ReadLine(port, BUFFER_SIZE, debug)
+	} else {
+		session.OutputInfo("Password recovery was enabled\n")
+		step = session.Step("Entering the recovery console")
+		if match.Case != atRecoveryPrompt {
+			_, err = session.Expect(common.Expect{Cases: []common.Case{{Pattern: recoveryPrompt}}, Nudge: true})
 			if err != nil {
-				resetLogger.Fatalf("switches.Reset: Error while reading line: %s\n", err)
+				return result.Fail(step, fmt.Errorf("switches.Reset: Error while waiting for the recovery console: %w", err))
 			}
-			common.WriteLine(port, "", debug)
-			consoleOutput = append(consoleOutput, output)
 		}
-		resetLogger.Debugf("DEBUG: %s\n", common.TrimNull(output))
 
 		// Initialize Flash
-		common.OutputInfo("Entered recovery console, now initializing flash\n")
-		progress.CurrentStep += 1
-		common.WriteLine(port, "flash_init", debug)
-		//time.Sleep(5 * time.Second)
-		err = port.SetReadTimeout(1 * time.Second)
-		if err != nil {
-			resetLogger.Fatalf("switches.Reset: Error while setting the read timeout: %s\n", err)
-		}
-		output, err = common.ReadLine(port, 500, debug)
-		if err != nil {
-			resetLogger.Fatalf("switches.Reset: Error while reading line: %s\n", err)
-		}
-		consoleOutput = append(consoleOutput, output)
-
-		// Loop until it stops getting butchered
-		for strings.Contains(strings.ToLower(strings.TrimSpace(string(common.TrimNull(output)))), "unknown cmd: ") ||
-			!strings.Contains(strings.ToLower(strings.TrimSpace(string(common.TrimNull(output)))), fmt.Sprintf("%s flash_init", RECOVERY_PROMPT)) {
-			common.WriteLine(port, "flash_init", debug)
-			output, err = common.ReadLine(port, 500, debug)
+		step = session.Step("Initializing flash")
+		session.OutputInfo("Entered recovery console, now initializing flash\n")
+		for _, command := range profile.Recovery.Commands {
+			// Commands sometimes get butchered on the way in, so keep trying until it's understood
+			_, err = session.Command(command, recoveryPrompt, common.Case{
+				Pattern: common.Contains("unknown cmd"),
+				Handle: func(line string) (common.Action, error) {
+					return common.Continue, common.WriteLine(session, command)
+				},
+			})
 			if err != nil {
-				resetLogger.Fatalf("switches.Reset: Error while reading line: %s\n", err)
+				return result.Fail(step, fmt.Errorf("switches.Reset: Error while running %s: %w", command, err))
 			}
-			consoleOutput = append(consoleOutput, output)
 		}
 
-		for !strings.Contains(strings.ToLower(strings.TrimSpace(string(common.TrimNull(output)))), RECOVERY_PROMPT) {
-			common.WriteLine(port, "", debug)
-			output, err = common.ReadLine(port, BUFFER_SIZE, debug)
+		if profile.Recovery.List != "" {
+			// Get files
+			step = session.Step("Listing flash")
+			session.OutputInfo("Flash has been initialized, now listing directory\n")
+			match, err = session.Command(profile.Recovery.List, recoveryPrompt)
 			if err != nil {
-				resetLogger.Fatalf("switches.Reset: Error while reading line: %s\n", err)
+				return result.Fail(step, fmt.Errorf("switches.Reset: Error while listing flash: %w", err))
+			}
+			listing := make([][]byte, 0, len(match.Lines))
+			for _, line := range match.Lines {
+				listing = append(listing, []byte(line))
 			}
-			consoleOutput = append(consoleOutput, output)
-		}
 
-		// Make sure there's nothing extra left in the buffer
-		for !strings.HasSuffix(strings.ToLower(strings.TrimSpace(string(output))), RECOVERY_PROMPT) {
-			output, err = common.ReadLine(port, 500, debug)
-			if errors.Is(err, io.ErrNoProgress) {
-				resetLogger.Debugf("INPUT: %s\n", "\\n\\n\\n")
-				common.WriteLine(port, "", debug)
-				common.WriteLine(port, "", debug)
-				common.WriteLine(port, "", debug)
-			} else if err != nil {
-				resetLogger.Fatalf("switches.Reset: Error while reading line: %s\n", err)
+			// Determine the files we need to delete
+			if backup.Backup {
+				session.OutputInfo("Parsing files to move...\n")
 			} else {
-				resetLogger.Debugf("OUTPUT: %s\n", common.TrimNull(output))
-				consoleOutput = append(consoleOutput, output)
+				session.OutputInfo("Parsing files to delete...\n")
 			}
-		}
+			files = ParseFilesToDelete(session, listing, profile.DeleteFiles)
+			session.AddSteps(len(files))
 
-		// Clear out buffer
-		for !errors.Is(err, io.ErrNoProgress) {
-			output, err = common.ReadLine(port, 500, debug)
-			if errors.Is(err, io.ErrNoProgress) {
-				break
-			} else if err != nil {
-				resetLogger.Fatalf("switches.Reset: Error while reading line: %s\n", err)
+			// Delete files if necessary
+			if len(files) == 0 {
+				session.OutputInfo("Switch has been reset already.\n")
 			} else {
-				resetLogger.Debugf("OUTPUT: %s\n", common.TrimNull(output))
-				consoleOutput = append(consoleOutput, output)
+				if backup.Backup {
+					session.OutputInfo("Moving files\n")
+					for _, file := range files {
+						step = session.Step(fmt.Sprintf("Moving %s", file))
+						session.OutputInfo(fmt.Sprintf("Moving file %s to %s-%s\n", file, backup.Prefix, file))
+						_, err = session.Command(fmt.Sprintf("rename flash:%s flash:%s-%s", file, backup.Prefix, file), recoveryPrompt)
+						if err != nil {
+							return result.Fail(step, fmt.Errorf("switches.Reset: Error while moving %s: %w", file, err))
+						}
+						result.Backups = append(result.Backups, fmt.Sprintf("flash:%s-%s", backup.Prefix, file))
+					}
+				} else {
+					session.OutputInfo("Deleting files\n")
+					for _, file := range files {
+						step = session.Step(fmt.Sprintf("Deleting %s", file))
+						session.OutputInfo(fmt.Sprintf("Deleting %s\n", file))
+						_, err = session.Command(fmt.Sprintf(profile.Recovery.Delete, file), recoveryPrompt,
+							common.Answer(common.Prompt(YES_NO_PROMPT), session, "y"))
+						if err != nil {
+							return result.Fail(step, fmt.Errorf("switches.Reset: Error while deleting %s: %w", file, err))
+						}
+						result.FilesDeleted = append(result.FilesDeleted, file)
+					}
+				}
+				session.OutputInfo("Switch has been reset\n")
 			}
 		}
 
-		// Get files
-		common.OutputInfo("Flash has been initialized, now listing directory\n")
-		progress.CurrentStep += 1
-		listing := make([][]byte, 1)
-		common.WriteLine(port, "dir flash:", debug)
-		line, err := common.ReadLine(port, BUFFER_SIZE, debug)
+		step = session.Step("Restarting the switch")
+		session.OutputInfo("Restarting the switch\n")
+		err = common.WriteLine(session, profile.Recovery.Boot)
 		if err != nil {
-			resetLogger.Fatalf("switches.Reset: Error while reading line: %s\n", err)
-		}
-		//
-		//common.WriteLine(port, "dir flash:", debug)
-		//line, err = common.ReadLine(port, BUFFER_SIZE, debug)
-		//if err != nil {
-		//	resetLogger.Fatalf("switches.Reset: Error while reading line: %s\n", err)
-		//}
-
-		line, err = common.ReadLine(port, BUFFER_SIZE, debug)
+			return result.Fail(step, fmt.Errorf("switches.Reset: Error while restarting the switch: %w", err))
+		}
+		// Restarting may ask us to confirm, otherwise carry on as soon as the switch starts doing something else
+		_, err = session.Expect(common.Expect{Cases: []common.Case{
+			{Pattern: common.Prompt(YES_NO_PROMPT), Handle: func(line string) (common.Action, error) {
+				return common.Stop, common.WriteLine(session, "y")
+			}},
+			{Pattern: regexp.MustCompile(`.`), WholeLines: true, Handle: func(line string) (common.Action, error) {
+				if strings.EqualFold(line, profile.Recovery.Boot) || recoveryPrompt.MatchString(line) {
+					return common.Continue, nil
+				}
+				return common.Stop, nil
+			}},
+		}, NoAutoAnswer: true})
 		if err != nil {
-			resetLogger.Fatalf("switches.Reset: Error while reading line: %s\n", err)
-		}
-		consoleOutput = append(consoleOutput, line)
-		listing = append(listing, line)
-		for !strings.HasSuffix(strings.ToLower(strings.TrimSpace(string(common.TrimNull(line)))), RECOVERY_PROMPT) {
-			line, err = common.ReadLine(port, BUFFER_SIZE, debug)
-			listing = append(listing, line)
-			consoleOutput = append(consoleOutput, line)
-			common.WriteLine(port, "\r", debug)
-		}
-
-		// Determine the files we need to delete
-		// TODO: Debug this section
-		if backup.Backup {
-			common.OutputInfo("Parsing files to move...\n")
-		} else {
-			common.OutputInfo("Parsing files to delete...\n")
+			return result.Fail(step, fmt.Errorf("switches.Reset: Error while restarting the switch: %w", err))
 		}
-		progress.CurrentStep += 1
-		files = ParseFilesToDelete(listing, debug)
-
-		common.WaitForSubstring(port, RECOVERY_PROMPT, debug)
-
-		//err = port.SetReadTimeout(1 * time.Second)
-		//if err != nil {
-		//	resetLogger.Fatal(err)
-		//}
-
-		// Delete files if necessary
-		if len(files) == 0 {
-			common.OutputInfo("Switch has been reset already.\n")
-			progress.TotalSteps -= 1
-			progress.CurrentStep += 1
-		} else {
-			// Clear buffer
-			for !errors.Is(err, io.ErrNoProgress) {
-				output, err = common.ReadLine(port, 500, debug)
-				if errors.Is(err, io.ErrNoProgress) {
-
-					break
-				} else if err != nil && !errors.Is(err, io.ErrNoProgress) {
-					resetLogger.Fatalf("switches.Reset: Error while reading line: %s\n", err)
-				} else if strings.Contains(strings.ToLower(strings.TrimSpace(string(output))), "-- more --") {
-					resetLogger.Debugf("OUTPUT: %s\n", common.TrimNull(output))
-					resetLogger.Debugf("INPUT: %s\n", "\\n")
-					common.WriteLine(port, "", debug)
-					consoleOutput = append(consoleOutput, output)
-				} else {
-					resetLogger.Debugf("OUTPUT: %s\n", common.TrimNull(output))
-					consoleOutput = append(consoleOutput, output)
-				}
-			}
-
-			if backup.Backup {
-				common.OutputInfo("Moving files\n")
-				progress.CurrentStep += 1
-				for _, file := range files {
-					common.OutputInfo(fmt.Sprintf("Moving file %s to %s-%s\n", strings.TrimSpace(file), backup.Prefix, file))
-					common.WriteLine(port, fmt.Sprintf("rename flash:%s flash:%s-%s", strings.TrimSpace(file), backup.Prefix, strings.TrimSpace(file)), debug)
-					line, err = common.ReadLine(port, BUFFER_SIZE, debug)
-					resetLogger.Debugf("rename flash:%s flash:%s-%s\n", strings.TrimSpace(file), backup.Prefix, strings.TrimSpace(file))
-					resetLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(line)))))
-				}
-			} else {
-				common.OutputInfo("Deleting files\n")
-				progress.CurrentStep += 1
-				for _, file := range files {
-					common.OutputInfo(fmt.Sprintf("Deleting %s\n", strings.TrimSpace(file)))
-					resetLogger.Debugf("INPUT: %s%s\n", "del flash:", strings.TrimSpace(file))
-					common.WriteLine(port, fmt.Sprintf("del flash:%s", strings.TrimSpace(file)), debug)
-					output, err = common.ReadLine(port, BUFFER_SIZE, debug)
-					if err != nil {
-						resetLogger.Fatalf("switches.Reset: Error while reading line: %s\n", err)
-					}
-					consoleOutput = append(consoleOutput, output)
-					resetLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(line))))
-
-					time.Sleep(250 * time.Millisecond)
+	}
 
-					resetLogger.Debugf("DEBUG: Confirming deletion\n")
-					resetLogger.Debugf("INPUT: %s\n", "y")
-					common.WriteLine(port, "y", debug)
-					output, err = common.ReadLine(port, BUFFER_SIZE, debug)
-					if err != nil {
-						resetLogger.Fatalf("switches.Reset: Error while reading line: %s\n", err)
-					}
-					resetLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(line))))
-					consoleOutput = append(consoleOutput, output)
+	// Check we've got what we need to back up
+	if backup.Backup && !(backup.Destination != "" && ((backup.Source == "" && backup.SubnetMask == "") || (backup.Source != "" && backup.SubnetMask != ""))) {
+		backup.Backup = false
 
-					time.Sleep(250 * time.Millisecond)
-				}
-			}
-			common.OutputInfo("Switch has been reset\n")
-			progress.CurrentStep += 1
+		// Inform the user of the missing information
+		session.OutputInfo("Unable to back up configs to TFTP server as there are missing values\n")
+		if backup.Source == "" {
+			session.OutputInfo("Source address missing\n")
 		}
-
-		common.OutputInfo("Restarting the switch\n")
-		progress.CurrentStep += 1
-		for !strings.HasSuffix(strings.ToLower(strings.TrimSpace(string(common.TrimNull(output)))), RECOVERY_PROMPT) {
-			output, err = common.ReadLine(port, BUFFER_SIZE, debug)
-			if errors.Is(err, io.ErrNoProgress) {
-				common.WriteLine(port, "", debug)
-			} else if err != nil {
-				resetLogger.Fatalf("switches.Reset: Error while reading line: %s\n", err)
-			}
-			consoleOutput = append(consoleOutput, output)
+		if backup.SubnetMask == "" {
+			session.OutputInfo("Subnet mask missing\n")
+		}
+		if backup.Destination == "" {
+			session.OutputInfo("Destination address missing\n")
 		}
+	}
 
-		common.WriteLine(port, "reset", debug)
-		output, err = common.ReadLine(port, BUFFER_SIZE, debug)
+	// Some models need finishing off once IOS is up
+	restore := match.Case != recoveryDisabled && (len(profile.Recovery.Restore) > 0 || len(profile.Recovery.Erase) > 0)
+	if restore || backup.Backup {
+		steps := 1
+		if restore {
+			steps += 2
+		}
+		if backup.Backup {
+			steps += 1
+		}
+		session.AddSteps(steps)
+		step = session.Step("Waiting for the switch to start up again")
+		session.Phase(ctx, profile.Timeouts.Startup)
+		session.OutputInfo("Waiting for switch to start up\n")
+		match, err = session.Expect(common.Expect{Cases: []common.Case{
+			{Pattern: common.EXEC_PROMPT},
+			{Pattern: common.PRIV_PROMPT},
+		}, Nudge: true})
 		if err != nil {
-			resetLogger.Fatalf("switches.Reset: Error while reading line: %s\n", err)
+			return result.Fail(step, fmt.Errorf("switches.Reset: Error while waiting for the switch to start up: %w", err))
 		}
-		consoleOutput = append(consoleOutput, output)
+		session.OutputInfo("We have booted up now\n")
+		session.Phase(ctx, profile.Timeouts.Commands)
 
-		time.Sleep(100 * time.Millisecond)
-
-		common.WriteLine(port, "y", debug)
-		output, err = common.ReadLine(port, BUFFER_SIZE, debug)
-		if err != nil {
-			resetLogger.Fatalf("switches.Reset: Error while reading lines: %s\n", err)
+		if match.Case == 0 {
+			_, err = session.Command("enable", common.PRIV_PROMPT)
+			if err != nil {
+				return result.Fail(step, fmt.Errorf("switches.Reset: Error while entering privileged exec: %w", err))
+			}
 		}
-		consoleOutput = append(consoleOutput, output)
 	}
-	progress.CurrentStep += 1
-	common.OutputInfo("Successfully reset!\n")
-	if backup.Backup {
-		//err = port.SetReadTimeout(serial.NoTimeout)
-		//if err != nil {
-		//	resetLogger.Fatal(err)
-		//}
-		if backup.Destination != "" && ((backup.Source == "" && backup.SubnetMask == "") || (backup.Source != "" && backup.SubnetMask != "")) {
-			closeTftpServer := make(chan bool)
-
-			// Spin up TFTP server
-			if backup.UseBuiltIn {
-				go common.BuiltInTftpServer(closeTftpServer)
-			}
 
-			// Wait for the switch to start up
-			common.OutputInfo("Waiting for switch to start up to back up config\n")
-
-			for !strings.Contains(strings.ToLower(strings.TrimSpace(string(output[:]))), strings.ToLower(LOW_PRIV_PREFIX)) {
-				resetLogger.Debugf("FROM DEVICE: %s\n", output) // We don't really need all 32k bytes
-				resetLogger.Debugf("FROM DEVICE: Output size: %d\n", len(strings.TrimSpace(string(output))))
-				resetLogger.Debugf("FROM DEVICE: Output empty? %t\n", common.IsEmpty(output))
-				if common.IsEmpty(output) {
-					resetLogger.Debugf("TO DEVICE: %s\n", "\\r\\n")
-					_, err = port.Write([]byte("\r\n"))
-					if err != nil {
-						resetLogger.Fatalf("switches.Reset: Error while writing bytes to port: %s\n", err)
-					}
-				}
-				if strings.Contains(strings.ToLower(strings.TrimSpace(string(output[:]))), strings.ToLower(INITIAL_CONFIG_PROMPT)) {
-					//err = port.SetReadTimeout(1 * time.Second)
-					//if err != nil {
-					//	resetLogger.Fatalf("Error occurred while changing port timeout to back up config: %s\n", err)
-					//}
-
-					resetLogger.Debugf("TO DEVICE: %s\n", "no")
-					common.OutputInfo("Getting out of initial configuration dialog\n")
-					progress.CurrentStep += 1
-					_, err = port.Write(common.FormatCommand("no"))
-					if err != nil {
-						resetLogger.Fatalf("switches.Reset: Error while writing command to port: %s\n", err)
-					}
-				}
-				output, err = common.ReadLine(port, BUFFER_SIZE, debug)
-				if err != nil {
-					resetLogger.Fatalf("switches.Reset: Error while reading line: %s\n", err)
-				}
+	if restore {
+		step = session.Step("Restoring the switch's settings")
+		session.OutputInfo("Restoring the switch's settings\n")
+		commands := []string{"conf t"}
+		commands = append(commands, profile.Recovery.Restore...)
+		commands = append(commands, "end")
+		for i, command := range commands {
+			prompt := common.ConfigPrompt("config")
+			if i == len(commands)-1 {
+				prompt = common.PRIV_PROMPT
 			}
-			common.OutputInfo("Getting out of initial configuration dialog\n")
-			common.OutputInfo("We have booted up now\n")
-			progress.CurrentStep += 1
-			_, err = port.Write(common.FormatCommand(""))
+			_, err = session.Command(command, prompt)
 			if err != nil {
-				resetLogger.Fatalf("switches.Reset: Error while writing command to port: %s\n", err)
+				return result.Fail(step, fmt.Errorf("switches.Reset: %w", err))
 			}
-			line, err := common.ReadLine(port, BUFFER_SIZE, debug)
+		}
 
-			resetLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(line)))))
-			resetLogger.Debugf("INPUT: %s\n", "enable")
-			common.OutputInfo("Entering privileged exec.\n")
-			_, err = port.Write(common.FormatCommand("enable"))
+		// Erasing asks for confirmation, which gets answered for us
+		step = session.Step("Erasing the config")
+		for _, command := range profile.Recovery.Erase {
+			session.OutputInfo(fmt.Sprintf("INPUT: %s\n", command))
+			_, err = session.Command(command, common.PRIV_PROMPT)
 			if err != nil {
-				resetLogger.Fatalf("switches.Reset: Error while writing command to port: %s\n", err)
+				return result.Fail(step, fmt.Errorf("switches.Reset: %w", err))
 			}
-			line, err = common.ReadLine(port, BUFFER_SIZE, debug)
-
-			resetLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(line)))))
-
-			// Assign IP address
-			common.OutputInfo("Assigning vlan 1 an IP address")
-			common.OutputInfo(fmt.Sprintf("INPUT: %s\n", "conf t"))
-			_, err = port.Write(common.FormatCommand("conf t"))
-			line, err = common.ReadLine(port, BUFFER_SIZE, debug)
-			resetLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(line)))))
-			common.OutputInfo(fmt.Sprintf("INPUT: %s\n", "inter vlan 1"))
-			_, err = port.Write(common.FormatCommand("inter vlan 1"))
-			line, err = common.ReadLine(port, BUFFER_SIZE, debug)
-			resetLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(line)))))
+		}
+	}
 
-			// Make an educated guess if we should be using DHCP
-			if backup.Source == "" {
-				common.OutputInfo(fmt.Sprintf("INPUT: %s\n", "ip address dhcp"))
-				_, err = port.Write(common.FormatCommand("ip address dhcp"))
-				if err != nil {
-					resetLogger.Fatalf("switches.Reset: Error while sending DHCP to port: %s\n", err)
-				}
-			} else {
-				common.OutputInfo(fmt.Sprintf("INPUT: ip address %s %s\n", backup.Source, backup.SubnetMask))
-				_, err = port.Write(common.FormatCommand(fmt.Sprintf("ip address %s %s", backup.Source, backup.SubnetMask)))
-				if err != nil {
-					resetLogger.Fatal(err)
-				}
-			}
-			line, err = common.ReadLine(port, BUFFER_SIZE, debug)
-			resetLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(line)))))
-			common.OutputInfo(fmt.Sprintf("INPUT: %s\n", "end"))
-			_, err = port.Write(common.FormatCommand("end"))
-			if err != nil {
-				resetLogger.Fatal(err)
-			}
-			line, err = common.ReadLine(port, BUFFER_SIZE, debug)
-			resetLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(line)))))
+	session.OutputInfo("Successfully reset!\n")
+	if backup.Backup {
+		step = session.Step("Backing up the config")
 
-			// Begin copying files to TFTP server
-			common.OutputInfo(fmt.Sprintf("Copying %d files to %s.\n", len(files), backup.Destination))
+		// Have the built-in TFTP server take the backups in if chosen
+		if backup.UseBuiltIn {
 			for _, file := range files {
-				filename := fmt.Sprintf("%s-%s", backup.Prefix, file)
-				common.OutputInfo(fmt.Sprintf("Backing up file %s to %s.\n", filename, backup.Destination))
-				_, err = port.Write(common.FormatCommand(fmt.Sprintf("copy flash:%s tftp://%s/%s", filename, backup.Destination, filename)))
+				stopReceiving, err := common.ReceiveTftpFile(fmt.Sprintf("%s-%s", backup.Prefix, file))
 				if err != nil {
-					resetLogger.Fatal(err)
+					return result.Fail(step, fmt.Errorf("switches.Reset: %w", err))
 				}
-			}
-			if backup.UseBuiltIn {
-				closeTftpServer <- true
-			}
-		} else {
-			// Inform the user of the missing information
-			common.OutputInfo("Unable to back up configs to TFTP server as there are missing values\n")
-			if backup.Source == "" {
-				common.OutputInfo("Source address missing\n")
-			}
-			if backup.SubnetMask == "" {
-				common.OutputInfo("Subnet mask missing\n")
-			}
-			if backup.Destination == "" {
-				common.OutputInfo("Destination address missing\n")
+				defer stopReceiving()
 			}
 		}
-	}
 
-	dumpFile := os.Getenv("DumpConsoleOutput")
-	if dumpFile != "" {
-		file, err := os.OpenFile(dumpFile, os.O_RDWR|os.O_CREATE, 0644)
-		if err != nil {
-			resetLogger.Fatalf("Error while opening file %s to dump console outputs: %s\n", dumpFile, err)
+		commands := []struct {
+			command string
+			prompt  *regexp.Regexp
+		}{
+			{"conf t", common.ConfigPrompt("config")},
+			{"inter vlan 1", common.ConfigPrompt("config-if")},
+			// Make an educated guess if we should be using DHCP
+			{"ip address dhcp", common.ConfigPrompt("config-if")},
+			{"end", common.PRIV_PROMPT},
 		}
-
-		defer file.Close()
-
-		totalWritten := 0
-
-		for _, line := range consoleOutput {
-			written, err := file.Write(line)
+		if backup.Source != "" {
+			commands[2].command = fmt.Sprintf("ip address %s %s", backup.Source, backup.SubnetMask)
+		}
+		session.OutputInfo("Assigning vlan 1 an IP address\n")
+		for _, command := range commands {
+			session.OutputInfo(fmt.Sprintf("INPUT: %s\n", command.command))
+			_, err = session.Command(command.command, command.prompt)
 			if err != nil {
-				resetLogger.Fatalf("Error while writing %v to %s: %s\n", line, dumpFile, err)
+				return result.Fail(step, fmt.Errorf("switches.Reset: Error while assigning vlan 1 an IP address: %w", err))
 			}
-			totalWritten += written
-		}
-
-		common.OutputInfo(fmt.Sprintf("Wrote %d bytes to %s\n", totalWritten, dumpFile))
-	}
-
-	// Send clue that we're at the end
-	common.OutputInfo("---EOF---")
-}
-
-func Defaults(SerialPort string, PortSettings serial.Mode, config SwitchConfig, debug bool, updateChan chan bool) {
-	LoggerName = fmt.Sprintf("SwitchDefaults%s%d%d%d", SerialPort, PortSettings.BaudRate, PortSettings.StopBits, PortSettings.DataBits)
-	defaultsLogger := crglogging.New(LoggerName)
-
-	var progress common.Progress
-	progress.TotalSteps = 2
-	progress.CurrentStep = 0
-	progress.TotalSteps += (len(config.Lines) * 5) + 1 + (len(config.Ports) * 4) + 1 + (len(config.Vlans) * 3) + 1
-	if len(config.EnablePassword) != 0 {
-		progress.TotalSteps += 1
-	}
-	if len(config.ConsolePassword) != 0 {
-		progress.TotalSteps += 1
-	}
-	if len(config.Banner) != 0 {
-		progress.TotalSteps += 1
-	}
-	if len(config.DomainName) != 0 {
-		progress.TotalSteps += 1
-	}
-	if len(config.Hostname) != 0 {
-		progress.TotalSteps += 1
-	}
-	if config.Ssh.Enable && len(config.Ssh.Password) != 0 && len(config.Ssh.Username) != 0 && len(config.Ssh.Login) != 0 && len(config.Hostname) != 0 && len(config.DomainName) != 0 && config.Ssh.Bits != 0 {
-		progress.TotalSteps += 3
-	}
-
-	if updateChan != nil {
-		common.SetOutputChannel(updateChan, LoggerName)
-	}
-
-	if debug {
-		defaultsLogger.SetLogLevel(5)
-	} else {
-		defaultsLogger.SetLogLevel(4)
-	}
-
-	hostname := "Switch"
-	prompt := hostname + ">"
-
-	port, err := serial.Open(SerialPort, &PortSettings)
-
-	if err != nil {
-		defaultsLogger.Fatal(err)
-	}
-
-	defer func(port serial.Port) {
-		err := port.Close()
-		if err != nil {
-			defaultsLogger.Fatal(err)
 		}
-	}(port)
-
-	common.SetReaderPort(port)
-
-	defaultsLogger.Infoln("Waiting for the switch to startup")
 
-	// Try to guess if we've started yet
-	output, err := common.ReadLine(port, BUFFER_SIZE, debug)
-	for !strings.HasSuffix(strings.ToLower(strings.TrimSpace(string(output[:]))), strings.ToLower(prompt)) {
-		defaultsLogger.Debugf("FROM DEVICE: %s\n", output) // We don't really need all 32k bytes
-		defaultsLogger.Debugf("FROM DEVICE: Output size: %d\n", len(strings.TrimSpace(string(output))))
-		defaultsLogger.Debugf("FROM DEVICE: Output empty? %t\n", common.IsEmpty(output))
-		common.WriteLine(port, "", debug)
-
-		// Sometimes this'll pop up, sometimes this won't, so we can't test exclusively on this
-		if strings.Contains(strings.ToLower(strings.TrimSpace(string(output[:]))), strings.ToLower("Would you like to enter the initial configuration dialog? [yes/no]:")) {
-			defaultsLogger.Debugf(fmt.Sprintf("TO DEVICE: %s\n", "no"))
-			defaultsLogger.Infof("Getting out of initial configuration dialog\n")
-			progress.CurrentStep += 1
-			_, err = port.Write(common.FormatCommand("no"))
+		// Begin copying files to TFTP server, accepting the suggested host and file names
+		session.OutputInfo(fmt.Sprintf("Copying %d files to %s.\n", len(files), backup.Destination))
+		for _, file := range files {
+			filename := fmt.Sprintf("%s-%s", backup.Prefix, file)
+			session.OutputInfo(fmt.Sprintf("Backing up file %s to %s.\n", filename, backup.Destination))
+			url := fmt.Sprintf("tftp://%s/%s", backup.Destination, filename)
+			match, err := session.Command(fmt.Sprintf("copy flash:%s %s", filename, url),
+				common.PRIV_PROMPT, common.Answer(common.Prompt("]?"), session, ""))
 			if err != nil {
-				defaultsLogger.Fatal(err)
+				return result.Fail(step, fmt.Errorf("switches.Reset: Error while backing up %s: %w", filename, err))
 			}
+			for _, line := range match.Lines {
+				if strings.HasPrefix(line, "%Error") {
+					return result.Fail(step, fmt.Errorf("switches.Reset: Error while backing up %s: %s", filename, line))
+				}
+			}
+			result.Backups = append(result.Backups, url)
 		}
-		output, err = common.ReadLine(port, BUFFER_SIZE, debug)
-		if err != nil {
-			defaultsLogger.Fatalf("switches.Defaults: Error while reading line: %s\n", err)
-		}
-	}
-
-	err = port.SetReadTimeout(1 * time.Second)
-	if err != nil {
-		defaultsLogger.Fatal(err)
 	}
+	session.FinishSteps()
+	resetLogger.Debugf("Reset finished with %d files deleted and %d backups\n", len(result.FilesDeleted), len(result.Backups))
 
-	defaultsLogger.Info("We have booted up now\n")
-	progress.CurrentStep += 1
-	_, err = port.Write(common.FormatCommand(""))
+	err = session.WriteTranscript()
 	if err != nil {
-		defaultsLogger.Fatal(err)
+		return result.Fail("Dumping console output", err)
 	}
-	line, err := common.ReadLine(port, BUFFER_SIZE, debug)
 
-	defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(line)))))
-	defaultsLogger.Debugf("INPUT: %s\n", "enable")
+	return result.Succeed()
+}
 
-	// Elevate our privileges so we can run practical configuration commands
-	defaultsLogger.Info("Entering privileged exec.\n")
-	_, err = port.Write(common.FormatCommand("enable"))
-	if err != nil {
-		defaultsLogger.Fatal(err)
-	}
-	prompt = hostname + "#"
-	line, err = common.ReadLine(port, BUFFER_SIZE, debug)
-
-	defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(line)))))
-	defaultsLogger.Debugf("INPUT: %s\n", "conf t")
-	defaultsLogger.Info("Entering global configuration mode for the switch\n")
-	progress.CurrentStep += 1
-	_, err = port.Write(common.FormatCommand("conf t"))
-	if err != nil {
-		defaultsLogger.Fatal(err)
-	}
-	prompt = hostname + "(config)#"
+// sshBits fits the requested key size into what IOS 12.2 allows
+func sshBits(rendered *common.RenderedConfig, bits int) int {
+	if bits > 0 && bits < 360 {
+		rendered.Warn("Requested bit setting of %d is too low, defaulting to 360", bits)
+		return 360 // User presumably wanted minimum bit setting, 360 is minimum on IOS 12.2
+	} else if bits <= 0 {
+		return 512 // Accept default bit setting for non-provided values
+	} else if bits > 2048 {
+		rendered.Warn("Requested bit setting of %d is too high, defaulting to 2048", bits)
+		// User presumably wanted highest allowed bit setting, 2048 is max on IOS 12.2
+		// TODO: IOS 15 supports 4096 bit keys, can this get modified on the fly?
+		return 2048
+	}
+	return bits
+}
 
-	// Begin setting up Vlans
-	if len(config.Vlans) > 0 {
-		for _, vlan := range config.Vlans {
-			defaultsLogger.Infof("Configuring vlan %d\n", vlan.Vlan)
-			progress.CurrentStep += 1
+// Render turns config into the commands Defaults sends, without needing a switch. profile is only used for how many
+// lines the model has.
+func Render(profile common.Profile, config SwitchConfig) (common.RenderedConfig, error) {
+	var rendered common.RenderedConfig
 
-			defaultsLogger.Debugf("INPUT: %s\n", "inter vlan "+strconv.Itoa(vlan.Vlan))
-			_, err = port.Write(common.FormatCommand("inter vlan " + strconv.Itoa(vlan.Vlan)))
-			if err != nil {
-				defaultsLogger.Fatal(err)
-			}
-			line, err = common.ReadLine(port, BUFFER_SIZE, debug)
-			defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(line)))))
-
-			prompt = hostname + "(config-if)#"
-
-			// Assign a static IP
-			// TODO: handle DHCP
-			if vlan.IpAddress != "" && vlan.SubnetMask != "" {
-				defaultsLogger.Infof("Assigning IP address %s with subnet mask %s to vlan %d\n", vlan.IpAddress, vlan.SubnetMask, vlan.Vlan)
-				progress.CurrentStep += 1
-				defaultsLogger.Debugf("INPUT: %s\n", "ip addr "+vlan.IpAddress+" "+vlan.SubnetMask)
-				_, err = port.Write(common.FormatCommand("ip addr " + vlan.IpAddress + " " + vlan.SubnetMask))
-				if err != nil {
-					defaultsLogger.Fatal(err)
-				}
-				line, err = common.ReadLine(port, BUFFER_SIZE, debug)
-				defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(line)))))
-			}
+	step := "Entering global configuration"
+	rendered.Add(step, "conf t", common.MODE_CONFIG)
 
-			// Is this redundant?
-			if vlan.Shutdown {
-				defaultsLogger.Infof("Shutting down vlan %d\n", vlan.Vlan)
-				progress.CurrentStep += 1
-				defaultsLogger.Debugf("INPUT: %s\n", "shutdown")
-				_, err = port.Write(common.FormatCommand("shutdown"))
-				if err != nil {
-					defaultsLogger.Fatal(err)
-				}
-			} else {
-				defaultsLogger.Infof("Bringing up vlan %d\n", vlan.Vlan)
-				progress.CurrentStep += 1
-				defaultsLogger.Debugf("INPUT: %s\n", "no shutdown")
-				_, err = port.Write(common.FormatCommand("no shutdown"))
-				if err != nil {
-					defaultsLogger.Fatal(err)
-				}
-			}
-			line, err = common.ReadLine(port, BUFFER_SIZE, debug)
-			defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(line)))))
+	// Begin setting up Vlans
+	for _, vlan := range config.Vlans {
+		step = fmt.Sprintf("Configuring vlan %d", vlan.Vlan)
+		rendered.Add(step, "inter vlan "+strconv.Itoa(vlan.Vlan), common.MODE_INTERFACE)
 
-			defaultsLogger.Infof("Finished configuring vlan %d\n", vlan.Vlan)
-			defaultsLogger.Debugf("INPUT: %s\n", "exit")
-			_, err = port.Write(common.FormatCommand("exit"))
-			if err != nil {
-				defaultsLogger.Fatal(err)
-			}
-			line, err = common.ReadLine(port, BUFFER_SIZE, debug)
-			defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(line)))))
+		// Assign a static IP
+		// TODO: handle DHCP
+		if vlan.IpAddress != "" && vlan.SubnetMask != "" {
+			rendered.Add(step, "ip addr "+vlan.IpAddress+" "+vlan.SubnetMask, common.MODE_INTERFACE)
+		}
 
-			prompt = hostname + "(config)#"
+		// Is this redundant?
+		if vlan.Shutdown {
+			rendered.Add(step, "shutdown", common.MODE_INTERFACE)
+		} else {
+			rendered.Add(step, "no shutdown", common.MODE_INTERFACE)
 		}
-		defaultsLogger.Info("Finished configuring vlans\n")
+		rendered.Add(step, "exit", common.MODE_CONFIG)
 	}
 
 	// Configure our physical ports
-	if len(config.Ports) != 0 {
-		for _, switchPort := range config.Ports {
-			defaultsLogger.Infof("Configuring port %s\n", switchPort.Port)
-			progress.CurrentStep += 1
-
-			defaultsLogger.Debugf("INPUT: %s\n", "inter "+switchPort.Port)
-			_, err = port.Write(common.FormatCommand("inter " + switchPort.Port))
-			if err != nil {
-				defaultsLogger.Fatal(err)
-			}
-			line, err = common.ReadLine(port, BUFFER_SIZE, debug)
-			defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(line)))))
-			prompt = hostname + "(config-if)#"
-
-			// Setting intended functionality
-			if switchPort.SwitchportMode != "" {
-				defaultsLogger.Infof("Setting the switchport mode on port %s to %s\n", switchPort.Port, switchPort.SwitchportMode)
-				progress.CurrentStep += 1
-
-				defaultsLogger.Debugf("INPUT: %s\n", "switchport mode "+switchPort.SwitchportMode)
-				_, err = port.Write(common.FormatCommand("switchport mode " + switchPort.SwitchportMode))
-				if err != nil {
-					defaultsLogger.Fatal(err)
-				}
-				line, err = common.ReadLine(port, BUFFER_SIZE, debug)
-				defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(line)))))
-			}
+	for _, switchPort := range config.Ports {
+		step = fmt.Sprintf("Configuring port %s", switchPort.Port)
+		rendered.Add(step, "inter "+switchPort.Port, common.MODE_INTERFACE)
 
-			// Set the intended vlan
-			// TODO: Possible voice vlan stuff? Should this just get pawned off to ansible?
-			if switchPort.Vlan != 0 && (strings.ToLower(switchPort.SwitchportMode) == "access" || strings.ToLower(switchPort.SwitchportMode) == "trunk") {
-				if strings.ToLower(switchPort.SwitchportMode) == "access" {
-					defaultsLogger.Infof("Setting port %s to be an access port on vlan %d\n", switchPort.Port, switchPort.Vlan)
-					progress.CurrentStep += 1
-					defaultsLogger.Debugf("INPUT: %s\n", "switchport access vlan "+strconv.Itoa(switchPort.Vlan))
-					_, err = port.Write(common.FormatCommand("switchport access vlan " + strconv.Itoa(switchPort.Vlan)))
-					if err != nil {
-						defaultsLogger.Fatal(err)
-					}
-					line, err = common.ReadLine(port, BUFFER_SIZE, debug)
-					defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(line)))))
-				} else if strings.ToLower(switchPort.SwitchportMode) == "trunk" {
-					defaultsLogger.Infof("Setting port %s to be a trunk port with native vlan %d\n", switchPort.Port, switchPort.Vlan)
-					progress.CurrentStep += 1
-					defaultsLogger.Debugf("INPUT: %s\n", "switchport trunk native vlan "+strconv.Itoa(switchPort.Vlan))
-					_, err = port.Write(common.FormatCommand("switchport trunk native vlan " + strconv.Itoa(switchPort.Vlan)))
-					if err != nil {
-						defaultsLogger.Fatal(err)
-					}
-					line, err = common.ReadLine(port, BUFFER_SIZE, debug)
-					defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(line)))))
-				} else {
-					defaultsLogger.Infof("Switch port mode %s is not supported for static vlan assignment\n", switchPort.SwitchportMode)
-					progress.CurrentStep += 1
-				}
-			}
-
-			if switchPort.Shutdown {
-				defaultsLogger.Infof("Shutting down port %s\n", switchPort.Port)
-				progress.CurrentStep += 1
-				defaultsLogger.Debugf("INPUT: %s\n", "shutdown")
-				_, err = port.Write(common.FormatCommand("shutdown"))
-				if err != nil {
-					defaultsLogger.Fatal(err)
-				}
-				line, err = common.ReadLine(port, BUFFER_SIZE, debug)
-				defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(line)))))
-			} else {
-				defaultsLogger.Infof("Bringing up port %s\n", switchPort.Port)
-				progress.CurrentStep += 1
-				defaultsLogger.Debugf("INPUT: %s\n", "no shutdown")
-				_, err = port.Write(common.FormatCommand("no shutdown"))
-				if err != nil {
-					defaultsLogger.Fatal(err)
-				}
-				line, err = common.ReadLine(port, BUFFER_SIZE, debug)
-				defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(line)))))
-			}
+		// Setting intended functionality
+		if switchPort.SwitchportMode != "" {
+			rendered.Add(step, "switchport mode "+switchPort.SwitchportMode, common.MODE_INTERFACE)
+		}
 
-			defaultsLogger.Infof("Finished configuring port %s\n", switchPort.Port)
-			progress.CurrentStep += 1
-			defaultsLogger.Debugf("INPUT: %s\n", "exit")
-			_, err = port.Write(common.FormatCommand("exit"))
-			if err != nil {
-				defaultsLogger.Fatal(err)
+		// Set the intended vlan
+		// TODO: Possible voice vlan stuff? Should this just get pawned off to ansible?
+		if switchPort.Vlan != 0 {
+			switch strings.ToLower(switchPort.SwitchportMode) {
+			case "access":
+				rendered.Add(step, "switchport access vlan "+strconv.Itoa(switchPort.Vlan), common.MODE_INTERFACE)
+			case "trunk":
+				rendered.Add(step, "switchport trunk native vlan "+strconv.Itoa(switchPort.Vlan), common.MODE_INTERFACE)
+			default:
+				rendered.Warn("Port %s is on vlan %d but isn't an access or trunk port, so the vlan is left alone", switchPort.Port, switchPort.Vlan)
 			}
-			line, err = common.ReadLine(port, BUFFER_SIZE, debug)
-			defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(line)))))
+		}
 
-			prompt = hostname + "(config)#"
+		if switchPort.Shutdown {
+			rendered.Add(step, "shutdown", common.MODE_INTERFACE)
+		} else {
+			rendered.Add(step, "no shutdown", common.MODE_INTERFACE)
 		}
-		defaultsLogger.Info("Finished configuring ports\n")
-		progress.CurrentStep += 1
+		rendered.Add(step, "exit", common.MODE_CONFIG)
 	}
 
-	// Set up the banner
 	if config.Banner != "" {
-		defaultsLogger.Infof("Setting the banner to %s\n", config.Banner)
-		progress.CurrentStep += 1
-		defaultsLogger.Debugf("INPUT: %s\n", "banner motd \""+config.Banner+"\"")
-		_, err = port.Write(common.FormatCommand("banner motd \"" + config.Banner + "\""))
-		if err != nil {
-			defaultsLogger.Fatal(err)
-		}
-		line, err = common.ReadLine(port, BUFFER_SIZE, debug)
-		defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(line)))))
+		rendered.Add("Setting the banner", "banner motd \""+config.Banner+"\"", common.MODE_CONFIG)
 	}
 
 	// Set up the console password (old templates only)
 	if config.Version < 0.02 && config.ConsolePassword != "" {
-		defaultsLogger.Infof("Setting the console password to %s\n", config.ConsolePassword)
-		progress.CurrentStep += 1
-		defaultsLogger.Debugf("INPUT: %s\n", "line console 0")
-		_, err = port.Write(common.FormatCommand("line console 0"))
-		if err != nil {
-			defaultsLogger.Fatal(err)
-		}
-		line, err = common.ReadLine(port, BUFFER_SIZE, debug)
-		defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(line)))))
-		prompt = hostname + "(config-line)#"
-
-		defaultsLogger.Debugf("INPUT: %s\n", "password "+config.ConsolePassword)
-		_, err = port.Write(common.FormatCommand("password " + config.ConsolePassword))
-		if err != nil {
-			defaultsLogger.Fatal(err)
-		}
-		line, err = common.ReadLine(port, BUFFER_SIZE, debug)
-		defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(line)))))
-
-		defaultsLogger.Info("Enabling login on the console port\n")
-		progress.CurrentStep += 1
-		defaultsLogger.Debugf("INPUT: %s\n", "login ")
-		_, err = port.Write(common.FormatCommand("login"))
-		if err != nil {
-			defaultsLogger.Fatal(err)
-		}
-		line, err = common.ReadLine(port, BUFFER_SIZE, debug)
-		defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(line)))))
-		defaultsLogger.Debugf("INPUT: %s\n", "exit")
-		_, err = port.Write(common.FormatCommand("exit"))
-		if err != nil {
-			defaultsLogger.Fatal(err)
-		}
-		line, err = common.ReadLine(port, BUFFER_SIZE, debug)
-		defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(line)))))
-		prompt = hostname + "(config)#"
-
-		defaultsLogger.Info("Finished configuring the console port\n")
+		step = "Setting the console password"
+		rendered.Add(step, "line console 0", common.MODE_LINE)
+		rendered.Add(step, "password "+config.ConsolePassword, common.MODE_LINE)
+		rendered.Add(step, "login", common.MODE_LINE)
+		rendered.Add(step, "exit", common.MODE_CONFIG)
 	}
 
 	// Enable password, defaulting to a secret rather than plain text
 	// TODO: Should plain text enable passwords be allowed? Our console passwords are plain text
 	if config.EnablePassword != "" {
-		defaultsLogger.Infof("Setting the privileged exec password to %s\n", config.EnablePassword)
-		progress.CurrentStep += 1
-		defaultsLogger.Debugf("INPUT: %s\n", "enable secret "+config.EnablePassword)
-		_, err = port.Write(common.FormatCommand("enable secret " + config.EnablePassword))
-		if err != nil {
-			defaultsLogger.Fatal(err)
-		}
-		line, err = common.ReadLine(port, BUFFER_SIZE, debug)
-		defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(line)))))
-		defaultsLogger.Info("Finished setting the privileged exec password\n")
+		rendered.Add("Setting the enable password", "enable secret "+config.EnablePassword, common.MODE_CONFIG)
 	}
 
 	// Default gateway
 	// TODO: Probably redundant if/when DHCP gets set up, logically speaking could get moved up near vlan configuration
 	if config.DefaultGateway != "" {
-		defaultsLogger.Infof("Setting the default gateway to %s\n", config.DefaultGateway)
-		defaultsLogger.Debugf("INPUT: %s\n", "ip default-gateway "+config.DefaultGateway)
-		_, err = port.Write(common.FormatCommand("ip default-gateway " + config.DefaultGateway))
-		if err != nil {
-			defaultsLogger.Fatal(err)
-		}
-		line, err = common.ReadLine(port, BUFFER_SIZE, debug)
-		defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(line)))))
-		defaultsLogger.Info("Finished setting the default gateway\n")
+		rendered.Add("Setting the default gateway", "ip default-gateway "+config.DefaultGateway, common.MODE_CONFIG)
 	}
 
-	// Hostname configuration
 	if config.Hostname != "" {
-		defaultsLogger.Infof("Setting the hostname to %s\n", config.Hostname)
-		defaultsLogger.Debugf("INPUT: %s\n", "hostname "+config.Hostname)
-		_, err = port.Write(common.FormatCommand("hostname " + config.Hostname))
-		if err != nil {
-			defaultsLogger.Fatal(err)
-		}
-		line, err = common.ReadLine(port, BUFFER_SIZE, debug)
-		defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(line)))))
-		hostname = config.Hostname
-		prompt = hostname + "(config)#"
-
-		defaultsLogger.Info("Finished setting the hostname.\n")
+		rendered.Add("Setting the hostname", "hostname "+config.Hostname, common.MODE_CONFIG)
 	}
 
-	// Domain name configuration
 	// TODO: Should any sort of validation be done for this? Or do we just want to make the switch responsible for this?
 	if config.DomainName != "" {
-		defaultsLogger.Infof("Setting the domain name of the switch to %s\n", config.DomainName)
-		defaultsLogger.Debugf("INPUT: %s\n", "ip domain-name "+config.DomainName)
-		_, err = port.Write(common.FormatCommand("ip domain-name " + config.DomainName))
-		if err != nil {
-			defaultsLogger.Fatal(err)
-		}
-		line, err = common.ReadLine(port, BUFFER_SIZE, debug)
-		defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(line)))))
-		defaultsLogger.Info("Finished setting the domain name.\n")
+		rendered.Add("Setting the domain name", "ip domain-name "+config.DomainName, common.MODE_CONFIG)
 	}
 
 	if config.Ssh.Enable {
-		allowSSH := true
 		// Ensure SSH prereqs are met
+		var missing []string
 		if config.Ssh.Username == "" {
-			defaultsLogger.Info("WARNING: SSH username not specified.\n")
-			allowSSH = false
+			missing = append(missing, "SSH username")
 		}
 		if config.Ssh.Password == "" {
-			defaultsLogger.Info("WARNING: SSH password not specified.\n")
-			allowSSH = false
+			missing = append(missing, "SSH password")
 		}
 		if config.DomainName == "" {
-			defaultsLogger.Info("WARNING: Domain name not specified.\n")
-			allowSSH = false
+			missing = append(missing, "domain name")
 		}
 		if config.Hostname == "" {
-			defaultsLogger.Info("WARNING: Hostname not specified.\n")
-			allowSSH = false
+			missing = append(missing, "hostname")
 		}
 
-		// Prereqs are met, so we can proceed
-		if allowSSH {
-			defaultsLogger.Infof("Enabling SSH with username %s and password %s\n", config.Ssh.Username, config.Ssh.Password)
-			progress.CurrentStep += 1
-			defaultsLogger.Debugf("INPUT: %s\n", "username "+config.Ssh.Username+" password "+config.Ssh.Password)
-			_, err = port.Write(common.FormatCommand("username " + config.Ssh.Username + " password " + config.Ssh.Password))
-			if err != nil {
-				defaultsLogger.Fatal(err)
-			}
-			line, err = common.ReadLine(port, BUFFER_SIZE, debug)
-			defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(line)))))
+		if len(missing) > 0 {
+			rendered.Warn("SSH isn't being set up without a %s", strings.Join(missing, ", "))
+		} else {
+			step = "Setting up SSH"
+			rendered.Add(step, "username "+config.Ssh.Username+" password "+config.Ssh.Password, common.MODE_CONFIG)
+			// Generating the key can take a while, so the prompt takes a while to come back
+			rendered.Add(step, "crypto key gen rsa", common.MODE_CONFIG,
+				common.ConfigAnswer{Question: "How many bits in the modulus", Answer: strconv.Itoa(sshBits(&rendered, config.Ssh.Bits))},
+				common.ConfigAnswer{Question: "Do you really want to replace them? [yes/no]", Answer: "yes"})
+		}
+	}
 
-			defaultsLogger.Debugf("INPUT: %s\n", "crypto key gen rsa")
-			_, err = port.Write(common.FormatCommand("crypto key gen rsa"))
-			if err != nil {
-				defaultsLogger.Fatal(err)
-			}
-			line, err = common.ReadLine(port, BUFFER_SIZE, debug)
-			defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(line)))))
-
-			if config.Ssh.Bits > 0 && config.Ssh.Bits < 360 {
-				defaultsLogger.Debugf("DEBUG: Requested bit setting of %d is too low, defaulting to 360\n", config.Ssh.Bits)
-				config.Ssh.Bits = 360 // User presumably wanted minimum bit setting, 360 is minimum on IOS 12.2
-			} else if config.Ssh.Bits <= 0 {
-				defaultsLogger.Debugf("DEBUG: Bit setting not provided, defaulting to 512\n")
-				config.Ssh.Bits = 512 // Accept default bit setting for non-provided values
-			} else if config.Ssh.Bits > 2048 {
-				defaultsLogger.Debugf("DEBUG: Requested bit setting of %d is too low, defaulting to 2048\n", config.Ssh.Bits)
-				// User presumably wanted highest allowed bit setting, 2048 is max on IOS 12.2
-				// TODO: IOS 15 supports 4096 bit keys, can this get modified on the fly?
-				config.Ssh.Bits = 2048
-			}
+	// Configure console lines
+	for _, line := range config.Lines {
+		if line.Type == "" {
+			continue
+		}
+		step = fmt.Sprintf("Configuring %s lines %d to %d", line.Type, line.StartLine, line.EndLine)
 
-			defaultsLogger.Infof("Generating an SSH key with %d bits big\n", config.Ssh.Bits)
-			progress.CurrentStep += 1
-			defaultsLogger.Debugf("INPUT: %s\n", strconv.Itoa(config.Ssh.Bits))
-			_, err = port.Write(common.FormatCommand(strconv.Itoa(config.Ssh.Bits)))
-			if err != nil {
-				defaultsLogger.Fatal(err)
-			}
-			line, err = common.ReadLine(port, BUFFER_SIZE, debug)
-			defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(line)))))
+		// Ensure both lines are within what the model has
+		if line.StartLine > profile.MaxVty {
+			rendered.Warn("Starting %s line of %d is invalid, defaulting back to %d", line.Type, line.StartLine, profile.MaxVty)
+			line.StartLine = profile.MaxVty
+		}
+		if line.EndLine > profile.MaxVty {
+			rendered.Warn("Ending %s line of %d is invalid, defaulting back to %d", line.Type, line.EndLine, profile.MaxVty)
+			line.EndLine = profile.MaxVty
+		}
 
-			// Previous command can take a while, so wait for the prompt
-			err = port.SetReadTimeout(10 * time.Second)
-			if err != nil {
-				defaultsLogger.Fatal(err)
-			}
-			output, err = common.ReadLine(port, BUFFER_SIZE, debug)
-			if err != nil {
-				defaultsLogger.Fatalf("switches.Reset: Error while reading line: %s\n", err)
-			}
-			for !strings.HasSuffix(strings.ToLower(strings.TrimSpace(string(output[:]))), strings.ToLower(prompt)) {
-				defaultsLogger.Debugf("FROM DEVICE: %s\n", output) // We don't really need all 32k bytes
-				defaultsLogger.Debugf("FROM DEVICE: Output size: %d\n", len(strings.TrimSpace(string(output))))
-				defaultsLogger.Debugf("FROM DEVICE: Output empty? %t\n", common.IsEmpty(output))
-				defaultsLogger.Debugf("DEBUG: Expected prompt: %s\n", strings.ToLower(prompt))
-				common.WriteLine(port, "", debug)
-				output, err = common.ReadLine(port, BUFFER_SIZE, debug)
-				if err != nil {
-					defaultsLogger.Fatalf("switches.Reset: Error while reading line: %s\n", err)
-				}
+		// Figure out line ranges
+		if line.StartLine == line.EndLine {
+			rendered.Add(step, "line "+line.Type+" "+strconv.Itoa(line.StartLine), common.MODE_LINE)
+		} else if line.StartLine < line.EndLine {
+			rendered.Add(step, "line "+line.Type+" "+strconv.Itoa(line.StartLine)+" "+strconv.Itoa(line.EndLine), common.MODE_LINE)
+		} else {
+			return rendered, &common.RenderError{Step: step, Err: fmt.Errorf("switches.Render: Start line %d is greater than end line %d", line.StartLine, line.EndLine)}
+		}
+
+		if line.Password != "" {
+			rendered.Add(step, "password "+line.Password, common.MODE_LINE)
+
+			// In case login type wasn't provided, set that.
+			if line.Login != "" && line.Type == "vty" {
+				line.Login = "local"
 			}
-			err = port.SetReadTimeout(1 * time.Second)
-			if err != nil {
-				defaultsLogger.Fatal(err)
+		}
+
+		// Set login method (empty string is valid for line console 0)
+		if line.Login != "" || (line.Type == "console" && line.Password != "") {
+			rendered.Add(step, "login "+line.Login, common.MODE_LINE)
+		}
+
+		if line.Transport != "" && line.Type == "vty" { // console 0 can't use telnet or ssh
+			rendered.Add(step, "transport input "+line.Transport, common.MODE_LINE)
+		}
+		rendered.Add(step, "exit", common.MODE_CONFIG)
+	}
+
+	rendered.Add("Leaving global configuration", "end", common.MODE_PRIV)
+	return rendered, nil
+}
+
+// sshSetUp reports whether Render sets up SSH for config, which it only does with everything SSH needs
+func sshSetUp(config SwitchConfig) bool {
+	return config.Ssh.Enable && config.Ssh.Username != "" && config.Ssh.Password != "" && config.DomainName != "" && config.Hostname != ""
+}
+
+// vlanPorts is a vlan from show vlan brief and the ports on it
+type vlanPorts struct {
+	Vlan  int
+	Ports []string
+}
+
+var VLAN_BRIEF_ROW = regexp.MustCompile(`^(\d+)\s+\S+\s+\S+\s*(.*)$`)
+
+// parseVlanBrief picks the vlans and their ports out of show vlan brief. Ports that don't fit on a vlan's row carry on
+// underneath it.
+func parseVlanBrief(lines []string) []vlanPorts {
+	var vlans []vlanPorts
+	for _, line := range lines {
+		var ports string
+		if match := VLAN_BRIEF_ROW.FindStringSubmatch(line); match != nil {
+			vlan, _ := strconv.Atoi(match[1])
+			vlans = append(vlans, vlanPorts{Vlan: vlan})
+			ports = match[2]
+		} else if len(vlans) > 0 && strings.Contains(line, "/") && !strings.HasPrefix(line, "----") {
+			ports = line
+		}
+		for _, port := range strings.Split(ports, ",") {
+			if port = strings.TrimSpace(port); port != "" {
+				vlans[len(vlans)-1].Ports = append(vlans[len(vlans)-1].Ports, port)
 			}
-			defaultsLogger.Info("Finished generating the SSH key.\n")
-			progress.CurrentStep += 1
 		}
 	}
+	return vlans
+}
 
-	// Configure console lines
-	if len(config.Lines) != 0 {
-		for _, line := range config.Lines {
-			if line.Type != "" {
-				defaultsLogger.Infof("Configuring %s lines %d to %d\n", line.Type, line.StartLine, line.EndLine)
-				progress.CurrentStep += 1
-				// Ensure both lines are <= 15
-				if line.StartLine > 15 {
-					defaultsLogger.Infof("Starting line of %d is invalid, defaulting back to 15\n", line.StartLine)
-					line.StartLine = 15
-				}
-				if line.EndLine > 15 {
-					defaultsLogger.Infof("Ending line of %d is invalid, defaulting back to 15\n", line.EndLine)
-					line.EndLine = 15
-				}
+// Parse reads show running-config and show vlan brief back into the settings they show. Passwords are as IOS shows
+// them, which is usually hashed, and SSH counts as set up once there's a user to log in as.
+func Parse(running []string, vlanBrief []string) SwitchConfig {
+	shown := common.ParseShownConfig(running)
 
-				// Figure out line ranges
-				command := ""
-				if line.StartLine == line.EndLine { // Check if start line = end line
-					command = "line " + line.Type + " " + strconv.Itoa(line.StartLine)
-				} else if line.StartLine < line.EndLine { // Make sure starting line < end line
-					command = "line " + line.Type + " " + strconv.Itoa(line.StartLine) + " " + strconv.Itoa(line.EndLine)
-				} else { // Check if invalid ranges were given
-					defaultsLogger.Fatalln("Start line is greater than end line.")
-				}
-				defaultsLogger.Debugf("INPUT: %s\n", command)
-				_, err = port.Write(common.FormatCommand(command))
-				if err != nil {
-					defaultsLogger.Fatal(err)
-				}
-				defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(output)))))
-
-				prompt = hostname + "(config-line)#"
-				common.WaitForSubstring(port, prompt, debug)
-
-				// Set the line password
-				if line.Password != "" {
-					defaultsLogger.Infof("Setting the %s lines %d to %d password to %s\n", line.Type, line.StartLine, line.EndLine, line.Password)
-					progress.CurrentStep += 1
-					defaultsLogger.Debugf("INPUT: %s\n", "password "+line.Password)
-					_, err = port.Write(common.FormatCommand("password " + line.Password))
-					if err != nil {
-						defaultsLogger.Fatal(err)
-					}
-					defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(output)))))
+	var config SwitchConfig
+	config.Hostname, _ = common.ConfigValue(shown.Global, "hostname")
+	// Newer IOS shows ip domain-name as ip domain name
+	config.DomainName, _ = common.ConfigValue(shown.Global, "ip domain name", "ip domain-name")
+	config.DefaultGateway, _ = common.ConfigValue(shown.Global, "ip default-gateway")
+	config.EnablePassword, _ = common.ConfigValue(shown.Global, "enable secret")
+	banner, _ := common.ConfigValue(shown.Global, "banner motd")
+	config.Banner = common.BannerText(banner)
+	if user, found := common.ConfigValue(shown.Global, "username"); found && user != "" {
+		config.Ssh.Enable = true
+		config.Ssh.Username, config.Ssh.Password = common.UserPassword(user)
+	}
 
-					// In case login type wasn't provided, set that.
-					if line.Login != "" && line.Type == "vty" {
-						line.Login = "local"
-					}
-				}
+	for _, section := range shown.Sections {
+		name, isInterface := strings.CutPrefix(section.Header, "interface ")
+		if !isInterface {
+			continue
+		}
+		shutdown := common.HasCommand(section.Lines, "shutdown")
 
-				// Set login method (empty string is valid for line console 0)
-				if line.Login != "" || (line.Type == "console" && line.Password != "") {
-					defaultsLogger.Infof("Enabling login for %s lines %d to %d\n", line.Type, line.StartLine, line.EndLine)
-					progress.CurrentStep += 1
-					defaultsLogger.Debugf("INPUT: %s\n", "login "+line.Login)
-					_, err = port.Write(common.FormatCommand("login " + line.Login))
-					if err != nil {
-						defaultsLogger.Fatal(err)
-					}
-					output, err = common.ReadLine(port, BUFFER_SIZE, debug)
-					if err != nil {
-						defaultsLogger.Fatalf("switches.Defaults: Error while reading line: %s\n", err)
-					}
-					defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(output)))))
-				}
+		if number, isVlan := strings.CutPrefix(strings.ToLower(name), "vlan"); isVlan {
+			vlan := VlanConfig{Shutdown: shutdown}
+			vlan.Vlan, _ = strconv.Atoi(number)
+			address, _ := common.ConfigValue(section.Lines, "ip address")
+			if fields := strings.Fields(address); len(fields) == 2 {
+				vlan.IpAddress, vlan.SubnetMask = fields[0], fields[1]
+			}
+			config.Vlans = append(config.Vlans, vlan)
+			continue
+		}
 
-				if line.Transport != "" && line.Type == "vty" { // console 0 can't use telnet or ssh
-					defaultsLogger.Infof("Setting transport input for %s lines %d to %d to %s\n", line.Type, line.StartLine, line.EndLine, line.Transport)
-					progress.CurrentStep += 1
-					defaultsLogger.Debugf("INPUT: %s\n", "transport input "+line.Transport)
-					_, err = port.Write(common.FormatCommand("transport input " + line.Transport))
-					if err != nil {
-						defaultsLogger.Fatal(err)
-					}
-					output, err = common.ReadLine(port, BUFFER_SIZE, debug)
-					if err != nil {
-						defaultsLogger.Fatalf("switches.Defaults: Error while reading line: %s\n", err)
-					}
-					defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(output)))))
-				} else {
-					progress.TotalSteps -= 1
+		port := SwitchPortConfig{Port: name, Shutdown: shutdown, Vlan: 1}
+		port.SwitchportMode, _ = common.ConfigValue(section.Lines, "switchport mode")
+		vlan, found := common.ConfigValue(section.Lines, "switchport access vlan")
+		if strings.ToLower(port.SwitchportMode) == "trunk" {
+			vlan, found = common.ConfigValue(section.Lines, "switchport trunk native vlan")
+		}
+		if found {
+			port.Vlan, _ = strconv.Atoi(vlan)
+		}
+		config.Ports = append(config.Ports, port)
+	}
+
+	for _, line := range shown.Lines() {
+		config.Lines = append(config.Lines, LineConfig(line))
+	}
+
+	// Vlans without an interface of their own, and which vlan each access port really ended up on
+	for _, vlan := range parseVlanBrief(vlanBrief) {
+		if vlan.Vlan >= 1002 && vlan.Vlan <= 1005 {
+			continue
+		}
+		found := false
+		for _, existing := range config.Vlans {
+			found = found || existing.Vlan == vlan.Vlan
+		}
+		if !found {
+			config.Vlans = append(config.Vlans, VlanConfig{Vlan: vlan.Vlan})
+		}
+		for _, name := range vlan.Ports {
+			for i := range config.Ports {
+				if common.SameInterface(name, config.Ports[i].Port) && strings.ToLower(config.Ports[i].SwitchportMode) != "trunk" {
+					config.Ports[i].Vlan = vlan.Vlan
 				}
 			}
+		}
+	}
+	return config
+}
 
-			defaultsLogger.Infof("Finished configuring %s lines %d to %d\n", line.Type, line.StartLine, line.EndLine)
-			progress.CurrentStep += 1
+// Diff lists what in requested the switch doesn't have, going by actual, what Parse read back off it. Only what
+// Render would have sent is checked, so a port's vlan isn't unless it's an access or trunk port.
+func Diff(profile common.Profile, requested SwitchConfig, actual SwitchConfig) common.Differences {
+	var differences common.Differences
+	differences.Compare("Hostname", requested.Hostname, actual.Hostname)
+	differences.Compare("DomainName", requested.DomainName, actual.DomainName)
+	differences.Compare("DefaultGateway", requested.DefaultGateway, actual.DefaultGateway)
+	differences.Compare("EnablePassword", common.Secret(requested.EnablePassword), common.Secret(actual.EnablePassword))
+	differences.Compare("Banner", requested.Banner, actual.Banner)
+	if sshSetUp(requested) {
+		differences.Compare("Ssh.Username", requested.Ssh.Username, actual.Ssh.Username)
+	}
+
+	for _, vlan := range requested.Vlans {
+		setting := fmt.Sprintf("Vlans[%d]", vlan.Vlan)
+		var found *VlanConfig
+		for i := range actual.Vlans {
+			if actual.Vlans[i].Vlan == vlan.Vlan {
+				found = &actual.Vlans[i]
+				break
+			}
+		}
+		if found == nil {
+			differences.Missing(setting)
+			continue
+		}
+		if vlan.IpAddress != "" && vlan.SubnetMask != "" {
+			differences.Compare(setting+".IpAddress", vlan.IpAddress, found.IpAddress)
+			differences.Compare(setting+".SubnetMask", vlan.SubnetMask, found.SubnetMask)
+		}
+		differences.Compare(setting+".Shutdown", strconv.FormatBool(vlan.Shutdown), strconv.FormatBool(found.Shutdown))
+	}
 
-			defaultsLogger.Debugf("INPUT: %s\n", "exit")
-			_, err = port.Write(common.FormatCommand("exit"))
-			if err != nil {
-				defaultsLogger.Fatal(err)
+	for _, port := range requested.Ports {
+		setting := fmt.Sprintf("Ports[%s]", port.Port)
+		var found *SwitchPortConfig
+		for i := range actual.Ports {
+			if common.SameInterface(port.Port, actual.Ports[i].Port) {
+				found = &actual.Ports[i]
+				break
 			}
-			output, err = common.ReadLine(port, BUFFER_SIZE, debug)
-			if err != nil {
-				defaultsLogger.Fatalf("switches.Defaults: Error while reading line: %s\n", err)
+		}
+		if found == nil {
+			differences.Missing(setting)
+			continue
+		}
+		differences.Compare(setting+".SwitchportMode", port.SwitchportMode, found.SwitchportMode)
+		switch strings.ToLower(port.SwitchportMode) {
+		case "access", "trunk":
+			if port.Vlan != 0 {
+				differences.Compare(setting+".Vlan", strconv.Itoa(port.Vlan), strconv.Itoa(found.Vlan))
 			}
-			defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(output)))))
+		}
+		differences.Compare(setting+".Shutdown", strconv.FormatBool(port.Shutdown), strconv.FormatBool(found.Shutdown))
+	}
 
-			prompt = hostname + "(config)#"
-			common.WaitForSubstring(port, prompt, debug)
+	shownLines := make([]common.ConfigLine, len(actual.Lines))
+	for i, line := range actual.Lines {
+		shownLines[i] = common.ConfigLine(line)
+	}
+	if requested.Version < 0.02 && requested.ConsolePassword != "" {
+		differences.CompareLines(profile, common.ConfigLine{Type: "console", Password: requested.ConsolePassword}, shownLines)
+	}
+	for _, line := range requested.Lines {
+		differences.CompareLines(profile, common.ConfigLine(line), shownLines)
+	}
+	return differences
+}
 
+// check reads the running config and vlans back off the switch, failing if they aren't what config asked for
+func check(session *common.Session, profile common.Profile, config SwitchConfig) (common.Differences, error) {
+	running, err := common.RunningConfig(session)
+	if err != nil {
+		return nil, err
+	}
+	vlanBrief, err := common.ShowLines(session, "show vlan brief")
+	if err != nil {
+		return nil, err
+	}
+	differences := Diff(profile, config, Parse(running, vlanBrief))
+	return differences, differences.Err()
+}
+
+func Defaults(ctx context.Context, session *common.Session, profile common.Profile, config SwitchConfig, apply common.ApplyOptions) common.Result {
+	port := session.Port
+	defaultsLogger := session.Logger()
+
+	var result common.Result
+	step := "Waiting for the switch to start up"
+
+	// Worked out up front, so a config that can't be applied doesn't get partway onto the switch
+	rendered, err := Render(profile, config)
+	if err != nil {
+		var renderErr *common.RenderError
+		if errors.As(err, &renderErr) {
+			step = renderErr.Step
 		}
-		defaultsLogger.Info("Finished configuring console lines.\n")
-		progress.CurrentStep += 1
-		_, err = port.Write(common.FormatCommand("end"))
-		if err != nil {
-			defaultsLogger.Fatal(err)
-		}
-		output, err = common.ReadLine(port, BUFFER_SIZE, debug)
+		return result.Fail(step, err)
+	}
+	for _, warning := range rendered.Warnings {
+		defaultsLogger.Warningf("WARNING: %s\n", warning)
+	}
+	apply = apply.ForDevice(common.SWITCH)
+	err = apply.Check()
+	if err != nil {
+		return result.Fail(step, err)
+	}
+
+	ctx, cancel := common.WithTimeout(ctx, profile.Timeouts.Overall)
+	defer cancel()
+	defer session.EndPhase()
+	session.Phase(ctx, profile.Timeouts.Startup)
+
+	// Starting up, everything rendered, then checking it all went in
+	session.AddSteps(2 + apply.Steps(rendered))
+	session.Step(step)
+
+	err = port.SetReadTimeout(1 * time.Second)
+	if err != nil {
+		return result.Fail(step, err)
+	}
+
+	defaultsLogger.Infoln("Waiting for the switch to startup")
+
+	// The initial configuration dialog sometimes pops up on the way, which gets answered for us
+	match, err := session.Expect(common.Expect{Cases: []common.Case{
+		{Pattern: common.EXEC_PROMPT},
+		{Pattern: common.PRIV_PROMPT},
+	}, Nudge: true})
+	if err != nil {
+		return result.Fail(step, fmt.Errorf("switches.Defaults: Error while waiting for the switch to start up: %w", err))
+	}
+
+	defaultsLogger.Info("We have booted up now\n")
+
+	// Elevate our privileges so we can run practical configuration commands
+	step = session.Step("Entering global configuration")
+	session.Phase(ctx, profile.Timeouts.Commands)
+	if match.Case == 0 {
+		defaultsLogger.Info("Entering privileged exec.\n")
+		_, err = session.Command("enable", common.PRIV_PROMPT)
 		if err != nil {
-			defaultsLogger.Fatalf("switches.Reset: Error while reading line: %s\n", err)
+			return result.Fail(step, err)
 		}
-		defaultsLogger.Debugf("OUTPUT: %s\n", strings.ToLower(strings.TrimSpace(string(common.TrimNull(output)))))
 	}
 
+	rejectedBefore := len(session.CommandErrors())
+	step, err = apply.Apply(ctx, session, rendered, step)
+	result.CommandErrors = session.CommandErrors()[rejectedBefore:]
+	if err != nil {
+		return result.Fail(step, err)
+	}
+
+	step = session.Step("Checking the running config")
+	result.Differences, err = check(session, profile, config)
+	if err != nil {
+		return result.Fail(step, err)
+	}
+	session.FinishSteps()
+
 	defaultsLogger.Info("Settings applied!\n")
 	defaultsLogger.Info("Note: Settings have not been made persistent and will be lost upon reboot.\n")
 	defaultsLogger.Info("To fix this, run `wr` on the target device.\n") // Should this be ran automatically?
-	defaultsLogger.Info("---EOF---")
+
+	return result.Succeed()
 }
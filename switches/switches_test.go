@@ -1,15 +1,23 @@
 package switches
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/pin/tftp/v3"
 	"go.bug.st/serial"
 	"io"
 	"log"
 	"main/common"
 	"main/crglogging"
+	"main/simulator"
 	"math"
+	"net"
 	"os"
+	"path"
+	"reflect"
 	"runtime"
 	"strings"
 	"testing"
@@ -28,8 +36,8 @@ func getPortType() string {
 	return ""
 }
 
-func getLastLogLine() (string, error) {
-	logger := crglogging.GetLogger(LoggerName)
+func getLastLogLine(loggerName string) (string, error) {
+	logger := crglogging.GetLogger(loggerName)
 	contents, err := logger.GetMemLogContents("WebHandler")
 	if err != nil {
 		return "", fmt.Errorf("could not get memory contents. error: %s\n", err)
@@ -113,7 +121,12 @@ func TestReset(t *testing.T) {
 	}
 	for _, tt := range tests {
 		go t.Run(tt.name, func(t *testing.T) {
-			Reset(tt.args.SerialPort, tt.args.PortSettings, tt.args.backup, tt.args.debug, tt.args.progressDest)
+			port, err := common.OpenSerial(tt.args.SerialPort, tt.args.PortSettings)
+			if err != nil {
+				t.Fatalf("Error while opening port %s: %s", tt.args.SerialPort, err)
+			}
+			defer port.Close()
+			Reset(context.Background(), common.NewSession(port, tt.name, tt.args.progressDest, tt.args.debug), common.DefaultSwitchProfile(), tt.args.backup)
 		})
 
 		time.Sleep(5 * time.Second)
@@ -123,7 +136,7 @@ func TestReset(t *testing.T) {
 			canExit := false
 			select {
 			case _ = <-tt.args.progressDest:
-				msg, err := getLastLogLine()
+				msg, err := getLastLogLine(tt.name)
 				if err != nil {
 					t.Errorf("Error getting last log line: %s\n", err)
 				}
@@ -231,7 +244,12 @@ func TestDefaults(t *testing.T) {
 
 	for _, tt := range tests {
 		go t.Run(tt.name, func(t *testing.T) {
-			Defaults(tt.args.SerialPort, tt.args.PortSettings, tt.args.config, tt.args.debug, tt.args.progressDest)
+			port, err := common.OpenSerial(tt.args.SerialPort, tt.args.PortSettings)
+			if err != nil {
+				t.Fatalf("Error while opening port %s: %s", tt.args.SerialPort, err)
+			}
+			defer port.Close()
+			Defaults(context.Background(), common.NewSession(port, tt.name, tt.args.progressDest, tt.args.debug), common.DefaultSwitchProfile(), tt.args.config, common.ApplyOptions{})
 		})
 
 		time.Sleep(5 * time.Second)
@@ -242,7 +260,7 @@ func TestDefaults(t *testing.T) {
 			canExit := false
 			select {
 			case _ = <-tt.args.progressDest:
-				msg, err := getLastLogLine()
+				msg, err := getLastLogLine(tt.name)
 				if err != nil {
 					t.Errorf("Error getting last log line: %s\n", err)
 				}
@@ -371,7 +389,12 @@ func TestResetAndDefaults(t *testing.T) {
 
 	for _, tt := range tests {
 		go t.Run(tt.name, func(t *testing.T) {
-			Reset(tt.resetArgs.SerialPort, tt.resetArgs.PortSettings, tt.resetArgs.backup, tt.resetArgs.debug, tt.resetArgs.progressDest)
+			port, err := common.OpenSerial(tt.resetArgs.SerialPort, tt.resetArgs.PortSettings)
+			if err != nil {
+				t.Fatalf("Error while opening port %s: %s", tt.resetArgs.SerialPort, err)
+			}
+			defer port.Close()
+			Reset(context.Background(), common.NewSession(port, tt.name, tt.resetArgs.progressDest, tt.resetArgs.debug), common.DefaultSwitchProfile(), tt.resetArgs.backup)
 		})
 
 		time.Sleep(5 * time.Second)
@@ -382,7 +405,7 @@ func TestResetAndDefaults(t *testing.T) {
 			canExit := false
 			select {
 			case _ = <-tt.resetArgs.progressDest:
-				msg, err := getLastLogLine()
+				msg, err := getLastLogLine(tt.name)
 				if err != nil {
 					t.Errorf("Error getting last log line: %s\n", err)
 				}
@@ -403,13 +426,18 @@ func TestResetAndDefaults(t *testing.T) {
 		time.Sleep(5 * time.Second)
 
 		go t.Run(tt.name, func(t *testing.T) {
-			Defaults(tt.defaultsArgs.SerialPort, tt.defaultsArgs.PortSettings, tt.defaultsArgs.config, tt.defaultsArgs.debug, tt.defaultsArgs.progressDest)
+			port, err := common.OpenSerial(tt.defaultsArgs.SerialPort, tt.defaultsArgs.PortSettings)
+			if err != nil {
+				t.Fatalf("Error while opening port %s: %s", tt.defaultsArgs.SerialPort, err)
+			}
+			defer port.Close()
+			Defaults(context.Background(), common.NewSession(port, tt.name, tt.defaultsArgs.progressDest, tt.defaultsArgs.debug), common.DefaultSwitchProfile(), tt.defaultsArgs.config, common.ApplyOptions{})
 		})
 		for {
 			canExit := false
 			select {
 			case _ = <-tt.defaultsArgs.progressDest:
-				msg, err := getLastLogLine()
+				msg, err := getLastLogLine(tt.name)
 				if err != nil {
 					t.Errorf("Error getting last log line: %s\n", err)
 				}
@@ -429,3 +457,648 @@ func TestResetAndDefaults(t *testing.T) {
 		time.Sleep(5 * time.Second)
 	}
 }
+
+func TestResetAndDefaultsSimulated(t *testing.T) {
+	if os.Getenv("SKIP_RESET_TESTS") != "" {
+		t.Skip("Skipping all reset tests")
+	}
+
+	defaults := SwitchConfig{
+		Version: 0.02,
+		Vlans: []VlanConfig{
+			{Vlan: 1, IpAddress: "192.168.1.2", SubnetMask: "255.255.255.0"},
+		},
+		Ports: []SwitchPortConfig{
+			{Port: "Fa0/1", SwitchportMode: "access", Vlan: 10},
+			{Port: "Gi0/1", SwitchportMode: "trunk", Vlan: 1},
+		},
+		Lines: []LineConfig{
+			{Type: "vty", StartLine: 0, EndLine: 15, Login: "local", Transport: "ssh"},
+		},
+		Ssh:            SshConfig{Enable: true, Username: "admin", Password: "cisco", Bits: 2048},
+		EnablePassword: "class",
+		Banner:         "Authorized access only",
+		Hostname:       "S1",
+		DomainName:     "example.com",
+		DefaultGateway: "192.168.1.254",
+	}
+
+	device := simulator.NewSwitch("sim-2960")
+	device.ModeHeld = true
+	defer device.Close()
+
+	progress := make(chan bool)
+	go func() {
+		for range progress {
+		}
+	}()
+
+	session := common.NewSession(device, t.Name(), progress, testing.Verbose())
+
+	var resetResult, defaultsResult common.Result
+	done := make(chan bool)
+	go func() {
+		device.PowerOn()
+		resetResult = Reset(context.Background(), session, common.DefaultSwitchProfile(), common.Backup{})
+		if resetResult.Success {
+			defaultsResult = Defaults(context.Background(), session, common.DefaultSwitchProfile(), defaults, common.ApplyOptions{})
+		}
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Minute):
+		t.Fatalf("Reset and defaults against the simulated switch timed out. Received: %q", device.Received())
+	}
+
+	if !resetResult.Success {
+		t.Fatalf("Reset failed while %s: %s", resetResult.FailedStep, resetResult.Err)
+	}
+	if !defaultsResult.Success {
+		t.Fatalf("Defaults failed while %s: %s", defaultsResult.FailedStep, defaultsResult.Err)
+	}
+	t.Logf("Files deleted: %v", resetResult.FilesDeleted)
+	for _, expected := range []string{"config.text", "vlan.dat"} {
+		found := false
+		for _, file := range resetResult.FilesDeleted {
+			if file == expected {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Files deleted %v is missing %s", resetResult.FilesDeleted, expected)
+		}
+	}
+
+	for _, file := range device.Files {
+		if strings.Contains(file.Name, "config") || strings.Contains(file.Name, "vlan") {
+			t.Errorf("%s was left in flash after the reset", file.Name)
+		}
+	}
+
+	config := device.RunningConfig()
+	for _, expected := range []string{
+		"hostname S1",
+		"enable secret class",
+		"ip domain-name example.com",
+		"ip default-gateway 192.168.1.254",
+		"username admin password cisco",
+		"interface Vlan1",
+		" ip addr 192.168.1.2 255.255.255.0",
+		"interface FastEthernet0/1",
+		" switchport access vlan 10",
+		"interface GigabitEthernet0/1",
+		" switchport trunk native vlan 1",
+		"line vty 0 15",
+		" transport input ssh",
+	} {
+		if !strings.Contains(config, expected+"\n") {
+			t.Errorf("Running config is missing %q:\n%s", expected, config)
+		}
+	}
+	if strings.Contains(config, "OldSwitch") {
+		t.Errorf("Running config still contains the old configuration:\n%s", config)
+	}
+
+	steps := session.Progress()
+	if steps.Percent() != 100 {
+		t.Errorf("Progress is at %d%%, %d of %d steps", steps.Percent(), steps.CurrentStep, steps.TotalSteps)
+	}
+	names := make([]string, 0, len(steps.Steps))
+	for _, step := range steps.Steps {
+		if step.Finished.IsZero() {
+			t.Errorf("Step %q never finished", step.Name)
+		}
+		names = append(names, step.Name)
+	}
+	for _, expected := range []string{"Deleting vlan.dat", "Configuring vlan 1", "Configuring port Gi0/1", "Configuring vty lines 0 to 15"} {
+		if !strings.Contains(strings.Join(names, "\n")+"\n", expected+"\n") {
+			t.Errorf("Steps %q are missing %q", names, expected)
+		}
+	}
+}
+
+func TestDefaultsInvalidLineRange(t *testing.T) {
+	device := simulator.NewSwitch("sim-2960")
+	defer device.Close()
+
+	// Boot straight into the configuration dialog
+	var files []simulator.File
+	for _, file := range device.Files {
+		if file.Name != "config.text" {
+			files = append(files, file)
+		}
+	}
+	device.Files = files
+
+	results := make(chan common.Result, 1)
+	go func() {
+		device.PowerOn()
+		results <- Defaults(context.Background(), common.NewSession(device, t.Name(), nil, testing.Verbose()), common.DefaultSwitchProfile(), SwitchConfig{Lines: []LineConfig{{Type: "vty", StartLine: 10, EndLine: 4}}}, common.ApplyOptions{})
+	}()
+
+	select {
+	case result := <-results:
+		if result.Success {
+			t.Fatalf("Defaults succeeded with a start line greater than the end line")
+		}
+		if result.FailedStep != "Configuring vty lines 10 to 4" {
+			t.Errorf("FailedStep = %q, want %q", result.FailedStep, "Configuring vty lines 10 to 4")
+		}
+		if result.Err == nil || !strings.Contains(result.Err.Error(), "Start line 10 is greater than end line 4") {
+			t.Errorf("Err = %v, want the invalid line range", result.Err)
+		}
+	case <-time.After(time.Minute):
+		t.Fatalf("Defaults against the simulated switch timed out. Received: %q", device.Received())
+	}
+}
+
+func TestRender(t *testing.T) {
+	config := SwitchConfig{
+		Version: 0.02,
+		Vlans:   []VlanConfig{{Vlan: 1, IpAddress: "192.168.1.2", SubnetMask: "255.255.255.0"}},
+		Ports: []SwitchPortConfig{
+			{Port: "Fa0/1", SwitchportMode: "access", Vlan: 10},
+			{Port: "Fa0/2", Vlan: 20, Shutdown: true},
+		},
+		Lines:          []LineConfig{{Type: "vty", StartLine: 0, EndLine: 20, Login: "local", Transport: "ssh"}},
+		Ssh:            SshConfig{Enable: true, Username: "admin", Password: "cisco", Bits: 100},
+		EnablePassword: "class",
+		Hostname:       "S1",
+		DomainName:     "example.com",
+	}
+
+	rendered, err := Render(common.DefaultSwitchProfile(), config)
+	if err != nil {
+		t.Fatalf("Render failed: %s", err)
+	}
+
+	expected := `! WARNING: Port Fa0/2 is on vlan 20 but isn't an access or trunk port, so the vlan is left alone
+! WARNING: Requested bit setting of 100 is too low, defaulting to 360
+! WARNING: Ending vty line of 20 is invalid, defaulting back to 15
+! Entering global configuration
+conf t
+! Configuring vlan 1
+inter vlan 1
+ ip addr 192.168.1.2 255.255.255.0
+ no shutdown
+ exit
+! Configuring port Fa0/1
+inter Fa0/1
+ switchport mode access
+ switchport access vlan 10
+ no shutdown
+ exit
+! Configuring port Fa0/2
+inter Fa0/2
+ shutdown
+ exit
+! Setting the enable password
+enable secret class
+! Setting the hostname
+hostname S1
+! Setting the domain name
+ip domain-name example.com
+! Setting up SSH
+username admin password cisco
+crypto key gen rsa
+ ! How many bits in the modulus 360
+ ! Do you really want to replace them? [yes/no] yes
+! Configuring vty lines 0 to 20
+line vty 0 15
+ login local
+ transport input ssh
+ exit
+! Leaving global configuration
+end
+`
+	if rendered.String() != expected {
+		t.Errorf("Rendered config is\n%s\nwant\n%s", rendered, expected)
+	}
+	if rendered.Steps() != 10 {
+		t.Errorf("Steps = %d, want 10", rendered.Steps())
+	}
+
+	last := rendered.Commands[len(rendered.Commands)-1]
+	if last.Mode != common.MODE_CONFIG || last.Next != common.MODE_PRIV {
+		t.Errorf("Last command goes from %s to %s, want %s to %s", last.Mode, last.Next, common.MODE_CONFIG, common.MODE_PRIV)
+	}
+
+	// SSH needs a hostname for the key, so it's left out rather than failing on the switch
+	config.Hostname = ""
+	rendered, err = Render(common.DefaultSwitchProfile(), config)
+	if err != nil {
+		t.Fatalf("Render failed: %s", err)
+	}
+	if strings.Contains(rendered.String(), "crypto key gen rsa") {
+		t.Errorf("SSH was set up without a hostname:\n%s", rendered)
+	}
+	if !strings.Contains(rendered.String(), "! WARNING: SSH isn't being set up without a hostname\n") {
+		t.Errorf("Rendered config doesn't warn about the missing hostname:\n%s", rendered)
+	}
+}
+
+// fastConsole caps read timeouts the same way the simulator does, as the flows otherwise wait on each quiet read for
+// as long as they would on real hardware
+type fastConsole struct {
+	common.Transport
+}
+
+func (f fastConsole) SetReadTimeout(t time.Duration) error {
+	if t < 0 || t > 5*time.Millisecond {
+		t = 5 * time.Millisecond
+	}
+	return f.Transport.SetReadTimeout(t)
+}
+
+func TestResetOverTelnet(t *testing.T) {
+	if os.Getenv("SKIP_RESET_TESTS") != "" {
+		t.Skip("Skipping all reset tests")
+	}
+
+	device := simulator.NewSwitch("sim-2960")
+	device.ModeHeld = true
+	defer device.Close()
+
+	// Stand in for a terminal server's reverse telnet port
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error while listening: %s", err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		device.Serve(conn)
+		conn.Close()
+	}()
+
+	console, err := common.OpenConsole("telnet://"+listener.Addr().String(), common.DefaultMode())
+	if err != nil {
+		t.Fatalf("Error while opening console: %s", err)
+	}
+	defer console.Close()
+
+	results := make(chan common.Result, 1)
+	go func() {
+		device.PowerOn()
+		results <- Reset(context.Background(), common.NewSession(fastConsole{console}, t.Name(), nil, testing.Verbose()), common.DefaultSwitchProfile(), common.Backup{})
+	}()
+
+	select {
+	case result := <-results:
+		if !result.Success {
+			t.Fatalf("Reset failed while %s: %s", result.FailedStep, result.Err)
+		}
+	case <-time.After(2 * time.Minute):
+		t.Fatalf("Reset over telnet timed out. Received: %q", device.Received())
+	}
+}
+
+func TestResetCancelled(t *testing.T) {
+	device := simulator.NewSwitch("sim-2960")
+	device.ModeHeld = true
+	defer device.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	device.PowerOn()
+	result := Reset(ctx, common.NewSession(device, t.Name(), nil, testing.Verbose()), common.DefaultSwitchProfile(), common.Backup{})
+	if result.Success {
+		t.Fatalf("Reset succeeded after being cancelled")
+	}
+	if !errors.Is(result.Err, context.Canceled) {
+		t.Errorf("Err = %v, want a cancelled error", result.Err)
+	}
+}
+
+func TestResetRecoveryDisabled(t *testing.T) {
+	device := simulator.NewSwitch("sim-2960")
+	device.ModeHeld = true
+	device.PasswordRecovery = false
+	defer device.Close()
+
+	results := make(chan common.Result, 1)
+	go func() {
+		device.PowerOn()
+		results <- Reset(context.Background(), common.NewSession(device, t.Name(), nil, testing.Verbose()), common.DefaultSwitchProfile(), common.Backup{})
+	}()
+
+	select {
+	case result := <-results:
+		if !result.Success {
+			t.Fatalf("Reset failed while %s: %s", result.FailedStep, result.Err)
+		}
+	case <-time.After(time.Minute):
+		t.Fatalf("Reset against the simulated switch timed out. Received: %q", device.Received())
+	}
+
+	for _, file := range device.Files {
+		if strings.Contains(file.Name, "config") || strings.Contains(file.Name, "vlan") {
+			t.Errorf("%s was left in flash after the reset", file.Name)
+		}
+	}
+}
+
+func TestResetRecoveryDisabledPolicy(t *testing.T) {
+	backup := common.Backup{Backup: true, Destination: "192.168.1.10"}
+
+	tests := []struct {
+		name    string
+		policy  common.Policy
+		success bool
+	}{
+		{name: "Abort", policy: common.Abort{}, success: false},
+		{name: "Continue", policy: common.AutoContinue{}, success: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			device := simulator.NewSwitch("sim-2960")
+			device.ModeHeld = true
+			device.PasswordRecovery = false
+			defer device.Close()
+
+			session := common.NewSession(device, t.Name(), nil, testing.Verbose())
+			session.SetPolicy(tt.policy)
+			results := make(chan common.Result, 1)
+			go func() {
+				device.PowerOn()
+				results <- Reset(context.Background(), session, common.DefaultSwitchProfile(), backup)
+			}()
+
+			select {
+			case result := <-results:
+				if result.Success != tt.success {
+					t.Fatalf("Reset success = %t, want %t. Failed while %s: %s", result.Success, tt.success, result.FailedStep, result.Err)
+				}
+			case <-time.After(time.Minute):
+				t.Fatalf("Reset against the simulated switch timed out. Received: %q", device.Received())
+			}
+
+			// Giving up leaves the config alone
+			kept := false
+			for _, file := range device.Files {
+				if file.Name == "config.text" {
+					kept = true
+				}
+			}
+			if kept == tt.success {
+				t.Errorf("config.text kept = %t after the reset", kept)
+			}
+		})
+	}
+}
+
+func TestResetWithBackup(t *testing.T) {
+	if os.Getenv("SKIP_RESET_TESTS") != "" {
+		t.Skip("Skipping all reset tests")
+	}
+
+	tests := []struct {
+		name string
+		// Whether anything's there to take the backups
+		listening bool
+	}{
+		{name: "Sent", listening: true},
+		{name: "Timed out", listening: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			device := simulator.NewSwitch("sim-2960")
+			device.ModeHeld = true
+			defer device.Close()
+			sent := make(map[string]string)
+			if tt.listening {
+				device.Send = func(url string, contents []byte) error {
+					sent[url] = string(contents)
+					return nil
+				}
+			}
+
+			backup := common.Backup{Backup: true, Destination: "192.0.2.10", Prefix: "rack1"}
+			results := make(chan common.Result, 1)
+			go func() {
+				device.PowerOn()
+				results <- Reset(context.Background(), common.NewSession(device, t.Name(), nil, testing.Verbose()), common.DefaultSwitchProfile(), backup)
+			}()
+
+			var result common.Result
+			select {
+			case result = <-results:
+			case <-time.After(time.Minute):
+				t.Fatalf("Reset with a backup timed out. Received: %q", device.Received())
+			}
+
+			var copied []string
+			for _, backup := range result.Backups {
+				if strings.HasPrefix(backup, "tftp://") {
+					copied = append(copied, backup)
+				}
+			}
+			if !tt.listening {
+				if result.Success || result.FailedStep != "Backing up the config" || len(copied) != 0 {
+					t.Errorf("Reset = %t while %s with %q copied, want it to fail backing up", result.Success, result.FailedStep, copied)
+				}
+				return
+			}
+			if !result.Success {
+				t.Fatalf("Reset failed while %s: %s", result.FailedStep, result.Err)
+			}
+			if len(copied) == 0 || len(copied) != len(sent) {
+				t.Errorf("Backed up %q, but sent %d files", copied, len(sent))
+			}
+			for _, url := range copied {
+				if _, ok := sent[url]; !ok {
+					t.Errorf("%s was never sent", url)
+				}
+				if !strings.HasPrefix(url, "tftp://192.0.2.10/rack1-") {
+					t.Errorf("%s wasn't named with the prefix it was given", url)
+				}
+			}
+		})
+	}
+}
+
+func TestDefaultsApplyMethods(t *testing.T) {
+	if os.Getenv("SKIP_RESET_TESTS") != "" {
+		t.Skip("Skipping all reset tests")
+	}
+
+	// Somewhere the built-in TFTP server can listen without needing root
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error while finding a free port: %s", err)
+	}
+	tftpAddress := conn.LocalAddr().String()
+	conn.Close()
+	common.TftpListen = tftpAddress
+
+	defaults := SwitchConfig{
+		Version: 0.02,
+		Vlans:   []VlanConfig{{Vlan: 1, IpAddress: "192.168.1.2", SubnetMask: "255.255.255.0"}},
+		Ports: []SwitchPortConfig{
+			{Port: "Fa0/1", SwitchportMode: "access", Vlan: 10},
+			{Port: "Gi0/1", SwitchportMode: "trunk", Vlan: 1},
+		},
+		Lines:          []LineConfig{{Type: "vty", StartLine: 0, EndLine: 15, Login: "local", Transport: "ssh"}},
+		Ssh:            SshConfig{Enable: true, Username: "admin", Password: "cisco", Bits: 2048},
+		EnablePassword: "class",
+		Hostname:       "S1",
+		DomainName:     "example.com",
+	}
+
+	tests := []struct {
+		name  string
+		apply common.ApplyOptions
+	}{
+		{name: "Paste", apply: common.ApplyOptions{Method: common.APPLY_PASTE, PasteDelay: time.Millisecond}},
+		{name: "TFTP", apply: common.ApplyOptions{Method: common.APPLY_TFTP, Server: "127.0.0.1", Source: "192.168.1.2", SubnetMask: "255.255.255.0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			device := simulator.NewSwitch("sim-2960")
+			defer device.Close()
+			device.Erase()
+			device.Fetch = func(url string) ([]byte, error) {
+				client, err := tftp.NewClient(tftpAddress)
+				if err != nil {
+					return nil, err
+				}
+				wt, err := client.Receive(path.Base(url), "octet")
+				if err != nil {
+					return nil, err
+				}
+				var contents bytes.Buffer
+				_, err = wt.WriteTo(&contents)
+				return contents.Bytes(), err
+			}
+
+			session := common.NewSession(device, t.Name(), nil, testing.Verbose())
+			results := make(chan common.Result, 1)
+			go func() {
+				device.PowerOn()
+				results <- Defaults(context.Background(), session, common.DefaultSwitchProfile(), defaults, tt.apply)
+			}()
+
+			var result common.Result
+			select {
+			case result = <-results:
+			case <-time.After(time.Minute):
+				t.Fatalf("Defaults against the simulated switch timed out. Received: %q", device.Received())
+			}
+			if !result.Success {
+				t.Fatalf("Defaults failed while %s: %s", result.FailedStep, result.Err)
+			}
+
+			config := device.RunningConfig()
+			for _, expected := range []string{"hostname S1", "interface FastEthernet0/1", " switchport access vlan 10", "line vty 0 15", " transport input ssh"} {
+				if !strings.Contains(config, expected+"\n") {
+					t.Errorf("Running config is missing %q:\n%s", expected, config)
+				}
+			}
+			if steps := session.Progress(); steps.Percent() != 100 {
+				t.Errorf("Progress is at %d%%, %d of %d steps", steps.Percent(), steps.CurrentStep, steps.TotalSteps)
+			}
+
+			received := strings.Join(device.Received(), "\n")
+			if tt.apply.Method == common.APPLY_TFTP && (!strings.Contains(received, "copy tftp://127.0.0.1/") || strings.Contains(received, "switchport access vlan 10")) {
+				t.Errorf("Config wasn't copied over TFTP, sent:\n%s", received)
+			}
+		})
+	}
+}
+
+func TestDiff(t *testing.T) {
+	running := strings.Split(`Building configuration...
+
+Current configuration : 2048 bytes
+!
+version 15.0
+hostname S1
+!
+enable secret 5 $1$mERr$hx5rVt7rPNoS4wqbXKX7m0
+!
+username admin password 0 cisco
+ip domain-name example.com
+!
+interface FastEthernet0/1
+switchport mode access
+!
+interface FastEthernet0/2
+switchport mode access
+shutdown
+!
+interface GigabitEthernet0/1
+switchport mode trunk
+!
+interface Vlan1
+ip address 192.168.1.2 255.255.255.0
+!
+ip default-gateway 192.168.1.254
+banner motd ^CAuthorized access only^C
+!
+line con 0
+line vty 0 4
+login local
+transport input ssh
+line vty 5 15
+login local
+transport input telnet
+!
+end`, "\n")
+	vlanBrief := strings.Split(`VLAN Name                             Status    Ports
+---- -------------------------------- --------- -------------------------------
+1    default                          active    Fa0/3, Fa0/4, Fa0/5, Fa0/6
+Fa0/7, Fa0/8
+10   VLAN0010                         active    Fa0/1, Fa0/2
+1002 fddi-default                     act/unsup`, "\n")
+
+	actual := Parse(running, vlanBrief)
+	if actual.Hostname != "S1" || actual.DomainName != "example.com" || actual.Banner != "Authorized access only" || actual.Ssh.Username != "admin" || actual.Ssh.Password != "cisco" {
+		t.Errorf("Parse got the global settings wrong: %+v", actual)
+	}
+	if len(actual.Ports) != 3 || actual.Ports[0].Vlan != 10 || actual.Ports[2].Vlan != 1 || !actual.Ports[1].Shutdown {
+		t.Errorf("Parse got the ports wrong: %+v", actual.Ports)
+	}
+	if len(actual.Vlans) != 2 || actual.Vlans[0].IpAddress != "192.168.1.2" || actual.Vlans[1].Vlan != 10 {
+		t.Errorf("Parse got the vlans wrong: %+v", actual.Vlans)
+	}
+
+	requested := SwitchConfig{
+		Version: 0.02,
+		Vlans:   []VlanConfig{{Vlan: 1, IpAddress: "192.168.1.2", SubnetMask: "255.255.255.0"}, {Vlan: 20}},
+		Ports: []SwitchPortConfig{
+			{Port: "Fa0/1", SwitchportMode: "access", Vlan: 10},
+			{Port: "Fa0/2", SwitchportMode: "access", Vlan: 10},
+			{Port: "Gi0/1", SwitchportMode: "trunk", Vlan: 1},
+			{Port: "Fa0/99", SwitchportMode: "access", Vlan: 10},
+		},
+		Lines:          []LineConfig{{Type: "vty", StartLine: 0, EndLine: 20, Login: "local", Transport: "ssh"}},
+		Ssh:            SshConfig{Enable: true, Username: "admin", Password: "cisco"},
+		EnablePassword: "class",
+		Banner:         "Authorized access only",
+		Hostname:       "S1",
+		DomainName:     "example.com",
+		DefaultGateway: "192.168.1.254",
+	}
+	differences := Diff(common.DefaultSwitchProfile(), requested, actual)
+	expected := common.Differences{
+		{Setting: "Vlans[20]", Expected: "present"},
+		{Setting: "Ports[Fa0/2].Shutdown", Expected: "false", Actual: "true"},
+		{Setting: "Ports[Fa0/99]", Expected: "present"},
+		{Setting: "Lines[vty 5 15].Transport", Expected: "ssh", Actual: "telnet"},
+	}
+	if !reflect.DeepEqual(differences, expected) {
+		t.Errorf("Diff = %+v, want %+v", differences, expected)
+	}
+
+	requested.Lines = append(requested.Lines, LineConfig{Type: "aux", StartLine: 0, EndLine: 0, Password: "cisco"})
+	differences = Diff(common.DefaultSwitchProfile(), requested, actual)
+	if last := differences[len(differences)-1]; last.Setting != "Lines[aux 0 0]" {
+		t.Errorf("Missing aux line came out as %+v", last)
+	}
+}
@@ -27,6 +27,15 @@ var Port string
 //go:embed ports.html
 var Ports string
 
+//go:embed terminal.html
+var Terminal string
+
+//go:embed batch.html
+var Batch string
+
+//go:embed batch_report.html
+var BatchReport string
+
 //go:embed reset.html
 var Reset string
 
@@ -0,0 +1,498 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"main/common"
+	"main/crglogging"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ApiError is what every /api/v1 endpoint sends back when something goes wrong
+type ApiError struct {
+	Error string
+}
+
+// ApiPort is a port along with who's using it and who's waiting on it
+type ApiPort struct {
+	Name         string
+	Description  string
+	IsUSB        bool
+	VID          string
+	PID          string
+	SerialNumber string
+	// Who's using the port, or null if nobody is
+	User *portClaim
+	// Jobs waiting on the port, in the order they'll get it
+	Queue []int
+}
+
+// JobList is one page of the jobs matching the query, newest first
+type JobList struct {
+	Jobs []Job
+	// How many jobs matched across every page
+	Total int
+	Page  int
+	Pages int
+}
+
+// JobRequest is what a new job's asked for with. Anything left out gets the same default as the web form.
+type JobRequest struct {
+	Port string
+	// 9600 8N1 unless given
+	BaudRate int
+	DataBits int
+	// none, even, odd, mark or space
+	Parity   string
+	StopBits float32
+	// router, switch or auto to detect it, which is the default
+	DeviceType string
+	Profile    string
+	Verbose    bool
+	Reset      bool
+	// Defaults to apply, given inline
+	Defaults json.RawMessage
+	// Name of a defaults template to apply instead of giving them inline
+	DefaultsTemplate string
+	Backup           common.Backup
+	BreakMethod      string
+	// ask, continue or abort
+	Policy   string
+	Priority int
+	// wait or reject
+	WhenBusy string
+	// Number of a job that has to succeed first
+	After int
+	// How the defaults get onto the device, typing each command in unless given
+	Apply common.ApplyOptions
+}
+
+// AnswerRequest answers the question a job's waiting on
+type AnswerRequest struct {
+	Answer string
+}
+
+// rules checks the request over and turns it into what the job runs with
+func (req JobRequest) rules() (RunParams, error) {
+	var rules RunParams
+	var err error
+
+	rules.PortConfig = SerialConfiguration{Port: strings.TrimSpace(req.Port), BaudRate: 9600, DataBits: 8, Parity: "no", StopBits: 1}
+	if rules.PortConfig.Port == "" {
+		return rules, errors.New("Port is needed")
+	}
+	if req.BaudRate != 0 {
+		rules.PortConfig.BaudRate = req.BaudRate
+	}
+	if req.DataBits != 0 {
+		rules.PortConfig.DataBits = req.DataBits
+	}
+	switch req.StopBits {
+	case 0:
+	case 1, 1.5, 2:
+		rules.PortConfig.StopBits = req.StopBits
+	default:
+		return rules, fmt.Errorf("StopBits has to be 1, 1.5 or 2, not %g", req.StopBits)
+	}
+	switch strings.ToLower(req.Parity) {
+	case "", "n", "no", "none":
+	case "e", "even":
+		rules.PortConfig.Parity = "even"
+	case "o", "odd":
+		rules.PortConfig.Parity = "odd"
+	case "m", "mark":
+		rules.PortConfig.Parity = "mark"
+	case "s", "space":
+		rules.PortConfig.Parity = "space"
+	default:
+		return rules, fmt.Errorf("Parity has to be none, even, odd, mark or space, not %q", req.Parity)
+	}
+	rules.PortConfig.ShortHand = rules.PortConfig.shortHand()
+
+	rules.DeviceType = strings.ToLower(req.DeviceType)
+	if rules.DeviceType == "" {
+		rules.DeviceType = common.AUTO_PROFILE
+	}
+	if rules.DeviceType != common.ROUTER && rules.DeviceType != common.SWITCH && rules.DeviceType != common.AUTO_PROFILE {
+		return rules, fmt.Errorf("DeviceType has to be router, switch or auto, not %q", req.DeviceType)
+	}
+	rules.DeviceType, rules.Profile, err = resolveProfile(rules.DeviceType, req.Profile)
+	if err != nil {
+		return rules, err
+	}
+
+	rules.Verbose = req.Verbose
+	rules.Reset = req.Reset
+	inline := len(req.Defaults) > 0 && string(req.Defaults) != "null"
+	switch {
+	case inline && req.DefaultsTemplate != "":
+		return rules, errors.New("Give either Defaults or DefaultsTemplate, not both")
+	case inline:
+		if !json.Valid(req.Defaults) {
+			return rules, errors.New("Defaults aren't valid JSON")
+		}
+		rules.Defaults = true
+		rules.DefaultsContents = string(req.Defaults)
+	case req.DefaultsTemplate != "":
+		template, err := loadDefaults(req.DefaultsTemplate)
+		if err != nil {
+			return rules, fmt.Errorf("Defaults template %s: %w", req.DefaultsTemplate, err)
+		}
+		if rules.DeviceType != common.AUTO_PROFILE && template.Type != rules.DeviceType {
+			return rules, fmt.Errorf("Defaults template %s is for a %s, not a %s", template.Name, template.Type, rules.DeviceType)
+		}
+		rules.Defaults = true
+		rules.DefaultsFile = template.Name + ".json"
+		rules.DefaultsContents = string(template.Defaults)
+	}
+	if !rules.Reset && !rules.Defaults {
+		return rules, errors.New("The job has nothing to do, set Reset or give some defaults")
+	}
+
+	rules.BackupConfig = req.Backup
+	rules.BackupConfig.Backup = rules.BackupConfig.Backup || rules.BackupConfig.Destination != ""
+	rules.BreakMethod = req.BreakMethod
+
+	rules.Apply = req.Apply.ForDevice(rules.DeviceType)
+	err = checkApply(rules)
+	if err != nil {
+		return rules, err
+	}
+
+	rules.Policy = strings.ToLower(req.Policy)
+	switch rules.Policy {
+	case "":
+		rules.Policy = ASK_POLICY
+	case ASK_POLICY, common.POLICY_CONTINUE, common.POLICY_ABORT:
+	default:
+		return rules, fmt.Errorf("Policy has to be ask, continue or abort, not %q", req.Policy)
+	}
+
+	rules.Priority = req.Priority
+	rules.After = req.After
+	rules.WhenBusy = strings.ToLower(req.WhenBusy)
+	switch rules.WhenBusy {
+	case "":
+		rules.WhenBusy = WHEN_BUSY_WAIT
+	case WHEN_BUSY_WAIT, WHEN_BUSY_REJECT:
+	default:
+		return rules, fmt.Errorf("WhenBusy has to be wait or reject, not %q", req.WhenBusy)
+	}
+	return rules, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(body)
+	if err != nil {
+		webLogger := crglogging.GetLogger(WEB_LOGGER_NAME)
+		webLogger.Errorf("Error while writing a response: %s\n", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, format string, args ...any) {
+	writeJSON(w, status, ApiError{Error: fmt.Sprintf(format, args...)})
+}
+
+// readBody decodes the request's JSON body into body, refusing any fields it doesn't have
+func readBody(w http.ResponseWriter, r *http.Request, body any) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request body: %s", err)
+		return false
+	}
+	return true
+}
+
+// apiJobNumber gets the job in the path, writing an error and returning false if there isn't one
+func apiJobNumber(w http.ResponseWriter, r *http.Request) (Job, bool) {
+	num, err := strconv.Atoi(mux.Vars(r)["job"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid job %q", mux.Vars(r)["job"])
+		return Job{}, false
+	}
+
+	job, found := getJob(num)
+	if !found {
+		writeError(w, http.StatusNotFound, "Job %d not found", num)
+		return job, false
+	}
+	return job, true
+}
+
+func apiListPorts(w http.ResponseWriter, r *http.Request) {
+	ports, err := listPorts()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Couldn't list the ports: %s", err)
+		return
+	}
+
+	found := make([]ApiPort, 0, len(ports))
+	for _, port := range ports {
+		found = append(found, ApiPort{
+			Name:         port.Name,
+			Description:  port.Product,
+			IsUSB:        port.IsUSB,
+			VID:          port.VID,
+			PID:          port.PID,
+			SerialNumber: port.SerialNumber,
+			User:         portUser(port.Name),
+			Queue:        portQueue(port.Name),
+		})
+	}
+	writeJSON(w, http.StatusOK, found)
+}
+
+func apiListJobs(w http.ResponseWriter, r *http.Request) {
+	page := findJobs(parseJobFilter(r.URL.Query()))
+	list := JobList{Jobs: make([]Job, 0, len(page.Jobs)), Total: page.Total, Page: page.Filter.Page, Pages: page.Pages}
+	for _, job := range page.Jobs {
+		list.Jobs = append(list.Jobs, withoutOutput(job))
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func apiCreateJob(w http.ResponseWriter, r *http.Request) {
+	webLogger := crglogging.GetLogger(WEB_LOGGER_NAME)
+
+	var req JobRequest
+	if !readBody(w, r, &req) {
+		return
+	}
+	rules, err := req.rules()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	if rules.WhenBusy == WHEN_BUSY_REJECT && portBusy(rules.PortConfig.Port) {
+		writeError(w, http.StatusConflict, "%s is busy", rules.PortConfig.Port)
+		return
+	}
+
+	jobsMu.Lock()
+	job := queueJob(rules, initiator(r), 0)
+	jobsMu.Unlock()
+
+	webLogger.Infof("apiCreateJob: %s started job %d on %s\n", r.RemoteAddr, job.Number, rules.PortConfig.Port)
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/jobs/%d", job.Number))
+	writeJSON(w, http.StatusCreated, withoutOutput(job))
+}
+
+func apiGetJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := apiJobNumber(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, withoutOutput(job))
+}
+
+// apiJobOutput sends what the job's logged as plain text, or just the last few lines of it with ?lines=
+func apiJobOutput(w http.ResponseWriter, r *http.Request) {
+	job, ok := apiJobNumber(w, r)
+	if !ok {
+		return
+	}
+
+	output := job.Output
+	if query := r.URL.Query().Get("lines"); query != "" {
+		count, err := strconv.Atoi(query)
+		if err != nil || count < 0 {
+			writeError(w, http.StatusBadRequest, "Invalid line count %q", query)
+			return
+		}
+		lines := strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+		if len(lines) > count {
+			output = strings.Join(lines[len(lines)-count:], "\n") + "\n"
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, err := w.Write([]byte(output))
+	if err != nil {
+		webLogger := crglogging.GetLogger(WEB_LOGGER_NAME)
+		webLogger.Errorf("Error while writing the output of job %d: %s\n", job.Number, err)
+	}
+}
+
+func apiCancelJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := apiJobNumber(w, r)
+	if !ok {
+		return
+	}
+	if !cancelJob(job.Number) {
+		writeError(w, http.StatusConflict, "Job %d isn't running", job.Number)
+		return
+	}
+
+	job, _ = getJob(job.Number)
+	writeJSON(w, http.StatusAccepted, withoutOutput(job))
+}
+
+func apiAnswerJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := apiJobNumber(w, r)
+	if !ok {
+		return
+	}
+	var req AnswerRequest
+	if !readBody(w, r, &req) {
+		return
+	}
+
+	err := answerJob(job.Number, req.Answer)
+	if err != nil {
+		status := http.StatusBadRequest
+		if job.Prompt == nil {
+			status = http.StatusConflict
+		}
+		writeError(w, status, "%s", err)
+		return
+	}
+
+	job, _ = getJob(job.Number)
+	writeJSON(w, http.StatusAccepted, withoutOutput(job))
+}
+
+// defaultsError writes the status that goes with an error from a defaults template
+func defaultsError(w http.ResponseWriter, name string, err error) {
+	switch {
+	case errors.Is(err, errNoDefaultsDir):
+		writeError(w, http.StatusServiceUnavailable, "%s", err)
+	case errors.Is(err, errDefaultsNotFound):
+		writeError(w, http.StatusNotFound, "No defaults template called %s", name)
+	case errors.Is(err, errDefaultsExist):
+		writeError(w, http.StatusConflict, "There's already a defaults template called %s", name)
+	case errors.Is(err, errInvalidDefaults):
+		writeError(w, http.StatusBadRequest, "%s", err)
+	default:
+		webLogger := crglogging.GetLogger(WEB_LOGGER_NAME)
+		webLogger.Errorf("Error with defaults template %s: %s\n", name, err)
+		writeError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+	}
+}
+
+func apiListDefaults(w http.ResponseWriter, r *http.Request) {
+	found, err := listDefaults()
+	if err != nil {
+		defaultsError(w, "", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, found)
+}
+
+func apiCreateDefaults(w http.ResponseWriter, r *http.Request) {
+	var template DefaultsTemplate
+	if !readBody(w, r, &template) {
+		return
+	}
+	template, err := saveDefaults(template, false)
+	if err != nil {
+		defaultsError(w, template.Name, err)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/templates/%s", template.Name))
+	writeJSON(w, http.StatusCreated, template)
+}
+
+func apiGetDefaults(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	template, err := loadDefaults(name)
+	if err != nil {
+		defaultsError(w, name, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, template)
+}
+
+func apiReplaceDefaults(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	var template DefaultsTemplate
+	if !readBody(w, r, &template) {
+		return
+	}
+	if template.Name != "" && template.Name != name {
+		writeError(w, http.StatusBadRequest, "Templates can't be renamed, create %s and delete %s instead", template.Name, name)
+		return
+	}
+	template.Name = name
+
+	template, err := saveDefaults(template, true)
+	if err != nil {
+		defaultsError(w, name, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, template)
+}
+
+func apiDeleteDefaults(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	err := deleteDefaults(name)
+	if err != nil {
+		defaultsError(w, name, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiV1Routes are the /api/v1 endpoints, which both the muxer and the OpenAPI document are built from
+func apiV1Routes() []apiRoute {
+	jobParam := apiParam{Name: "job", In: "path", Type: "integer", Description: "Job number"}
+	nameParam := apiParam{Name: "name", In: "path", Type: "string", Description: "Template name"}
+
+	return []apiRoute{
+		{Method: "GET", Path: "/ports", Summary: "List the serial ports and remote consoles", Handler: apiListPorts,
+			Response: []ApiPort{}},
+		{Method: "GET", Path: "/jobs", Summary: "List jobs, newest first", Handler: apiListJobs,
+			Params: []apiParam{
+				{Name: "type", In: "query", Type: "string", Description: "Device type"},
+				{Name: "port", In: "query", Type: "string", Description: "Port the job's on"},
+				{Name: "status", In: "query", Type: "string", Description: "Status or state"},
+				{Name: "initiator", In: "query", Type: "string", Description: "Address the job was started from"},
+				{Name: "page", In: "query", Type: "integer", Description: "Page, starting from 1"},
+			},
+			Response: JobList{}},
+		{Method: "POST", Path: "/jobs", Summary: "Start a job", Handler: apiCreateJob,
+			Request: JobRequest{}, Status: http.StatusCreated, Response: Job{}, Errors: []int{400, 409}},
+		{Method: "GET", Path: "/jobs/{job}", Summary: "Get a job, without its output", Handler: apiGetJob,
+			Params: []apiParam{jobParam}, Response: Job{}, Errors: []int{400, 404}},
+		{Method: "GET", Path: "/jobs/{job}/output", Summary: "Get what a job's logged", Handler: apiJobOutput,
+			Params:   []apiParam{jobParam, {Name: "lines", In: "query", Type: "integer", Description: "Only the last this many lines"}},
+			Response: "", Errors: []int{400, 404}},
+		{Method: "POST", Path: "/jobs/{job}/cancel", Summary: "Cancel a job", Handler: apiCancelJob,
+			Params: []apiParam{jobParam}, Status: http.StatusAccepted, Response: Job{}, Errors: []int{400, 404, 409}},
+		{Method: "POST", Path: "/jobs/{job}/answer", Summary: "Answer the question a job's waiting on", Handler: apiAnswerJob,
+			Params: []apiParam{jobParam}, Request: AnswerRequest{}, Status: http.StatusAccepted, Response: Job{}, Errors: []int{400, 404, 409}},
+		{Method: "GET", Path: "/templates", Summary: "List the defaults templates", Handler: apiListDefaults,
+			Response: []DefaultsTemplate{}, Errors: []int{503}},
+		{Method: "POST", Path: "/templates", Summary: "Create a defaults template", Handler: apiCreateDefaults,
+			Request: DefaultsTemplate{}, Status: http.StatusCreated, Response: DefaultsTemplate{}, Errors: []int{400, 409, 503}},
+		{Method: "GET", Path: "/templates/{name}", Summary: "Get a defaults template", Handler: apiGetDefaults,
+			Params: []apiParam{nameParam}, Response: DefaultsTemplate{}, Errors: []int{404, 503}},
+		{Method: "PUT", Path: "/templates/{name}", Summary: "Replace a defaults template", Handler: apiReplaceDefaults,
+			Params: []apiParam{nameParam}, Request: DefaultsTemplate{}, Response: DefaultsTemplate{}, Errors: []int{400, 404, 503}},
+		{Method: "DELETE", Path: "/templates/{name}", Summary: "Delete a defaults template", Handler: apiDeleteDefaults,
+			Params: []apiParam{nameParam}, Status: http.StatusNoContent, Errors: []int{404, 503}},
+		{Method: "GET", Path: "/openapi.json", Summary: "This document", Handler: apiOpenAPI,
+			Response: map[string]any{}},
+	}
+}
+
+// registerApiV1 adds the /api/v1 endpoints to muxer
+func registerApiV1(muxer *mux.Router) {
+	for _, route := range apiV1Routes() {
+		route := route
+		muxer.HandleFunc(API_V1_PREFIX+route.Path, func(w http.ResponseWriter, r *http.Request) {
+			webLogger := crglogging.GetLogger(WEB_LOGGER_NAME)
+			webLogger.Infof("api: %s %s from %s\n", r.Method, filepath.Clean(r.URL.Path), r.RemoteAddr)
+			route.Handler(w, r)
+		}).Methods(route.Method)
+	}
+}
@@ -0,0 +1,322 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"html/template"
+	"io"
+	"main/batch"
+	"main/common"
+	"main/crglogging"
+	"main/templates"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// BatchSummary is how the jobs started from one batch manifest are getting on
+type BatchSummary struct {
+	Number int
+	Jobs   []Job
+	// How many of the jobs are in each state
+	States map[string]int
+	// Only there once every job has finished
+	Report *batch.Report
+}
+
+// jobOutcome is how a finished job went, in the same terms as a batch run from the command line
+func jobOutcome(job Job) batch.Outcome {
+	outcome := batch.Outcome{
+		Entry: batch.Entry{
+			Port:      job.Params.PortConfig.Port,
+			Type:      job.Params.DeviceType,
+			Profile:   job.Params.Profile.Name,
+			SkipReset: !job.Params.Reset,
+			Defaults:  job.Params.DefaultsFile,
+			Baud:      job.Params.PortConfig.BaudRate,
+			Backup:    job.Params.BackupConfig,
+		},
+		Device:  job.Device,
+		Result:  job.Result,
+		Started: job.Created,
+	}
+	for _, change := range job.History {
+		if change.Status == "Running" {
+			outcome.Started = change.At
+		}
+		outcome.Finished = change.At
+	}
+
+	outcome.Result.Success = job.State == JOB_SUCCEEDED
+	if !outcome.Result.Success && outcome.Result.FailedStep == "" {
+		// Jobs that never got as far as a flow only have their status to say what went wrong
+		outcome.Result.FailedStep = job.Status
+		outcome.Result.Error = job.State
+	}
+	return outcome
+}
+
+// listBatches gets every batch, newest first
+func listBatches() []BatchSummary {
+	byNumber := make(map[int]*BatchSummary)
+	for _, job := range listJobs() {
+		if job.Batch == 0 {
+			continue
+		}
+		summary, ok := byNumber[job.Batch]
+		if !ok {
+			summary = &BatchSummary{Number: job.Batch, States: make(map[string]int)}
+			byNumber[job.Batch] = summary
+		}
+		// The output is on the job's own page
+		job.Output = ""
+		job.Transcript = ""
+		job.Params.DefaultsContents = ""
+		summary.Jobs = append(summary.Jobs, job)
+		summary.States[job.State] += 1
+	}
+
+	batches := make([]BatchSummary, 0, len(byNumber))
+	for _, summary := range byNumber {
+		finished := true
+		outcomes := make([]batch.Outcome, 0, len(summary.Jobs))
+		for _, job := range summary.Jobs {
+			finished = finished && !job.Running()
+			outcomes = append(outcomes, jobOutcome(job))
+		}
+		if finished {
+			report := batch.NewReport(outcomes)
+			summary.Report = &report
+		}
+		batches = append(batches, *summary)
+	}
+	sort.Slice(batches, func(i, j int) bool {
+		return batches[i].Number > batches[j].Number
+	})
+	return batches
+}
+
+// findBatch gets batch num, returning false if there's no such batch
+func findBatch(num int) (BatchSummary, bool) {
+	for _, summary := range listBatches() {
+		if summary.Number == num {
+			return summary, true
+		}
+	}
+	return BatchSummary{}, false
+}
+
+// batchRules turns a manifest entry into what a job runs with. defaults are the uploaded defaults files by name.
+func batchRules(entry batch.Entry, defaults map[string]string, policy string, verbose bool) (RunParams, error) {
+	var rules RunParams
+	var err error
+
+	rules.PortConfig = SerialConfiguration{Port: entry.Port, BaudRate: 9600, DataBits: 8, Parity: "no", StopBits: 1}
+	if entry.Baud != 0 {
+		rules.PortConfig.BaudRate = entry.Baud
+	}
+	rules.PortConfig.ShortHand = rules.PortConfig.shortHand()
+
+	rules.DeviceType, rules.Profile, err = resolveProfile(entry.Type, entry.Profile)
+	if err != nil {
+		return rules, err
+	}
+
+	rules.Reset = !entry.SkipReset
+	if entry.Defaults != "" {
+		rules.Defaults = true
+		rules.DefaultsFile = filepath.Base(entry.Defaults)
+		contents, ok := defaults[rules.DefaultsFile]
+		if !ok {
+			return rules, fmt.Errorf("%s needs %s, which wasn't uploaded", entry.Name(), rules.DefaultsFile)
+		}
+		rules.DefaultsContents = contents
+	}
+
+	rules.BackupConfig = entry.Backup
+	rules.Verbose = verbose
+	rules.Policy = policy
+	rules.WhenBusy = WHEN_BUSY_WAIT
+	return rules, nil
+}
+
+// batchHome is where a batch manifest gets uploaded, along with the batches so far
+func batchHome(w http.ResponseWriter, r *http.Request) {
+	webLogger := crglogging.GetLogger(WEB_LOGGER_NAME)
+
+	layoutTemplate, err := template.New("layout").Parse(templates.Layout)
+	if err != nil {
+		webLogger.Errorf(err.Error())
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	batchTemplate, err := layoutTemplate.Parse(templates.Batch)
+	if err != nil {
+		webLogger.Errorf(err.Error())
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	webLogger.Infof("batchHome: %s requested %s\n", r.RemoteAddr, filepath.Clean(r.URL.Path))
+
+	err = batchTemplate.ExecuteTemplate(w, "layout", listBatches())
+	if err != nil {
+		webLogger.Errorf(err.Error())
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+}
+
+// startBatch queues a job for each device in the uploaded manifest. Jobs on different ports run at the same time.
+func startBatch(w http.ResponseWriter, r *http.Request) {
+	webLogger := crglogging.GetLogger(WEB_LOGGER_NAME)
+
+	webLogger.Infof("startBatch: %s requested %s\n", r.RemoteAddr, filepath.Clean(r.URL.Path))
+
+	err := r.ParseMultipartForm(32 << 20)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	file, header, err := r.FormFile("manifest")
+	if err != nil {
+		http.Error(w, "A manifest is needed", http.StatusBadRequest)
+		return
+	}
+	contents, err := io.ReadAll(file)
+	file.Close()
+	if err != nil {
+		webLogger.Errorf("Error while reading the batch manifest: %s\n", err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	entries, err := batch.Parse(header.Filename, contents)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ports, err := listPorts()
+	if err != nil {
+		webLogger.Errorf("Error while listing ports: %s\n", err)
+	}
+	err = batch.Resolve(entries, ports)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	defaults := make(map[string]string)
+	for _, header := range r.MultipartForm.File["defaultsFiles"] {
+		file, err := header.Open()
+		if err != nil {
+			http.Error(w, http.StatusText(500), 500)
+			return
+		}
+		contents, err := io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			http.Error(w, http.StatusText(500), 500)
+			return
+		}
+		defaults[filepath.Base(header.Filename)] = string(contents)
+	}
+
+	policy := r.PostFormValue("policy")
+	if policy != ASK_POLICY && policy != common.POLICY_ABORT {
+		policy = common.POLICY_CONTINUE
+	}
+	verbose := r.PostFormValue("verbose") == "verbose"
+
+	allRules := make([]RunParams, 0, len(entries))
+	for _, entry := range entries {
+		rules, err := batchRules(entry, defaults, policy, verbose)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		allRules = append(allRules, rules)
+	}
+
+	jobsMu.Lock()
+	batchNum := nextBatchNumber()
+	for _, rules := range allRules {
+		queueJob(rules, initiator(r), batchNum)
+	}
+	jobsMu.Unlock()
+
+	webLogger.Infof("Batch %d started %d jobs from %s\n", batchNum, len(allRules), header.Filename)
+	http.Redirect(w, r, fmt.Sprintf("/batch/%d/", batchNum), http.StatusSeeOther)
+}
+
+// batchHandler shows how each job in a batch is getting on
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	webLogger := crglogging.GetLogger(WEB_LOGGER_NAME)
+
+	layoutTemplate, err := template.New("layout").Parse(templates.Layout)
+	if err != nil {
+		webLogger.Errorf(err.Error())
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	reportTemplate, err := layoutTemplate.Parse(templates.BatchReport)
+	if err != nil {
+		webLogger.Errorf(err.Error())
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	webLogger.Infof("batchHandler: %s requested %s\n", r.RemoteAddr, filepath.Clean(r.URL.Path))
+
+	num, err := strconv.Atoi(mux.Vars(r)["batch"])
+	if err != nil {
+		http.Error(w, http.StatusText(400), 400)
+		return
+	}
+	summary, ok := findBatch(num)
+	if !ok {
+		http.Error(w, http.StatusText(404), 404)
+		return
+	}
+
+	err = reportTemplate.ExecuteTemplate(w, "layout", summary)
+	if err != nil {
+		webLogger.Errorf(err.Error())
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+}
+
+// batchApi gets a batch as JSON, or just its report as a table with ?format=text
+func batchApi(w http.ResponseWriter, r *http.Request) {
+	webLogger := crglogging.GetLogger(WEB_LOGGER_NAME)
+
+	num, err := strconv.Atoi(mux.Vars(r)["batch"])
+	if err != nil {
+		http.Error(w, http.StatusText(400), 400)
+		return
+	}
+	summary, ok := findBatch(num)
+	if !ok {
+		http.Error(w, http.StatusText(404), 404)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "text" {
+		if summary.Report == nil {
+			http.Error(w, fmt.Sprintf("Batch %d is still running", num), http.StatusConflict)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		err = summary.Report.Write(w)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(summary)
+	}
+	if err != nil {
+		webLogger.Errorf("Error while writing batch %d: %s\n", num, err)
+	}
+}
@@ -0,0 +1,202 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"main/common"
+	"main/routers"
+	"main/switches"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultsDir is where defaults templates are kept, one JSON file each
+var DefaultsDir string
+
+// DefaultsTemplate is a named set of defaults that jobs can apply without uploading a file
+type DefaultsTemplate struct {
+	Name string
+	// common.ROUTER or common.SWITCH
+	Type    string
+	Updated time.Time
+	// A switches.SwitchConfig or routers.RouterDefaults, depending on the type
+	Defaults json.RawMessage
+}
+
+// Names end up as file names, so they're kept to ones that are safe as one
+var defaultsNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// Guards the files in DefaultsDir, so a template isn't read halfway through being replaced
+var defaultsMu sync.Mutex
+
+// Errors the API tells apart when reporting what went wrong with a template
+var (
+	errNoDefaultsDir    = errors.New("defaults templates aren't being kept anywhere")
+	errDefaultsNotFound = errors.New("no such defaults template")
+	errDefaultsExist    = errors.New("there's already a defaults template with that name")
+	errInvalidDefaults  = errors.New("invalid defaults template")
+)
+
+func defaultsPath(name string) string {
+	return filepath.Join(DefaultsDir, name+".json")
+}
+
+// check makes sure the template's name is usable and its defaults are what its type expects. Fields that neither
+// config has are refused, as they're most likely typos that would otherwise be silently ignored.
+func (t DefaultsTemplate) check() error {
+	if !defaultsNamePattern.MatchString(t.Name) {
+		return fmt.Errorf("%q isn't a valid name, use letters, numbers, dots, dashes and underscores", t.Name)
+	}
+
+	var config any
+	switch t.Type {
+	case common.ROUTER:
+		config = &routers.RouterDefaults{}
+	case common.SWITCH:
+		config = &switches.SwitchConfig{}
+	default:
+		return fmt.Errorf("type has to be %s or %s, not %q", common.ROUTER, common.SWITCH, t.Type)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(t.Defaults))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(config)
+	if err != nil {
+		return fmt.Errorf("defaults aren't a valid %s config: %w", t.Type, err)
+	}
+	return nil
+}
+
+// listDefaults gets every defaults template, sorted by name
+func listDefaults() ([]DefaultsTemplate, error) {
+	if DefaultsDir == "" {
+		return nil, errNoDefaultsDir
+	}
+
+	defaultsMu.Lock()
+	defer defaultsMu.Unlock()
+
+	paths, err := filepath.Glob(filepath.Join(DefaultsDir, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("web.listDefaults: Error while listing templates: %w", err)
+	}
+
+	found := make([]DefaultsTemplate, 0, len(paths))
+	for _, path := range paths {
+		template, err := readDefaults(path)
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, template)
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].Name < found[j].Name
+	})
+	return found, nil
+}
+
+// readDefaults reads the template at path. The caller holds defaultsMu.
+func readDefaults(path string) (DefaultsTemplate, error) {
+	var template DefaultsTemplate
+	contents, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return template, errDefaultsNotFound
+	}
+	if err != nil {
+		return template, fmt.Errorf("web.readDefaults: Error while reading %s: %w", path, err)
+	}
+	err = json.Unmarshal(contents, &template)
+	if err != nil {
+		return template, fmt.Errorf("web.readDefaults: Error while parsing %s: %w", path, err)
+	}
+	return template, nil
+}
+
+// loadDefaults gets the template called name
+func loadDefaults(name string) (DefaultsTemplate, error) {
+	if DefaultsDir == "" {
+		return DefaultsTemplate{}, errNoDefaultsDir
+	}
+	if !defaultsNamePattern.MatchString(name) {
+		return DefaultsTemplate{}, errDefaultsNotFound
+	}
+
+	defaultsMu.Lock()
+	defer defaultsMu.Unlock()
+
+	return readDefaults(defaultsPath(name))
+}
+
+// saveDefaults writes template out, only replacing one with the same name if replace is set and only creating a new
+// one if it isn't
+func saveDefaults(template DefaultsTemplate, replace bool) (DefaultsTemplate, error) {
+	if DefaultsDir == "" {
+		return template, errNoDefaultsDir
+	}
+	template.Type = strings.ToLower(strings.TrimSpace(template.Type))
+	err := template.check()
+	if err != nil {
+		return template, fmt.Errorf("%w: %s", errInvalidDefaults, err)
+	}
+
+	defaultsMu.Lock()
+	defer defaultsMu.Unlock()
+
+	_, err = os.Stat(defaultsPath(template.Name))
+	exists := err == nil
+	if replace && !exists {
+		return template, errDefaultsNotFound
+	}
+	if !replace && exists {
+		return template, errDefaultsExist
+	}
+
+	// Tidied up, so what's kept doesn't depend on how it was sent
+	var compacted bytes.Buffer
+	err = json.Compact(&compacted, template.Defaults)
+	if err != nil {
+		return template, fmt.Errorf("%w: %s", errInvalidDefaults, err)
+	}
+	template.Defaults = compacted.Bytes()
+	template.Updated = time.Now()
+
+	contents, err := json.MarshalIndent(template, "", "  ")
+	if err != nil {
+		return template, fmt.Errorf("web.saveDefaults: Error while encoding %s: %w", template.Name, err)
+	}
+	err = os.MkdirAll(DefaultsDir, 0755)
+	if err != nil {
+		return template, fmt.Errorf("web.saveDefaults: Error while creating %s: %w", DefaultsDir, err)
+	}
+	err = replaceFile(defaultsPath(template.Name), contents)
+	if err != nil {
+		return template, fmt.Errorf("web.saveDefaults: Error while saving %s: %w", template.Name, err)
+	}
+	return template, nil
+}
+
+// deleteDefaults removes the template called name
+func deleteDefaults(name string) error {
+	if DefaultsDir == "" {
+		return errNoDefaultsDir
+	}
+	if !defaultsNamePattern.MatchString(name) {
+		return errDefaultsNotFound
+	}
+
+	defaultsMu.Lock()
+	defer defaultsMu.Unlock()
+
+	err := os.Remove(defaultsPath(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return errDefaultsNotFound
+	}
+	return err
+}
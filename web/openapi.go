@@ -0,0 +1,236 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"main/routers"
+	"main/switches"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const API_V1_PREFIX = "/api/v1"
+
+// apiRoute is one /api/v1 endpoint. Request and Response are zero values of the types sent and received, which the
+// OpenAPI document describes them from.
+type apiRoute struct {
+	Method  string
+	Path    string
+	Summary string
+	Handler http.HandlerFunc
+	Params  []apiParam
+	Request any
+	// http.StatusOK unless given
+	Status   int
+	Response any
+	// Statuses the endpoint can fail with, each sending an ApiError
+	Errors []int
+}
+
+type apiParam struct {
+	Name string
+	// path or query
+	In          string
+	Type        string
+	Description string
+}
+
+// openAPISchemas builds JSON schemas for Go types, keeping named structs as components so they're only described once
+type openAPISchemas struct {
+	components map[string]any
+	// Which type each component name went to, so types with the same name from different packages don't clash
+	names map[string]reflect.Type
+}
+
+func (s *openAPISchemas) ref(name string) map[string]any {
+	return map[string]any{"$ref": "#/components/schemas/" + name}
+}
+
+func (s *openAPISchemas) schema(t reflect.Type) map[string]any {
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		return map[string]any{"type": "string", "format": "date-time"}
+	case reflect.TypeOf(time.Duration(0)):
+		return map[string]any{"type": "integer", "format": "int64", "description": "Nanoseconds"}
+	case reflect.TypeOf(json.RawMessage{}):
+		return map[string]any{"description": "Any JSON"}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		schema := s.schema(t.Elem())
+		if _, isRef := schema["$ref"]; isRef {
+			return map[string]any{"allOf": []any{schema}, "nullable": true}
+		}
+		schema["nullable"] = true
+		return schema
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": s.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": s.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.structSchema(t)
+		}
+		name := t.Name()
+		if other, taken := s.names[name]; taken && other != t {
+			name = fmt.Sprintf("%s.%s", t.PkgPath()[strings.LastIndex(t.PkgPath(), "/")+1:], t.Name())
+		}
+		if _, done := s.names[name]; !done {
+			// Claimed before it's described, in case it refers to itself
+			s.names[name] = t
+			s.components[name] = s.structSchema(t)
+		}
+		return s.ref(name)
+	}
+	return map[string]any{}
+}
+
+// structSchema describes a struct the way encoding/json sends it, with embedded structs' fields brought up a level
+func (s *openAPISchemas) structSchema(t reflect.Type) map[string]any {
+	properties := make(map[string]any)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		name, _, _ := strings.Cut(tag, ",")
+		if name == "-" {
+			continue
+		}
+
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Pointer {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				for key, value := range s.structSchema(embedded)["properties"].(map[string]any) {
+					properties[key] = value
+				}
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = s.schema(field.Type)
+	}
+	return map[string]any{"type": "object", "properties": properties}
+}
+
+// operationId names a route after its method and path, e.g. getJobsJobOutput
+func operationId(route apiRoute) string {
+	id := strings.ToLower(route.Method)
+	for _, part := range strings.Split(route.Path, "/") {
+		part = strings.Trim(part, "{}")
+		part = strings.TrimSuffix(part, ".json")
+		if part != "" {
+			id += strings.ToUpper(part[:1]) + part[1:]
+		}
+	}
+	return id
+}
+
+// openAPI is the OpenAPI document for routes
+func openAPI(routes []apiRoute) map[string]any {
+	schemas := &openAPISchemas{components: make(map[string]any), names: make(map[string]reflect.Type)}
+	errorSchema := schemas.schema(reflect.TypeOf(ApiError{}))
+
+	paths := make(map[string]any)
+	for _, route := range routes {
+		operation := map[string]any{
+			"summary":     route.Summary,
+			"operationId": operationId(route),
+		}
+
+		var params []any
+		for _, param := range route.Params {
+			params = append(params, map[string]any{
+				"name":        param.Name,
+				"in":          param.In,
+				"required":    param.In == "path",
+				"description": param.Description,
+				"schema":      map[string]any{"type": param.Type},
+			})
+		}
+		if params != nil {
+			operation["parameters"] = params
+		}
+
+		if route.Request != nil {
+			operation["requestBody"] = map[string]any{
+				"required": true,
+				"content": map[string]any{
+					"application/json": map[string]any{"schema": schemas.schema(reflect.TypeOf(route.Request))},
+				},
+			}
+		}
+
+		status := route.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		success := map[string]any{"description": http.StatusText(status)}
+		switch response := route.Response.(type) {
+		case nil:
+		case string:
+			success["content"] = map[string]any{"text/plain": map[string]any{"schema": map[string]any{"type": "string"}}}
+		default:
+			success["content"] = map[string]any{"application/json": map[string]any{"schema": schemas.schema(reflect.TypeOf(response))}}
+		}
+		responses := map[string]any{fmt.Sprint(status): success}
+		for _, code := range route.Errors {
+			responses[fmt.Sprint(code)] = map[string]any{
+				"description": http.StatusText(code),
+				"content":     map[string]any{"application/json": map[string]any{"schema": errorSchema}},
+			}
+		}
+		operation["responses"] = responses
+
+		path := API_V1_PREFIX + route.Path
+		if paths[path] == nil {
+			paths[path] = make(map[string]any)
+		}
+		paths[path].(map[string]any)[strings.ToLower(route.Method)] = operation
+	}
+
+	// Templates hold their defaults as raw JSON, so say what shape that takes
+	if template, ok := schemas.components["DefaultsTemplate"].(map[string]any); ok {
+		template["properties"].(map[string]any)["Defaults"] = map[string]any{
+			"oneOf": []any{
+				schemas.schema(reflect.TypeOf(switches.SwitchConfig{})),
+				schemas.schema(reflect.TypeOf(routers.RouterDefaults{})),
+			},
+		}
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "Cisco Resetter Go",
+			"version": "1",
+		},
+		"paths":      paths,
+		"components": map[string]any{"schemas": schemas.components},
+	}
+}
+
+func apiOpenAPI(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, openAPI(apiV1Routes()))
+}
@@ -0,0 +1,187 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// portClaim is who's using a port, so jobs and terminals don't fight over it
+type portClaim struct {
+	// Number of the job using the port, or 0 if it's someone at a terminal
+	Job int
+	Who string
+}
+
+// portWaiter is someone waiting on a port. Higher priorities go first, then whoever started waiting first.
+type portWaiter struct {
+	claim    portClaim
+	priority int
+	seq      int
+}
+
+// Someone taking a port over at a terminal goes before any queued jobs
+const TERMINAL_PRIORITY = math.MaxInt
+
+// Claims on ports and who's waiting on them, keyed by port name. Guarded by portsMu.
+var portClaims = make(map[string]*portClaim)
+var portWaiters = make(map[string][]*portWaiter)
+var portsMu sync.Mutex
+
+// Closed and replaced whenever a port's let go of or someone stops waiting on one. Guarded by portsMu.
+var portsChanged = make(chan struct{})
+var waiterSeq int
+
+func jobClaim(num int) portClaim {
+	return portClaim{Job: num, Who: fmt.Sprintf("job %d", num)}
+}
+
+func (c portClaim) is(other portClaim) bool {
+	return c.Job == other.Job && c.Who == other.Who
+}
+
+// portsChange wakes up everyone waiting on a port. The caller holds portsMu.
+func portsChange() {
+	close(portsChanged)
+	portsChanged = make(chan struct{})
+}
+
+// take gives port to claim. The caller holds portsMu.
+func take(port string, claim portClaim) portClaim {
+	portClaims[port] = &claim
+	return claim
+}
+
+// claimPort takes port for claim, returning who has it instead if it's already taken. Anyone waiting on the port
+// counts as having it, so nobody jumps the queue.
+func claimPort(port string, claim portClaim) (portClaim, bool) {
+	portsMu.Lock()
+	defer portsMu.Unlock()
+
+	port = strings.TrimSpace(port)
+	holder, taken := portClaims[port]
+	if taken {
+		return *holder, false
+	}
+	if len(portWaiters[port]) > 0 {
+		return portWaiters[port][0].claim, false
+	}
+	return take(port, claim), true
+}
+
+// waitForPort takes port for claim once it's been let go of and nobody with a higher priority is waiting on it,
+// giving up once ctx is done
+func waitForPort(ctx context.Context, port string, claim portClaim, priority int) error {
+	portsMu.Lock()
+	port = strings.TrimSpace(port)
+	waiterSeq += 1
+	waiter := &portWaiter{claim: claim, priority: priority, seq: waiterSeq}
+	waiters := append(portWaiters[port], waiter)
+	sort.SliceStable(waiters, func(i, j int) bool {
+		if waiters[i].priority != waiters[j].priority {
+			return waiters[i].priority > waiters[j].priority
+		}
+		return waiters[i].seq < waiters[j].seq
+	})
+	portWaiters[port] = waiters
+	portsMu.Unlock()
+
+	for {
+		portsMu.Lock()
+		_, taken := portClaims[port]
+		if !taken && portWaiters[port][0] == waiter {
+			portWaiters[port] = portWaiters[port][1:]
+			if len(portWaiters[port]) == 0 {
+				delete(portWaiters, port)
+			}
+			take(port, claim)
+			portsMu.Unlock()
+			return nil
+		}
+		holder := "someone waiting on it"
+		if taken {
+			holder = portClaims[port].Who
+		}
+		changed := portsChanged
+		portsMu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			stopWaiting(port, waiter)
+			return fmt.Errorf("%s is still in use by %s: %w", port, holder, ctx.Err())
+		case <-changed:
+		}
+	}
+}
+
+// stopWaiting takes waiter out of port's queue
+func stopWaiting(port string, waiter *portWaiter) {
+	portsMu.Lock()
+	defer portsMu.Unlock()
+
+	waiters := portWaiters[port]
+	for i := range waiters {
+		if waiters[i] == waiter {
+			portWaiters[port] = append(waiters[:i:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(portWaiters[port]) == 0 {
+		delete(portWaiters, port)
+	}
+	portsChange()
+}
+
+// releasePort lets go of port, as long as it's claim that has it
+func releasePort(port string, claim portClaim) {
+	portsMu.Lock()
+	defer portsMu.Unlock()
+
+	port = strings.TrimSpace(port)
+	holder, taken := portClaims[port]
+	if !taken || !holder.is(claim) {
+		return
+	}
+	delete(portClaims, port)
+	portsChange()
+}
+
+// portBusy is true if port is in use or someone's waiting on it
+func portBusy(port string) bool {
+	portsMu.Lock()
+	defer portsMu.Unlock()
+
+	port = strings.TrimSpace(port)
+	_, taken := portClaims[port]
+	return taken || len(portWaiters[port]) > 0
+}
+
+// portUser is who's using port, or nil if nobody is
+func portUser(port string) *portClaim {
+	portsMu.Lock()
+	defer portsMu.Unlock()
+
+	holder, taken := portClaims[strings.TrimSpace(port)]
+	if !taken {
+		return nil
+	}
+	user := *holder
+	return &user
+}
+
+// portQueue is the jobs waiting on port, in the order they'll get it
+func portQueue(port string) []int {
+	portsMu.Lock()
+	defer portsMu.Unlock()
+
+	var queue []int
+	for _, waiter := range portWaiters[strings.TrimSpace(port)] {
+		if waiter.claim.Job != 0 {
+			queue = append(queue, waiter.claim.Job)
+		}
+	}
+	return queue
+}
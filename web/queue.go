@@ -0,0 +1,160 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"main/crglogging"
+	"time"
+)
+
+// Where a job is in its life. Status says what it's doing in more detail.
+const (
+	JOB_QUEUED    = "queued"
+	JOB_RUNNING   = "running"
+	JOB_WAITING   = "waiting-for-operator"
+	JOB_SUCCEEDED = "succeeded"
+	JOB_FAILED    = "failed"
+	JOB_CANCELLED = "cancelled"
+)
+
+// What a job does when its port is busy
+const (
+	// Wait its turn
+	WHEN_BUSY_WAIT = "wait"
+	// Fail straight away
+	WHEN_BUSY_REJECT = "reject"
+)
+
+// Closed once each job has finished, keyed by job number. Guarded by jobsMu.
+var jobsDone = make(map[int]chan struct{})
+
+// finalState is the state a job that's stopped with status ends up in
+func finalState(status string) string {
+	switch status {
+	case "Done":
+		return JOB_SUCCEEDED
+	case "Cancelled", "Cancelling":
+		return JOB_CANCELLED
+	}
+	return JOB_FAILED
+}
+
+// waitForJob waits for job num to finish, returning an error if it didn't succeed
+func waitForJob(ctx context.Context, num int) (Job, error) {
+	jobsMu.Lock()
+	done, running := jobsDone[num]
+	jobsMu.Unlock()
+
+	if running {
+		select {
+		case <-ctx.Done():
+			return Job{}, ctx.Err()
+		case <-done:
+		}
+	}
+
+	job, found := getJob(num)
+	if !found {
+		return job, fmt.Errorf("job %d not found", num)
+	}
+	if job.State != JOB_SUCCEEDED && job.Status != "Done" {
+		return job, fmt.Errorf("job %d didn't succeed, it's %s", num, job.Status)
+	}
+	return job, nil
+}
+
+// failJob marks job num as having errored before it got to run
+func failJob(num int, step string, err error) {
+	updateJob(num, func(job *Job) {
+		job.Status = "Errored"
+		job.Result.Fail(step, err)
+	})
+}
+
+// queueJob adds a job for rules and sets it going, as part of batch batchNum if that isn't 0. The caller holds jobsMu.
+func queueJob(rules RunParams, initiator string, batchNum int) Job {
+	newJob := Job{
+		Number:    nextJobNumber(),
+		Output:    "",
+		Status:    "Created",
+		Params:    rules,
+		Initiator: initiator,
+		Created:   time.Now(),
+		State:     JOB_QUEUED,
+		Batch:     batchNum,
+	}
+	recordStatus(&newJob)
+
+	jobs = append(jobs, newJob)
+	storeJob(newJob)
+	ctx, cancel := context.WithCancel(context.Background())
+	jobCancels[newJob.Number] = cancel
+	jobsDone[newJob.Number] = make(chan struct{})
+
+	go scheduleJob(ctx, rules, newJob.Number)
+	return newJob
+}
+
+// scheduleJob runs job num once the job it's to follow has succeeded and the port is free, with higher priority jobs
+// going first
+func scheduleJob(ctx context.Context, rules RunParams, jobNum int) {
+	webLogger := crglogging.GetLogger(WEB_LOGGER_NAME)
+
+	defer func() {
+		jobsMu.Lock()
+		jobCancels[jobNum]()
+		delete(jobCancels, jobNum)
+		close(jobsDone[jobNum])
+		delete(jobsDone, jobNum)
+		jobsMu.Unlock()
+
+		updateJob(jobNum, func(job *Job) { job.State = finalState(job.Status) })
+		finishFeed(jobNum)
+	}()
+
+	if rules.After != 0 {
+		setJobStatus(jobNum, fmt.Sprintf("Waiting for job %d", rules.After))
+		after, err := waitForJob(ctx, rules.After)
+		if err != nil {
+			webLogger.Errorf("Job %d won't run: %s\n", jobNum, err)
+			if ctx.Err() != nil {
+				setJobStatus(jobNum, "Cancelled")
+			} else {
+				failJob(jobNum, fmt.Sprintf("Waiting for job %d", rules.After), err)
+			}
+			return
+		}
+
+		// It's the same device, so there's no need to work out what it is again
+		if rules.DeviceType == "auto" && after.Params.DeviceType != "auto" {
+			rules.DeviceType = after.Params.DeviceType
+			rules.Profile = after.Params.Profile
+			updateJob(jobNum, func(job *Job) { job.Params = rules })
+		}
+	}
+
+	claim := jobClaim(jobNum)
+	if rules.WhenBusy == WHEN_BUSY_REJECT {
+		user, ok := claimPort(rules.PortConfig.Port, claim)
+		if !ok {
+			webLogger.Errorf("Job %d failed as port %s is in use by %s\n", jobNum, rules.PortConfig.Port, user.Who)
+			failJob(jobNum, "Waiting for the port", fmt.Errorf("%s is in use by %s", rules.PortConfig.Port, user.Who))
+			return
+		}
+	} else {
+		setJobStatus(jobNum, "Queued")
+		err := waitForPort(ctx, rules.PortConfig.Port, claim, rules.Priority)
+		if err != nil {
+			webLogger.Infof("Job %d stopped waiting for port %s: %s\n", jobNum, rules.PortConfig.Port, err)
+			setJobStatus(jobNum, "Cancelled")
+			return
+		}
+	}
+	defer releasePort(rules.PortConfig.Port, claim)
+
+	updateJob(jobNum, func(job *Job) {
+		job.State = JOB_RUNNING
+		job.Status = "Running"
+	})
+	runJob(ctx, rules, jobNum)
+}
@@ -0,0 +1,264 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"main/crglogging"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JobsDir is where jobs are kept so they outlive the server, one JSON file each. Jobs only live in memory if it's
+// empty.
+var JobsDir string
+
+// How often a running job is written out while only its output is changing
+const JOB_SAVE_INTERVAL = 5 * time.Second
+
+const JOBS_PER_PAGE = 25
+
+// StatusChange is when a job's status changed, and what to
+type StatusChange struct {
+	Status string
+	At     time.Time
+}
+
+// When each job was last written out and with what status, keyed by job number. Guarded by jobsMu.
+var jobsSaved = make(map[int]StatusChange)
+
+func jobPath(num int) string {
+	return filepath.Join(JobsDir, fmt.Sprintf("job-%d.json", num))
+}
+
+// recordStatus adds the job's status to its history if it's changed. The caller holds jobsMu.
+func recordStatus(job *Job) {
+	if len(job.History) > 0 && job.History[len(job.History)-1].Status == job.Status {
+		return
+	}
+	job.History = append(job.History, StatusChange{Status: job.Status, At: time.Now()})
+}
+
+// storeJob writes job out if its status has changed, it's finished, or it's been a while. The caller holds jobsMu.
+func storeJob(job Job) {
+	if JobsDir == "" {
+		return
+	}
+
+	saved, ok := jobsSaved[job.Number]
+	if ok && job.Running() && saved.Status == job.Status && time.Since(saved.At) < JOB_SAVE_INTERVAL {
+		return
+	}
+
+	err := saveJob(job)
+	if err != nil {
+		webLogger := crglogging.GetLogger(WEB_LOGGER_NAME)
+		webLogger.Errorf("Job %d couldn't be saved: %s\n", job.Number, err)
+		return
+	}
+	jobsSaved[job.Number] = StatusChange{Status: job.Status, At: time.Now()}
+}
+
+// saveJob writes job to JobsDir, replacing it in one go so a crash never leaves half a job behind
+func saveJob(job Job) error {
+	err := os.MkdirAll(JobsDir, 0755)
+	if err != nil {
+		return fmt.Errorf("web.saveJob: Error while creating %s: %w", JobsDir, err)
+	}
+
+	contents, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return fmt.Errorf("web.saveJob: Error while encoding job %d: %w", job.Number, err)
+	}
+
+	err = replaceFile(jobPath(job.Number), contents)
+	if err != nil {
+		return fmt.Errorf("web.saveJob: Error while saving job %d: %w", job.Number, err)
+	}
+	return nil
+}
+
+// replaceFile writes contents to path through a temporary file, so it's never left half written
+func replaceFile(path string, contents []byte) error {
+	temp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = temp.Write(contents)
+	closeErr := temp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+	}
+	return err
+}
+
+// loadJobs reads the jobs kept in JobsDir. Jobs that were still running when the server stopped are marked as
+// interrupted, as there's nothing left running them.
+func loadJobs() error {
+	if JobsDir == "" {
+		return nil
+	}
+
+	paths, err := filepath.Glob(filepath.Join(JobsDir, "job-*.json"))
+	if err != nil {
+		return fmt.Errorf("web.loadJobs: Error while listing jobs: %w", err)
+	}
+
+	loaded := make([]Job, 0, len(paths))
+	interrupted := make([]Job, 0)
+	for _, path := range paths {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("web.loadJobs: Error while reading %s: %w", path, err)
+		}
+		var job Job
+		err = json.Unmarshal(contents, &job)
+		if err != nil {
+			return fmt.Errorf("web.loadJobs: Error while parsing %s: %w", path, err)
+		}
+		if job.Running() {
+			job.Status = "Interrupted"
+			job.Prompt = nil
+			recordStatus(&job)
+			interrupted = append(interrupted, job)
+		}
+		loaded = append(loaded, job)
+	}
+	sort.Slice(loaded, func(i, j int) bool {
+		return loaded[i].Number < loaded[j].Number
+	})
+
+	jobsMu.Lock()
+	jobs = loaded
+	// Only the jobs that were just interrupted have changed since they were written out
+	for _, job := range interrupted {
+		storeJob(job)
+	}
+	jobsMu.Unlock()
+	return nil
+}
+
+// nextJobNumber is one more than the highest job number so far. The caller holds jobsMu.
+func nextJobNumber() int {
+	next := 1
+	for _, job := range jobs {
+		if job.Number >= next {
+			next = job.Number + 1
+		}
+	}
+	return next
+}
+
+// nextBatchNumber is one more than the highest batch number so far. The caller holds jobsMu.
+func nextBatchNumber() int {
+	next := 1
+	for _, job := range jobs {
+		if job.Batch >= next {
+			next = job.Batch + 1
+		}
+	}
+	return next
+}
+
+// JobFilter narrows down the job list. Empty fields match everything.
+type JobFilter struct {
+	DeviceType string
+	Port       string
+	Status     string
+	Initiator  string
+	// Starting from 1
+	Page int
+}
+
+func parseJobFilter(query url.Values) JobFilter {
+	filter := JobFilter{
+		DeviceType: strings.TrimSpace(query.Get("type")),
+		Port:       strings.TrimSpace(query.Get("port")),
+		Status:     strings.TrimSpace(query.Get("status")),
+		Initiator:  strings.TrimSpace(query.Get("initiator")),
+		Page:       1,
+	}
+	page, err := strconv.Atoi(query.Get("page"))
+	if err == nil && page > 1 {
+		filter.Page = page
+	}
+	return filter
+}
+
+func (f JobFilter) matches(job Job) bool {
+	return (f.DeviceType == "" || strings.EqualFold(job.Params.DeviceType, f.DeviceType) || strings.EqualFold(job.Device.Type, f.DeviceType)) &&
+		(f.Port == "" || strings.TrimSpace(job.Params.PortConfig.Port) == f.Port) &&
+		(f.Status == "" || strings.EqualFold(job.Status, f.Status) || strings.EqualFold(job.State, f.Status)) &&
+		(f.Initiator == "" || job.Initiator == f.Initiator)
+}
+
+// Query is the filter as a query string for page, for links to other pages
+func (f JobFilter) Query(page int) template.URL {
+	query := url.Values{}
+	for key, value := range map[string]string{"type": f.DeviceType, "port": f.Port, "status": f.Status, "initiator": f.Initiator} {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+	query.Set("page", strconv.Itoa(page))
+	return template.URL(query.Encode())
+}
+
+// JobPage is one page of the jobs a filter matched, newest first
+type JobPage struct {
+	Filter JobFilter
+	Jobs   []Job
+	// How many jobs matched across every page
+	Total int
+	Pages int
+}
+
+func (p JobPage) Previous() int {
+	if p.Filter.Page <= 1 {
+		return 0
+	}
+	return p.Filter.Page - 1
+}
+
+func (p JobPage) Next() int {
+	if p.Filter.Page >= p.Pages {
+		return 0
+	}
+	return p.Filter.Page + 1
+}
+
+// findJobs gets the page of jobs filter asks for
+func findJobs(filter JobFilter) JobPage {
+	page := JobPage{Filter: filter}
+	all := listJobs()
+	for i := len(all) - 1; i >= 0; i-- {
+		if filter.matches(all[i]) {
+			page.Jobs = append(page.Jobs, all[i])
+		}
+	}
+
+	page.Total = len(page.Jobs)
+	page.Pages = (page.Total + JOBS_PER_PAGE - 1) / JOBS_PER_PAGE
+	start := (filter.Page - 1) * JOBS_PER_PAGE
+	if start >= page.Total {
+		page.Jobs = nil
+		return page
+	}
+	end := start + JOBS_PER_PAGE
+	if end > page.Total {
+		end = page.Total
+	}
+	page.Jobs = page.Jobs[start:end]
+	return page
+}
@@ -0,0 +1,293 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"main/crglogging"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// jobEvent is something that's happened on a job, as sent to whoever's streaming it
+type jobEvent struct {
+	// output for a line of the job's log, job for a change to the job itself, or end once it's finished
+	Name string
+	Data string
+}
+
+// jobFeed fans a running job's events out to everyone streaming it
+type jobFeed struct {
+	mu sync.Mutex
+	// Every line of output so far, so anyone joining late can catch up. Once the job's finished, its output is read
+	// from the job instead.
+	output      []jobEvent
+	lastJob     string
+	subscribers map[chan jobEvent]bool
+	finished    bool
+}
+
+// Feeds for every running job, keyed by job number. Guarded by jobsMu.
+var jobFeeds = make(map[int]*jobFeed)
+
+// How many events a subscriber can fall behind by before it's cut off, so nobody streaming holds up the job
+const STREAM_BACKLOG = 256
+
+func newJobFeed() *jobFeed {
+	return &jobFeed{subscribers: make(map[chan jobEvent]bool)}
+}
+
+// feedFor gets job num's feed, which is nil if there's no such job or it's finished without one. The caller holds
+// jobsMu.
+func feedFor(num int) *jobFeed {
+	feed, ok := jobFeeds[num]
+	if !ok {
+		jobIdx := findJob(num)
+		if jobIdx == -1 || !jobs[jobIdx].Running() {
+			return nil
+		}
+		feed = newJobFeed()
+		jobFeeds[num] = feed
+	}
+	return feed
+}
+
+// withoutOutput is job without its output and transcript, which are too big to send every time it changes
+func withoutOutput(job Job) Job {
+	job.Output = ""
+	job.Transcript = ""
+	return job
+}
+
+// jobSnapshot is job as sent in a job event, without the output that's streamed line by line
+func jobSnapshot(job Job) string {
+	snapshot, err := json.Marshal(withoutOutput(job))
+	if err != nil {
+		return "{}"
+	}
+	return string(snapshot)
+}
+
+// publish sends event to every subscriber, cutting off any that have fallen too far behind. The caller holds f.mu.
+func (f *jobFeed) publish(event jobEvent) {
+	for subscriber := range f.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+			delete(f.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+}
+
+// jobChanged lets the job's subscribers know about a change to it. Changes to the output alone aren't sent, as
+// outputAdded streams those. The caller holds jobsMu.
+func jobChanged(job Job) {
+	feed := feedFor(job.Number)
+	if feed == nil {
+		return
+	}
+	snapshot := jobSnapshot(job)
+
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+
+	if feed.finished || snapshot == feed.lastJob {
+		return
+	}
+	feed.lastJob = snapshot
+	feed.publish(jobEvent{Name: "job", Data: snapshot})
+}
+
+// outputAdded streams output that's just been added to the end of job num's output, a line at a time
+func outputAdded(num int, output string) {
+	if output == "" {
+		return
+	}
+
+	jobsMu.Lock()
+	feed := feedFor(num)
+	jobsMu.Unlock()
+	if feed == nil {
+		return
+	}
+
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+
+	if feed.finished {
+		return
+	}
+	for _, event := range outputEvents(output) {
+		feed.output = append(feed.output, event)
+		feed.publish(event)
+	}
+}
+
+// outputEvents is an event for each line of output
+func outputEvents(output string) []jobEvent {
+	if output == "" {
+		return nil
+	}
+	lines := strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+	events := make([]jobEvent, 0, len(lines))
+	for _, line := range lines {
+		events = append(events, jobEvent{Name: "output", Data: line})
+	}
+	return events
+}
+
+// finishFeed tells everyone streaming job num that it's over, then lets go of its feed. Anyone streaming it after gets
+// its output from the job.
+func finishFeed(num int) {
+	jobsMu.Lock()
+	feed, ok := jobFeeds[num]
+	delete(jobFeeds, num)
+	jobIdx := findJob(num)
+	snapshot := ""
+	if jobIdx != -1 {
+		snapshot = jobSnapshot(jobs[jobIdx])
+	}
+	jobsMu.Unlock()
+	if !ok {
+		return
+	}
+
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+
+	if snapshot != "" && snapshot != feed.lastJob {
+		feed.lastJob = snapshot
+		feed.publish(jobEvent{Name: "job", Data: snapshot})
+	}
+	feed.publish(jobEvent{Name: "end"})
+	feed.finished = true
+	feed.output = nil
+	for subscriber := range feed.subscribers {
+		delete(feed.subscribers, subscriber)
+		close(subscriber)
+	}
+}
+
+// subscribe gets what's happened on the job so far, and a channel for what happens next that's closed when the job
+// finishes. The channel is nil if it's already finished.
+func (f *jobFeed) subscribe() ([]jobEvent, chan jobEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	history := append([]jobEvent{}, f.output...)
+	if f.lastJob != "" {
+		history = append(history, jobEvent{Name: "job", Data: f.lastJob})
+	}
+	if f.finished {
+		return append(history, jobEvent{Name: "end"}), nil
+	}
+
+	events := make(chan jobEvent, STREAM_BACKLOG)
+	f.subscribers[events] = true
+	return history, events
+}
+
+func (f *jobFeed) unsubscribe(events chan jobEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.subscribers[events] {
+		delete(f.subscribers, events)
+		close(events)
+	}
+}
+
+// writeEvent sends event in the Server-Sent Events format
+func writeEvent(w http.ResponseWriter, event jobEvent) error {
+	_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Name, event.Data)
+	return err
+}
+
+// Streams a job's output and changes to it as Server-Sent Events, starting with everything that's happened so far
+func streamJobApi(w http.ResponseWriter, r *http.Request) {
+	webLogger := crglogging.GetLogger(WEB_LOGGER_NAME)
+
+	vars := mux.Vars(r)
+
+	reqJob, err := strconv.Atoi(vars["job"])
+	if err != nil {
+		webLogger.Errorf("streamJobApi: Requested job %s is invalid\n", vars["job"])
+		http.Error(w, "Invalid job given", http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		webLogger.Errorf("streamJobApi: Responses can't be streamed\n")
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	jobsMu.Lock()
+	jobIdx := findJob(reqJob)
+	var job Job
+	var feed *jobFeed
+	if jobIdx != -1 {
+		job = jobs[jobIdx]
+		feed = feedFor(reqJob)
+	}
+	if feed != nil {
+		// Make sure there's something to start from
+		feed.mu.Lock()
+		if feed.lastJob == "" {
+			feed.lastJob = jobSnapshot(job)
+		}
+		feed.mu.Unlock()
+	}
+	jobsMu.Unlock()
+	if jobIdx == -1 {
+		webLogger.Errorf("streamJobApi: Requested job %d not found\n", reqJob)
+		http.Error(w, fmt.Sprintf("Job %d not found", reqJob), http.StatusNotFound)
+		return
+	}
+	webLogger.Infof("streamJobApi: %s is streaming job %d\n", r.RemoteAddr, reqJob)
+
+	var history []jobEvent
+	var events chan jobEvent
+	if feed != nil {
+		history, events = feed.subscribe()
+	} else {
+		// A finished job has nothing more coming, so everything it has comes from the job itself
+		history = append(outputEvents(job.Output), jobEvent{Name: "job", Data: jobSnapshot(job)}, jobEvent{Name: "end"})
+	}
+	if events != nil {
+		defer feed.unsubscribe(events)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	for _, event := range history {
+		err = writeEvent(w, event)
+		if err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	for events != nil {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			err = writeEvent(w, event)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"go.bug.st/serial"
+	"html/template"
+	"main/common"
+	"main/crglogging"
+	"main/templates"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How long taking over a port from a job waits for the job to let go of it
+const TAKEOVER_TIMEOUT = 30 * time.Second
+
+// How long a break sent from the terminal lasts
+const TERMINAL_BREAK = 500 * time.Millisecond
+
+var upgrader = websocket.Upgrader{}
+
+// TerminalHelper is what the terminal page needs
+type TerminalHelper struct {
+	Port string
+	// Who's using the port, if anyone is
+	User *portClaim
+	// Set when the terminal should take the port off the job using it
+	Takeover bool
+	// The page's query string, which is passed on to the terminal's WebSocket
+	Query template.URL
+}
+
+// terminalMessage is what the browser sends down the WebSocket
+type terminalMessage struct {
+	// input for keystrokes in Data, or break to send a break
+	Type string `json:"type"`
+	Data string `json:"data"`
+}
+
+// terminalMode reads the port and its settings from the query, defaulting to 9600 8N1
+func terminalMode(query url.Values) (string, serial.Mode, error) {
+	mode := common.DefaultMode()
+	port := query.Get("port")
+	if port == "" {
+		return port, mode, fmt.Errorf("no port given")
+	}
+
+	var err error
+	if query.Get("baud") != "" {
+		mode.BaudRate, err = strconv.Atoi(query.Get("baud"))
+		if err != nil {
+			return port, mode, fmt.Errorf("invalid baud rate %s", query.Get("baud"))
+		}
+	}
+	if query.Get("data") != "" {
+		mode.DataBits, err = strconv.Atoi(query.Get("data"))
+		if err != nil {
+			return port, mode, fmt.Errorf("invalid data bits %s", query.Get("data"))
+		}
+	}
+	if query.Get("parity") != "" {
+		mode.Parity, err = common.ParseParity(query.Get("parity"))
+		if err != nil {
+			return port, mode, err
+		}
+	}
+	if query.Get("stop") != "" {
+		mode.StopBits, err = common.ParseStopBits(query.Get("stop"))
+		if err != nil {
+			return port, mode, err
+		}
+	}
+	return port, mode, nil
+}
+
+func terminalPage(w http.ResponseWriter, r *http.Request) {
+	webLogger := crglogging.GetLogger(WEB_LOGGER_NAME)
+
+	layoutTemplate, err := template.New("layout").Parse(templates.Layout)
+	if err != nil {
+		webLogger.Errorf(err.Error())
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	terminalTemplate, err := layoutTemplate.Parse(templates.Terminal)
+	if err != nil {
+		webLogger.Errorf(err.Error())
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	webLogger.Infof("terminalPage: %s requested %s\n", r.RemoteAddr, filepath.Clean(r.URL.Path))
+
+	port, _, err := terminalMode(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	helper := TerminalHelper{
+		Port:     port,
+		User:     portUser(port),
+		Takeover: r.URL.Query().Get("takeover") == "1",
+		Query:    template.URL(r.URL.RawQuery),
+	}
+	err = terminalTemplate.ExecuteTemplate(w, "layout", helper)
+	if err != nil {
+		webLogger.Errorf("Error while executing template: %s\n", err)
+		http.Error(w, http.StatusText(500), 500)
+	}
+}
+
+// closeTerminal ends the WebSocket, telling the browser why
+func closeTerminal(conn *websocket.Conn, code int, reason string) {
+	message := websocket.FormatCloseMessage(code, reason)
+	_ = conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+	conn.Close()
+}
+
+// Bridges a WebSocket to a serial port or remote console, for as long as nothing else is using it
+func terminalApi(w http.ResponseWriter, r *http.Request) {
+	webLogger := crglogging.GetLogger(WEB_LOGGER_NAME)
+
+	portName, mode, err := terminalMode(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		webLogger.Errorf("terminalApi: Couldn't open a WebSocket for %s: %s\n", r.RemoteAddr, err)
+		return
+	}
+
+	claim := portClaim{Who: fmt.Sprintf("a terminal for %s", r.RemoteAddr)}
+	user, ok := claimPort(portName, claim)
+	if !ok && user.Job != 0 && r.URL.Query().Get("takeover") == "1" {
+		// Hand the port over once the job's let go of it
+		webLogger.Infof("terminalApi: %s is taking %s over from job %d\n", r.RemoteAddr, portName, user.Job)
+		cancelJob(user.Job)
+		ctx, cancel := context.WithTimeout(r.Context(), TAKEOVER_TIMEOUT)
+		err = waitForPort(ctx, portName, claim, TERMINAL_PRIORITY)
+		cancel()
+		ok = err == nil
+	}
+	if !ok {
+		closeTerminal(conn, websocket.CloseTryAgainLater, fmt.Sprintf("%s is in use by %s", portName, user.Who))
+		return
+	}
+	defer releasePort(portName, claim)
+
+	port, err := common.OpenConsole(portName, mode)
+	if err != nil {
+		webLogger.Errorf("terminalApi: Couldn't open %s: %s\n", portName, err)
+		closeTerminal(conn, websocket.CloseInternalServerErr, fmt.Sprintf("Couldn't open %s: %s", portName, err))
+		return
+	}
+	defer port.Close()
+	webLogger.Infof("terminalApi: %s opened a terminal on %s\n", r.RemoteAddr, portName)
+
+	err = port.SetReadTimeout(100 * time.Millisecond)
+	if err != nil {
+		closeTerminal(conn, websocket.CloseInternalServerErr, err.Error())
+		return
+	}
+
+	// Only one thing can write to the WebSocket at a time
+	var writeMu sync.Mutex
+	send := func(messageType int, data []byte) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+
+		return conn.WriteMessage(messageType, data)
+	}
+
+	// Whatever the device says goes straight to the browser
+	closed := make(chan bool)
+	go func() {
+		buff := make([]byte, 4096)
+		for {
+			select {
+			case <-closed:
+				return
+			default:
+			}
+			n, err := port.Read(buff)
+			if err != nil {
+				closeTerminal(conn, websocket.CloseGoingAway, fmt.Sprintf("Lost %s: %s", portName, err))
+				return
+			}
+			if n == 0 {
+				continue
+			}
+			err = send(websocket.BinaryMessage, buff[:n])
+			if err != nil {
+				return
+			}
+		}
+	}()
+	defer close(closed)
+
+	for {
+		var message terminalMessage
+		err = conn.ReadJSON(&message)
+		if err != nil {
+			webLogger.Infof("terminalApi: %s closed the terminal on %s\n", r.RemoteAddr, portName)
+			return
+		}
+
+		switch message.Type {
+		case "input":
+			_, err = port.Write([]byte(message.Data))
+		case "break":
+			err = common.SendBreak(port, common.BreakStrategy{Method: common.BREAK_SERIAL, Duration: TERMINAL_BREAK})
+		}
+		if err != nil {
+			webLogger.Warningf("terminalApi: Error while sending %s to %s: %s\n", message.Type, portName, err)
+			_ = send(websocket.TextMessage, []byte(fmt.Sprintf("\r\n[%s]\r\n", err)))
+		}
+	}
+}
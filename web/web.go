@@ -2,6 +2,7 @@ package web
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -20,19 +21,54 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 var server = &http.Server{}
 
 type Job struct {
-	Number     int
-	Output     string
-	Status     string
-	Initiator  string
-	Params     RunParams
-	LoggerName string
-	MemLog     string
+	Number    int
+	Output    string
+	Status    string
+	Initiator string
+	Params    RunParams
+	Result    common.Result
+	// What the device turned out to be
+	Device common.Device
+	// Question the job is waiting on someone to answer, nil when it isn't waiting
+	Prompt *JobPrompt
+	// JOB_QUEUED, JOB_RUNNING and so on, while Status is what it's up to in more detail
+	State string
+	// Which steps the flows have been through and how long each took
+	Progress common.Progress
+	Created  time.Time
+	History  []StatusChange
+	// Everything the device sent, as it was sent
+	Transcript string
+	// Number of the batch the job was started as part of, or 0 if it was started on its own
+	Batch int `json:",omitempty"`
+}
+
+// Running is true until the job has finished one way or another
+func (j Job) Running() bool {
+	switch j.State {
+	case JOB_SUCCEEDED, JOB_FAILED, JOB_CANCELLED:
+		return false
+	}
+	// Jobs from before there were states only have their status to go on
+	switch j.Status {
+	case "Done", "Failed", "Cancelled", "Errored", "Interrupted":
+		return false
+	}
+	return true
+}
+
+// JobPrompt is a question a running job has for whoever's at the device
+type JobPrompt struct {
+	Message string
+	// Answers to pick from. A single option is just an acknowledgement.
+	Options []string
 }
 
 type IndexHelper struct {
@@ -40,6 +76,12 @@ type IndexHelper struct {
 	Jobs        []Job
 }
 
+// PortStatus is a port along with who's using it, if anyone is
+type PortStatus struct {
+	*enumerator.PortDetails
+	User *portClaim
+}
+
 type RunParams struct {
 	PortConfig       SerialConfiguration
 	DeviceType       string
@@ -49,6 +91,30 @@ type RunParams struct {
 	DefaultsFile     string
 	DefaultsContents string
 	BackupConfig     common.Backup
+	Profile          common.Profile
+	// Overrides the profile's break method once it's known
+	BreakMethod string
+	// What to do when the flow needs someone to do something or make a call: ASK_POLICY, POLICY_CONTINUE or
+	// POLICY_ABORT
+	Policy string
+	// Jobs waiting on the same port with higher priorities go first
+	Priority int
+	// WHEN_BUSY_WAIT or WHEN_BUSY_REJECT
+	WhenBusy string
+	// Number of a job that has to succeed before this one runs, such as a reset before applying defaults
+	After int
+	// How the defaults get onto the device
+	Apply common.ApplyOptions
+}
+
+// checkApply makes sure the job's defaults can be applied the way it asks. Until an auto-detected device is known, the
+// interface a switch would fill in can't be, so that's left to the flow.
+func checkApply(rules RunParams) error {
+	apply := rules.Apply
+	if rules.DeviceType == common.AUTO_PROFILE {
+		apply = apply.ForDevice(common.SWITCH)
+	}
+	return apply.Check()
 }
 
 type SerialConfiguration struct {
@@ -60,10 +126,59 @@ type SerialConfiguration struct {
 	ShortHand string
 }
 
+// shortHand is the settings written the usual way, e.g. 9600 8n1
+func (c SerialConfiguration) shortHand() string {
+	truncated := fmt.Sprintf("%.1f", c.StopBits)
+	if strings.HasSuffix(truncated, ".0") {
+		truncated = truncated[:len(truncated)-2]
+	}
+	parity := byte('?')
+	if c.Parity != "" {
+		parity = c.Parity[0]
+	}
+	return fmt.Sprintf("%d %d%c%s", c.BaudRate, c.DataBits, parity, truncated)
+}
+
 const WEB_LOGGER_NAME = "WebLogger"
 
+// ASK_POLICY puts the flow's questions on the job page
+const ASK_POLICY = "ask"
+
 var jobs []Job
-var updateChan = make(chan bool)
+
+// Jobs run in parallel, so anything touching jobs holds jobsMu
+var jobsMu sync.Mutex
+
+// Cancels the jobs that are still running, keyed by job number. Also guarded by jobsMu.
+var jobCancels = make(map[int]context.CancelFunc)
+
+// Where answers to the jobs' prompts go, keyed by job number. Also guarded by jobsMu.
+var jobAnswers = make(map[int]chan string)
+
+// RemoteConsoles are the tcp:// and telnet:// consoles offered alongside the local serial ports
+var RemoteConsoles []string
+
+// listPorts gets the local serial ports, followed by any configured remote consoles
+func listPorts() ([]*enumerator.PortDetails, error) {
+	ports, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		return ports, err
+	}
+
+	for _, console := range RemoteConsoles {
+		ports = append(ports, &enumerator.PortDetails{
+			Name:    strings.TrimSpace(console),
+			Product: "Remote console",
+		})
+	}
+
+	return ports, nil
+}
+
+// initiator is the address a request came from, without its port
+func initiator(r *http.Request) string {
+	return strings.Join(strings.Split(r.RemoteAddr, ":")[:len(strings.Split(r.RemoteAddr, ":"))-1], ":")
+}
 
 func findJob(num int) int {
 	for i, job := range jobs {
@@ -74,39 +189,177 @@ func findJob(num int) int {
 	return -1
 }
 
-func snitchOutput(c chan bool, job int) {
-	webLogger := crglogging.GetLogger(WEB_LOGGER_NAME)
+// updateJob runs change on job num while holding jobsMu, returning false if the job doesn't exist
+func updateJob(num int, change func(job *Job)) bool {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
 
-	jobIdx := findJob(job)
+	jobIdx := findJob(num)
 	if jobIdx == -1 {
-		webLogger.Errorf("snitchOutput: Could not find job %d\n", job)
+		return false
 	}
+	change(&jobs[jobIdx])
+	recordStatus(&jobs[jobIdx])
+	jobChanged(jobs[jobIdx])
+	storeJob(jobs[jobIdx])
+	return true
+}
 
-	jobLogger := crglogging.GetLogger(jobs[jobIdx].LoggerName)
+// getJob copies job num so it can be read without holding jobsMu, returning false if the job doesn't exist
+func getJob(num int) (Job, bool) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
 
-	for !strings.Contains(strings.TrimSpace(jobs[jobIdx].Output), "---EOF---") {
-		contents, err := jobLogger.GetMemLogContents("WebHandler")
-		if err != nil {
-			webLogger.Errorf("Could not get web logger for job %d. Error: %s\n", jobs[jobIdx].Number, err)
+	jobIdx := findJob(num)
+	if jobIdx == -1 {
+		return Job{}, false
+	}
+	return jobs[jobIdx], true
+}
+
+func setJobStatus(num int, status string) {
+	updateJob(num, func(job *Job) { job.Status = status })
+}
+
+// listJobs copies the jobs so they can be read without holding jobsMu
+func listJobs() []Job {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+
+	return append([]Job{}, jobs...)
+}
+
+// jobLogged adds a record the job's session has just logged to the end of its output and streams it
+func jobLogged(num int, record string) {
+	output := record + "\n"
+	if !updateJob(num, func(job *Job) { job.Output += output }) {
+		return
+	}
+	outputAdded(num, output)
+}
+
+// finishFlow records the result of a flow on the job, returning false if the job can't carry on
+func finishFlow(session *common.Session, jobNum int, flow string, result common.Result) bool {
+	webLogger := crglogging.GetLogger(WEB_LOGGER_NAME)
+
+	updateJob(jobNum, func(job *Job) {
+		job.Result = result
+		job.Device = session.Device()
+		if errors.Is(result.Err, context.Canceled) {
+			job.Status = "Cancelled"
+		} else if !result.Success {
+			job.Status = "Failed"
 		}
+	})
+	if result.Success {
+		return true
+	}
 
-		jobs[jobIdx].Output = ""
+	webLogger.Errorf("Job %d failed to %s while %s: %s\n", jobNum, flow, strings.ToLower(result.FailedStep), result.Err)
+	session.Logger().Errorf("Failed while %s: %s\n", strings.ToLower(result.FailedStep), result.Err)
 
-		for buffLine := contents.Buff.Head(); buffLine != nil; buffLine = buffLine.Next() {
-			if buffLine.Record.Formatted(0) != buffLine.Record.Message() {
-				jobs[jobIdx].Output += fmt.Sprintf("%s\n", buffLine.Record.Formatted(3))
-			}
+	return false
+}
+
+// cancelJob stops a running job, returning false if it isn't running
+func cancelJob(num int) bool {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+
+	cancel, ok := jobCancels[num]
+	if !ok {
+		return false
+	}
+	cancel()
+
+	jobIdx := findJob(num)
+	if jobIdx != -1 {
+		jobs[jobIdx].Status = "Cancelling"
+		recordStatus(&jobs[jobIdx])
+		jobChanged(jobs[jobIdx])
+		storeJob(jobs[jobIdx])
+	}
+	return true
+}
+
+// askOperator puts a prompt on job num's page, waiting until it's answered with one of options or ctx is done
+func askOperator(ctx context.Context, num int, message string, options []string) (string, error) {
+	answers := make(chan string, 1)
+
+	jobsMu.Lock()
+	jobIdx := findJob(num)
+	if jobIdx == -1 {
+		jobsMu.Unlock()
+		return "", fmt.Errorf("web.askOperator: Job %d not found", num)
+	}
+	jobs[jobIdx].Prompt = &JobPrompt{Message: message, Options: options}
+	jobs[jobIdx].State = JOB_WAITING
+	jobAnswers[num] = answers
+	jobChanged(jobs[jobIdx])
+	jobsMu.Unlock()
+
+	defer func() {
+		jobsMu.Lock()
+		defer jobsMu.Unlock()
+
+		delete(jobAnswers, num)
+		jobIdx := findJob(num)
+		if jobIdx != -1 {
+			jobs[jobIdx].Prompt = nil
+			jobs[jobIdx].State = JOB_RUNNING
+			jobChanged(jobs[jobIdx])
 		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case answer := <-answers:
+		return answer, nil
+	}
+}
 
-		delimited := strings.Split(jobs[jobIdx].Output, "\n")
-		webLogger.Infof("Line count on job %d: %d\n", job, len(delimited))
-		webLogger.Infof("snitchOutput: Serial output on job %d: %s\n", jobs[jobIdx].Number, jobs[jobIdx].Output)
-		<-c
+// answerJob answers the prompt job num is waiting on, returning an error if it isn't waiting or answer isn't an option
+func answerJob(num int, answer string) error {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+
+	answers, ok := jobAnswers[num]
+	jobIdx := findJob(num)
+	if !ok || jobIdx == -1 || jobs[jobIdx].Prompt == nil {
+		return fmt.Errorf("job %d isn't waiting on an answer", num)
 	}
-	jobs[jobIdx].Status = "EOF"
+	for _, option := range jobs[jobIdx].Prompt.Options {
+		if option == answer {
+			// Only the first answer counts
+			delete(jobAnswers, num)
+			jobs[jobIdx].Prompt = nil
+			jobs[jobIdx].State = JOB_RUNNING
+			jobChanged(jobs[jobIdx])
+			answers <- answer
+			return nil
+		}
+	}
+	return fmt.Errorf("%q isn't one of the answers to %q", answer, jobs[jobIdx].Prompt.Message)
+}
+
+// operatorPolicy asks whoever's watching the job page
+type operatorPolicy struct {
+	jobNum int
+}
+
+func (p operatorPolicy) Pause(ctx context.Context, message string) error {
+	_, err := askOperator(ctx, p.jobNum, message, []string{"Done"})
+	return err
+}
+
+func (p operatorPolicy) Confirm(ctx context.Context, question string) (bool, error) {
+	answer, err := askOperator(ctx, p.jobNum, question, []string{"Yes", "No"})
+	return answer == "Yes", err
 }
 
-func runJob(rules RunParams, jobNum int) {
+// runJob runs job num's flows. It's up to scheduleJob to make sure the port's free first.
+func runJob(ctx context.Context, rules RunParams, jobNum int) {
 	webLogger := crglogging.GetLogger(WEB_LOGGER_NAME)
 
 	mode := &serial.Mode{
@@ -136,82 +389,113 @@ func runJob(rules RunParams, jobNum int) {
 		mode.StopBits = serial.OnePointFiveStopBits
 	}
 
+	port, err := common.OpenConsole(rules.PortConfig.Port, *mode)
+	if err != nil {
+		webLogger.Errorf("Job %d failed while opening port %s: %s\n", jobNum, rules.PortConfig.Port, err)
+		setJobStatus(jobNum, "Errored")
+		return
+	}
+	defer port.Close()
+
+	session := common.NewSession(port, fmt.Sprintf("Job%d", jobNum), nil, rules.Verbose)
+	session.OnOutput(func(record string) { jobLogged(jobNum, record) })
+	defer session.Close()
+	if rules.Policy == ASK_POLICY {
+		session.SetPolicy(operatorPolicy{jobNum})
+	} else {
+		policy, err := common.NewPolicy(rules.Policy, 0)
+		if err != nil {
+			webLogger.Errorf("Job %d failed: %s\n", jobNum, err)
+			setJobStatus(jobNum, "Errored")
+			return
+		}
+		session.SetPolicy(policy)
+	}
+	session.OnProgress(func(progress common.Progress) {
+		updateJob(jobNum, func(job *Job) { job.Progress = progress })
+	})
+
+	defer func() {
+		// The one marker for the end of the job, however many flows it ran
+		session.OutputInfo("---EOF---")
+		transcript := bytes.Join(session.Transcript(), nil)
+		updateJob(jobNum, func(job *Job) { job.Transcript = string(transcript) })
+	}()
+
+	if rules.DeviceType == "auto" {
+		setJobStatus(jobNum, "Detecting")
+		device, err := common.Identify(ctx, session)
+		updateJob(jobNum, func(job *Job) { job.Device = device })
+		if err != nil {
+			webLogger.Errorf("Job %d failed while identifying the device: %s\n", jobNum, err)
+			session.Logger().Errorf("Failed while identifying the device: %s\n", err)
+			if errors.Is(err, context.Canceled) {
+				setJobStatus(jobNum, "Cancelled")
+			} else {
+				setJobStatus(jobNum, "Errored")
+			}
+			return
+		}
+
+		rules.DeviceType = device.Type
+		rules.Profile, err = common.FindProfile(device.Type, device.Profile)
+		if err != nil {
+			webLogger.Errorf("Job %d failed: %s\n", jobNum, err)
+			setJobStatus(jobNum, "Errored")
+			return
+		}
+		updateJob(jobNum, func(job *Job) { job.Params = rules })
+	}
+	if rules.BreakMethod != "" {
+		rules.Profile.Break.Method = rules.BreakMethod
+	}
+
 	if rules.DeviceType == "switch" {
 		if rules.Reset {
-			jobIdx := findJob(jobNum)
-			if jobIdx == -1 {
-				webLogger.Errorf("How did we get here?\nJob number for switch requested: %d\nGot index %d\n", jobNum, jobIdx)
-				jobs[jobIdx].Status = "Errored"
-			} else {
-				go switches.Reset(rules.PortConfig.Port, *mode, rules.BackupConfig, rules.Verbose, updateChan)
-				time.Sleep(5 * time.Second)
-				jobs[jobIdx].LoggerName = switches.LoggerName
-				go snitchOutput(updateChan, jobNum)
-				jobs[jobIdx].Status = "Resetting"
-				for jobs[jobIdx].Status != "EOF" {
-					time.Sleep(1 * time.Minute)
-				}
-				jobs[jobIdx].Status = "Finished resetting"
+			setJobStatus(jobNum, "Resetting")
+			if !finishFlow(session, jobNum, "reset", switches.Reset(ctx, session, rules.Profile, rules.BackupConfig)) {
+				return
 			}
+			setJobStatus(jobNum, "Finished resetting")
 		}
 		if rules.Defaults {
 			var defaults switches.SwitchConfig
 			err := json.Unmarshal([]byte(rules.DefaultsContents), &defaults)
 			if err != nil {
 				webLogger.Warningf("Job %d failed: %s\n", jobNum, err)
+				setJobStatus(jobNum, "Errored")
 				return
 			}
 
-			go switches.Defaults(rules.PortConfig.Port, *mode, defaults, rules.Verbose, updateChan)
-			jobIdx := findJob(jobNum)
-			time.Sleep(5 * time.Second)
-			jobs[jobIdx].LoggerName = switches.LoggerName
-			go snitchOutput(updateChan, jobNum)
-			jobs[jobIdx].Status = "Applying defaults"
-			for jobs[jobIdx].Status != "EOF" {
-				time.Sleep(1 * time.Minute)
+			setJobStatus(jobNum, "Applying defaults")
+			if !finishFlow(session, jobNum, "apply defaults", switches.Defaults(ctx, session, rules.Profile, defaults, rules.Apply)) {
+				return
 			}
-			jobs[jobIdx].Status = "Finished resetting"
 		}
-		jobIdx := findJob(jobNum)
-		jobs[jobIdx].Status = "Done"
+		setJobStatus(jobNum, "Done")
 	} else if rules.DeviceType == "router" {
 		if rules.Reset {
-			go routers.Reset(rules.PortConfig.Port, *mode, rules.BackupConfig, rules.Verbose, updateChan)
-			jobIdx := findJob(jobNum)
-			if jobIdx == -1 {
-				webLogger.Errorf("How did we get here? Job number for switch requested: %d\n", jobNum)
-			} else {
-				time.Sleep(5 * time.Second)
-				jobs[jobIdx].LoggerName = routers.LoggerName
-				go snitchOutput(updateChan, jobNum)
-				jobs[jobIdx].Status = "Resetting"
-				for jobs[jobIdx].Status != "EOF" {
-					time.Sleep(1 * time.Minute)
-				}
+			setJobStatus(jobNum, "Resetting")
+			if !finishFlow(session, jobNum, "reset", routers.Reset(ctx, session, rules.Profile, rules.BackupConfig)) {
+				return
 			}
+			setJobStatus(jobNum, "Finished resetting")
 		}
 		if rules.Defaults {
 			var defaults routers.RouterDefaults
 			err := json.Unmarshal([]byte(rules.DefaultsContents), &defaults)
 			if err != nil {
 				webLogger.Warningf("Job %d failed: %s\n", jobNum, err)
+				setJobStatus(jobNum, "Errored")
 				return
 			}
 
-			go routers.Defaults(rules.PortConfig.Port, *mode, defaults, rules.Verbose, updateChan)
-			jobIdx := findJob(jobNum)
-			time.Sleep(5 * time.Second)
-			jobs[jobIdx].LoggerName = routers.LoggerName
-			go snitchOutput(updateChan, jobNum)
-			jobs[jobIdx].Status = "Applying defaults"
-			for jobs[jobIdx].Status != "EOF" {
-				time.Sleep(1 * time.Minute)
+			setJobStatus(jobNum, "Applying defaults")
+			if !finishFlow(session, jobNum, "apply defaults", routers.Defaults(ctx, session, rules.Profile, defaults, rules.Apply)) {
+				return
 			}
 		}
-
-		jobIdx := findJob(jobNum)
-		jobs[jobIdx].Status = "Done"
+		setJobStatus(jobNum, "Done")
 	}
 }
 
@@ -247,7 +531,7 @@ func newClientApi(w http.ResponseWriter, r *http.Request) {
 	webLogger.Infof("clientHandler: %s requested %s\n", r.RemoteAddr, filepath.Clean(r.URL.Path))
 
 	if r.Method == "POST" {
-		ports, err := enumerator.GetDetailedPortsList()
+		ports, err := listPorts()
 		if err != nil {
 			// Log the detailed error
 			webLogger.Errorf(err.Error())
@@ -281,36 +565,10 @@ func newClientApi(w http.ResponseWriter, r *http.Request) {
 func clientJobApi(w http.ResponseWriter, r *http.Request) {
 	webLogger := crglogging.GetLogger(WEB_LOGGER_NAME)
 
+	// Jobs can't be changed through here any more, only through /api/v1
 	w.Header().Set("Content-Type", "application/json")
-	if r.Method == "POST" {
-		rawBody, err := io.ReadAll(r.Body)
-		if err != nil {
-			webLogger.Errorf(err.Error())
-			http.Error(w, http.StatusText(400), 400)
-			return
-		}
-
-		webLogger.Infof("clientJobApi: %s sent data to %s\n", r.RemoteAddr, filepath.Clean(r.URL.Path))
-
-		var body Job
-		err = json.Unmarshal(rawBody, &body)
-		if err != nil {
-			webLogger.Errorf("clientJobApi: Error while unmarshalling data from %s: %s\n", r.RemoteAddr, err.Error())
-			http.Error(w, http.StatusText(400), 400)
-			return
-		}
-
-		jobIdx := findJob(body.Number)
-		if jobIdx == -1 {
-			webLogger.Errorf("Job %d could not be found.\n", body.Number)
-			http.Error(w, http.StatusText(404), 404)
-			return
-		}
-		jobs[jobIdx] = body
-
-		webLogger.Infof("Updated job %d info from client %s\n", body.Number, r.RemoteAddr)
-
-		jsonJob, err := json.Marshal(jobs)
+	if r.Method == "GET" {
+		jsonJob, err := json.Marshal(listJobs())
 		if err != nil {
 			webLogger.Errorf(err.Error())
 			http.Error(w, http.StatusText(500), 500)
@@ -323,21 +581,112 @@ func clientJobApi(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, http.StatusText(500), 500)
 		}
 		return
-	} else if r.Method == "GET" {
-		jsonJob, err := json.Marshal(jobs)
-		if err != nil {
-			webLogger.Errorf(err.Error())
-			http.Error(w, http.StatusText(500), 500)
-		}
+	}
+}
 
-		w.Header().Set("Content-Type", "application/json")
-		_, err = w.Write(jsonJob)
-		if err != nil {
-			webLogger.Errorf(err.Error())
-			http.Error(w, http.StatusText(500), 500)
+// Cancel a running job
+func cancelJobApi(w http.ResponseWriter, r *http.Request) {
+	webLogger := crglogging.GetLogger(WEB_LOGGER_NAME)
+
+	vars := mux.Vars(r)
+
+	reqJob, err := strconv.Atoi(vars["job"])
+	if err != nil {
+		webLogger.Errorf("cancelJobApi: Requested job %s is invalid\n", vars["job"])
+		http.Error(w, "Invalid job given", http.StatusBadRequest)
+		return
+	}
+
+	job, found := getJob(reqJob)
+	if !found {
+		webLogger.Errorf("cancelJobApi: Requested job %d not found\n", reqJob)
+		http.Error(w, fmt.Sprintf("Job %d not found", reqJob), http.StatusNotFound)
+		return
+	}
+
+	if !cancelJob(reqJob) {
+		webLogger.Warningf("cancelJobApi: %s tried to cancel job %d, which isn't running\n", r.RemoteAddr, reqJob)
+		http.Error(w, fmt.Sprintf("Job %d isn't running", reqJob), http.StatusConflict)
+		return
+	}
+
+	webLogger.Infof("cancelJobApi: %s cancelled job %d\n", r.RemoteAddr, reqJob)
+
+	// The job page cancels through a form, so send it back there
+	if r.PostFormValue("redirect") == "1" {
+		http.Redirect(w, r, fmt.Sprintf("/jobs/%d/", reqJob), http.StatusSeeOther)
+		return
+	}
+
+	job, _ = getJob(reqJob)
+	jsonJob, err := json.Marshal(job)
+	if err != nil {
+		webLogger.Errorf(err.Error())
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_, err = w.Write(jsonJob)
+	if err != nil {
+		webLogger.Errorf(err.Error())
+	}
+}
+
+func answerJobApi(w http.ResponseWriter, r *http.Request) {
+	webLogger := crglogging.GetLogger(WEB_LOGGER_NAME)
+
+	vars := mux.Vars(r)
+
+	reqJob, err := strconv.Atoi(vars["job"])
+	if err != nil {
+		webLogger.Errorf("answerJobApi: Requested job %s is invalid\n", vars["job"])
+		http.Error(w, "Invalid job given", http.StatusBadRequest)
+		return
+	}
+
+	job, found := getJob(reqJob)
+	if !found {
+		webLogger.Errorf("answerJobApi: Requested job %d not found\n", reqJob)
+		http.Error(w, fmt.Sprintf("Job %d not found", reqJob), http.StatusNotFound)
+		return
+	}
+
+	answer := r.PostFormValue("answer")
+	err = answerJob(reqJob, answer)
+	if err != nil {
+		webLogger.Warningf("answerJobApi: %s couldn't answer job %d: %s\n", r.RemoteAddr, reqJob, err)
+		status := http.StatusBadRequest
+		if job.Prompt == nil {
+			status = http.StatusConflict
 		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	webLogger.Infof("answerJobApi: %s answered job %d with %s\n", r.RemoteAddr, reqJob, answer)
+
+	// The job page answers through a form, so send it back there
+	if r.PostFormValue("redirect") == "1" {
+		http.Redirect(w, r, fmt.Sprintf("/jobs/%d/", reqJob), http.StatusSeeOther)
+		return
+	}
+
+	job, _ = getJob(reqJob)
+	jsonJob, err := json.Marshal(job)
+	if err != nil {
+		webLogger.Errorf(err.Error())
+		http.Error(w, http.StatusText(500), 500)
 		return
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_, err = w.Write(jsonJob)
+	if err != nil {
+		webLogger.Errorf(err.Error())
+	}
 }
 
 func portConfig(w http.ResponseWriter, r *http.Request) {
@@ -363,7 +712,7 @@ func portConfig(w http.ResponseWriter, r *http.Request) {
 
 	webLogger.Infof("portConfig: %s requested %s\n", r.RemoteAddr, filepath.Clean(r.URL.Path))
 
-	data, err := enumerator.GetDetailedPortsList()
+	data, err := listPorts()
 	if err != nil {
 		// Log the detailed error
 		webLogger.Errorf(err.Error())
@@ -403,7 +752,7 @@ func jobListHandler(w http.ResponseWriter, r *http.Request) {
 
 	webLogger.Infof("jobListHandler: %s requested %s\n", r.RemoteAddr, filepath.Clean(r.URL.Path))
 
-	err = jobsTemplate.ExecuteTemplate(w, "layout", jobs)
+	err = jobsTemplate.ExecuteTemplate(w, "layout", findJobs(parseJobFilter(r.URL.Query())))
 	if err != nil {
 		// Log the detailed error
 		webLogger.Errorf(err.Error())
@@ -434,7 +783,7 @@ func portListHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	webLogger.Infof("port: %s requested %s\n", r.RemoteAddr, filepath.Clean(r.URL.Path))
 
-	ports, err := enumerator.GetDetailedPortsList()
+	ports, err := listPorts()
 	if err != nil {
 		// Log the detailed error
 		webLogger.Errorf(err.Error())
@@ -443,7 +792,12 @@ func portListHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = portsTemplate.ExecuteTemplate(w, "layout", ports)
+	statuses := make([]PortStatus, 0, len(ports))
+	for _, port := range ports {
+		statuses = append(statuses, PortStatus{PortDetails: port, User: portUser(port.Name)})
+	}
+
+	err = portsTemplate.ExecuteTemplate(w, "layout", statuses)
 	if err != nil {
 		// Log the detailed error
 		webLogger.Errorf(err.Error())
@@ -485,30 +839,12 @@ func jobHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var job Job
-
-	jobIdx := findJob(reqJob)
-	if jobIdx == -1 {
+	job, found := getJob(reqJob)
+	if !found {
 		webLogger.Errorf("jobHandler: Requested job %d not found\n", reqJob)
 		http.Error(w, fmt.Sprintf("Job %d not found", reqJob), http.StatusTeapot)
 		return
 	}
-	job = jobs[jobIdx]
-
-	// Get job output from log buffer
-	// TODO: Is getting this at runtime better than storing it in the job contents?
-	jobLogger := crglogging.GetLogger(job.LoggerName)
-	job.Output = ""
-	contents, err := jobLogger.GetMemLogContents("WebHandler")
-	if err != nil {
-		webLogger.Errorf("Could not get web logger for job %d. Error: %s\n", jobs[jobIdx].Number, err)
-	}
-
-	for buffLine := contents.Buff.Head(); buffLine != nil; buffLine = buffLine.Next() {
-		if buffLine.Record.Formatted(0) != buffLine.Record.Message() {
-			job.Output += fmt.Sprintf("%s\n", buffLine.Record.Formatted(3))
-		}
-	}
 
 	// Determine the amount of lines to print out if requested
 	if len(r.URL.Query().Get("lines")) != 0 {
@@ -531,7 +867,7 @@ func jobHandler(w http.ResponseWriter, r *http.Request) {
 	err = jobTemplate.ExecuteTemplate(w, "layout", job)
 	if err != nil {
 		// Log the detailed error
-		webLogger.Errorf("An error occurred while executing the template for job %d: %s\n", jobIdx, err.Error())
+		webLogger.Errorf("An error occurred while executing the template for job %d: %s\n", reqJob, err.Error())
 		// Return a generic "Internal Server Error" message
 		http.Error(w, http.StatusText(500), 500)
 		return
@@ -601,13 +937,40 @@ func deviceConfig(w http.ResponseWriter, r *http.Request) {
 		serialConf.StopBits = -1
 	}
 
-	err = deviceTemplate.ExecuteTemplate(w, "layout", serialConf)
+	// Set when queueing a job to run after another one on the same device
+	after, _ := strconv.Atoi(r.PostFormValue("after"))
+
+	page := struct {
+		SerialConfiguration
+		Profiles []common.Profile
+		After    int
+	}{serialConf, common.ListProfiles(""), after}
+
+	err = deviceTemplate.ExecuteTemplate(w, "layout", page)
 	if err != nil {
 		webLogger.Errorf("Error while executing template: %s\n", err)
 		http.Error(w, http.StatusText(500), 500)
 	}
 }
 
+// resolveProfile finds the profile a job runs with. Picking a model says what sort of device it is, otherwise it's
+// left to be detected when the job runs.
+func resolveProfile(deviceType string, profileName string) (string, common.Profile, error) {
+	var profile common.Profile
+	var err error
+	if deviceType == common.AUTO_PROFILE && profileName != "" && !strings.EqualFold(profileName, common.AUTO_PROFILE) {
+		profile, err = common.FindProfile("", profileName)
+		if err != nil {
+			return deviceType, profile, err
+		}
+		deviceType = profile.Type
+	}
+	if deviceType != common.AUTO_PROFILE {
+		profile, err = common.FindProfile(deviceType, profileName)
+	}
+	return deviceType, profile, err
+}
+
 func resetDevice(w http.ResponseWriter, r *http.Request) {
 	webLogger := crglogging.GetLogger(WEB_LOGGER_NAME)
 
@@ -659,12 +1022,7 @@ func resetDevice(w http.ResponseWriter, r *http.Request) {
 		rules.PortConfig.StopBits = -1
 	}
 
-	// Build the shorthand version
-	truncated := fmt.Sprintf("%.1f", rules.PortConfig.StopBits)
-	if strings.HasSuffix(truncated, ".0") {
-		truncated = truncated[:len(truncated)-2]
-	}
-	rules.PortConfig.ShortHand = fmt.Sprintf("%d %d%c%s", rules.PortConfig.BaudRate, rules.PortConfig.DataBits, rules.PortConfig.Parity[0], truncated)
+	rules.PortConfig.ShortHand = rules.PortConfig.shortHand()
 
 	// Format some more HTML results to be presented in a table
 	rules.DeviceType = r.PostFormValue("device")
@@ -695,21 +1053,52 @@ func resetDevice(w http.ResponseWriter, r *http.Request) {
 	rules.BackupConfig.Destination = r.PostFormValue("destination")
 	rules.BackupConfig.UseBuiltIn = r.PostFormValue("builtin") == "builtin"
 
-	webLogger.Debugf("POST Data: %+v\n", rules)
+	rules.DeviceType, rules.Profile, err = resolveProfile(rules.DeviceType, r.PostFormValue("profile"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rules.BreakMethod = r.PostFormValue("break")
 
-	jobNum := len(jobs) + 1
+	// TFTP uses the same address and server as backing up
+	rules.Apply = common.ApplyOptions{
+		Method:    r.PostFormValue("apply"),
+		Interface: r.PostFormValue("apply_interface"),
+		OnError:   r.PostFormValue("on_error"),
+	}
+	if rules.Apply.Method == common.APPLY_TFTP {
+		rules.Apply.Server = rules.BackupConfig.Destination
+		rules.Apply.Source = rules.BackupConfig.Source
+		rules.Apply.SubnetMask = rules.BackupConfig.SubnetMask
+	}
+	rules.Apply = rules.Apply.ForDevice(rules.DeviceType)
+	err = checkApply(rules)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	newJob := Job{
-		Number:    jobNum,
-		Output:    "",
-		Status:    "Created",
-		Params:    rules,
-		Initiator: strings.Join(strings.Split(r.RemoteAddr, ":")[:len(strings.Split(r.RemoteAddr, ":"))-1], ":"),
+	rules.Policy = r.PostFormValue("policy")
+	if rules.Policy != common.POLICY_ABORT && rules.Policy != common.POLICY_CONTINUE {
+		rules.Policy = ASK_POLICY
 	}
 
-	jobs = append(jobs, newJob)
+	rules.Priority, _ = strconv.Atoi(r.PostFormValue("priority"))
+	rules.After, _ = strconv.Atoi(r.PostFormValue("after"))
+	rules.WhenBusy = r.PostFormValue("when_busy")
+	if rules.WhenBusy != WHEN_BUSY_REJECT {
+		rules.WhenBusy = WHEN_BUSY_WAIT
+	}
+	if rules.WhenBusy == WHEN_BUSY_REJECT && portBusy(rules.PortConfig.Port) {
+		http.Error(w, fmt.Sprintf("%s is busy", rules.PortConfig.Port), http.StatusConflict)
+		return
+	}
+
+	webLogger.Debugf("POST Data: %+v\n", rules)
 
-	go runJob(rules, jobNum)
+	jobsMu.Lock()
+	newJob := queueJob(rules, initiator(r), 0)
+	jobsMu.Unlock()
 
 	err = resetTemplate.ExecuteTemplate(w, "layout", newJob)
 	if err != nil {
@@ -755,6 +1144,10 @@ func builderHome(w http.ResponseWriter, r *http.Request) {
 		}
 
 		var formattedJson []byte
+		// Preview shows the commands the template would send instead of downloading it
+		preview := r.PostFormValue("preview") != ""
+		var rendered common.RenderedConfig
+		var renderErr error
 
 		if devType == "switch" {
 			// Build out json file
@@ -882,6 +1275,9 @@ func builderHome(w http.ResponseWriter, r *http.Request) {
 			sshConfig.Enable = r.PostFormValue("sshenable") == "enablessh"
 
 			createdTemplate.Ssh = sshConfig
+			if preview {
+				rendered, renderErr = switches.Render(common.DefaultSwitchProfile(), createdTemplate)
+			}
 
 			formattedJson, err = json.Marshal(createdTemplate)
 			if err != nil {
@@ -979,6 +1375,9 @@ func builderHome(w http.ResponseWriter, r *http.Request) {
 			sshConfig.Enable = r.PostFormValue("sshenable") == "enablessh"
 
 			createdTemplate.Ssh = sshConfig
+			if preview {
+				rendered, renderErr = routers.Render(common.DefaultRouterProfile(), createdTemplate)
+			}
 
 			formattedJson, err = json.Marshal(createdTemplate)
 			if err != nil {
@@ -989,6 +1388,17 @@ func builderHome(w http.ResponseWriter, r *http.Request) {
 			w.Header().Add("Content-Disposition", "attachment; filename=\"router_defaults.json\"")
 		}
 
+		if preview {
+			w.Header().Del("Content-Disposition")
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			if renderErr != nil {
+				http.Error(w, renderErr.Error(), http.StatusBadRequest)
+				return
+			}
+			fmt.Fprint(w, rendered.String())
+			return
+		}
+
 		w.Header().Add("Content-Length", fmt.Sprintf("%d", len(string(formattedJson))))
 
 		fmt.Fprintf(w, string(formattedJson))
@@ -1054,7 +1464,7 @@ func serveIndex(w http.ResponseWriter, r *http.Request) {
 
 	webLogger.Infof("serveIndex: %s requested %s\n", r.RemoteAddr, filepath.Clean(r.URL.Path))
 
-	serialPorts, err := enumerator.GetDetailedPortsList()
+	serialPorts, err := listPorts()
 	if err != nil {
 		// Log the detailed error
 		webLogger.Errorf("An error occurred while getting the list of serial ports: %s\n", err.Error())
@@ -1062,7 +1472,7 @@ func serveIndex(w http.ResponseWriter, r *http.Request) {
 
 	// Because templates have to only take one struct, we have to have a special struct just for it
 	var indexHelper IndexHelper
-	indexHelper.Jobs = jobs
+	indexHelper.Jobs = listJobs()
 	indexHelper.SerialPorts = serialPorts
 
 	err = indexTemplate.ExecuteTemplate(w, "layout", indexHelper)
@@ -1102,13 +1512,24 @@ func ServeWeb() {
 	muxer.HandleFunc("/device/{port}/{baud}/", deviceConfig).Methods("POST")
 	muxer.HandleFunc("/device/{port}/{baud}/{data}/{parity}/{stop}/", deviceConfig).Methods("POST")
 	muxer.HandleFunc("/reset/", resetDevice).Methods("POST")
+	muxer.HandleFunc("/batch/", batchHome).Methods("GET")
+	muxer.HandleFunc("/batch/", startBatch).Methods("POST")
+	muxer.HandleFunc("/batch/{batch}/", batchHandler).Methods("GET")
+	muxer.HandleFunc("/api/batch/{batch}/", batchApi).Methods("GET")
 	muxer.HandleFunc("/list/jobs/", jobListHandler).Methods("GET")
 	muxer.HandleFunc("/jobs/{id}/", jobHandler).Methods("GET")
 	muxer.HandleFunc("/api/client/{client}/", newClientApi).Methods("GET", "POST")
-	muxer.HandleFunc("/api/jobs/{job}/", clientJobApi).Methods("GET", "POST")
+	muxer.HandleFunc("/api/jobs/{job}/", clientJobApi).Methods("GET")
+	muxer.HandleFunc("/api/jobs/{job}/cancel/", cancelJobApi).Methods("POST")
+	muxer.HandleFunc("/api/jobs/{job}/answer/", answerJobApi).Methods("POST")
+	muxer.HandleFunc("/terminal/", terminalPage).Methods("GET")
+	muxer.HandleFunc("/api/terminal/", terminalApi).Methods("GET")
+	muxer.HandleFunc("/api/jobs/{job}/stream", streamJobApi).Methods("GET")
+	muxer.HandleFunc("/api/jobs/{job}/stream/", streamJobApi).Methods("GET")
 	muxer.HandleFunc("/builder/", builderHome).Methods("GET")
 	muxer.HandleFunc("/builder/{device}/", builderHome).Methods("GET", "POST")
 	muxer.HandleFunc("/api/debug/{function}/", debugTools).Methods("GET")
+	registerApiV1(muxer)
 
 	server = &http.Server{
 		Handler:      muxer,
@@ -1119,9 +1540,14 @@ func ServeWeb() {
 
 	webLogger := crglogging.New(WEB_LOGGER_NAME)
 
+	err := loadJobs()
+	if err != nil {
+		webLogger.Fatalf("Error while loading jobs from %s: %s\n", JobsDir, err)
+	}
+
 	webLogger.Infof("Listening on %s\n", server.Addr)
 
-	err := server.ListenAndServe()
+	err = server.ListenAndServe()
 	defer server.Close()
 	webLogger.Debugf("ALLOWDEBUGENDPOINTS: %s\n", os.Getenv("ALLOWDEBUGENDPOINTS"))
 	if os.Getenv("ALLOWDEBUGENDPOINTS") == "1" && errors.Is(err, http.ErrServerClosed) {
@@ -3,11 +3,18 @@ package web
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/gorilla/mux"
 	"io"
+	"main/common"
+	"main/crglogging"
 	"mime/multipart"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"os/exec"
 	"strings"
@@ -30,8 +37,8 @@ type resetParams struct {
 	Parity string `json:"parity"`
 	Stop   string `json:"stop"`
 
-	Device  string `json:"string"`
-	Verbose string `json:"string"`
+	Device  string `json:"device"`
+	Verbose string `json:"verbose"`
 	Reset   string `json:"reset"`
 }
 
@@ -409,7 +416,7 @@ func TestApiClient(t *testing.T) {
 	t.SkipNow()
 }
 
-// Legal methods: GET, POST
+// Legal methods: GET
 // Legal paths: /api/jobs/{job}/
 func TestApiJobs(t *testing.T) {
 	t.SkipNow()
@@ -508,3 +515,688 @@ func TestBuilderDevice(t *testing.T) {
 		})
 	}
 }
+
+// Legal methods: POST
+// Legal paths: /builder/{device}/
+func TestBuilderPreview(t *testing.T) {
+	if crglogging.GetLogger(WEB_LOGGER_NAME) == nil {
+		crglogging.New(WEB_LOGGER_NAME)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/builder/{device}/", builderHome).Methods("GET", "POST")
+
+	preview := func(device string, form url.Values) *httptest.ResponseRecorder {
+		form.Set("preview", "preview")
+		request := httptest.NewRequest("POST", "/builder/"+device+"/", strings.NewReader(form.Encode()))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	recorder := preview("switch", url.Values{"hostname": {"S1"}, "vlan": {"1"}, "vlanTag0": {"10"}})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Previewing a switch got %d: %s", recorder.Code, recorder.Body)
+	}
+	if recorder.Header().Get("Content-Disposition") != "" {
+		t.Errorf("Preview is sent as a download")
+	}
+	for _, expected := range []string{"conf t\n", "inter vlan 10\n", " no shutdown\n", "hostname S1\n", "end\n"} {
+		if !strings.Contains(recorder.Body.String(), expected) {
+			t.Errorf("Switch preview is missing %q:\n%s", expected, recorder.Body)
+		}
+	}
+
+	recorder = preview("router", url.Values{"sshbits": {"0"}, "consoleportcount": {"1"}, "portType0": {"vty"}, "portRangeStart0": {"4"}, "portRangeEnd0": {"1"}})
+	if recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), "Start line 4 is greater than end line 1") {
+		t.Errorf("Previewing a router with a backwards line range got %d: %s", recorder.Code, recorder.Body)
+	}
+}
+
+// Legal methods: POST
+// Legal paths: /api/jobs/{job}/answer/
+func TestJobPrompt(t *testing.T) {
+	if crglogging.GetLogger(WEB_LOGGER_NAME) == nil {
+		crglogging.New(WEB_LOGGER_NAME)
+	}
+	jobsMu.Lock()
+	jobs = append(jobs, Job{Number: 1000, Status: "Resetting"})
+	jobsMu.Unlock()
+
+	answer := func(job string, value string) int {
+		request := httptest.NewRequest("POST", "/api/jobs/"+job+"/answer/", strings.NewReader("answer="+value))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		request = mux.SetURLVars(request, map[string]string{"job": job})
+		recorder := httptest.NewRecorder()
+		answerJobApi(recorder, request)
+		return recorder.Code
+	}
+
+	if code := answer("1000", "Yes"); code != http.StatusConflict {
+		t.Errorf("Answering a job that isn't asking anything gave %d, want %d", code, http.StatusConflict)
+	}
+	if code := answer("1001", "Yes"); code != http.StatusNotFound {
+		t.Errorf("Answering a job that doesn't exist gave %d, want %d", code, http.StatusNotFound)
+	}
+
+	confirmed := make(chan bool, 1)
+	go func() {
+		yes, err := operatorPolicy{1000}.Confirm(context.Background(), "Would you like to continue without backing up?")
+		if err != nil {
+			t.Error(err)
+		}
+		confirmed <- yes
+	}()
+
+	// Wait for the question to show up on the job
+	for asked := false; !asked; {
+		updateJob(1000, func(job *Job) { asked = job.Prompt != nil })
+		time.Sleep(time.Millisecond)
+	}
+	if code := answer("1000", "Maybe"); code != http.StatusBadRequest {
+		t.Errorf("Answering with something that isn't an option gave %d, want %d", code, http.StatusBadRequest)
+	}
+	if code := answer("1000", "No"); code != http.StatusAccepted {
+		t.Errorf("Answering gave %d, want %d", code, http.StatusAccepted)
+	}
+
+	select {
+	case yes := <-confirmed:
+		if yes {
+			t.Error("Answering No confirmed it")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Confirm didn't return after being answered")
+	}
+}
+
+// Legal methods: GET
+// Legal paths: /api/jobs/{job}/stream/
+func TestStreamJob(t *testing.T) {
+	if crglogging.GetLogger(WEB_LOGGER_NAME) == nil {
+		crglogging.New(WEB_LOGGER_NAME)
+	}
+	jobsMu.Lock()
+	jobs = append(jobs, Job{Number: 2000, Status: "Created"})
+	jobsMu.Unlock()
+	outputAdded(2000, "Already said\n")
+
+	muxer := mux.NewRouter()
+	muxer.HandleFunc("/api/jobs/{job}/stream/", streamJobApi)
+	server := httptest.NewServer(muxer)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/api/jobs/2000/stream/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("Content-Type = %s", resp.Header.Get("Content-Type"))
+	}
+
+	events := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if scanner.Text() != "" {
+				events <- scanner.Text()
+			}
+		}
+		close(events)
+	}()
+	next := func() string {
+		select {
+		case event := <-events:
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for an event")
+			return ""
+		}
+	}
+
+	// What's happened so far comes first
+	for _, want := range []string{"event: output", "data: Already said", "event: job"} {
+		if got := next(); got != want {
+			t.Fatalf("Got %q, want %q", got, want)
+		}
+	}
+	next()
+
+	setJobStatus(2000, "Resetting")
+	if got := next(); got != "event: job" {
+		t.Fatalf("Got %q after a status change", got)
+	}
+	if got := next(); !strings.Contains(got, `"Status":"Resetting"`) {
+		t.Errorf("Job event was %q", got)
+	}
+
+	outputAdded(2000, "Something new\n")
+	for _, want := range []string{"event: output", "data: Something new"} {
+		if got := next(); got != want {
+			t.Fatalf("Got %q, want %q", got, want)
+		}
+	}
+
+	finishFeed(2000)
+	if got := next(); got != "event: end" {
+		t.Fatalf("Got %q, want the end", got)
+	}
+	next()
+	if _, open := <-events; open {
+		t.Error("Stream carried on after the job finished")
+	}
+
+	// Once it's finished, its output comes from the job rather than being kept around a second time
+	jobsMu.Lock()
+	_, kept := jobFeeds[2000]
+	jobsMu.Unlock()
+	if kept {
+		t.Error("Job 2000's feed was kept after it finished")
+	}
+	updateJob(2000, func(job *Job) {
+		job.Status = "Done"
+		job.Output = "Already said\nSomething new\n"
+	})
+	finished, err := http.Get(server.URL + "/api/jobs/2000/stream/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer finished.Body.Close()
+	body, _ := io.ReadAll(finished.Body)
+	if !strings.HasPrefix(string(body), "event: output\ndata: Already said\n\nevent: output\ndata: Something new\n\n") ||
+		!strings.HasSuffix(string(body), "event: end\ndata: \n\n") {
+		t.Errorf("Streaming the finished job got:\n%s", body)
+	}
+}
+
+func TestJobLogged(t *testing.T) {
+	jobsMu.Lock()
+	jobs = append(jobs, Job{Number: 2001, Status: "Resetting"})
+	feed := feedFor(2001)
+	jobsMu.Unlock()
+
+	session := common.NewSession(nil, t.Name(), nil, false)
+	session.OnOutput(func(record string) { jobLogged(2001, record) })
+	session.OutputInfo("First")
+	session.Logger().Debug("Not verbose")
+	session.OutputInfo("Second")
+
+	// Each record's there as soon as it's logged, however much has come before it
+	job, _ := getJob(2001)
+	lines := strings.Split(strings.TrimSuffix(job.Output, "\n"), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], "First") || !strings.Contains(lines[1], "Second") {
+		t.Errorf("Output = %q, want First then Second", job.Output)
+	}
+	history, events := feed.subscribe()
+	defer feed.unsubscribe(events)
+	if len(history) < 2 || history[1].Name != "output" || history[1].Data != lines[1] {
+		t.Errorf("Streamed %+v, want both lines", history)
+	}
+}
+
+func TestPortClaims(t *testing.T) {
+	job := jobClaim(3000)
+	_, ok := claimPort("/dev/ttyTEST", job)
+	if !ok {
+		t.Fatal("Couldn't claim a free port")
+	}
+	user := portUser("/dev/ttyTEST")
+	if user == nil || user.Job != 3000 {
+		t.Fatalf("portUser = %v", user)
+	}
+
+	terminal := portClaim{Who: "a terminal"}
+	holder, ok := claimPort("/dev/ttyTEST", terminal)
+	if ok || holder.Who != "job 3000" {
+		t.Fatalf("Claimed a port held by %s", holder.Who)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	err := waitForPort(ctx, "/dev/ttyTEST", terminal, 0)
+	cancel()
+	if err == nil {
+		t.Fatal("Got a port that was never let go of")
+	}
+
+	// Someone else's release doesn't count
+	releasePort("/dev/ttyTEST", terminal)
+	if portUser("/dev/ttyTEST") == nil {
+		t.Fatal("Released a port held by someone else")
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		releasePort("/dev/ttyTEST", job)
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = waitForPort(ctx, "/dev/ttyTEST", terminal, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user = portUser("/dev/ttyTEST")
+	if user == nil || user.Who != "a terminal" {
+		t.Fatalf("portUser = %v", user)
+	}
+	releasePort("/dev/ttyTEST", terminal)
+	if portUser("/dev/ttyTEST") != nil {
+		t.Fatal("Port still claimed after release")
+	}
+}
+
+func TestJobStore(t *testing.T) {
+	if crglogging.GetLogger(WEB_LOGGER_NAME) == nil {
+		crglogging.New(WEB_LOGGER_NAME)
+	}
+	jobsMu.Lock()
+	before := jobs
+	jobs = nil
+	jobsMu.Unlock()
+	JobsDir = t.TempDir()
+	defer func() {
+		jobsMu.Lock()
+		jobs = before
+		jobsMu.Unlock()
+		JobsDir = ""
+	}()
+
+	jobsMu.Lock()
+	for i := 0; i < JOBS_PER_PAGE+2; i++ {
+		job := Job{Number: nextJobNumber(), Status: "Created", Initiator: "10.0.0.1", Created: time.Now()}
+		job.Params.DeviceType = "switch"
+		job.Params.PortConfig.Port = "/dev/ttyUSB0"
+		if i%2 == 1 {
+			job.Params.DeviceType = "router"
+			job.Params.PortConfig.Port = "/dev/ttyUSB1"
+		}
+		recordStatus(&job)
+		jobs = append(jobs, job)
+		storeJob(job)
+	}
+	jobsMu.Unlock()
+	// Output alone doesn't get written out straight away, but it goes with the next change of status
+	updateJob(1, func(job *Job) { job.Output = "Resetting the switch\n" })
+	setJobStatus(1, "Resetting")
+	setJobStatus(2, "Resetting")
+	setJobStatus(2, "Done")
+
+	// As if the server had been restarted
+	jobsMu.Lock()
+	jobs = nil
+	jobsMu.Unlock()
+	finished, err := os.Stat(jobPath(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = loadJobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only what was interrupted gets written out again
+	reloaded, err := os.Stat(jobPath(2))
+	if err != nil || !reloaded.ModTime().Equal(finished.ModTime()) {
+		t.Errorf("Job 2 was written out again when it was loaded")
+	}
+
+	jobsMu.Lock()
+	count := len(jobs)
+	next := nextJobNumber()
+	jobsMu.Unlock()
+	if count != JOBS_PER_PAGE+2 || next != JOBS_PER_PAGE+3 {
+		t.Fatalf("Loaded %d jobs with %d next, want %d and %d", count, next, JOBS_PER_PAGE+2, JOBS_PER_PAGE+3)
+	}
+
+	first, _ := getJob(1)
+	second, _ := getJob(2)
+	if first.Status != "Interrupted" || first.Output != "Resetting the switch\n" {
+		t.Errorf("Job 1 was loaded as %q with output %q", first.Status, first.Output)
+	}
+	statuses := make([]string, 0, len(second.History))
+	for _, change := range second.History {
+		statuses = append(statuses, change.Status)
+	}
+	if strings.Join(statuses, ",") != "Created,Resetting,Done" {
+		t.Errorf("Job 2's history is %v", statuses)
+	}
+
+	page := findJobs(JobFilter{Page: 1})
+	if page.Total != JOBS_PER_PAGE+2 || page.Pages != 2 || len(page.Jobs) != JOBS_PER_PAGE || page.Jobs[0].Number != JOBS_PER_PAGE+2 {
+		t.Errorf("First page has %d of %d jobs over %d pages", len(page.Jobs), page.Total, page.Pages)
+	}
+	page = findJobs(JobFilter{Page: 2})
+	if len(page.Jobs) != 2 || page.Next() != 0 || page.Previous() != 1 {
+		t.Errorf("Second page has %d jobs", len(page.Jobs))
+	}
+	page = findJobs(parseJobFilter(url.Values{"type": {"router"}, "status": {"done"}}))
+	if page.Total != 1 || page.Jobs[0].Number != 2 {
+		t.Errorf("Filtering found %d jobs", page.Total)
+	}
+	page = findJobs(parseJobFilter(url.Values{"port": {"/dev/ttyUSB0"}, "initiator": {"10.0.0.1"}}))
+	if page.Total != (JOBS_PER_PAGE+3)/2 {
+		t.Errorf("Filtering by port found %d jobs", page.Total)
+	}
+
+	muxer := mux.NewRouter()
+	muxer.HandleFunc("/list/jobs/", jobListHandler)
+	server := httptest.NewServer(muxer)
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/list/jobs/?type=switch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "Jobs: 14") {
+		t.Errorf("Job list returned %d:\n%s", resp.StatusCode, body)
+	}
+}
+
+func TestJobQueue(t *testing.T) {
+	if crglogging.GetLogger(WEB_LOGGER_NAME) == nil {
+		crglogging.New(WEB_LOGGER_NAME)
+	}
+
+	// Higher priorities go first, whenever they started waiting
+	holder := jobClaim(4000)
+	_, ok := claimPort("/dev/ttyQUEUE", holder)
+	if !ok {
+		t.Fatal("Couldn't claim a free port")
+	}
+	got := make(chan int, 2)
+	for i, waiter := range []struct{ job, priority int }{{4001, 0}, {4002, 5}} {
+		waiter := waiter
+		go func() {
+			err := waitForPort(context.Background(), "/dev/ttyQUEUE", jobClaim(waiter.job), waiter.priority)
+			if err != nil {
+				t.Error(err)
+			}
+			got <- waiter.job
+		}()
+		for len(portQueue("/dev/ttyQUEUE")) != i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if queue := portQueue("/dev/ttyQUEUE"); len(queue) != 2 || queue[0] != 4002 || queue[1] != 4001 {
+		t.Fatalf("Queue = %v, want [4002 4001]", queue)
+	}
+	if !portBusy("/dev/ttyQUEUE") {
+		t.Error("Port with a queue isn't busy")
+	}
+
+	releasePort("/dev/ttyQUEUE", holder)
+	first := <-got
+	releasePort("/dev/ttyQUEUE", jobClaim(first))
+	second := <-got
+	releasePort("/dev/ttyQUEUE", jobClaim(second))
+	if first != 4002 || second != 4001 {
+		t.Errorf("Port went to %d then %d, want 4002 then 4001", first, second)
+	}
+	if portBusy("/dev/ttyQUEUE") {
+		t.Error("Port is still busy once everyone's done")
+	}
+
+	// A job that follows another waits for it to succeed
+	addJob := func(num int) context.Context {
+		jobsMu.Lock()
+		defer jobsMu.Unlock()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		jobs = append(jobs, Job{Number: num, Status: "Created", State: JOB_QUEUED})
+		jobCancels[num] = cancel
+		jobsDone[num] = make(chan struct{})
+		return ctx
+	}
+	finish := func(num int, status string) {
+		setJobStatus(num, status)
+		jobsMu.Lock()
+		jobCancels[num]()
+		delete(jobCancels, num)
+		close(jobsDone[num])
+		delete(jobsDone, num)
+		jobsMu.Unlock()
+		updateJob(num, func(job *Job) { job.State = finalState(job.Status) })
+	}
+	state := func(num int) Job {
+		job, _ := getJob(num)
+		return job
+	}
+
+	addJob(4010)
+	ctx := addJob(4011)
+	followed := make(chan bool)
+	go func() {
+		scheduleJob(ctx, RunParams{After: 4010, DeviceType: "switch", PortConfig: SerialConfiguration{Port: "/dev/ttyQUEUE-missing"}}, 4011)
+		followed <- true
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if job := state(4011); job.Status != "Waiting for job 4010" || !job.Running() {
+		t.Errorf("Following job is %s (%s)", job.Status, job.State)
+	}
+	finish(4010, "Done")
+	select {
+	case <-followed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Following job never ran")
+	}
+	// There's no such port, but it got as far as trying to open it
+	if job := state(4011); job.Status != "Errored" || job.State != JOB_FAILED || job.Result.FailedStep != "" {
+		t.Errorf("Following job ended up %s (%s) failing while %q", job.Status, job.State, job.Result.FailedStep)
+	}
+
+	addJob(4020)
+	ctx = addJob(4021)
+	finish(4020, "Failed")
+	scheduleJob(ctx, RunParams{After: 4020, PortConfig: SerialConfiguration{Port: "/dev/ttyQUEUE-missing"}}, 4021)
+	if job := state(4021); job.State != JOB_FAILED || job.Result.FailedStep != "Waiting for job 4020" {
+		t.Errorf("Job following a failed one ended up %s failing while %q", job.State, job.Result.FailedStep)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	if crglogging.GetLogger(WEB_LOGGER_NAME) == nil {
+		crglogging.New(WEB_LOGGER_NAME)
+	}
+	jobsMu.Lock()
+	before := jobs
+	jobs = nil
+	jobsMu.Unlock()
+	defer func() {
+		jobsMu.Lock()
+		jobs = before
+		jobsMu.Unlock()
+	}()
+
+	upload := func(manifestName, manifest string, defaults map[string]string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		part, _ := form.CreateFormFile("manifest", manifestName)
+		part.Write([]byte(manifest))
+		for name, contents := range defaults {
+			part, _ := form.CreateFormFile("defaultsFiles", name)
+			part.Write([]byte(contents))
+		}
+		form.WriteField("policy", "abort")
+		form.Close()
+
+		request := httptest.NewRequest("POST", "/batch/", &body)
+		request.Header.Set("Content-Type", form.FormDataContentType())
+		recorder := httptest.NewRecorder()
+		startBatch(recorder, request)
+		return recorder
+	}
+
+	manifest := "port,type,defaults\n/dev/ttyBATCH-missing-1,switch,switch.json\n/dev/ttyBATCH-missing-2,router,\n"
+	if recorder := upload("rack.csv", manifest, nil); recorder.Code != http.StatusBadRequest {
+		t.Errorf("Batch missing its defaults file got %d", recorder.Code)
+	}
+	if count := len(listJobs()); count != 0 {
+		t.Fatalf("Rejected batch started %d jobs", count)
+	}
+
+	recorder := upload("rack.csv", manifest, map[string]string{"switch.json": "{}"})
+	if recorder.Code != http.StatusSeeOther || recorder.Header().Get("Location") != "/batch/1/" {
+		t.Fatalf("Batch got %d to %q: %s", recorder.Code, recorder.Header().Get("Location"), recorder.Body.String())
+	}
+
+	// Neither port exists, so both jobs fail once they get to open them
+	var summary BatchSummary
+	deadline := time.Now().Add(5 * time.Second)
+	for summary.Report == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("Batch never finished: %+v", summary)
+		}
+		time.Sleep(10 * time.Millisecond)
+		summary, _ = findBatch(1)
+	}
+	if len(summary.Jobs) != 2 || summary.States[JOB_FAILED] != 2 || summary.Report.Failed != 2 {
+		t.Errorf("Batch finished as %+v", summary)
+	}
+	if job := summary.Jobs[0]; job.Batch != 1 || job.Params.DefaultsContents != "" || !job.Params.Defaults || job.Params.Policy != "abort" {
+		t.Errorf("First job in the batch is %+v", job.Params)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/batch/{batch}/", batchApi)
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/api/batch/1/?format=text", nil))
+	if report := recorder.Body.String(); !strings.Contains(report, "/dev/ttyBATCH-missing-2") || !strings.Contains(report, "0 succeeded, 2 failed") {
+		t.Errorf("Batch report is:\n%s", report)
+	}
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/api/batch/2/", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Missing batch got %d", recorder.Code)
+	}
+}
+
+func TestApiV1(t *testing.T) {
+	if crglogging.GetLogger(WEB_LOGGER_NAME) == nil {
+		crglogging.New(WEB_LOGGER_NAME)
+	}
+	jobsMu.Lock()
+	before := jobs
+	jobs = nil
+	jobsMu.Unlock()
+	DefaultsDir = t.TempDir()
+	defer func() {
+		jobsMu.Lock()
+		jobs = before
+		jobsMu.Unlock()
+		DefaultsDir = ""
+	}()
+
+	router := mux.NewRouter()
+	registerApiV1(router)
+	call := func(method, path, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return recorder
+	}
+	expect := func(recorder *httptest.ResponseRecorder, status int, into any) {
+		t.Helper()
+		if recorder.Code != status {
+			t.Fatalf("Got %d, want %d: %s", recorder.Code, status, recorder.Body.String())
+		}
+		if into != nil {
+			err := json.Unmarshal(recorder.Body.Bytes(), into)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Defaults templates
+	var template DefaultsTemplate
+	expect(call("POST", "/api/v1/templates", `{"Name": "lab", "Type": "Switch", "Defaults": {"Hostname": "Lab"}}`), http.StatusCreated, &template)
+	if template.Type != "switch" || string(template.Defaults) != `{"Hostname":"Lab"}` || template.Updated.IsZero() {
+		t.Errorf("Created template is %+v", template)
+	}
+	expect(call("POST", "/api/v1/templates", `{"Name": "lab", "Type": "switch", "Defaults": {}}`), http.StatusConflict, nil)
+	expect(call("POST", "/api/v1/templates", `{"Name": "../lab", "Type": "switch", "Defaults": {}}`), http.StatusBadRequest, nil)
+	expect(call("POST", "/api/v1/templates", `{"Name": "typo", "Type": "switch", "Defaults": {"Hostnme": "Lab"}}`), http.StatusBadRequest, nil)
+	expect(call("POST", "/api/v1/templates", `{"Name": "edge", "Type": "router", "Defaults": {"Hostname": "Edge"}}`), http.StatusCreated, nil)
+	expect(call("PUT", "/api/v1/templates/lab", `{"Type": "switch", "Defaults": {"Hostname": "Lab2"}}`), http.StatusOK, nil)
+	expect(call("PUT", "/api/v1/templates/missing", `{"Type": "switch", "Defaults": {}}`), http.StatusNotFound, nil)
+	expect(call("GET", "/api/v1/templates/lab", ""), http.StatusOK, &template)
+	if string(template.Defaults) != `{"Hostname":"Lab2"}` {
+		t.Errorf("Replaced template has %s", template.Defaults)
+	}
+	var templates []DefaultsTemplate
+	expect(call("GET", "/api/v1/templates", ""), http.StatusOK, &templates)
+	if len(templates) != 2 || templates[0].Name != "edge" {
+		t.Errorf("Listed templates are %+v", templates)
+	}
+
+	// Jobs
+	var apiErr ApiError
+	expect(call("POST", "/api/v1/jobs", `{"Port": "/dev/ttyAPI-missing", "Reset": true, "Parity": "sideways"}`), http.StatusBadRequest, &apiErr)
+	if !strings.Contains(apiErr.Error, "Parity") {
+		t.Errorf("Bad parity error is %q", apiErr.Error)
+	}
+	expect(call("POST", "/api/v1/jobs", `{"Port": "/dev/ttyAPI-missing", "Colour": "blue"}`), http.StatusBadRequest, nil)
+	expect(call("POST", "/api/v1/jobs", `{"Port": "/dev/ttyAPI-missing", "DeviceType": "router", "DefaultsTemplate": "lab"}`), http.StatusBadRequest, nil)
+
+	recorder := call("POST", "/api/v1/jobs", `{"Port": "/dev/ttyAPI-missing", "DeviceType": "switch", "DefaultsTemplate": "lab", "Policy": "abort"}`)
+	var job Job
+	expect(recorder, http.StatusCreated, &job)
+	if recorder.Header().Get("Location") != fmt.Sprintf("/api/v1/jobs/%d", job.Number) {
+		t.Errorf("New job is at %q", recorder.Header().Get("Location"))
+	}
+	if !job.Params.Defaults || job.Params.DefaultsFile != "lab.json" || job.Params.PortConfig.ShortHand != "9600 8n1" {
+		t.Errorf("New job is %+v", job.Params)
+	}
+	_, err := waitForJob(context.Background(), job.Number)
+	if err == nil {
+		t.Error("Job on a missing port succeeded")
+	}
+
+	expect(call("GET", fmt.Sprintf("/api/v1/jobs/%d", job.Number), ""), http.StatusOK, &job)
+	if job.State != JOB_FAILED || job.Output != "" {
+		t.Errorf("Job ended up %s with output %q", job.State, job.Output)
+	}
+	updateJob(job.Number, func(j *Job) { j.Output = "one\ntwo\nthree\n" })
+	recorder = call("GET", fmt.Sprintf("/api/v1/jobs/%d/output?lines=2", job.Number), "")
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "two\nthree\n" {
+		t.Errorf("Output is %d %q", recorder.Code, recorder.Body.String())
+	}
+	expect(call("POST", fmt.Sprintf("/api/v1/jobs/%d/cancel", job.Number), ""), http.StatusConflict, nil)
+	expect(call("POST", fmt.Sprintf("/api/v1/jobs/%d/answer", job.Number), `{"Answer": "yes"}`), http.StatusConflict, nil)
+	expect(call("GET", "/api/v1/jobs/999999", ""), http.StatusNotFound, nil)
+	expect(call("GET", "/api/v1/jobs/abc", ""), http.StatusBadRequest, nil)
+
+	var list JobList
+	expect(call("GET", "/api/v1/jobs?port=/dev/ttyAPI-missing", ""), http.StatusOK, &list)
+	if list.Total != 1 || list.Page != 1 || list.Jobs[0].Number != job.Number {
+		t.Errorf("Job list is %+v", list)
+	}
+
+	expect(call("DELETE", "/api/v1/templates/lab", ""), http.StatusNoContent, nil)
+	expect(call("GET", "/api/v1/templates/lab", ""), http.StatusNotFound, nil)
+	expect(call("DELETE", "/api/v1/templates/lab", ""), http.StatusNotFound, nil)
+
+	// The document covers every route, described from the same types they use
+	var doc struct {
+		Paths      map[string]map[string]any
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]any
+			}
+		}
+	}
+	expect(call("GET", "/api/v1/openapi.json", ""), http.StatusOK, &doc)
+	for _, route := range apiV1Routes() {
+		if _, ok := doc.Paths[API_V1_PREFIX+route.Path][strings.ToLower(route.Method)]; !ok {
+			t.Errorf("%s %s isn't in the document", route.Method, route.Path)
+		}
+	}
+	for schema, property := range map[string]string{"Job": "State", "JobRequest": "DefaultsTemplate", "ApiPort": "Queue", "SwitchConfig": "Vlans", "Result": "FailedStep"} {
+		if _, ok := doc.Components.Schemas[schema].Properties[property]; !ok {
+			t.Errorf("Schema %s has no %s", schema, property)
+		}
+	}
+	if _, ok := doc.Components.Schemas["Result"].Properties["Err"]; ok {
+		t.Error("Fields left out of the JSON are in the schema")
+	}
+}